@@ -0,0 +1,346 @@
+// Package bridgeline parses and validates the bridge lines that Tor accepts in
+// its Bridge configuration option, e.g.:
+//
+//	obfs4 1.2.3.4:1234 0123456789ABCDEF0123456789ABCDEF01234567 cert=... iat-mode=0
+package bridgeline
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// VanillaTransport is the transport name that we use for bridge lines that
+	// don't use a pluggable transport.
+	VanillaTransport = "vanilla"
+	// WebtunnelTransport is the name of the webtunnel transport, whose bridge
+	// lines carry the bridge's HTTPS endpoint in their "url" argument.
+	WebtunnelTransport = "webtunnel"
+	// MeekTransport and MeekLiteTransport are the names of the meek
+	// transports, whose bridge lines carry the URL of the bridge's meek
+	// server in their "url" argument, and the domain that we front with in
+	// their optional "front" argument.
+	MeekTransport     = "meek"
+	MeekLiteTransport = "meek_lite"
+	// Obfs4Transport is the name of the obfs4 transport, whose bridge lines
+	// must carry the bridge's "cert" and "iat-mode" arguments.
+	Obfs4Transport = "obfs4"
+)
+
+// The parts of a bridge line that a ValidationError can refer to.
+const (
+	FieldLine        = "line"
+	FieldTransport   = "transport"
+	FieldAddrPort    = "address"
+	FieldPort        = "port"
+	FieldFingerprint = "fingerprint"
+	FieldArgs        = "args"
+)
+
+// ValidationError explains which part of a bridge line is invalid, and why.
+type ValidationError struct {
+	// Field is the invalid part of the bridge line, e.g., FieldPort.
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// invalid returns a ValidationError for the given field, whose reason is
+// formatted according to the given format specifier.
+func invalid(field, format string, a ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, a...)}
+}
+
+// AddrPortPattern captures the address:port part of a bridge line (for both
+// IPv4 and IPv6 addresses).
+var AddrPortPattern = regexp.MustCompile(`[0-9a-z\[\]\.:]+:[0-9]{1,5}`)
+
+var transportName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+var fingerprintField = regexp.MustCompile(`^[A-Fa-f0-9]{40}$`)
+var fingerprint = regexp.MustCompile(`([A-F0-9]{40})`)
+
+// Validate checks if the given bridge line is syntactically valid and returns
+// a *ValidationError if it isn't.  We don't want to hand malformed bridge
+// lines to Tor because a single malformed bridge line makes Tor reject our
+// entire SETCONF command.
+func Validate(bridgeLine string) error {
+
+	for _, r := range bridgeLine {
+		if unicode.IsControl(r) || r == '"' || r == '\\' {
+			return invalid(FieldLine, "bridge line contains forbidden characters")
+		}
+	}
+
+	fields := strings.Fields(bridgeLine)
+	if len(fields) == 0 {
+		return invalid(FieldLine, "bridge line is empty")
+	}
+
+	// The first field is either a transport name or an addr:port tuple.
+	addrPortIndex := 0
+	if !AddrPortPattern.MatchString(fields[0]) {
+		if !transportName.MatchString(fields[0]) {
+			return invalid(FieldTransport, "invalid transport name %q", fields[0])
+		}
+		addrPortIndex = 1
+	}
+	if len(fields) <= addrPortIndex {
+		return invalid(FieldAddrPort, "bridge line contains no address:port")
+	}
+
+	addrPort := fields[addrPortIndex]
+	if AddrPortPattern.FindString(addrPort) != addrPort {
+		return invalid(FieldAddrPort, "invalid address:port %q", addrPort)
+	}
+	port, err := strconv.Atoi(addrPort[strings.LastIndex(addrPort, ":")+1:])
+	if err != nil || port < 1 || port > 65535 {
+		return invalid(FieldPort, "invalid port in %q", addrPort)
+	}
+
+	// The optional fingerprint follows the addr:port tuple.
+	if len(fields) > addrPortIndex+1 {
+		next := fields[addrPortIndex+1]
+		if !strings.Contains(next, "=") && !fingerprintField.MatchString(next) {
+			return invalid(FieldFingerprint, "invalid fingerprint %q", next)
+		}
+	}
+
+	switch Transport(bridgeLine) {
+	case Obfs4Transport:
+		err = validateObfs4(Args(bridgeLine))
+	case WebtunnelTransport:
+		err = validateWebtunnel(Args(bridgeLine))
+	case MeekTransport, MeekLiteTransport:
+		// Tor reaches meek bridges via their front, so we can only tell
+		// which of Tor's events belong to the bridge by its fingerprint.
+		if _, err := Fingerprint(bridgeLine); err != nil {
+			return invalid(FieldFingerprint, "meek bridge line contains no fingerprint")
+		}
+		err = validateMeek(Args(bridgeLine))
+	default:
+		err = nil
+	}
+	if err != nil {
+		return invalid(FieldArgs, "%s", err)
+	}
+	return nil
+}
+
+// validateObfs4 checks the given arguments of an obfs4 bridge line.  The
+// "cert" argument is mandatory, and so is the "iat-mode" argument, which must
+// be 0, 1, or 2.  Without them, obfs4 clients can't even attempt a handshake.
+func validateObfs4(args map[string]string) error {
+
+	if args["cert"] == "" {
+		return errors.New("obfs4 bridge line contains no cert")
+	}
+	switch mode, exists := args["iat-mode"]; {
+	case !exists:
+		return errors.New("obfs4 bridge line contains no iat-mode")
+	case mode != "0" && mode != "1" && mode != "2":
+		return fmt.Errorf("invalid obfs4 iat-mode %q", mode)
+	}
+	return nil
+}
+
+// validateMeek checks the given arguments of a meek bridge line.  The "url"
+// argument is mandatory and must be an absolute HTTP(S) URL, while the
+// "front" argument is optional and must be a domain.
+func validateMeek(args map[string]string) error {
+
+	if _, err := parseHTTPURL(args["url"]); err != nil {
+		return fmt.Errorf("invalid meek url: %v", err)
+	}
+	if front, exists := args["front"]; exists && (front == "" || strings.ContainsAny(front, "/:")) {
+		return fmt.Errorf("invalid meek front %q", front)
+	}
+	return nil
+}
+
+// parseHTTPURL parses the given absolute HTTP(S) URL.
+func parseHTTPURL(rawURL string) (*url.URL, error) {
+
+	if rawURL == "" {
+		return nil, errors.New("url is missing")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return nil, fmt.Errorf("%q is not an absolute HTTP(S) URL", rawURL)
+	}
+	return u, nil
+}
+
+// validateWebtunnel checks the given arguments of a webtunnel bridge line.
+// The "url" argument is mandatory and must be an absolute HTTP(S) URL, while
+// the "ver" argument is optional.
+func validateWebtunnel(args map[string]string) error {
+
+	if _, err := parseHTTPURL(args["url"]); err != nil {
+		return fmt.Errorf("invalid webtunnel url: %v", err)
+	}
+	if ver, exists := args["ver"]; exists && ver == "" {
+		return errors.New("webtunnel bridge line contains empty ver")
+	}
+	return nil
+}
+
+// Args returns the transport arguments of the given bridge line, e.g.,
+// "cert" and "iat-mode" for obfs4 bridge lines.
+func Args(bridgeLine string) map[string]string {
+
+	args := make(map[string]string)
+	for _, field := range strings.Fields(bridgeLine) {
+		if i := strings.Index(field, "="); i > 0 {
+			args[field[:i]] = field[i+1:]
+		}
+	}
+	return args
+}
+
+// Endpoint returns the addr:port that clients of the given bridge line
+// actually connect to.  That's the bridge line's addr:port, except for
+// webtunnel and meek bridge lines, whose addr:port is often a placeholder, so
+// we return the host and port of their URL instead.  Meek clients connect to
+// their front if they have one.
+func Endpoint(bridgeLine string) (string, error) {
+
+	transport := Transport(bridgeLine)
+	if transport != WebtunnelTransport && transport != MeekTransport && transport != MeekLiteTransport {
+		return AddrPort(bridgeLine)
+	}
+	args := Args(bridgeLine)
+	u, err := parseHTTPURL(args["url"])
+	if err != nil {
+		return "", fmt.Errorf("could not extract endpoint from %s url", transport)
+	}
+	host := u.Hostname()
+	if front, exists := args["front"]; exists && transport != WebtunnelTransport {
+		host = front
+	}
+	port := u.Port()
+	if port == "" && u.Scheme == "http" {
+		port = "80"
+	} else if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// AddrPort takes a bridge line as input and returns a string consisting of the
+// bridge's addr:port (for both IPv4 and IPv6 addresses).
+func AddrPort(bridgeLine string) (string, error) {
+
+	result := string(AddrPortPattern.Find([]byte(bridgeLine)))
+	if result == "" {
+		return result, fmt.Errorf("could not extract addr:port from bridge line")
+	} else {
+		return result, nil
+	}
+}
+
+// Identifier turns the given bridgeLine into a canonical identifier that we
+// use to look for relevant ORCONN events.  If the given bridge line contains a
+// fingerprint, the function returns $FINGERPRINT.  If it doesn't, the function
+// returns the address:port tuple of the given bridge line.
+func Identifier(bridgeLine string) (string, error) {
+
+	if result := string(fingerprint.Find([]byte(bridgeLine))); result != "" {
+		return "$" + result, nil
+	}
+
+	if result := string(AddrPortPattern.Find([]byte(bridgeLine))); result != "" {
+		return result, nil
+	}
+
+	return "", errors.New("could not extract bridge identifier")
+}
+
+// Fingerprint returns the upper-case fingerprint of the given bridge line, or
+// an error if the bridge line contains no fingerprint.
+func Fingerprint(bridgeLine string) (string, error) {
+
+	fields := strings.Fields(Canonicalize(bridgeLine))
+	i := 0
+	if len(fields) > 0 && !AddrPortPattern.MatchString(fields[0]) {
+		i = 1
+	}
+	if i+1 < len(fields) && fingerprintField.MatchString(fields[i+1]) {
+		return fields[i+1], nil
+	}
+	return "", errors.New("bridge line contains no fingerprint")
+}
+
+// Transport returns the transport of the given bridge line, e.g., "obfs4".  If
+// the bridge line contains no transport, the function returns
+// VanillaTransport.
+func Transport(bridgeLine string) string {
+
+	fields := strings.Fields(bridgeLine)
+	if len(fields) == 0 || AddrPortPattern.MatchString(fields[0]) {
+		return VanillaTransport
+	}
+	return strings.ToLower(fields[0])
+}
+
+// Canonicalize returns the canonical form of the given bridge line, so bridge
+// lines that only differ in their formatting map to the same string.  The
+// canonical form lacks the optional "Bridge" keyword, has single spaces
+// between fields, a lower-case transport name and address, an upper-case
+// fingerprint, and sorted transport arguments.  Tor doesn't care about the
+// order of transport arguments.
+func Canonicalize(bridgeLine string) string {
+
+	fields := canonicalLines([]string{bridgeLine})
+	if len(fields) == 0 {
+		return ""
+	}
+	fields = strings.Fields(fields[0])
+
+	i := 0
+	if !AddrPortPattern.MatchString(fields[0]) {
+		fields[0] = strings.ToLower(fields[0])
+		i = 1
+	}
+	if i < len(fields) {
+		fields[i] = strings.ToLower(fields[i])
+		i++
+	}
+	if i < len(fields) && fingerprintField.MatchString(fields[i]) {
+		fields[i] = strings.ToUpper(fields[i])
+		i++
+	}
+	sort.Strings(fields[i:])
+
+	return strings.Join(fields, " ")
+}
+
+// Family returns "ipv4" or "ipv6", depending on the address family of the
+// given addr:port tuple, and an empty string if its host isn't an IP address.
+func Family(addrPort string) string {
+
+	host, _, err := net.SplitHostPort(addrPort)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
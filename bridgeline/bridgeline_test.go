@@ -0,0 +1,210 @@
+package bridgeline
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+
+	valid := []string{
+		"1.2.3.4:1234",
+		"1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678",
+		"[2001:db8::1]:443",
+		"obfs4 1.2.3.4:1234 cert=fJRlJc0T7i2Qkw3SyLQq+M6iTGs9ghLHK65LBy/MQewXJpNOKFq63Om1JHVkLlrmEBbX1w iat-mode=0",
+		"obfs4 37.218.245.14:38224 D9A82D2F9C2F65A18407B1D2B764F130847F8B5D cert=foo iat-mode=0",
+		"snowflake 192.0.2.3:80 2B280B23E1107BB62ABFC40DDCC8824814F80A72 fingerprint=2B280B23E1107BB62ABFC40DDCC8824814F80A72 url=https://snowflake-broker.example/ fronts=a.example,b.example ice=stun:stun.l.google.com:19302,stun:stun.antisip.com:3478",
+		"webtunnel [2001:db8::1]:443 2B280B23E1107BB62ABFC40DDCC8824814F80A72 url=https://bridge.example/secret-path ver=0.0.1",
+		"webtunnel [2001:db8::1]:443 url=https://bridge.example:8443/secret-path",
+		"meek_lite 192.0.2.18:80 BE776A53492E1E044A26F17306E1BC46A55A1625 url=https://meek.azureedge.net/ front=ajax.aspnetcdn.com",
+		"meek 0.0.2.0:2 B9E7141C594AF25699E0079C1F0146F409495296 url=https://meek.example/",
+	}
+	for _, bridgeLine := range valid {
+		if err := Validate(bridgeLine); err != nil {
+			t.Errorf("Rejected valid bridge line %q: %s", bridgeLine, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"obfs4",
+		"bogus-bridge-line",
+		"1.2.3.4:99999",
+		"1.2.3.4:0",
+		"obfs4 1.2.3.4:1234 NOTAFINGERPRINT",
+		"obfs-4! 1.2.3.4:1234",
+		"1.2.3.4:1234\nBridge 5.6.7.8:1234",
+		"obfs4 1.2.3.4:1234 cert=\"foo\"",
+		"obfs4 1.2.3.4:1234 iat-mode=0",
+		"obfs4 1.2.3.4:1234 cert=foo",
+		"obfs4 1.2.3.4:1234 cert=foo iat-mode=3",
+		"webtunnel [2001:db8::1]:443 2B280B23E1107BB62ABFC40DDCC8824814F80A72",
+		"webtunnel [2001:db8::1]:443 url=ftp://bridge.example/",
+		"webtunnel [2001:db8::1]:443 url=https:///secret-path",
+		"webtunnel [2001:db8::1]:443 url=https://bridge.example/ ver=",
+		"meek_lite 192.0.2.18:80 url=https://meek.azureedge.net/ front=ajax.aspnetcdn.com",
+		"meek_lite 192.0.2.18:80 BE776A53492E1E044A26F17306E1BC46A55A1625 front=ajax.aspnetcdn.com",
+		"meek_lite 192.0.2.18:80 BE776A53492E1E044A26F17306E1BC46A55A1625 url=https://meek.azureedge.net/ front=https://ajax.aspnetcdn.com/",
+	}
+	for _, bridgeLine := range invalid {
+		if err := Validate(bridgeLine); err == nil {
+			t.Errorf("Accepted invalid bridge line %q.", bridgeLine)
+		}
+	}
+}
+
+func TestValidationErrorField(t *testing.T) {
+
+	for bridgeLine, field := range map[string]string{
+		"":                                       FieldLine,
+		"obfs-4! 1.2.3.4:1234":                   FieldTransport,
+		"obfs4":                                  FieldAddrPort,
+		"1.2.3.4:99999":                          FieldPort,
+		"obfs4 1.2.3.4:1234 NOTAFINGERPRINT":     FieldFingerprint,
+		"obfs4 1.2.3.4:1234 cert=foo iat-mode=3": FieldArgs,
+		"webtunnel [2001:db8::1]:443 url=ftp://a": FieldArgs,
+	} {
+		err, ok := Validate(bridgeLine).(*ValidationError)
+		if !ok || err.Field != field {
+			t.Errorf("Expected invalid field %q in %q but got %+v.", field, bridgeLine, err)
+		}
+	}
+}
+
+func TestIdentifier(t *testing.T) {
+
+	bridgeLine := "obfs4 37.218.245.14:38224 D9A82D2F9C2F65A18407B1D2B764F130847F8B5D cert=bjRaMrr1BRiAW8IE9U5z27fQaYgOhX1UCmOpg2pFpoMvo6ZgQMzLsaTzzQNTlm7hNcb+Sg iat-mode=0"
+	identifier, err := Identifier(bridgeLine)
+	if err != nil || identifier != "$D9A82D2F9C2F65A18407B1D2B764F130847F8B5D" {
+		t.Errorf("failed to extract bridge identifier")
+	}
+
+	// Let's try again but this time without fingerprint.
+	bridgeLine = "obfs4 37.218.245.14:38224 cert=bjRaMrr1BRiAW8IE9U5z27fQaYgOhX1UCmOpg2pFpoMvo6ZgQMzLsaTzzQNTlm7hNcb+Sg iat-mode=0"
+	identifier, err = Identifier(bridgeLine)
+	if err != nil || identifier != "37.218.245.14:38224" {
+		t.Errorf("failed to extract bridge identifier")
+	}
+
+	// Vanilla bridge lines lack a transport.
+	identifier, err = Identifier("37.218.245.14:38224 D9A82D2F9C2F65A18407B1D2B764F130847F8B5D")
+	if err != nil || identifier != "$D9A82D2F9C2F65A18407B1D2B764F130847F8B5D" {
+		t.Errorf("failed to extract vanilla bridge identifier")
+	}
+	identifier, err = Identifier("37.218.245.14:38224")
+	if err != nil || identifier != "37.218.245.14:38224" {
+		t.Errorf("failed to extract vanilla bridge identifier")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+
+	fingerprint, err := Fingerprint("Bridge obfs4 1.2.3.4:1234 d9a82d2f9c2f65a18407b1d2b764f130847f8b5d cert=foo iat-mode=0")
+	if err != nil || fingerprint != "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D" {
+		t.Errorf("Failed to extract fingerprint: %q (%v)", fingerprint, err)
+	}
+
+	fingerprint, err = Fingerprint("1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678")
+	if err != nil || fingerprint != "1234567890ABCDEF1234567890ABCDEF12345678" {
+		t.Errorf("Failed to extract fingerprint of vanilla bridge: %q (%v)", fingerprint, err)
+	}
+
+	if _, err = Fingerprint("obfs4 1.2.3.4:1234 cert=1234567890ABCDEF1234567890ABCDEF12345678"); err == nil {
+		t.Errorf("Extracted fingerprint from bridge line without fingerprint.")
+	}
+}
+
+func TestTransport(t *testing.T) {
+
+	transport := Transport("obfs4 1.2.3.4:1234 cert=foo iat-mode=0")
+	if transport != "obfs4" {
+		t.Errorf("Expected transport \"obfs4\" but got %q.", transport)
+	}
+
+	transport = Transport("1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678")
+	if transport != VanillaTransport {
+		t.Errorf("Expected transport %q but got %q.", VanillaTransport, transport)
+	}
+
+	transport = Transport("[2001:db8::1]:443")
+	if transport != VanillaTransport {
+		t.Errorf("Expected transport %q but got %q.", VanillaTransport, transport)
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+
+	expected := "obfs4 1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678 cert=foo iat-mode=0"
+	for _, bridgeLine := range []string{
+		expected,
+		"Bridge OBFS4  1.2.3.4:1234 1234567890abcdef1234567890abcdef12345678 iat-mode=0 cert=foo",
+		"  obfs4 1.2.3.4:1234\t1234567890ABCDEF1234567890ABCDEF12345678 cert=foo iat-mode=0 ",
+	} {
+		if c := Canonicalize(bridgeLine); c != expected {
+			t.Errorf("Expected %q but got %q.", expected, c)
+		}
+	}
+
+	if c := Canonicalize("[2001:DB8::1]:443"); c != "[2001:db8::1]:443" {
+		t.Errorf("Failed to canonicalize IPv6 bridge line: %q", c)
+	}
+	if c := Canonicalize(""); c != "" {
+		t.Errorf("Expected empty canonical form but got %q.", c)
+	}
+
+	// Snowflake's broker and ICE parameters must survive unchanged.
+	snowflake := "snowflake 192.0.2.3:80 2B280B23E1107BB62ABFC40DDCC8824814F80A72 fronts=A.example ice=stun:stun.l.google.com:19302 url=https://Broker.example/"
+	if c := Canonicalize(snowflake); c != snowflake {
+		t.Errorf("Expected %q but got %q.", snowflake, c)
+	}
+
+	// Different certificates must not collide.
+	if Canonicalize("obfs4 1.2.3.4:1234 cert=foo") == Canonicalize("obfs4 1.2.3.4:1234 cert=bar") {
+		t.Errorf("Bridge lines with different certificates have the same canonical form.")
+	}
+}
+
+func TestArgs(t *testing.T) {
+
+	args := Args("webtunnel [2001:db8::1]:443 url=https://bridge.example/?a=b ver=0.0.1")
+	if len(args) != 2 || args["url"] != "https://bridge.example/?a=b" || args["ver"] != "0.0.1" {
+		t.Errorf("Unexpected arguments: %v", args)
+	}
+	if args := Args("1.2.3.4:1234"); len(args) != 0 {
+		t.Errorf("Expected no arguments but got %v.", args)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+
+	for bridgeLine, expected := range map[string]string{
+		"obfs4 1.2.3.4:1234 cert=foo iat-mode=0":                                                                                    "1.2.3.4:1234",
+		"webtunnel [2001:db8::1]:443 url=https://bridge.example/foo":                                                                "bridge.example:443",
+		"webtunnel [2001:db8::1]:443 url=http://bridge.example/foo":                                                                 "bridge.example:80",
+		"webtunnel [2001:db8::1]:443 url=https://[2001:db8::2]:8443":                                                                "[2001:db8::2]:8443",
+		"meek_lite 192.0.2.18:80 BE776A53492E1E044A26F17306E1BC46A55A1625 url=https://meek.azureedge.net/ front=ajax.aspnetcdn.com": "ajax.aspnetcdn.com:443",
+		"meek 0.0.2.0:2 B9E7141C594AF25699E0079C1F0146F409495296 url=http://meek.example/":                                          "meek.example:80",
+	} {
+		endpoint, err := Endpoint(bridgeLine)
+		if err != nil || endpoint != expected {
+			t.Errorf("Expected endpoint %q for %q but got %q (%v).", expected, bridgeLine, endpoint, err)
+		}
+	}
+	if _, err := Endpoint("webtunnel [2001:db8::1]:443"); err == nil {
+		t.Errorf("Got endpoint for webtunnel bridge line without url.")
+	}
+}
+
+func TestFamily(t *testing.T) {
+
+	for addrPort, expected := range map[string]string{
+		"1.2.3.4:1234":         "ipv4",
+		"[2001:db8::1]:443":    "ipv6",
+		"[::ffff:1.2.3.4]:443": "ipv4",
+		"bridge.example:443":   "",
+		"1.2.3.4":              "",
+	} {
+		if family := Family(addrPort); family != expected {
+			t.Errorf("Expected family %q for %q but got %q.", expected, addrPort, family)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package bridgeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// CardBegin and CardEnd delimit a bridge card, e.g.:
+	//
+	//	-----BEGIN BRIDGE-----
+	//	transport: obfs4
+	//	address: 1.2.3.4:1234
+	//	fingerprint: 0123 4567 89AB CDEF 0123 4567 89AB CDEF 0123 4567
+	//	cert: ...
+	//	iat-mode: 0
+	//	-----END BRIDGE-----
+	CardBegin = "-----BEGIN BRIDGE-----"
+	CardEnd   = "-----END BRIDGE-----"
+)
+
+// IsCard returns true if the given text isn't a single bridge line but needs
+// to be normalised using Normalize: a bridge card, the JSON payload of a
+// bridge QR code, or several lines.
+func IsCard(text string) bool {
+
+	text = strings.TrimSpace(text)
+	return strings.HasPrefix(text, "[") || strings.Contains(text, "\n") || strings.HasPrefix(text, CardBegin)
+}
+
+// Normalize turns the given text into canonical bridge lines.  The text can
+// contain:
+//
+//   - the JSON payload of a bridge QR code, i.e., an array of bridge lines;
+//   - one or more bridge cards, i.e., bridges whose transport, address,
+//     fingerprint, and parameters are on separate "key: value" lines, delimited
+//     by CardBegin and CardEnd or separated by empty lines;
+//   - one bridge line per line.
+//
+// Bridge lines may start with the "Bridge" keyword of Tor's configuration
+// file, which we strip.  Normalize doesn't validate the resulting bridge
+// lines; use Validate for that.
+func Normalize(text string) ([]string, error) {
+
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "[") {
+		var bridgeLines []string
+		if err := json.Unmarshal([]byte(text), &bridgeLines); err != nil {
+			return nil, fmt.Errorf("invalid QR code payload: %v", err)
+		}
+		return canonicalLines(bridgeLines), nil
+	}
+
+	bridgeLines := []string{}
+	card := []string{}
+	flushCard := func() error {
+		if len(card) == 0 {
+			return nil
+		}
+		bridgeLine, err := parseCard(card)
+		if err != nil {
+			return err
+		}
+		bridgeLines = append(bridgeLines, bridgeLine)
+		card = []string{}
+		return nil
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == CardBegin || line == CardEnd || line == "":
+			if err := flushCard(); err != nil {
+				return nil, err
+			}
+		case isCardField(line):
+			card = append(card, line)
+		default:
+			if err := flushCard(); err != nil {
+				return nil, err
+			}
+			bridgeLines = append(bridgeLines, canonicalLines([]string{line})...)
+		}
+	}
+	if err := flushCard(); err != nil {
+		return nil, err
+	}
+
+	if len(bridgeLines) == 0 {
+		return nil, errors.New("no bridge lines found")
+	}
+	return bridgeLines, nil
+}
+
+// canonicalLines strips whitespace and the optional "Bridge" keyword from the
+// given bridge lines, and drops empty ones.
+func canonicalLines(bridgeLines []string) []string {
+
+	result := []string{}
+	for _, bridgeLine := range bridgeLines {
+		fields := strings.Fields(bridgeLine)
+		if len(fields) > 0 && strings.EqualFold(fields[0], "Bridge") {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			result = append(result, strings.Join(fields, " "))
+		}
+	}
+	return result
+}
+
+// isCardField returns true if the given line is a "key: value" line of a
+// bridge card.  Bridge lines never contain ": ", and a bridge card's address
+// field is the only one whose value contains colons.
+func isCardField(line string) bool {
+
+	i := strings.Index(line, ":")
+	if i <= 0 {
+		return false
+	}
+	key := line[:i]
+	return transportName.MatchString(strings.Replace(key, "-", "_", -1)) &&
+		(len(line) == i+1 || line[i+1] == ' ' || line[i+1] == '\t')
+}
+
+// parseCard turns the "key: value" lines of a bridge card into a bridge line.
+// The keys "transport", "address", and "fingerprint" are special; all other
+// keys are transport parameters, e.g., "cert".
+func parseCard(fields []string) (string, error) {
+
+	var transport, address, fp string
+	params := []string{}
+	for _, field := range fields {
+		i := strings.Index(field, ":")
+		key := strings.ToLower(strings.TrimSpace(field[:i]))
+		value := strings.TrimSpace(field[i+1:])
+		switch key {
+		case "transport", "type":
+			transport = value
+		case "address", "addr":
+			address = value
+		case "fingerprint":
+			// Fingerprints are often shown in groups of four digits.
+			fp = strings.ToUpper(strings.Join(strings.Fields(value), ""))
+		default:
+			params = append(params, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+
+	if address == "" {
+		return "", errors.New("bridge card contains no address")
+	}
+	parts := []string{}
+	if transport != "" && !strings.EqualFold(transport, VanillaTransport) {
+		parts = append(parts, transport)
+	}
+	parts = append(parts, address)
+	if fp != "" {
+		parts = append(parts, fp)
+	}
+	parts = append(parts, params...)
+	return strings.Join(parts, " "), nil
+}
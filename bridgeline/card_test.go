@@ -0,0 +1,70 @@
+package bridgeline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+
+	cert := "cert=fJRlJc0T7i2Qkw3SyLQq+M6iTGs9ghLHK65LBy/MQewXJpNOKFq63Om1JHVkLlrmEBbX1w"
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{
+			`-----BEGIN BRIDGE-----
+transport: obfs4
+address: 1.2.3.4:1234
+fingerprint: 0123 4567 89ab cdef 0123 4567 89AB CDEF 0123 4567
+cert: fJRlJc0T7i2Qkw3SyLQq+M6iTGs9ghLHK65LBy/MQewXJpNOKFq63Om1JHVkLlrmEBbX1w
+iat-mode: 0
+-----END BRIDGE-----`,
+			[]string{"obfs4 1.2.3.4:1234 0123456789ABCDEF0123456789ABCDEF01234567 " + cert + " iat-mode=0"},
+		},
+		{
+			// Two cards without delimiters, separated by an empty line.
+			"transport: vanilla\naddress: 1.2.3.4:1234\n\naddress: [2001:db8::1]:443\n",
+			[]string{"1.2.3.4:1234", "[2001:db8::1]:443"},
+		},
+		{
+			`["obfs4 1.2.3.4:1234 ` + cert + ` iat-mode=0", "Bridge 5.6.7.8:443"]`,
+			[]string{"obfs4 1.2.3.4:1234 " + cert + " iat-mode=0", "5.6.7.8:443"},
+		},
+		{
+			"Bridge obfs4 1.2.3.4:1234   " + cert + " iat-mode=0\n5.6.7.8:443\n",
+			[]string{"obfs4 1.2.3.4:1234 " + cert + " iat-mode=0", "5.6.7.8:443"},
+		},
+	}
+	for _, test := range tests {
+		bridgeLines, err := Normalize(test.text)
+		if err != nil {
+			t.Errorf("Failed to normalise %q: %s", test.text, err)
+			continue
+		}
+		if !reflect.DeepEqual(bridgeLines, test.expected) {
+			t.Errorf("Expected %q but got %q.", test.expected, bridgeLines)
+		}
+		for _, bridgeLine := range bridgeLines {
+			if err := Validate(bridgeLine); err != nil {
+				t.Errorf("Normalised bridge line %q is invalid: %s", bridgeLine, err)
+			}
+		}
+	}
+
+	for _, invalid := range []string{"", "[not json", "transport: obfs4\ncert: foo"} {
+		if _, err := Normalize(invalid); err == nil {
+			t.Errorf("Failed to reject %q.", invalid)
+		}
+	}
+}
+
+func TestIsCard(t *testing.T) {
+
+	if IsCard("obfs4 1.2.3.4:1234 cert=foo iat-mode=0") || IsCard(" 1.2.3.4:1234 ") {
+		t.Errorf("Mistook bridge line for card.")
+	}
+	if !IsCard(CardBegin+"\naddress: 1.2.3.4:1234\n"+CardEnd) || !IsCard(`["1.2.3.4:1234"]`) {
+		t.Errorf("Mistook card for bridge line.")
+	}
+}
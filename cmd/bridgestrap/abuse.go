@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+const (
+	// AbuseSchemaVersion is the schema version of our abuse log file.
+	AbuseSchemaVersion = 1
+	// DefaultAbuseRetention determines how long our abuse log keeps
+	// records unless the operator tells us otherwise.
+	DefaultAbuseRetention = 90 * 24 * time.Hour
+
+	// The reasons for which we reject or throttle requests.
+	AbuseRateLimit      = "rate_limit"
+	AbuseQuota          = "quota"
+	AbuseInvalidToken   = "invalid_token"
+	AbuseForbidden      = "forbidden"
+	AbuseTooManyBridges = "too_many_bridges"
+
+	// ClassUnauthenticated is the client class of requests whose token we
+	// couldn't verify.
+	ClassUnauthenticated = "unauthenticated"
+	// ClassToken is the client class of requests with a valid token.
+	ClassToken = "token"
+	// ClassAdmin is the client class of requests with an admin token.
+	ClassAdmin = "admin"
+)
+
+// abuseLog counts the requests that we rejected or throttled.  It always
+// exists; main loads it from disk.
+var abuseLog = NewAbuseLog(DefaultAbuseRetention)
+
+// AbuseRecord counts the requests of a given client class that a given
+// endpoint rejected for a given reason, during a given hour.
+type AbuseRecord struct {
+	Hour     time.Time `json:"hour"`
+	Reason   string    `json:"reason"`
+	Endpoint string    `json:"endpoint"`
+	Class    string    `json:"class"`
+	Count    int       `json:"count"`
+}
+
+// key returns the string that identifies the record's hour, reason, endpoint,
+// and client class.
+func (r *AbuseRecord) key() string {
+	return fmt.Sprintf("%d|%s|%s|%s", r.Hour.Unix(), r.Reason, r.Endpoint, r.Class)
+}
+
+// AbuseLog keeps hourly counts of the requests that we rejected or throttled,
+// so operators can review abuse patterns over weeks rather than grepping our
+// logs.  We never record who sent a request; only the client's class, e.g.,
+// "anonymous" or "token".  It's safe for concurrent use.
+type AbuseLog struct {
+	// Records maps a record's key to the record.
+	Records map[string]*AbuseRecord
+	// retention determines how long we keep records for.
+	retention time.Duration
+	l         sync.Mutex
+}
+
+// persistedAbuseLog is the on-disk representation of our abuse log.
+type persistedAbuseLog struct {
+	Version int
+	Records []*AbuseRecord
+}
+
+// abuseResponse represents our response to abuse log queries.
+type abuseResponse struct {
+	Since   time.Time      `json:"since"`
+	Records []*AbuseRecord `json:"records"`
+	Totals  map[string]int `json:"totals"`
+}
+
+// NewAbuseLog returns a new abuse log that keeps records for the given
+// duration.
+func NewAbuseLog(retention time.Duration) *AbuseLog {
+	return &AbuseLog{Records: make(map[string]*AbuseRecord), retention: retention}
+}
+
+// clientClass returns the anonymised class of the given client, which is nil
+// if we couldn't verify the client's token.
+func clientClass(client *Token) string {
+
+	switch {
+	case client == nil:
+		return ClassUnauthenticated
+	case client.Name == AnonymousClient || client.Name == WebClient:
+		return client.Name
+	case client.Admin:
+		return ClassAdmin
+	default:
+		return ClassToken
+	}
+}
+
+// routeName returns the name of the route that the given request matched,
+// e.g., "BridgeState".
+func routeName(r *http.Request) string {
+
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		return route.GetName()
+	}
+	return r.URL.Path
+}
+
+// prune removes records that are older than our retention period.  The
+// caller must hold our lock.
+func (a *AbuseLog) prune(now time.Time) {
+
+	cutoff := now.Add(-a.retention)
+	for key, record := range a.Records {
+		if record.Hour.Before(cutoff) {
+			delete(a.Records, key)
+		}
+	}
+}
+
+// Record counts the given request, which we rejected for the given reason.
+// The class is the anonymised class of the request's client; see
+// clientClass.
+func (a *AbuseLog) Record(r *http.Request, reason, class string) {
+
+	record := &AbuseRecord{
+		Hour:     time.Now().UTC().Truncate(time.Hour),
+		Reason:   reason,
+		Endpoint: routeName(r),
+		Class:    class,
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	if existing, exists := a.Records[record.key()]; exists {
+		record = existing
+	} else {
+		a.Records[record.key()] = record
+	}
+	record.Count++
+	metrics.RejectedRequests.With(prometheus.Labels{"reason": reason}).Inc()
+}
+
+// Query returns copies of the records since the given time, optionally only
+// those of the given reason, sorted by hour, reason, endpoint, and class.
+func (a *AbuseLog) Query(since time.Time, reason string) []*AbuseRecord {
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.prune(time.Now().UTC())
+	records := []*AbuseRecord{}
+	for _, record := range a.Records {
+		if record.Hour.Before(since.Truncate(time.Hour)) {
+			continue
+		}
+		if reason != "" && record.Reason != reason {
+			continue
+		}
+		recordCopy := *record
+		records = append(records, &recordCopy)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Hour.Equal(records[j].Hour) {
+			return records[i].Hour.Before(records[j].Hour)
+		}
+		return records[i].key() < records[j].key()
+	})
+	return records
+}
+
+// WriteToDisk writes our abuse log to disk, allowing it to persist across
+// program restarts.  We prune expired records first, so our abuse log file
+// doesn't grow forever.
+func (a *AbuseLog) WriteToDisk(abuseFile string) error {
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	a.prune(time.Now().UTC())
+	records := []*AbuseRecord{}
+	for _, record := range a.Records {
+		records = append(records, record)
+	}
+	err := testcache.WriteFileAtomically(abuseFile, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(persistedAbuseLog{
+			Version: AbuseSchemaVersion,
+			Records: records,
+		})
+	})
+	if err == nil {
+		log.Printf("Wrote %d abuse log records to %q.", len(records), abuseFile)
+	}
+
+	return err
+}
+
+// ReadFromDisk reads our abuse log from disk.
+func (a *AbuseLog) ReadFromDisk(abuseFile string) error {
+
+	fh, err := os.Open(abuseFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	pa := &persistedAbuseLog{}
+	if err := gob.NewDecoder(fh).Decode(pa); err != nil {
+		return err
+	}
+	if pa.Version > AbuseSchemaVersion {
+		return fmt.Errorf("abuse log schema version %d is newer than ours (%d)",
+			pa.Version, AbuseSchemaVersion)
+	}
+
+	a.l.Lock()
+	a.Records = make(map[string]*AbuseRecord)
+	for _, record := range pa.Records {
+		a.Records[record.key()] = record
+	}
+	a.prune(time.Now().UTC())
+	log.Printf("Read %d abuse log records from %q.", len(a.Records), abuseFile)
+	a.l.Unlock()
+
+	return nil
+}
+
+// AbuseLogQuery responds with the records of our abuse log.  The optional
+// parameter "days" limits the response to the given number of past days, and
+// the optional parameter "reason" limits it to the given reason.
+func AbuseLogQuery(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	since := time.Now().UTC().Add(-abuseLog.retention)
+	if days := r.URL.Query().Get("days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 {
+			http.Error(w, "parameter \"days\" must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		if s := time.Now().UTC().Add(-time.Duration(n) * 24 * time.Hour); s.After(since) {
+			since = s
+		}
+	}
+
+	resp := &abuseResponse{
+		Since:   since,
+		Records: abuseLog.Query(since, r.URL.Query().Get("reason")),
+		Totals:  make(map[string]int),
+	}
+	for _, record := range resp.Records {
+		resp.Totals[record.Reason] += record.Count
+	}
+	jsonResult, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal abuse log", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %s queried our abuse log.", client.Name)
+	SendJSONResponse(w, string(jsonResult))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAbuseLog(t *testing.T) {
+
+	a := NewAbuseLog(24 * time.Hour)
+	r := httptest.NewRequest("GET", "/bridge-state", nil)
+	a.Record(r, AbuseQuota, ClassToken)
+	a.Record(r, AbuseQuota, ClassToken)
+	a.Record(r, AbuseRateLimit, AnonymousClient)
+
+	since := time.Now().UTC().Add(-time.Hour)
+	records := a.Query(since, AbuseQuota)
+	if len(records) != 1 || records[0].Count != 2 || records[0].Endpoint != "/bridge-state" {
+		t.Fatalf("Unexpected records: %+v", records)
+	}
+	if records = a.Query(since, ""); len(records) != 2 {
+		t.Errorf("Expected 2 records but got %d.", len(records))
+	}
+
+	// Expired records must disappear.
+	old := &AbuseRecord{Hour: time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Hour), Reason: AbuseQuota}
+	a.Records[old.key()] = old
+	if records = a.Query(time.Time{}, ""); len(records) != 2 {
+		t.Errorf("Failed to prune expired record.")
+	}
+
+	// Records must survive restarts.
+	dir, err := ioutil.TempDir("", "bridgestrap-abuse-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "abuse.bin")
+	if err := a.WriteToDisk(filename); err != nil {
+		t.Fatalf("Failed to write abuse log: %s", err)
+	}
+	b := NewAbuseLog(24 * time.Hour)
+	if err := b.ReadFromDisk(filename); err != nil {
+		t.Fatalf("Failed to read abuse log: %s", err)
+	}
+	b.Record(r, AbuseQuota, ClassToken)
+	if records = b.Query(since, AbuseQuota); len(records) != 1 || records[0].Count != 3 {
+		t.Errorf("Unexpected records after reload: %+v", records)
+	}
+}
+
+func TestAbuseLogQuery(t *testing.T) {
+
+	abuseLog = NewAbuseLog(DefaultAbuseRetention)
+	defer func() { abuseLog = NewAbuseLog(DefaultAbuseRetention) }()
+	tokens = map[string]*Token{
+		"admin": &Token{Token: "admin", Name: "admin", Weight: 1, Admin: true},
+		"user":  &Token{Token: "user", Name: "user", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	for _, token := range []string{"bogus", "user"} {
+		r := httptest.NewRequest("GET", "/abuse", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		AbuseLogQuery(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code %d but got %d.", http.StatusForbidden, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/abuse?days=7", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	AbuseLogQuery(w, r)
+	resp := &abuseResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to query abuse log: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Totals[AbuseInvalidToken] != 1 || resp.Totals[AbuseForbidden] != 1 {
+		t.Errorf("Unexpected totals: %v", resp.Totals)
+	}
+
+	r = httptest.NewRequest("GET", "/abuse?days=bogus", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	AbuseLogQuery(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// BridgePageDays is the number of days that our bridge health pages
+	// cover, including today.
+	BridgePageDays = 30
+	// BridgePageMaxAge is how long clients and CDNs may cache our bridge
+	// health pages.  Daily statuses change slowly, so we let operators link
+	// to the pages without worrying about the traffic that they cause.
+	BridgePageMaxAge = time.Hour
+
+	// DayUp means that the bridge worked in at least one of the day's tests.
+	DayUp = "up"
+	// DayDown means that the bridge failed all of the day's tests.
+	DayDown = "down"
+	// DayUnknown means that we didn't test the bridge on that day.
+	DayUnknown = "unknown"
+)
+
+// BridgeHealthPage is the template of our bridge health pages.
+var BridgeHealthPage *template.Template
+
+// bridgeDay is the coarse status of a bridge on a given day.
+type bridgeDay struct {
+	Date   time.Time
+	Status string
+}
+
+// bridgePage contains the data that our bridge health template needs.  It
+// deliberately lacks anything that could reveal the bridge's address, like
+// detailed error messages.
+type bridgePage struct {
+	HashedID string
+	Known    bool
+	// Days contains the bridge's status per day, from oldest to newest.
+	Days []*bridgeDay
+	// ErrorCode is the machine-readable reason why the bridge failed its
+	// latest test, if it did, and our redaction policy allows us to show it.
+	ErrorCode string
+}
+
+// newBridgePage turns the given history of the bridge with the given hashed
+// identifier into the data of its health page, which covers BridgePageDays
+// days up to the given time.
+func newBridgePage(hashedID string, results []testcache.HistoryResult, now time.Time) *bridgePage {
+
+	page := &bridgePage{HashedID: strings.ToUpper(hashedID), Known: len(results) > 0}
+	today := now.UTC().Truncate(24 * time.Hour)
+	first := today.AddDate(0, 0, -(BridgePageDays - 1))
+	for i := 0; i < BridgePageDays; i++ {
+		page.Days = append(page.Days, &bridgeDay{Date: first.AddDate(0, 0, i), Status: DayUnknown})
+	}
+
+	for _, result := range results {
+		i := int(result.Time.UTC().Truncate(24*time.Hour).Sub(first) / (24 * time.Hour))
+		if i < 0 || i >= BridgePageDays {
+			continue
+		}
+		if result.Error == "" {
+			page.Days[i].Status = DayUp
+		} else if page.Days[i].Status == DayUnknown {
+			page.Days[i].Status = DayDown
+		}
+	}
+
+	if len(results) > 0 && !redaction.Hides(ChannelBridgePage, FieldErrorCode) {
+		page.ErrorCode = tester.FailureCode(results[len(results)-1].Error)
+	}
+	return page
+}
+
+// BridgeHealthWeb serves a public Web page that shows the daily status of the
+// bridge with the given hashed identifier over the last BridgePageDays days.
+// Bridge operators can link to it from their own documentation.  Like our
+// badges, the page never triggers a bridge test.
+func BridgeHealthWeb(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "bridge-page", "status": reqStatus}).Inc()
+	}()
+
+	if !badgeLimiter.Allow() {
+		abuseLog.Record(r, AbuseRateLimit, AnonymousClient)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	reqStatus = "valid"
+
+	hashedID := mux.Vars(r)["id"]
+	page := newBridgePage(hashedID, history.FindByHashedID(hasher, hashedID), time.Now())
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(BridgePageMaxAge.Seconds())))
+	if err := BridgeHealthPage.Execute(w, page); err != nil {
+		log.Printf("Failed to render bridge health page: %s", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestNewBridgePage(t *testing.T) {
+
+	now := time.Date(2020, 11, 30, 12, 0, 0, 0, time.UTC)
+	failure := tester.FailureReasons["CONNECTREFUSED"]
+	results := []testcache.HistoryResult{
+		// Too old to show up.
+		{Time: now.AddDate(0, 0, -BridgePageDays), Error: failure},
+		{Time: now.AddDate(0, 0, -2), Error: failure},
+		{Time: now.AddDate(0, 0, -1), Error: failure},
+		{Time: now.AddDate(0, 0, -1).Add(time.Hour)},
+		{Time: now, Error: failure},
+	}
+
+	page := newBridgePage("abcd", results, now)
+	if !page.Known || page.HashedID != "ABCD" || len(page.Days) != BridgePageDays {
+		t.Fatalf("Unexpected page: %+v", page)
+	}
+	if !page.Days[0].Date.Equal(time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Page starts on unexpected day %s.", page.Days[0].Date)
+	}
+	expected := map[int]string{0: DayUnknown, 27: DayDown, 28: DayUp, 29: DayDown}
+	for i, status := range expected {
+		if page.Days[i].Status != status {
+			t.Errorf("Expected day %d to be %q but got %q.", i, status, page.Days[i].Status)
+		}
+	}
+	if page.ErrorCode != "CONNECTREFUSED" {
+		t.Errorf("Expected error code CONNECTREFUSED but got %q.", page.ErrorCode)
+	}
+
+	redaction = RedactionPolicy{ChannelBridgePage: {FieldErrorCode: true}}
+	defer func() { redaction = RedactionPolicy{} }()
+	if page = newBridgePage("abcd", results, now); page.ErrorCode != "" {
+		t.Errorf("Failed to redact error code %q.", page.ErrorCode)
+	}
+
+	if page = newBridgePage("abcd", nil, now); page.Known {
+		t.Errorf("Bridge without history must be unknown.")
+	}
+}
+
+func TestBridgeHealthWeb(t *testing.T) {
+
+	var err error
+	if BridgeHealthPage, err = template.ParseFiles("../../templates/bridge.html"); err != nil {
+		t.Fatalf("Failed to parse bridge health template: %s", err)
+	}
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	history = testcache.NewHistory(24 * time.Hour)
+	defer func() { hasher, history = nil, nil }()
+	history.Add("1.2.3.4:1234 D9A82D2F9C2F65A18407B1D2B764F130847F8B5D", errors.New("bridge is on fire"), time.Now().UTC())
+
+	hashedID := hasher.HashAddrPort("1.2.3.4:1234")
+	r := mux.SetURLVars(httptest.NewRequest("GET", "/b/"+hashedID, nil), map[string]string{"id": hashedID})
+	w := httptest.NewRecorder()
+	BridgeHealthWeb(w, r)
+	body := w.Body.String()
+	if !strings.Contains(body, hashedID) || !strings.Contains(body, DayDown) {
+		t.Errorf("Bridge health page lacks the bridge's status: %s", body)
+	}
+	// The page must not reveal the bridge's address or detailed errors.
+	for _, secret := range []string{"1.2.3.4", "on fire"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("Bridge health page reveals %q.", secret)
+		}
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("Unexpected Cache-Control header %q.", w.Header().Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+const (
+	// CacheListingPageSize is the number of cache entries per page of our
+	// cache listing.
+	CacheListingPageSize = 50
+)
+
+// CacheRow represents a single cache entry in our cache listing.  We only
+// show hashed identifiers, so the listing doesn't reveal bridge addresses.
+type CacheRow struct {
+	HashedID   string
+	Functional bool
+	Error      string
+	LastTested time.Time
+	Hits       int
+}
+
+// CacheListing represents a page of our cache listing.
+type CacheListing struct {
+	Rows     []*CacheRow
+	Total    int
+	Page     int
+	NumPages int
+	Query    string
+	Status   string
+	Sort     string
+}
+
+// PrevPage returns the number of the previous page, or 0 if there is none.
+func (l *CacheListing) PrevPage() int {
+	if l.Page > 1 {
+		return l.Page - 1
+	}
+	return 0
+}
+
+// NextPage returns the number of the next page, or 0 if there is none.
+func (l *CacheListing) NextPage() int {
+	if l.Page < l.NumPages {
+		return l.Page + 1
+	}
+	return 0
+}
+
+// listCache turns the given cache snapshot, which is keyed by hashed
+// identifier (see Cache.SnapshotByHashedID), into a page of our cache listing.
+// The query filters entries by hashed identifier prefix, status is one of
+// "working", "failing", or "" (for all entries), and sortBy is one of
+// "hits", "id", or "" (for most recently tested first).  Pages start at 1.
+func listCache(snapshot map[string]testcache.Entry, query, status, sortBy string, page int) *CacheListing {
+
+	query = strings.ToUpper(strings.TrimSpace(query))
+	listing := &CacheListing{Query: query, Status: status, Sort: sortBy}
+
+	rows := []*CacheRow{}
+	for hashedID, entry := range snapshot {
+		row := &CacheRow{
+			HashedID:   hashedID,
+			Functional: entry.Error == "",
+			Error:      entry.Error,
+			LastTested: entry.Time,
+			Hits:       entry.Hits,
+		}
+		if query != "" && !strings.HasPrefix(row.HashedID, query) {
+			continue
+		}
+		if (status == "working" && !row.Functional) || (status == "failing" && row.Functional) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	switch sortBy {
+	case "hits":
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].Hits == rows[j].Hits {
+				return rows[i].HashedID < rows[j].HashedID
+			}
+			return rows[i].Hits > rows[j].Hits
+		})
+	case "id":
+		sort.Slice(rows, func(i, j int) bool { return rows[i].HashedID < rows[j].HashedID })
+	default:
+		listing.Sort = ""
+		sort.Slice(rows, func(i, j int) bool {
+			if rows[i].LastTested.Equal(rows[j].LastTested) {
+				return rows[i].HashedID < rows[j].HashedID
+			}
+			return rows[i].LastTested.After(rows[j].LastTested)
+		})
+	}
+
+	listing.Total = len(rows)
+	listing.NumPages = (len(rows) + CacheListingPageSize - 1) / CacheListingPageSize
+	if listing.NumPages == 0 {
+		listing.NumPages = 1
+	}
+	if page < 1 {
+		page = 1
+	} else if page > listing.NumPages {
+		page = listing.NumPages
+	}
+	listing.Page = page
+
+	start := (page - 1) * CacheListingPageSize
+	end := start + CacheListingPageSize
+	if end > len(rows) {
+		end = len(rows)
+	}
+	listing.Rows = rows[start:end]
+
+	return listing
+}
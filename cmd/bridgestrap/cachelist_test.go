@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+func TestListCache(t *testing.T) {
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	now := time.Now().UTC()
+	c := testcache.New(time.Hour)
+	c.SetHasher(h)
+	for i := 0; i < CacheListingPageSize+10; i++ {
+		var err error
+		if i%2 == 1 {
+			err = errors.New("error")
+		}
+		addrPort := fmt.Sprintf("1.1.1.1:%d", i+1)
+		c.AddEntry(addrPort, err, now.Add(-time.Duration(i)*time.Minute))
+		for j := 0; j < i; j++ {
+			c.IsCached(addrPort)
+		}
+	}
+	snapshot := c.SnapshotByHashedID()
+
+	l := listCache(snapshot, "", "", "", 1)
+	if l.Total != CacheListingPageSize+10 || l.NumPages != 2 || len(l.Rows) != CacheListingPageSize {
+		t.Errorf("Unexpected first page: %d total, %d pages, %d rows.", l.Total, l.NumPages, len(l.Rows))
+	}
+	if l.Rows[0].HashedID != h.HashAddrPort("1.1.1.1:1") {
+		t.Errorf("Most recently tested entry is not listed first.")
+	}
+	if l.PrevPage() != 0 || l.NextPage() != 2 {
+		t.Errorf("Unexpected previous or next page.")
+	}
+
+	l = listCache(snapshot, "", "", "", 100)
+	if l.Page != 2 || len(l.Rows) != 10 || l.NextPage() != 0 {
+		t.Errorf("Out-of-bounds page was not clamped to last page.")
+	}
+
+	l = listCache(snapshot, "", "failing", "hits", 1)
+	if l.Total != (CacheListingPageSize+10)/2 {
+		t.Errorf("Expected %d failing entries but got %d.", (CacheListingPageSize+10)/2, l.Total)
+	}
+	if l.Rows[0].Functional || l.Rows[0].Hits != CacheListingPageSize+9 {
+		t.Errorf("Entries are not sorted by hits.")
+	}
+
+	hashedID := h.HashAddrPort("1.1.1.1:7")
+	l = listCache(snapshot, hashedID[:20], "", "", 1)
+	if l.Total != 1 || l.Rows[0].HashedID != hashedID {
+		t.Errorf("Failed to search by hashed identifier.")
+	}
+
+	l = listCache(map[string]testcache.Entry{}, "", "", "bogus", 0)
+	if l.Page != 1 || l.NumPages != 1 || len(l.Rows) != 0 || l.Sort != "" {
+		t.Errorf("Unexpected listing of empty cache.")
+	}
+}
+
+func TestCacheListingWeb(t *testing.T) {
+
+	var err error
+	if CachePage, err = template.ParseFiles("../../templates/cache.html"); err != nil {
+		t.Fatalf("Failed to parse cache template: %s", err)
+	}
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	cache = testcache.New(time.Hour)
+	cache.SetHasher(hasher)
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	tokens = map[string]*Token{
+		"admin":    &Token{Token: "admin", Name: "admin", Weight: 1, Admin: true},
+		"operator": &Token{Token: "operator", Name: "operator", Weight: 1},
+	}
+	defer func() { hasher, cache, tokens = nil, nil, make(map[string]*Token) }()
+
+	handler := RequireConsoleAuth(CacheListingWeb)
+	for password, expected := range map[string]int{
+		"":         http.StatusUnauthorized,
+		"operator": http.StatusForbidden,
+		"admin":    http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/cache", nil)
+		if password != "" {
+			r.SetBasicAuth("", password)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != expected {
+			t.Errorf("Expected status code %d for token %q but got %d.", expected, password, w.Code)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), hasher.HashAddrPort("1.1.1.1:1")) {
+			t.Errorf("Cache listing lacks cached bridge.")
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// CanaryInterval determines how often we test our canary bridges.
+	CanaryInterval = 10 * time.Minute
+	// CanaryClient is the client name of our canary tests.
+	CanaryClient = "canary"
+)
+
+// canaries is our list of canary bridges.  It's nil if the operator didn't
+// configure a canary file.
+var canaries *CanaryList
+
+// canarySchema is the schema of our canary file.
+var canarySchema = &testcache.Schema{
+	Name:    "canary",
+	Version: 1,
+	Migrations: map[int]testcache.Migration{
+		0: testcache.NoMigration,
+	},
+}
+
+// CanaryConfig represents our canary file.
+type CanaryConfig struct {
+	Canaries []string `json:"canaries"`
+}
+
+// canaryRequest represents an API request to add or remove a canary bridge.
+type canaryRequest struct {
+	BridgeLine string `json:"bridge_line"`
+}
+
+// canaryResponse represents our response to canary API requests.
+type canaryResponse struct {
+	Canaries []string                      `json:"canaries"`
+	Results  map[string]*tester.BridgeTest `json:"bridge_results"`
+}
+
+// CanaryList is the list of canary bridges that we keep testing, e.g., Tor
+// Browser's default bridges.  If canaries that are known to work stop
+// working, our tester (or its network) is broken, and not the bridges that
+// our clients asked us about.  Operators can change the list at runtime, and
+// we persist it to disk.  It's safe for concurrent use.
+type CanaryList struct {
+	bridgeLines []string
+	results     map[string]*tester.BridgeTest
+	filename    string
+	// changed tells our monitor that the list changed.
+	changed chan bool
+	sync.Mutex
+}
+
+// LoadCanaryList reads our list of canary bridges from the given JSON file.
+// If the file doesn't exist, we start with our Tor instances' bootstrap
+// bridges, which are the canaries that most operators want.
+func LoadCanaryList(filename string) (*CanaryList, error) {
+
+	l := &CanaryList{
+		results:  make(map[string]*tester.BridgeTest),
+		filename: filename,
+		changed:  make(chan bool, 1),
+	}
+
+	config := &CanaryConfig{}
+	err := canarySchema.ReadFile(filename, config)
+	if os.IsNotExist(err) {
+		l.bridgeLines = append([]string{}, tester.BootstrapBridges...)
+		return l, l.save()
+	} else if err != nil {
+		return nil, err
+	}
+	for _, bridgeLine := range config.Canaries {
+		if err := bridgeline.Validate(bridgeLine); err != nil {
+			return nil, fmt.Errorf("invalid canary: %v", err)
+		}
+		l.bridgeLines = append(l.bridgeLines, bridgeline.Canonicalize(bridgeLine))
+	}
+	return l, nil
+}
+
+// save writes our list to disk.  The caller must hold our lock.
+func (l *CanaryList) save() error {
+
+	return canarySchema.WriteFile(l.filename, &CanaryConfig{Canaries: l.bridgeLines})
+}
+
+// notify tells our monitor that the list changed, unless it already knows.
+func (l *CanaryList) notify() {
+
+	select {
+	case l.changed <- true:
+	default:
+	}
+}
+
+// index returns the index of the given canonical bridge line in our list, or
+// -1 if it's not in our list.  The caller must hold our lock.
+func (l *CanaryList) index(bridgeLine string) int {
+
+	for i, b := range l.bridgeLines {
+		if b == bridgeLine {
+			return i
+		}
+	}
+	return -1
+}
+
+// BridgeLines returns a copy of our canary bridges.
+func (l *CanaryList) BridgeLines() []string {
+
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]string{}, l.bridgeLines...)
+}
+
+// Add adds the given bridge line to our canaries and persists the list.
+func (l *CanaryList) Add(bridgeLine string) error {
+
+	if err := bridgeline.Validate(bridgeLine); err != nil {
+		return err
+	}
+	bridgeLine = bridgeline.Canonicalize(bridgeLine)
+
+	l.Lock()
+	defer l.Unlock()
+
+	if l.index(bridgeLine) >= 0 {
+		return errors.New("bridge line is already a canary")
+	}
+	l.bridgeLines = append(l.bridgeLines, bridgeLine)
+	if err := l.save(); err != nil {
+		l.bridgeLines = l.bridgeLines[:len(l.bridgeLines)-1]
+		return err
+	}
+	l.notify()
+	return nil
+}
+
+// Remove removes the given bridge line from our canaries and persists the
+// list.
+func (l *CanaryList) Remove(bridgeLine string) error {
+
+	bridgeLine = bridgeline.Canonicalize(bridgeLine)
+
+	l.Lock()
+	defer l.Unlock()
+
+	i := l.index(bridgeLine)
+	if i < 0 {
+		return errors.New("bridge line is not a canary")
+	}
+	old := l.bridgeLines
+	l.bridgeLines = append(append([]string{}, old[:i]...), old[i+1:]...)
+	if err := l.save(); err != nil {
+		l.bridgeLines = old
+		return err
+	}
+	delete(l.results, bridgeLine)
+	l.notify()
+	return nil
+}
+
+// Results returns our canaries' latest test results.
+func (l *CanaryList) Results() map[string]*tester.BridgeTest {
+
+	l.Lock()
+	defer l.Unlock()
+
+	results := make(map[string]*tester.BridgeTest)
+	for bridgeLine, bridgeTest := range l.results {
+		results[bridgeLine] = bridgeTest
+	}
+	return results
+}
+
+// check tests all of our canaries and updates our metrics.  We don't use or
+// update our cache because canaries are all about fresh test results.
+func (l *CanaryList) check() {
+
+	bridgeLines := l.BridgeLines()
+	if len(bridgeLines) == 0 {
+		metrics.Canary.Reset()
+		return
+	}
+
+	result := torPool().Test(&tester.TestRequest{
+		BridgeLines: bridgeLines,
+		Client:      CanaryClient,
+		Weight:      tester.DefaultWeight,
+	})
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Start from scratch, so removed canaries disappear from our metrics.
+	metrics.Canary.Reset()
+	numFunctional := 0
+	for _, bridgeLine := range bridgeLines {
+		// The canary may have been removed while we were testing it.
+		if l.index(bridgeLine) < 0 {
+			continue
+		}
+		bridgeTest := result.Bridges[bridgeLine]
+		l.results[bridgeLine] = bridgeTest
+		if bridgeTest.Verdict == tester.VerdictInconclusive {
+			continue
+		}
+		functional := 0.0
+		if bridgeTest.Functional {
+			functional = 1
+			numFunctional++
+		}
+		id, _ := hasher.Hash(bridgeLine)
+		metrics.Canary.With(prometheus.Labels{"bridge": id}).Set(functional)
+	}
+	log.Printf("%d out of %d canaries are functional.", numFunctional, len(bridgeLines))
+}
+
+// Monitor tests our canaries every CanaryInterval, and right away whenever
+// our list changes, until the given channel is closed.
+func (l *CanaryList) Monitor(shutdown chan bool) {
+
+	ticker := time.NewTicker(CanaryInterval)
+	defer ticker.Stop()
+	for {
+		l.check()
+		select {
+		case <-ticker.C:
+		case <-l.changed:
+			log.Printf("Canaries changed.  Testing them right away.")
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// getAdmin determines the client that sent the given API request and returns
+// an error if the client isn't allowed to administer bridgestrap.
+func getAdmin(r *http.Request) (*Token, error) {
+
+	client, err := getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		return nil, errors.New("token is not allowed to administer bridgestrap")
+	}
+	return client, nil
+}
+
+// sendCanaries responds with our canaries and their latest test results.
+func sendCanaries(w http.ResponseWriter) {
+
+	jsonResult, err := json.Marshal(&canaryResponse{
+		Canaries: canaries.BridgeLines(),
+		Results:  canaries.Results(),
+	})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal canaries", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// Canaries responds with our canaries and their latest test results.
+func Canaries(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := getAdmin(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	sendCanaries(w)
+}
+
+// EditCanaries adds a canary (for POST requests) or removes a canary (for
+// DELETE requests), and responds with our updated canaries.
+func EditCanaries(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	req := &canaryRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		err = canaries.Remove(req.BridgeLine)
+	} else {
+		err = canaries.Add(req.BridgeLine)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Client %s changed our canaries (%s).", client.Name, r.Method)
+	sendCanaries(w)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestCanaryList(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-canaries-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "canaries.json")
+
+	// Without a file, we start with our default bridges and persist them.
+	l, err := LoadCanaryList(filename)
+	if err != nil {
+		t.Fatalf("Failed to load canaries: %s", err)
+	}
+	if len(l.BridgeLines()) != 3 || l.BridgeLines()[0] != tester.DefaultBridge1 {
+		t.Errorf("Failed to start with default bridges: %v", l.BridgeLines())
+	}
+
+	if err := l.Add("bogus"); err == nil {
+		t.Errorf("Accepted invalid canary.")
+	}
+	if err := l.Add("Bridge 1.2.3.4:1234"); err != nil {
+		t.Errorf("Failed to add canary: %s", err)
+	}
+	if err := l.Add("1.2.3.4:1234"); err == nil {
+		t.Errorf("Accepted duplicate canary.")
+	}
+	select {
+	case <-l.changed:
+	default:
+		t.Errorf("Failed to notify monitor of new canary.")
+	}
+
+	if err := l.Remove(tester.DefaultBridge2); err != nil {
+		t.Errorf("Failed to remove canary: %s", err)
+	}
+	if err := l.Remove(tester.DefaultBridge2); err == nil {
+		t.Errorf("Removed canary that doesn't exist.")
+	}
+
+	// Changes must survive restarts.
+	l, err = LoadCanaryList(filename)
+	if err != nil {
+		t.Fatalf("Failed to reload canaries: %s", err)
+	}
+	expected := []string{tester.DefaultBridge1, tester.DefaultBridge3, "1.2.3.4:1234"}
+	bridgeLines := l.BridgeLines()
+	if strings.Join(bridgeLines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected canaries %v but got %v.", expected, bridgeLines)
+	}
+}
+
+func TestEditCanaries(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-canaries-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if canaries, err = LoadCanaryList(filepath.Join(dir, "canaries.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { canaries = nil }()
+	tokens = map[string]*Token{
+		"admin": &Token{Token: "admin", Name: "operator", Weight: 1, Admin: true},
+		"user":  &Token{Token: "user", Name: "rdsys", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	body := `{"bridge_line": "1.2.3.4:1234"}`
+	for _, auth := range []string{"", "Bearer user", "Bearer bogus"} {
+		r := httptest.NewRequest("POST", "/canaries", strings.NewReader(body))
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		EditCanaries(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected status code %d for %q but got %d.", http.StatusForbidden, auth, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/canaries", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	EditCanaries(w, r)
+	resp := &canaryResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to add canary: %d %s", w.Code, w.Body.String())
+	}
+	if len(resp.Canaries) != 4 {
+		t.Errorf("Expected 4 canaries but got %d.", len(resp.Canaries))
+	}
+
+	r = httptest.NewRequest("DELETE", "/canaries", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	EditCanaries(w, r)
+	if w.Code != http.StatusOK || len(canaries.BridgeLines()) != 3 {
+		t.Errorf("Failed to remove canary: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLegacyCanaryFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-canaries-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "canaries.json")
+
+	// Hand-written files without a schema version must keep working.
+	if err := ioutil.WriteFile(filename, []byte(`{"canaries": ["1.2.3.4:1234"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadCanaryList(filename)
+	if err != nil {
+		t.Fatalf("Failed to load unversioned canaries: %s", err)
+	}
+	if bridgeLines := l.BridgeLines(); len(bridgeLines) != 1 || bridgeLines[0] != "1.2.3.4:1234" {
+		t.Errorf("Unexpected canaries: %v", bridgeLines)
+	}
+
+	// Once we save the file, it has our schema version.
+	if err := l.Add("5.6.7.8:5678"); err != nil {
+		t.Fatalf("Failed to add canary: %s", err)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := struct{ Version int }{}
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != canarySchema.Version {
+		t.Errorf("Expected schema version %d but got %d.", canarySchema.Version, config.Version)
+	}
+
+	// Files from a newer version of bridgestrap are readable, too.
+	content = []byte(`{"version": 99, "canaries": ["1.2.3.4:1234"], "foo": true}`)
+	if err := ioutil.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err = LoadCanaryList(filename); err != nil {
+		t.Fatalf("Failed to load canaries of newer schema: %s", err)
+	}
+	if len(l.BridgeLines()) != 1 {
+		t.Errorf("Unexpected canaries: %v", l.BridgeLines())
+	}
+}
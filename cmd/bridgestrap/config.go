@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// reloadableSettings are the settings that we apply when we reload our config
+// file on SIGHUP.  All other settings only take effect after a restart.
+var reloadableSettings = []string{"test-timeout", "cache-timeout", "cache-timeout-success",
+	"cache-timeout-failure", "pt", "cert", "key"}
+
+// Config maps the names of our command line switches (without their dash) to
+// their values, e.g., {"addr": ":5000", "test-timeout": 60, "pt":
+// ["obfs4=/usr/bin/lyrebird"]}.  Repeatable switches take a list of values.
+// Switches that are given on the command line take precedence over the config
+// file.
+type Config map[string]interface{}
+
+// LoadConfig reads our config file, which is a JSON object like our other
+// config files.
+func LoadConfig(filename string) (Config, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	config := Config{}
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file %q: %v", filename, err)
+	}
+	if _, exists := config["config"]; exists {
+		return nil, fmt.Errorf("config file %q can't point to another config file", filename)
+	}
+	return config, nil
+}
+
+// configValues turns the given value of a setting into the strings that the
+// setting's switch understands.
+func configValues(value interface{}) ([]string, error) {
+
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case []interface{}:
+		values := []string{}
+		for _, elem := range v {
+			if _, isList := elem.([]interface{}); isList {
+				return nil, fmt.Errorf("lists can't contain lists")
+			}
+			elemValues, err := configValues(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, elemValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unsupported value %v", value)
+}
+
+// Apply sets the switches of the given flag set to our values, except the
+// switches in skip, which were given on the command line.  Unknown settings
+// are errors, so typos don't go unnoticed.
+func (c Config) Apply(fs *flag.FlagSet, skip map[string]bool) error {
+
+	names := []string{}
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if skip[name] {
+			continue
+		}
+		values, err := configValues(c[name])
+		if err != nil {
+			return fmt.Errorf("invalid setting %q: %v", name, err)
+		}
+		for _, value := range values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid setting %q: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// explicitFlags returns the switches that were given on the command line.
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// isReloadable returns true if we apply the given setting on SIGHUP.
+func isReloadable(name string) bool {
+
+	for _, setting := range reloadableSettings {
+		if setting == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadConfig reads the given config file again and applies its reloadable
+// settings.  The given flag set contains our switches.  Settings that were
+// given on the command line keep their values, and reloadable settings that
+// are missing from the config file return to their default.  We neither
+// restart our Web server nor our Tor instances, so queued test requests
+// survive a reload.
+func reloadConfig(switches *flag.FlagSet, filename string, explicit map[string]bool, certs *certLoader) error {
+
+	config, err := LoadConfig(filename)
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	testTimeout := fs.Int("test-timeout", 0, "")
+	cacheTimeout := fs.Int("cache-timeout", 0, "")
+	cacheTimeoutSuccess := fs.Int("cache-timeout-success", 0, "")
+	cacheTimeoutFailure := fs.Int("cache-timeout-failure", 0, "")
+	certFilename := fs.String("cert", "", "")
+	keyFilename := fs.String("key", "", "")
+	var plugins pluginFlag
+	fs.Var(&plugins, "pt", "")
+	for _, name := range reloadableSettings {
+		f := switches.Lookup(name)
+		value := f.DefValue
+		if explicit[name] {
+			value = f.Value.String()
+		}
+		if name != "pt" {
+			fs.Set(name, value)
+		}
+	}
+
+	reloadable := Config{}
+	for name, value := range config {
+		if isReloadable(name) {
+			reloadable[name] = value
+			continue
+		}
+		f := switches.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		if values, err := configValues(value); err == nil && strings.Join(values, " ") != f.Value.String() {
+			log.Printf("Setting %q only takes effect after a restart.", name)
+		}
+	}
+	if err := reloadable.Apply(fs, explicit); err != nil {
+		return err
+	}
+	if *testTimeout < 1 || *cacheTimeout < 1 {
+		return fmt.Errorf("test and cache timeout must be positive")
+	}
+	if *cacheTimeoutSuccess < 0 || *cacheTimeoutFailure < 0 {
+		return fmt.Errorf("cache timeouts of functional and dysfunctional bridges must not be negative")
+	}
+
+	if certs != nil {
+		if err := certs.Load(*certFilename, *keyFilename); err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+	}
+	tester.SetTestTimeout(time.Duration(*testTimeout) * time.Second)
+	cache.SetTimeouts(cacheTimeouts(*cacheTimeout, *cacheTimeoutSuccess, *cacheTimeoutFailure))
+	if !explicit["pt"] {
+		old := pluginSpecs(tester.Plugins())
+		tester.SetPlugins(plugins)
+		if pool := torPool(); pool != nil && old != pluginSpecs(tester.Plugins()) {
+			if err := pool.ReloadPlugins(); err != nil {
+				return fmt.Errorf("failed to reload plugins: %v", err)
+			}
+		}
+	}
+	log.Printf("Reloaded config file %q: test timeout is %s, cache timeout is %s (functional) and %s (dysfunctional).",
+		filename, tester.TestTimeout(), cache.SuccessTimeout(), cache.FailureTimeout())
+	return nil
+}
+
+// cacheTimeouts turns the given cache timeouts in hours into the timeouts of
+// functional and dysfunctional bridges.  The timeouts of functional and
+// dysfunctional bridges fall back to the general cache timeout if they're 0.
+func cacheTimeouts(general, success, failure int) (time.Duration, time.Duration) {
+
+	if success == 0 {
+		success = general
+	}
+	if failure == 0 {
+		failure = general
+	}
+	return time.Duration(success) * time.Hour, time.Duration(failure) * time.Hour
+}
+
+// pluginSpecs returns the given plugins in the form of our -pt switch.
+func pluginSpecs(plugins []*tester.Plugin) string {
+
+	specs := []string{}
+	for _, p := range plugins {
+		specs = append(specs, p.String())
+	}
+	return strings.Join(specs, " ")
+}
+
+// certLoader holds our TLS certificate, which we can replace at runtime, e.g.,
+// after renewing it.
+type certLoader struct {
+	cert *tls.Certificate
+	sync.RWMutex
+}
+
+// Load replaces our certificate with the one in the given files.
+func (l *certLoader) Load(certFilename, keyFilename string) error {
+
+	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	l.cert = &cert
+	return nil
+}
+
+// GetCertificate implements tls.Config's GetCertificate.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	l.RLock()
+	defer l.RUnlock()
+
+	return l.cert, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// testSwitches returns a flag set with the switches that our config tests
+// need.
+func testSwitches() *flag.FlagSet {
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.String("addr", ":5000", "")
+	fs.Bool("web", false, "")
+	fs.Int("test-timeout", 60, "")
+	fs.Int("cache-timeout", 18, "")
+	fs.Int("cache-timeout-success", 0, "")
+	fs.Int("cache-timeout-failure", 0, "")
+	fs.String("cert", "", "")
+	fs.String("key", "", "")
+	fs.Var(&pluginFlag{}, "pt", "")
+	return fs
+}
+
+func TestConfigApply(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	for _, content := range []string{`{"bogus": 1}`, `{"web": "maybe"}`, `{"config": "other.json"}`, `{"pt": [["obfs4=/bin/true"]]}`} {
+		ioutil.WriteFile(filename, []byte(content), 0600)
+		config, err := LoadConfig(filename)
+		if err == nil {
+			err = config.Apply(testSwitches(), nil)
+		}
+		if err == nil {
+			t.Errorf("Accepted invalid config %s.", content)
+		}
+	}
+
+	ioutil.WriteFile(filename, []byte(`{"addr": ":6000", "web": true, "test-timeout": 30,
+		"pt": ["obfs4=/usr/bin/lyrebird", "conjure=/usr/bin/conjure-client"]}`), 0600)
+	config, err := LoadConfig(filename)
+	if err != nil {
+		t.Fatalf("Failed to load config: %s", err)
+	}
+	fs := testSwitches()
+	// Switches on the command line take precedence.
+	fs.Parse([]string{"-addr", ":7000"})
+	if err := config.Apply(fs, explicitFlags(fs)); err != nil {
+		t.Fatalf("Failed to apply config: %s", err)
+	}
+	for name, expected := range map[string]string{
+		"addr":         ":7000",
+		"web":          "true",
+		"test-timeout": "30",
+		"pt":           "obfs4=/usr/bin/lyrebird conjure=/usr/bin/conjure-client",
+	} {
+		if value := fs.Lookup(name).Value.String(); value != expected {
+			t.Errorf("Expected %s to be %q but got %q.", name, expected, value)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	defer tester.SetTestTimeout(tester.TestTimeout())
+	defer tester.SetPlugins(nil)
+
+	fs := testSwitches()
+	fs.Parse([]string{"-test-timeout", "45"})
+	explicit := explicitFlags(fs)
+
+	ioutil.WriteFile(filename, []byte(`{"test-timeout": 30, "cache-timeout": 6, "cache-timeout-failure": 2, "addr": ":6000",
+		"pt": ["conjure=/usr/bin/conjure-client"]}`), 0600)
+	if err := reloadConfig(fs, filename, explicit, nil); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+	if tester.TestTimeout() != 45*time.Second {
+		t.Errorf("Reload overrode switch on the command line: %s", tester.TestTimeout())
+	}
+	if cache.SuccessTimeout() != 6*time.Hour || cache.FailureTimeout() != 2*time.Hour {
+		t.Errorf("Reload didn't change cache timeouts: %s %s", cache.SuccessTimeout(), cache.FailureTimeout())
+	}
+	if !tester.TransportAvailable("conjure") {
+		t.Errorf("Reload didn't add plugin.")
+	}
+
+	// Settings that we drop from the config file return to their default.
+	ioutil.WriteFile(filename, []byte(`{}`), 0600)
+	if err := reloadConfig(fs, filename, explicit, nil); err != nil {
+		t.Fatalf("Failed to reload config: %s", err)
+	}
+	if cache.SuccessTimeout() != 18*time.Hour || cache.FailureTimeout() != 18*time.Hour ||
+		tester.TransportAvailable("conjure") {
+		t.Errorf("Reload didn't restore defaults.")
+	}
+
+	// A broken config file leaves our settings alone.
+	ioutil.WriteFile(filename, []byte(`{"cache-timeout": 0}`), 0600)
+	if err := reloadConfig(fs, filename, explicit, nil); err == nil {
+		t.Errorf("Accepted invalid cache timeout.")
+	}
+	if cache.SuccessTimeout() != 18*time.Hour {
+		t.Errorf("Invalid config changed cache timeout.")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// ConsoleRealm is the HTTP authentication realm of our API console.
+const ConsoleRealm = "bridgestrap console"
+
+// consoleStage represents a test stage that operators can select in our
+// console.
+type consoleStage struct {
+	Name    string
+	Default bool
+}
+
+// consolePage contains the data that our console template needs.
+type consolePage struct {
+	Stages      []consoleStage
+	Vantages    []string
+	AllVantages string
+}
+
+// getConsoleClient determines which client is using our API console.  The
+// console uses HTTP basic authentication, with an API token as password, so
+// browsers prompt operators for their token.  The user name is ignored.
+func getConsoleClient(r *http.Request) (*Token, error) {
+
+	_, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errors.New("console requires authentication")
+	}
+	t, exists := tokens[password]
+	if !exists {
+		return nil, errors.New("invalid token")
+	}
+	return t, nil
+}
+
+// RequireConsoleAuth wraps the given handler and rejects requests that don't
+// authenticate with a valid API token.
+func RequireConsoleAuth(inner func(http.ResponseWriter, *http.Request, *Token)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := getConsoleClient(r)
+		if err != nil {
+			metrics.Requests.With(prometheus.Labels{"type": "console", "status": "invalid"}).Inc()
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+ConsoleRealm+`", charset="UTF-8"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		inner(w, r, client)
+	}
+}
+
+// Console serves our API console, which lets operators test bridge lines at
+// the test stages and vantage points of their choice, and inspect the
+// structured results.
+func Console(w http.ResponseWriter, r *http.Request, client *Token) {
+
+	page := &consolePage{AllVantages: tester.AllVantages}
+	// Read-only replicas have no Tor instances, and hence no vantage points.
+	if torPool() != nil {
+		page.Vantages = allVantages()
+	}
+	for _, stage := range tester.StageOrder {
+		page.Stages = append(page.Stages, consoleStage{
+			Name:    stage,
+			Default: tester.HasStage(tester.DefaultStages, stage),
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := ConsolePage.Execute(w, page); err != nil {
+		log.Printf("Failed to render console: %s", err)
+	}
+}
+
+// ConsoleTest tests the bridge lines that an operator submitted through our
+// API console.  It takes the same JSON requests as our API.
+func ConsoleTest(w http.ResponseWriter, r *http.Request, client *Token) {
+
+	log.Printf("Console request from client %s.", client.Name)
+	serveBridgeState(w, r, client, "console")
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestRequireConsoleAuth(t *testing.T) {
+
+	tokens = map[string]*Token{"secret": &Token{Token: "secret", Name: "operator", Weight: 1}}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	var authenticated *Token
+	handler := RequireConsoleAuth(func(w http.ResponseWriter, r *http.Request, client *Token) {
+		authenticated = client
+	})
+
+	r := httptest.NewRequest("GET", "/console", nil)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Failed to ask unauthenticated client for credentials.")
+	}
+
+	r.SetBasicAuth("", "bogus")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized || authenticated != nil {
+		t.Errorf("Accepted invalid token.")
+	}
+
+	r.SetBasicAuth("whoever", "secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if authenticated == nil || authenticated.Name != "operator" {
+		t.Errorf("Rejected valid token.")
+	}
+}
+
+func TestConsole(t *testing.T) {
+
+	var err error
+	if ConsolePage, err = template.ParseFiles("../../templates/console.html"); err != nil {
+		t.Fatalf("Failed to parse console template: %s", err)
+	}
+	setRole(tester.NewTorPool(&tester.TorContext{Vantage: "de"}, &tester.TorContext{Vantage: "ru"}), nil, nil)
+	defer setRole(nil, nil, nil)
+
+	w := httptest.NewRecorder()
+	Console(w, httptest.NewRequest("GET", "/console", nil), &Token{Name: "operator"})
+	body := w.Body.String()
+	for _, expected := range []string{`value="tcp"`, `<option value="de">`, `<option value="ru">`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Console lacks %q.", expected)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// controllerResponse represents our response to requests for our control port
+// audit trail.
+type controllerResponse struct {
+	Commands []*tester.ControllerCommand `json:"commands"`
+}
+
+// DebugController responds with the most recent control port commands that
+// our Tor instances issued, and Tor's responses.  The optional parameter
+// "instance" limits the response to the given Tor instance.
+func DebugController(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	instance := r.URL.Query().Get("instance")
+	resp := &controllerResponse{Commands: []*tester.ControllerCommand{}}
+	for _, cmd := range tester.ControllerAudit() {
+		if instance == "" || cmd.Instance == instance {
+			resp.Commands = append(resp.Commands, cmd)
+		}
+	}
+	jsonResult, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal controller audit trail", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %s queried our controller audit trail.", client.Name)
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// controllerTraceRequest represents requests for, and changes of, our
+// controller trace level.
+type controllerTraceRequest struct {
+	Level string `json:"level"`
+}
+
+// ControllerTrace responds with our controller trace level (for GET
+// requests), or changes it (for PUT requests), e.g., to trace a misbehaving
+// Tor instance without restarting bridgestrap.
+func ControllerTrace(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		req := &controllerTraceRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := tester.SetControllerTrace(req.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Client %s set our controller trace level to %q.", client.Name, req.Level)
+	}
+	jsonResult, err := json.Marshal(&controllerTraceRequest{Level: tester.ControllerTrace()})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal controller trace level", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
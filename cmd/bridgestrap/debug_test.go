@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestDebugController(t *testing.T) {
+
+	tokens = map[string]*Token{
+		"admin": &Token{Token: "admin", Name: "admin", Weight: 1, Admin: true},
+		"user":  &Token{Token: "user", Name: "user", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	r := httptest.NewRequest("GET", "/debug/controller", nil)
+	r.Header.Set("Authorization", "Bearer user")
+	w := httptest.NewRecorder()
+	DebugController(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d but got %d.", http.StatusForbidden, w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/debug/controller?instance=tor0", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	DebugController(w, r)
+	resp := &controllerResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to query controller audit trail: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Commands == nil {
+		t.Errorf("Expected empty list of commands but got null.")
+	}
+}
+
+func TestControllerTrace(t *testing.T) {
+
+	tokens = map[string]*Token{
+		"admin": &Token{Token: "admin", Name: "admin", Weight: 1, Admin: true},
+		"user":  &Token{Token: "user", Name: "user", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+	defer tester.SetControllerTrace(tester.TraceOff)
+
+	r := httptest.NewRequest("PUT", "/debug/controller/trace", strings.NewReader(`{"level": "all"}`))
+	r.Header.Set("Authorization", "Bearer user")
+	w := httptest.NewRecorder()
+	ControllerTrace(w, r)
+	if w.Code != http.StatusForbidden || tester.ControllerTrace() != tester.TraceOff {
+		t.Errorf("Non-admin changed our trace level: %d", w.Code)
+	}
+
+	r = httptest.NewRequest("PUT", "/debug/controller/trace", strings.NewReader(`{"level": "commands"}`))
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	ControllerTrace(w, r)
+	resp := &controllerTraceRequest{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || resp.Level != tester.TraceCommands ||
+		tester.ControllerTrace() != tester.TraceCommands {
+		t.Errorf("Failed to set trace level: %d %s", w.Code, w.Body.String())
+	}
+
+	r = httptest.NewRequest("PUT", "/debug/controller/trace", strings.NewReader(`{"level": "bogus"}`))
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	ControllerTrace(w, r)
+	if w.Code != http.StatusBadRequest || tester.ControllerTrace() != tester.TraceCommands {
+		t.Errorf("Failed to reject invalid trace level: %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/debug/controller/trace", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w = httptest.NewRecorder()
+	ControllerTrace(w, r)
+	if !strings.Contains(w.Body.String(), `"level":"commands"`) {
+		t.Errorf("Unexpected trace level: %s", w.Body.String())
+	}
+}
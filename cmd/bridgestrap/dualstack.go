@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// dualStack determines if we test dual-stack bridges over both IPv4 and IPv6.
+var dualStack = true
+
+// familyLines returns, keyed by address family, a vanilla bridge line for the
+// first ORPort of each family that the given functional bridge's descriptor
+// advertises.  It returns nil unless the bridge advertises both families.
+func familyLines(bridgeTest *tester.BridgeTest) map[string]string {
+
+	if !bridgeTest.Functional || bridgeTest.Descriptor == nil || bridgeTest.ObservedFingerprint == "" {
+		return nil
+	}
+	lines := make(map[string]string)
+	for _, orport := range bridgeTest.Descriptor.ORPorts {
+		family := bridgeline.Family(orport)
+		if _, exists := lines[family]; family != "" && !exists {
+			lines[family] = fmt.Sprintf("%s %s", orport, bridgeTest.ObservedFingerprint)
+		}
+	}
+	if len(lines) < 2 {
+		return nil
+	}
+	return lines
+}
+
+// setFamilyResult records if the given bridge works over the given address
+// family.
+func setFamilyResult(bridgeTest *tester.BridgeTest, family string, functional bool) {
+
+	switch family {
+	case "ipv4":
+		bridgeTest.FunctionalIPv4 = &functional
+	case "ipv6":
+		bridgeTest.FunctionalIPv6 = &functional
+	}
+}
+
+// testAddressFamilies tests each functional dual-stack bridge in the given
+// result over both address families, on behalf of the given request, using
+// the given test function, and adds the per-family results to the bridge's
+// result.  Functional vanilla bridge lines already told us that their ORPort
+// works.  Tor's events identify bridges by their fingerprint, so the bridge
+// lines of each family get their own batch, and we test the batches
+// concurrently.  We leave out families whose result is inconclusive.
+func testAddressFamilies(req *tester.TestRequest, result *tester.TestResult,
+	test func(*tester.TestRequest) *tester.TestResult) {
+
+	if !dualStack {
+		return
+	}
+
+	// The ORPorts of the functional vanilla bridge lines in our result work.
+	working := make(map[string]bool)
+	for bridgeLine, bridgeTest := range result.Bridges {
+		if bridgeTest.Functional && bridgeline.Transport(bridgeLine) == bridgeline.VanillaTransport {
+			if addrPort, err := bridgeline.AddrPort(bridgeLine); err == nil {
+				working[fmt.Sprintf("%s %s", addrPort, bridgeTest.ObservedFingerprint)] = true
+			}
+		}
+	}
+
+	batches := make(map[string][]string)
+	owners := make(map[string][]*tester.BridgeTest)
+	for _, bridgeTest := range result.Bridges {
+		for family, line := range familyLines(bridgeTest) {
+			if working[line] {
+				setFamilyResult(bridgeTest, family, true)
+				continue
+			}
+			if _, exists := owners[line]; !exists {
+				batches[family] = append(batches[family], line)
+			}
+			owners[line] = append(owners[line], bridgeTest)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	for family, lines := range batches {
+		wg.Add(1)
+		go func(family string, lines []string) {
+			defer wg.Done()
+			familyResult := test(&tester.TestRequest{
+				BridgeLines: lines,
+				Client:      req.Client,
+				Weight:      req.Weight,
+				Timeout:     req.Timeout,
+				Background:  req.Background,
+			})
+			l.Lock()
+			defer l.Unlock()
+			for _, line := range lines {
+				familyTest, exists := familyResult.Bridges[line]
+				if !exists || familyTest.Verdict == tester.VerdictInconclusive {
+					continue
+				}
+				for _, bridgeTest := range owners[line] {
+					setFamilyResult(bridgeTest, family, familyTest.Functional)
+				}
+			}
+		}(family, lines)
+	}
+	wg.Wait()
+}
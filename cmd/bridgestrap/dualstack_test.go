@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestFamilyLines(t *testing.T) {
+
+	bridgeTest := &tester.BridgeTest{
+		Functional:          true,
+		ObservedFingerprint: testFingerprint,
+		Descriptor:          &tester.Descriptor{ORPorts: []string{"1.2.3.4:9001", "[2001:db8::1]:9001", "[2001:db8::2]:443"}},
+	}
+	lines := familyLines(bridgeTest)
+	if len(lines) != 2 || lines["ipv4"] != vanillaLine || lines["ipv6"] != "[2001:db8::1]:9001 "+testFingerprint {
+		t.Errorf("Unexpected family lines: %v", lines)
+	}
+
+	bridgeTest.Descriptor.ORPorts = []string{"1.2.3.4:9001", "5.6.7.8:9001"}
+	if lines = familyLines(bridgeTest); lines != nil {
+		t.Errorf("Expected no family lines for single-stack bridge but got %v.", lines)
+	}
+
+	bridgeTest.Descriptor = nil
+	if lines = familyLines(bridgeTest); lines != nil {
+		t.Errorf("Expected no family lines for bridge without descriptor but got %v.", lines)
+	}
+}
+
+func TestTestAddressFamilies(t *testing.T) {
+
+	ipv6Line := "[2001:db8::1]:9001 " + testFingerprint
+	dualStackDescriptor := &tester.Descriptor{ORPorts: []string{"1.2.3.4:9001", "[2001:db8::1]:9001"}}
+	newResult := func() *tester.TestResult {
+		result := tester.NewTestResult()
+		for _, bridgeLine := range []string{obfs4Line, vanillaLine} {
+			result.Bridges[bridgeLine] = &tester.BridgeTest{
+				Functional:          true,
+				Verdict:             tester.VerdictFunctional,
+				ObservedFingerprint: testFingerprint,
+				Descriptor:          dualStackDescriptor,
+			}
+		}
+		return result
+	}
+
+	// Our bridge's IPv6 ORPort is broken.
+	var l sync.Mutex
+	tested := []string{}
+	test := func(req *tester.TestRequest) *tester.TestResult {
+		l.Lock()
+		tested = append(tested, req.BridgeLines...)
+		l.Unlock()
+		result := tester.NewTestResult()
+		for _, bridgeLine := range req.BridgeLines {
+			result.Bridges[bridgeLine] = &tester.BridgeTest{Functional: bridgeLine != ipv6Line, Verdict: tester.VerdictDysfunctional}
+		}
+		return result
+	}
+
+	result := newResult()
+	testAddressFamilies(&tester.TestRequest{}, result, test)
+	// We already know that the vanilla bridge line's ORPort works, and we
+	// test the bridge's IPv6 ORPort only once.
+	if len(tested) != 1 || tested[0] != ipv6Line {
+		t.Errorf("Unexpected tested bridge lines: %v", tested)
+	}
+	for bridgeLine, bridgeTest := range result.Bridges {
+		if bridgeTest.FunctionalIPv4 == nil || !*bridgeTest.FunctionalIPv4 ||
+			bridgeTest.FunctionalIPv6 == nil || *bridgeTest.FunctionalIPv6 {
+			t.Errorf("Unexpected family results for %q: %+v", bridgeLine, bridgeTest)
+		}
+	}
+
+	// Inconclusive results don't tell us anything about a family.
+	inconclusive := func(req *tester.TestRequest) *tester.TestResult {
+		result := tester.NewTestResult()
+		for _, bridgeLine := range req.BridgeLines {
+			result.Bridges[bridgeLine] = &tester.BridgeTest{Verdict: tester.VerdictInconclusive}
+		}
+		return result
+	}
+	result = newResult()
+	testAddressFamilies(&tester.TestRequest{}, result, inconclusive)
+	if b := result.Bridges[obfs4Line]; b.FunctionalIPv4 == nil || b.FunctionalIPv6 != nil {
+		t.Errorf("Unexpected family results after inconclusive test: %+v", b)
+	}
+
+	defer func() { dualStack = true }()
+	dualStack = false
+	result = newResult()
+	testAddressFamilies(&tester.TestRequest{}, result, test)
+	if b := result.Bridges[obfs4Line]; b.FunctionalIPv4 != nil || b.FunctionalIPv6 != nil {
+		t.Errorf("Tested address families despite being disabled: %+v", b)
+	}
+}
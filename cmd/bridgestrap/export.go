@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+const (
+	// BridgePoolAssignmentType is the type annotation of our bridge pool
+	// assignment export.  It's CollecTor's type annotation of BridgeDB's
+	// bridge pool assignments, so existing parsers accept our export:
+	// https://metrics.torproject.org/collector.html#type-bridge-pool-assignment
+	BridgePoolAssignmentType = "@type bridge-pool-assignment 1.0"
+	// BridgePoolAssignmentPool is the pool that our export assigns all
+	// bridges to, where BridgeDB names a distributor.
+	BridgePoolAssignmentPool = "bridgestrap"
+	// BridgePoolAssignmentIDLen is the number of hex digits of the bridge
+	// identifiers in bridge pool assignments.  BridgeDB's identifiers are
+	// SHA-1 hashes of fingerprints, which have 40 hex digits.
+	BridgePoolAssignmentIDLen = 40
+	// BridgeMetricsType is the type annotation of our bridge metrics, which
+	// Tor Metrics ingests.
+	BridgeMetricsType = "@type bridgestrap-bridge-metrics 1.0"
+	// ExportTimeFormat is the time format of Tor's bridge pool assignments.
+	ExportTimeFormat = "2006-01-02 15:04:05"
+)
+
+// ExportFilter determines which bridges our exports contain, so consumers can
+// fetch the slice they need rather than all of our results.  Its zero value
+// lets all bridges through.
+type ExportFilter struct {
+	// MaxAge excludes bridges that we last tested longer ago than MaxAge.
+	MaxAge time.Duration
+	// Transport excludes bridges of other transports, e.g., "obfs4".
+	Transport string
+	// Status excludes bridges that aren't "functional", or that aren't
+	// "dysfunctional".
+	Status string
+}
+
+// ParseExportFilter turns the query parameters "max_age" (a duration, e.g.,
+// "6h"), "transport", and "status" into an export filter.
+func ParseExportFilter(query url.Values) (*ExportFilter, error) {
+
+	f := &ExportFilter{
+		Transport: strings.ToLower(query.Get("transport")),
+		Status:    strings.ToLower(query.Get("status")),
+	}
+	if maxAge := query.Get("max_age"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("parameter \"max_age\" must be a positive duration, e.g., \"6h\"")
+		}
+		f.MaxAge = d
+	}
+	if f.Status != "" && f.Status != "functional" && f.Status != "dysfunctional" {
+		return nil, fmt.Errorf("parameter \"status\" must be \"functional\" or \"dysfunctional\"")
+	}
+	return f, nil
+}
+
+// IsZero returns true if the filter lets all bridges through.
+func (f *ExportFilter) IsZero() bool {
+	return *f == ExportFilter{}
+}
+
+// String returns the filter as query string, e.g., "status=functional".
+func (f *ExportFilter) String() string {
+
+	query := url.Values{}
+	if f.MaxAge != 0 {
+		query.Set("max_age", f.MaxAge.String())
+	}
+	if f.Transport != "" {
+		query.Set("transport", f.Transport)
+	}
+	if f.Status != "" {
+		query.Set("status", f.Status)
+	}
+	return query.Encode()
+}
+
+// matches returns true if a bridge of the given transport and status that we
+// last tested at the given time passes the filter at the given time.  Entries
+// that we cached before we kept track of transports have no transport, so
+// they never match a transport filter.
+func (f *ExportFilter) matches(transport string, functional bool, lastTested, now time.Time) bool {
+
+	if f.MaxAge != 0 && now.Sub(lastTested) > f.MaxAge {
+		return false
+	}
+	if f.Transport != "" && !strings.EqualFold(f.Transport, transport) {
+		return false
+	}
+	if (f.Status == "functional" && !functional) || (f.Status == "dysfunctional" && functional) {
+		return false
+	}
+	return true
+}
+
+// writeBridgePoolAssignments writes the given cache snapshot to the given
+// writer, in the format of BridgeDB's bridge pool assignments.  It looks as
+// follows:
+//
+//	@type bridge-pool-assignment 1.0
+//	bridge-pool-assignment 2020-11-12 19:42:16
+//	0123...cdef bridgestrap status=functional transport=obfs4 last-tested=2020-11-12T19:40:01Z
+//	4567...abcd bridgestrap status=dysfunctional last-tested=2020-11-12T19:41:34Z
+//
+// BridgeDB's assignments identify bridges by 40 hex digits, so we identify
+// bridges by the first 40 hex digits of their hashed identifier, in lower
+// case like BridgeDB's.  Lines are sorted by identifier, like in BridgeDB's
+// assignments.  Bridges that we cached before we kept track of transports
+// lack the transport field.  We only write bridges that pass the given
+// filter.
+func writeBridgePoolAssignments(w io.Writer, snapshot map[string]testcache.Entry,
+	h *BridgeHasher, published time.Time, f *ExportFilter) error {
+
+	lines := []string{}
+	for addrPort, entry := range snapshot {
+		if !f.matches(entry.Transport, entry.Error == "", entry.Time, published) {
+			continue
+		}
+		fields := []string{
+			strings.ToLower(h.HashAddrPort(addrPort)[:BridgePoolAssignmentIDLen]),
+			BridgePoolAssignmentPool,
+			"status=functional",
+		}
+		if entry.Error != "" {
+			fields[2] = "status=dysfunctional"
+		}
+		if entry.Transport != "" {
+			fields = append(fields, "transport="+entry.Transport)
+		}
+		fields = append(fields, "last-tested="+entry.Time.UTC().Format(time.RFC3339))
+		lines = append(lines, strings.Join(fields, " "))
+	}
+	sort.Strings(lines)
+
+	if _, err := fmt.Fprintf(w, "%s\nbridge-pool-assignment %s\n",
+		BridgePoolAssignmentType, published.UTC().Format(ExportTimeFormat)); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBridgeMetrics writes the given cache snapshot to the given writer as
+// bridge metrics for Tor Metrics.  Unlike our bridge pool assignments, the
+// metrics contain each bridge's transport, error code, and cache hits.  They
+// look as follows:
+//
+//	@type bridgestrap-bridge-metrics 1.0
+//	bridge-metrics-end 2020-11-12 19:42:16
+//	bridge 0123...CDEF transport=obfs4 status=functional last-tested=2020-11-12T19:40:01Z hits=3
+//	bridge 4567...ABCD transport=vanilla status=dysfunctional error-code=CONNECTREFUSED last-tested=2020-11-12T19:41:34Z hits=0
+//
+// Entries that we cached before we kept track of transports or error codes
+// lack the respective keyword.  Lines are sorted by hashed identifier, and we
+// only write bridges that pass the given filter.
+func writeBridgeMetrics(w io.Writer, snapshot map[string]testcache.Entry,
+	h *BridgeHasher, published time.Time, f *ExportFilter) error {
+
+	lines := []string{}
+	for addrPort, entry := range snapshot {
+		if !f.matches(entry.Transport, entry.Error == "", entry.Time, published) {
+			continue
+		}
+		line := fmt.Sprintf("bridge %s", h.HashAddrPort(addrPort))
+		if entry.Transport != "" {
+			line += fmt.Sprintf(" transport=%s", entry.Transport)
+		}
+		if entry.Error == "" {
+			line += " status=functional"
+		} else {
+			line += " status=dysfunctional"
+			if entry.ErrorCode != "" {
+				line += fmt.Sprintf(" error-code=%s", entry.ErrorCode)
+			}
+		}
+		line += fmt.Sprintf(" last-tested=%s hits=%d", entry.Time.UTC().Format(time.RFC3339), entry.Hits)
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	if _, err := fmt.Fprintf(w, "%s\nbridge-metrics-end %s\n",
+		BridgeMetricsType, published.UTC().Format(ExportTimeFormat)); err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
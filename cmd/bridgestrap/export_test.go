@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+func TestWriteBridgePoolAssignments(t *testing.T) {
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	tested := time.Date(2020, 11, 12, 19, 40, 1, 0, time.UTC)
+	published := time.Date(2020, 11, 12, 19, 42, 16, 0, time.UTC)
+
+	cache := testcache.New(time.Since(tested) + time.Hour)
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=foo iat-mode=0", nil, tested)
+	cache.AddEntry("2.2.2.2:2", errors.New("error"), tested)
+	// Make sure that expired entries are not exported.
+	cache.AddEntry("3.3.3.3:3", nil, tested.Add(-time.Hour*24*365*10))
+
+	lines := []string{
+		fmt.Sprintf("%s bridgestrap status=functional transport=obfs4 last-tested=2020-11-12T19:40:01Z", poolAssignmentID(h, "1.1.1.1:1")),
+		fmt.Sprintf("%s bridgestrap status=dysfunctional transport=vanilla last-tested=2020-11-12T19:40:01Z", poolAssignmentID(h, "2.2.2.2:2")),
+	}
+	sort.Strings(lines)
+	expected := "@type bridge-pool-assignment 1.0\n" +
+		"bridge-pool-assignment 2020-11-12 19:42:16\n" +
+		lines[0] + "\n" + lines[1] + "\n"
+
+	buf := new(bytes.Buffer)
+	if err := writeBridgePoolAssignments(buf, cache.Snapshot(), h, published, &ExportFilter{}); err != nil {
+		t.Fatalf("Failed to write bridge pool assignments: %s", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, buf.String())
+	}
+
+	// Parsers of BridgeDB's assignments expect 40 hex digits, followed by
+	// a pool and key=value pairs.
+	assignment := regexp.MustCompile(`^[0-9a-f]{40} [a-z]+( [a-z-]+=[^ ]+)*$`)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n")[2:] {
+		if !assignment.MatchString(line) {
+			t.Errorf("Line %q isn't a bridge pool assignment.", line)
+		}
+	}
+}
+
+// poolAssignmentID returns the identifier of the given addr:port tuple in our
+// bridge pool assignments.
+func poolAssignmentID(h *BridgeHasher, addrPort string) string {
+	return strings.ToLower(h.HashAddrPort(addrPort)[:BridgePoolAssignmentIDLen])
+}
+
+func TestExportFilter(t *testing.T) {
+
+	for _, query := range []string{"max_age=bogus", "max_age=-1h", "status=working"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := ParseExportFilter(values); err == nil {
+			t.Errorf("Accepted invalid filter %q.", query)
+		}
+	}
+
+	values, _ := url.ParseQuery("max_age=6h&transport=OBFS4&status=functional")
+	f, err := ParseExportFilter(values)
+	if err != nil {
+		t.Fatalf("Failed to parse filter: %s", err)
+	}
+	if f.IsZero() || f.String() != "max_age=6h0m0s&status=functional&transport=obfs4" {
+		t.Errorf("Unexpected filter: %q", f.String())
+	}
+
+	now := time.Now()
+	if !f.matches("obfs4", true, now.Add(-time.Hour), now) {
+		t.Errorf("Filter rejected matching bridge.")
+	}
+	if f.matches("obfs4", true, now.Add(-7*time.Hour), now) {
+		t.Errorf("Filter accepted old bridge.")
+	}
+	if f.matches("vanilla", true, now, now) || f.matches("", true, now, now) {
+		t.Errorf("Filter accepted bridge of other transport.")
+	}
+	if f.matches("obfs4", false, now, now) {
+		t.Errorf("Filter accepted dysfunctional bridge.")
+	}
+
+	if f, _ = ParseExportFilter(url.Values{}); !f.IsZero() || !f.matches("", false, time.Time{}, now) {
+		t.Errorf("Empty filter doesn't let everything through.")
+	}
+}
+
+func TestWriteFilteredBridgePoolAssignments(t *testing.T) {
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	published := time.Now().UTC()
+	cache := testcache.New(time.Hour)
+	cache.AddEntry("1.1.1.1:1", nil, published)
+	cache.AddEntry("2.2.2.2:2", errors.New("error"), published)
+
+	buf := new(bytes.Buffer)
+	if err := writeBridgePoolAssignments(buf, cache.Snapshot(), h, published, &ExportFilter{Status: "dysfunctional"}); err != nil {
+		t.Fatalf("Failed to write bridge pool assignments: %s", err)
+	}
+	if strings.Contains(buf.String(), poolAssignmentID(h, "1.1.1.1:1")) ||
+		!strings.Contains(buf.String(), poolAssignmentID(h, "2.2.2.2:2")) {
+		t.Errorf("Filter didn't apply to export:\n%s", buf.String())
+	}
+}
+
+func TestWriteBridgeMetrics(t *testing.T) {
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	tested := time.Date(2020, 11, 12, 19, 40, 1, 0, time.UTC)
+	published := time.Date(2020, 11, 12, 19, 42, 16, 0, time.UTC)
+	snapshot := map[string]testcache.Entry{
+		"1.1.1.1:1": testcache.Entry{Transport: "obfs4", Time: tested, Hits: 3},
+		"2.2.2.2:2": testcache.Entry{Transport: "vanilla", Error: "error", ErrorCode: "CONNECTREFUSED", Time: tested},
+		"3.3.3.3:3": testcache.Entry{Error: "error", Time: tested},
+	}
+
+	lines := []string{
+		fmt.Sprintf("bridge %s transport=obfs4 status=functional last-tested=2020-11-12T19:40:01Z hits=3", h.HashAddrPort("1.1.1.1:1")),
+		fmt.Sprintf("bridge %s transport=vanilla status=dysfunctional error-code=CONNECTREFUSED last-tested=2020-11-12T19:40:01Z hits=0", h.HashAddrPort("2.2.2.2:2")),
+		fmt.Sprintf("bridge %s status=dysfunctional last-tested=2020-11-12T19:40:01Z hits=0", h.HashAddrPort("3.3.3.3:3")),
+	}
+	sort.Strings(lines)
+	expected := "@type bridgestrap-bridge-metrics 1.0\n" +
+		"bridge-metrics-end 2020-11-12 19:42:16\n" +
+		strings.Join(lines, "\n") + "\n"
+
+	buf := new(bytes.Buffer)
+	if err := writeBridgeMetrics(buf, snapshot, h, published, &ExportFilter{}); err != nil {
+		t.Fatalf("Failed to write bridge metrics: %s", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, buf.String())
+	}
+}
+
+func TestBridgeMetrics(t *testing.T) {
+
+	tokens = map[string]*Token{
+		"metrics": &Token{Token: "metrics", Name: "collector", Weight: 1, Metrics: true},
+		"user":    &Token{Token: "user", Name: "user", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	defer func() { hasher = nil }()
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now())
+
+	for token, status := range map[string]int{
+		"":        http.StatusForbidden,
+		"user":    http.StatusForbidden,
+		"metrics": http.StatusOK,
+	} {
+		r := httptest.NewRequest("GET", "/bridge-metrics", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		BridgeMetrics(w, r)
+		if w.Code != status {
+			t.Errorf("Expected status code %d for token %q but got %d.", status, token, w.Code)
+		}
+		if status == http.StatusOK && !strings.Contains(w.Body.String(), hasher.HashAddrPort("1.1.1.1:1")) {
+			t.Errorf("Bridge metrics lack cached bridge:\n%s", w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// WorkerPath is the path of the API endpoint that we forward test
+	// requests to on our workers.
+	WorkerPath = "/bridge-state"
+	// WorkerTimeout is the time that we give a worker to respond to a
+	// forwarded test request.  Workers queue requests like we do, so this
+	// is generous.
+	WorkerTimeout = 10 * time.Minute
+	// WorkerCode is the error code of bridges that a worker failed to test
+	// for us, e.g., because we couldn't reach it.
+	WorkerCode = "WORKER_ERROR"
+)
+
+// federation is nil unless we forward test requests to remote workers.
+var federation *Federation
+
+// Worker represents a remote bridgestrap instance that tests bridges for us
+// from its own network, e.g., in another country.
+type Worker struct {
+	// Vantage is the name under which clients request the worker's vantage
+	// point, e.g., "de".
+	Vantage string `json:"vantage"`
+	// URL is the worker's base URL, e.g., "https://bridgestrap.example.de".
+	URL string `json:"url"`
+	// Token is the API token that we use to authenticate to the worker.
+	// Workers schedule our requests according to the token's weight.
+	Token string `json:"token,omitempty"`
+}
+
+// WorkerConfig represents our worker configuration file.
+type WorkerConfig struct {
+	Workers []*Worker `json:"workers"`
+}
+
+// Federation forwards test requests to remote workers, so clients can learn
+// how their bridges fare from networks other than ours.  Each worker is a
+// vantage point in addition to the vantage points of our own Tor instances.
+type Federation struct {
+	Workers map[string]*Worker
+	client  *http.Client
+}
+
+// LoadWorkers reads the given JSON worker configuration file and returns a
+// federation of its workers.  Workers can't take the name of the given
+// vantage point of our own Tor instances.
+func LoadWorkers(filename, localVantage string) (*Federation, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &WorkerConfig{}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+
+	f := &Federation{
+		Workers: make(map[string]*Worker),
+		client:  &http.Client{Timeout: WorkerTimeout},
+	}
+	for _, w := range config.Workers {
+		if w.Vantage == "" || w.URL == "" {
+			return nil, errors.New("workers must have a vantage point and a URL")
+		}
+		w.Vantage = strings.ToLower(w.Vantage)
+		w.URL = strings.TrimSuffix(w.URL, "/")
+		if w.Vantage == tester.AllVantages || w.Vantage == strings.ToLower(localVantage) {
+			return nil, fmt.Errorf("worker can't take reserved vantage point %q", w.Vantage)
+		}
+		if _, exists := f.Workers[w.Vantage]; exists {
+			return nil, fmt.Errorf("duplicate worker for vantage point %q", w.Vantage)
+		}
+		f.Workers[w.Vantage] = w
+	}
+	return f, nil
+}
+
+// Vantages returns the sorted vantage points of our workers.
+func (f *Federation) Vantages() []string {
+
+	vantages := []string{}
+	for vantage := range f.Workers {
+		vantages = append(vantages, vantage)
+	}
+	sort.Strings(vantages)
+	return vantages
+}
+
+// workerRequest is the test request that we forward to a worker.  We always
+// send a list of vantage points, even if it's empty, so the worker doesn't
+// apply the default vantage points of our token.
+type workerRequest struct {
+	BridgeLines []string `json:"bridge_lines"`
+	Stages      []string `json:"stages,omitempty"`
+	Vantages    []string `json:"vantages"`
+}
+
+// forward sends the given request's bridge lines to the given worker, and
+// returns the worker's result.
+func (f *Federation) forward(w *Worker, req *tester.TestRequest) (*tester.TestResult, error) {
+
+	body, err := json.Marshal(&workerRequest{
+		BridgeLines: req.BridgeLines,
+		Stages:      req.Stages,
+		Vantages:    []string{},
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", w.URL+WorkerPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if w.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+w.Token)
+	}
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Workers respond with 207 Multi-Status if they consider some of our
+	// bridge lines malformed, and still test the rest.
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("worker responded with status code %d", resp.StatusCode)
+	}
+
+	result := tester.NewTestResult()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	if result.Bridges == nil {
+		result.Bridges = make(map[string]*tester.BridgeTest)
+	}
+	return result, nil
+}
+
+// Test has the worker of the given request's vantage point test the request's
+// bridge lines, and returns the worker's result.  Bridge lines that the worker
+// failed to test are inconclusive.
+func (f *Federation) Test(req *tester.TestRequest) *tester.TestResult {
+
+	w := f.Workers[req.Vantage]
+	result, err := f.forward(w, req)
+	status := "ok"
+	if err != nil {
+		log.Printf("Failed to forward %d bridge lines to worker %q: %s", len(req.BridgeLines), w.Vantage, err)
+		status = "failed"
+		result = tester.NewTestResult()
+		result.Error = fmt.Sprintf("failed to reach worker: %s", err)
+	}
+	metrics.WorkerRequests.With(prometheus.Labels{"vantage": w.Vantage, "status": status}).Inc()
+	completeWorkerResult(result, req.BridgeLines)
+	return result
+}
+
+// completeWorkerResult marks the given bridge lines that are missing from the
+// given result of a worker as inconclusive.
+func completeWorkerResult(result *tester.TestResult, bridgeLines []string) {
+
+	for _, bridgeLine := range bridgeLines {
+		if _, exists := result.Bridges[bridgeLine]; exists {
+			continue
+		}
+		reason := result.Error
+		if reason == "" {
+			reason = "worker did not test bridge"
+		}
+		result.Bridges[bridgeLine] = &tester.BridgeTest{
+			Verdict:    tester.VerdictInconclusive,
+			LastTested: time.Now().UTC(),
+			Error:      reason,
+			ErrorCode:  WorkerCode,
+		}
+	}
+}
+
+// allVantages returns the vantage points of our own Tor instances, followed by
+// the vantage points of our workers and of our job queue.
+func allVantages() []string {
+
+	vantages := torPool().Vantages()
+	if federation != nil {
+		vantages = append(vantages, federation.Vantages()...)
+	}
+	if jobs != nil {
+		vantages = append(vantages, jobs.Vantages()...)
+	}
+	return vantages
+}
+
+// isRemoteVantage returns true if the given vantage point belongs to one of
+// our workers or to our job queue rather than to our own Tor instances.
+func isRemoteVantage(vantage string) bool {
+
+	if federation != nil {
+		if _, exists := federation.Workers[vantage]; exists {
+			return true
+		}
+	}
+	return jobs != nil && jobs.vantages[vantage]
+}
+
+// resolveVantages is like our Tor pool's ResolveVantages, but also knows about
+// the vantage points of our workers and of our job queue.
+func resolveVantages(requested []string) ([]string, error) {
+
+	if federation == nil && jobs == nil {
+		return torPool().ResolveVantages(requested)
+	}
+
+	local := []string{}
+	remote := []string{}
+	seen := make(map[string]bool)
+	for _, vantage := range requested {
+		vantage = strings.ToLower(vantage)
+		if vantage == tester.AllVantages {
+			return allVantages(), nil
+		}
+		if !isRemoteVantage(vantage) {
+			local = append(local, vantage)
+		} else if !seen[vantage] {
+			seen[vantage] = true
+			remote = append(remote, vantage)
+		}
+	}
+	resolved, err := torPool().ResolveVantages(local)
+	if err != nil {
+		return nil, err
+	}
+	return append(resolved, remote...), nil
+}
+
+// testAtVantage tests the given request from its vantage point, which is
+// either one of our Tor instances, one of our workers, or a worker that claims
+// the request from our job queue.
+func testAtVantage(req *tester.TestRequest) *tester.TestResult {
+
+	if federation != nil {
+		if _, exists := federation.Workers[req.Vantage]; exists {
+			return federation.Test(req)
+		}
+	}
+	if jobs != nil && jobs.vantages[req.Vantage] {
+		return jobs.Test(req)
+	}
+	return torPool().Test(req)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestLoadWorkers(t *testing.T) {
+
+	tmpFh, err := ioutil.TempFile(os.TempDir(), "workers-")
+	if err != nil {
+		t.Fatalf("Could not create temporary file for test: %s", err)
+	}
+	defer os.Remove(tmpFh.Name())
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"workers": [
+		{"vantage": "DE", "url": "https://de.example/", "token": "secret"},
+		{"vantage": "ru", "url": "https://ru.example"}
+	]}`), 0600)
+	f, err := LoadWorkers(tmpFh.Name(), tester.DefaultVantage)
+	if err != nil {
+		t.Fatalf("Failed to load workers: %s", err)
+	}
+	if w := f.Workers["de"]; w == nil || w.URL != "https://de.example" || w.Token != "secret" {
+		t.Errorf("Worker was not loaded correctly: %+v", w)
+	}
+	if !reflect.DeepEqual(f.Vantages(), []string{"de", "ru"}) {
+		t.Errorf("Unexpected vantage points: %v", f.Vantages())
+	}
+
+	for _, config := range []string{
+		`{"workers": [{"vantage": "de"}]}`,
+		`{"workers": [{"vantage": "all", "url": "https://all.example"}]}`,
+		`{"workers": [{"vantage": "default", "url": "https://default.example"}]}`,
+		`{"workers": [{"vantage": "de", "url": "https://a.example"}, {"vantage": "DE", "url": "https://b.example"}]}`,
+	} {
+		ioutil.WriteFile(tmpFh.Name(), []byte(config), 0600)
+		if _, err := LoadWorkers(tmpFh.Name(), tester.DefaultVantage); err == nil {
+			t.Errorf("Failed to reject invalid worker config %s.", config)
+		}
+	}
+}
+
+func TestFederation(t *testing.T) {
+
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != WorkerPath || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		raw := make(map[string]json.RawMessage)
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// We must opt out of our token's default vantage points.
+		if string(raw["vantages"]) != "[]" {
+			t.Errorf("Expected empty list of vantage points but got %s.", raw["vantages"])
+		}
+		// Our worker only tests the first bridge line.
+		result := tester.NewTestResult()
+		result.Bridges["1.1.1.1:1"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+		b, _ := json.Marshal(result)
+		SendJSONResponse(w, string(b))
+	}))
+	defer worker.Close()
+
+	setRole(tester.NewTorPool(&tester.TorContext{Vantage: tester.DefaultVantage}), nil, nil)
+	federation = &Federation{
+		Workers: map[string]*Worker{
+			"de": &Worker{Vantage: "de", URL: worker.URL, Token: "secret"},
+			"ru": &Worker{Vantage: "ru", URL: worker.URL, Token: "wrong"},
+		},
+		client: &http.Client{},
+	}
+	defer func() { setRole(nil, nil, nil); federation = nil }()
+
+	vantages, err := resolveVantages([]string{"DE", tester.DefaultVantage, "de"})
+	if err != nil {
+		t.Fatalf("Failed to resolve vantage points: %s", err)
+	}
+	if !reflect.DeepEqual(vantages, []string{tester.DefaultVantage, "de"}) {
+		t.Errorf("Unexpected vantage points: %v", vantages)
+	}
+	if vantages, _ = resolveVantages([]string{tester.AllVantages}); !reflect.DeepEqual(vantages, []string{tester.DefaultVantage, "de", "ru"}) {
+		t.Errorf("Unexpected vantage points: %v", vantages)
+	}
+	if _, err = resolveVantages([]string{"us"}); err == nil {
+		t.Errorf("Failed to reject unknown vantage point.")
+	}
+
+	bridgeLines := []string{"1.1.1.1:1", "2.2.2.2:2"}
+	result := testAtVantage(&tester.TestRequest{BridgeLines: bridgeLines, Vantage: "de"})
+	if !result.Bridges["1.1.1.1:1"].Functional {
+		t.Errorf("Failed to take worker's result.")
+	}
+	if bridgeTest := result.Bridges["2.2.2.2:2"]; bridgeTest.Verdict != tester.VerdictInconclusive || bridgeTest.ErrorCode != WorkerCode {
+		t.Errorf("Unexpected result for bridge that worker didn't test: %+v", bridgeTest)
+	}
+
+	// Our worker rejects our token at the other vantage point.
+	result = testAtVantage(&tester.TestRequest{BridgeLines: bridgeLines, Vantage: "ru"})
+	for _, bridgeLine := range bridgeLines {
+		if bridgeTest := result.Bridges[bridgeLine]; bridgeTest.Verdict != tester.VerdictInconclusive || bridgeTest.ErrorCode != WorkerCode {
+			t.Errorf("Unexpected result for bridge of unreachable worker: %+v", bridgeTest)
+		}
+	}
+}
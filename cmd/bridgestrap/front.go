@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// DefaultFrontSecretHeader is the HTTP header in which our front sends its
+// shared secret, unless configured otherwise.
+const DefaultFrontSecretHeader = "X-Bridgestrap-Front"
+
+// front is our domain fronting configuration.  Its zero value means that we
+// aren't fronted.
+var front = &FrontConfig{}
+
+// FrontConfig determines how we run behind a CDN that clients in censored
+// networks reach via domain fronting.  The CDN typically forwards requests for
+// a path prefix of a shared domain to us, which is why all of our routes can
+// live under a prefix.
+type FrontConfig struct {
+	// PathPrefix is the path under which we serve all of our routes, e.g.,
+	// "/bridgestrap".  It's empty if we serve from the root.
+	PathPrefix string
+	// Hosts contains the (lower-case) Host headers that we accept.  We
+	// accept any Host header if it's empty.
+	Hosts []string
+	// SecretHeader and Secret, if set, require requests to carry the given
+	// secret in the given header, so only our front can reach our API.
+	SecretHeader string
+	Secret       string
+}
+
+// NewFrontConfig returns a new fronting configuration with the given path
+// prefix, comma-separated list of accepted hosts, and header secret.
+func NewFrontConfig(pathPrefix, hosts, secretHeader, secret string) (*FrontConfig, error) {
+
+	f := &FrontConfig{SecretHeader: secretHeader, Secret: secret}
+	if pathPrefix != "" {
+		if !strings.HasPrefix(pathPrefix, "/") {
+			return nil, fmt.Errorf("path prefix %q must start with a slash", pathPrefix)
+		}
+		f.PathPrefix = strings.TrimSuffix(pathPrefix, "/")
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			f.Hosts = append(f.Hosts, host)
+		}
+	}
+	if f.Secret != "" && f.SecretHeader == "" {
+		return nil, fmt.Errorf("header secret requires a header name")
+	}
+	return f, nil
+}
+
+// LoadFrontSecret reads the secret that our front sends us from the given
+// file.
+func LoadFrontSecret(filename string) (string, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", fmt.Errorf("front secret file %q is empty", filename)
+	}
+	return secret, nil
+}
+
+// acceptsHost returns true if the given Host header is one that we accept.
+func (f *FrontConfig) acceptsHost(host string) bool {
+
+	if len(f.Hosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, h := range f.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireFront rejects requests with a Host header that we don't accept, and
+// requests that lack our front's secret.  It removes the secret from the
+// requests that it passes on, so it never ends up in logs or responses.
+func RequireFront(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !front.acceptsHost(r.Host) {
+			abuseLog.Record(r, AbuseForbidden, ClassUnauthenticated)
+			http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+			return
+		}
+		if front.Secret != "" {
+			got := r.Header.Get(front.SecretHeader)
+			if subtle.ConstantTimeCompare([]byte(got), []byte(front.Secret)) != 1 {
+				abuseLog.Record(r, AbuseForbidden, ClassUnauthenticated)
+				http.Error(w, "request didn't come through our front", http.StatusForbidden)
+				return
+			}
+			r.Header.Del(front.SecretHeader)
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
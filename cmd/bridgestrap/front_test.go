@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFrontConfig(t *testing.T) {
+
+	if _, err := NewFrontConfig("bridgestrap", "", "", ""); err == nil {
+		t.Errorf("Accepted path prefix without leading slash.")
+	}
+	if _, err := NewFrontConfig("", "", "", "secret"); err == nil {
+		t.Errorf("Accepted secret without header.")
+	}
+
+	f, err := NewFrontConfig("/bridgestrap/", " Front.Example, bridges.example:443 ,", DefaultFrontSecretHeader, "")
+	if err != nil {
+		t.Fatalf("Failed to create fronting configuration: %s", err)
+	}
+	if f.PathPrefix != "/bridgestrap" {
+		t.Errorf("Unexpected path prefix %q.", f.PathPrefix)
+	}
+	for host, accepted := range map[string]bool{
+		"front.example":      true,
+		"FRONT.example:8443": true,
+		"other.example":      false,
+		"":                   false,
+	} {
+		if f.acceptsHost(host) != accepted {
+			t.Errorf("Expected acceptsHost(%q) to be %t.", host, accepted)
+		}
+	}
+
+	if f, _ = NewFrontConfig("", "", "", ""); !f.acceptsHost("anything.example") {
+		t.Errorf("Rejected host without host list.")
+	}
+}
+
+func TestRequireFront(t *testing.T) {
+
+	defer func() { front = &FrontConfig{} }()
+	front, _ = NewFrontConfig("", "front.example", DefaultFrontSecretHeader, "secret")
+	handler := RequireFront(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(DefaultFrontSecretHeader) != "" {
+			t.Errorf("Secret header made it to our handler.")
+		}
+	}))
+
+	for _, test := range []struct {
+		host, secret string
+		code         int
+	}{
+		{"front.example", "secret", http.StatusOK},
+		{"other.example", "secret", http.StatusMisdirectedRequest},
+		{"front.example", "", http.StatusForbidden},
+		{"front.example", "wrong", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = test.host
+		if test.secret != "" {
+			r.Header.Set(DefaultFrontSecretHeader, test.secret)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("Expected status code %d for %+v but got %d.", test.code, test, w.Code)
+		}
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+
+	defer func() { front = &FrontConfig{} }()
+	front, _ = NewFrontConfig("/bridgestrap", "", "", "")
+	router := NewRouter()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/bridgestrap/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d under path prefix but got %d.", http.StatusOK, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d outside of path prefix but got %d.", http.StatusNotFound, w.Code)
+	}
+}
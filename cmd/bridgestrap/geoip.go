@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/geoip"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// geoIP is nil unless the operator gave us GeoIP databases.
+var geoIP *GeoIP
+
+// GeoIP locates bridges using MaxMind DB files, e.g., GeoLite2-Country.mmdb
+// and GeoLite2-ASN.mmdb, so our clients don't have to look up the bridges
+// that we tested themselves.  Either database may be nil.
+type GeoIP struct {
+	Country *geoip.Reader
+	ASN     *geoip.Reader
+}
+
+// LoadGeoIP reads the given country and ASN databases.  Either filename may
+// be empty.
+func LoadGeoIP(countryFile, asnFile string) (*GeoIP, error) {
+
+	g := &GeoIP{}
+	var err error
+	if countryFile != "" {
+		if g.Country, err = geoip.Open(countryFile); err != nil {
+			return nil, err
+		}
+	}
+	if asnFile != "" {
+		if g.ASN, err = geoip.Open(asnFile); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// recordString returns the string at the given path of keys in the given
+// GeoIP record, or "" if there's none.
+func recordString(record interface{}, path ...string) string {
+
+	for _, key := range path {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		record = m[key]
+	}
+	s, _ := record.(string)
+	return s
+}
+
+// Locate returns the country code (e.g., "de") and the autonomous system
+// number (e.g., "AS3320") of the given IP address.  Either is empty if we
+// don't know it.
+func (g *GeoIP) Locate(ip net.IP) (string, string) {
+
+	var country, asn string
+	if g.Country != nil {
+		record, err := g.Country.Lookup(ip)
+		if err != nil {
+			log.Printf("Failed to look up country of IP address: %s", err)
+		}
+		// Anycast and satellite addresses lack a country, but we may
+		// still know where they're registered.
+		if country = recordString(record, "country", "iso_code"); country == "" {
+			country = recordString(record, "registered_country", "iso_code")
+		}
+	}
+	if g.ASN != nil {
+		record, err := g.ASN.Lookup(ip)
+		if err != nil {
+			log.Printf("Failed to look up ASN of IP address: %s", err)
+		}
+		if m, ok := record.(map[string]interface{}); ok {
+			if n, ok := m["autonomous_system_number"].(uint64); ok {
+				asn = fmt.Sprintf("AS%d", n)
+			}
+		}
+	}
+	return strings.ToLower(country), asn
+}
+
+// locateResult adds the country and ASN of each bridge in the given result,
+// including its per-vantage results.
+func (g *GeoIP) locateResult(result *tester.TestResult) {
+
+	if g == nil {
+		return
+	}
+	for bridgeLine, bridgeTest := range result.Bridges {
+		addrPort, err := bridgeline.AddrPort(bridgeLine)
+		if err != nil {
+			continue
+		}
+		host, _, err := net.SplitHostPort(addrPort)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			bridgeTest.Country, bridgeTest.ASN = g.Locate(ip)
+		}
+	}
+	for _, vantageResult := range result.VantageResults {
+		g.locateResult(vantageResult)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/geoip"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// singleRecordDB returns an IPv4 MaxMind DB whose only node maps all
+// addresses to the given encoded record.
+func singleRecordDB(t *testing.T, record []byte) *geoip.Reader {
+
+	content := []byte{
+		// One node with 24-bit records that both point to offset 0 of our
+		// data section, i.e., node count (1) + 16 + 0.
+		0, 0, 17, 0, 0, 17,
+	}
+	content = append(content, make([]byte, 16)...)
+	content = append(content, record...)
+	content = append(content, "\xab\xcd\xefMaxMind.com"...)
+	content = append(content,
+		0xe3, // Map with 3 entries.
+		0x4a, 'i', 'p', '_', 'v', 'e', 'r', 's', 'i', 'o', 'n', 0xa1, 4,
+		0x4a, 'n', 'o', 'd', 'e', '_', 'c', 'o', 'u', 'n', 't', 0xc1, 1,
+		0x4b, 'r', 'e', 'c', 'o', 'r', 'd', '_', 's', 'i', 'z', 'e', 0xa1, 24)
+	r, err := geoip.New(content)
+	if err != nil {
+		t.Fatalf("Failed to read GeoIP database: %s", err)
+	}
+	return r
+}
+
+func TestLocateResult(t *testing.T) {
+
+	g := &GeoIP{
+		// {"country": {"iso_code": "DE"}}
+		Country: singleRecordDB(t, []byte{0xe1, 0x47, 'c', 'o', 'u', 'n', 't', 'r', 'y',
+			0xe1, 0x48, 'i', 's', 'o', '_', 'c', 'o', 'd', 'e', 0x42, 'D', 'E'}),
+		// {"autonomous_system_number": 3320}
+		ASN: singleRecordDB(t, append([]byte{0xe1, 0x58},
+			append([]byte("autonomous_system_number"), 0xc2, 0x0c, 0xf8)...)),
+	}
+
+	result := tester.NewTestResult()
+	result.Bridges["1.2.3.4:1234"] = &tester.BridgeTest{}
+	result.Bridges["[2001:db8::1]:1234"] = &tester.BridgeTest{}
+	result.VantageResults = map[string]*tester.TestResult{"ru": tester.NewTestResult()}
+	result.VantageResults["ru"].Bridges["1.2.3.4:1234"] = &tester.BridgeTest{}
+	g.locateResult(result)
+
+	if bridgeTest := result.Bridges["1.2.3.4:1234"]; bridgeTest.Country != "de" || bridgeTest.ASN != "AS3320" {
+		t.Errorf("Unexpected location %q, %q.", bridgeTest.Country, bridgeTest.ASN)
+	}
+	// Our IPv4 databases know nothing about IPv6 addresses.
+	if bridgeTest := result.Bridges["[2001:db8::1]:1234"]; bridgeTest.Country != "" || bridgeTest.ASN != "" {
+		t.Errorf("Unexpected location %q, %q.", bridgeTest.Country, bridgeTest.ASN)
+	}
+	if bridgeTest := result.VantageResults["ru"].Bridges["1.2.3.4:1234"]; bridgeTest.Country != "de" {
+		t.Errorf("Failed to locate bridges of per-vantage results.")
+	}
+
+	// Without databases, we leave results alone.
+	geoIP = nil
+	result = tester.NewTestResult()
+	result.Bridges["1.2.3.4:1234"] = &tester.BridgeTest{}
+	geoIP.locateResult(result)
+	if result.Bridges["1.2.3.4:1234"].Country != "" {
+		t.Errorf("Located bridge without databases.")
+	}
+}
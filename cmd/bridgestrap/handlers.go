@@ -0,0 +1,978 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+	"golang.org/x/time/rate"
+)
+
+var IndexPage string
+var BusyPage string
+var SuccessPage *template.Template
+var FailurePage *template.Template
+var CachePage *template.Template
+var ConsolePage *template.Template
+
+const (
+	// WebRate and WebBurst configure the rate limiter of our Web interface.
+	// We allow 1 request per second on average with bursts of up to 5
+	// requests per second.
+	WebRate  = 1
+	WebBurst = 5
+	// BadgeRate and BadgeBurst configure the rate limiter of our badges.
+	// Badges are embedded in dashboards and therefore requested more often
+	// than our Web interface, but they are only served from our cache,
+	// which makes them cheap.
+	BadgeRate  = 10
+	BadgeBurst = 50
+)
+
+// limiter implements a rate limiter for our Web interface.
+var limiter RateLimiter = rate.NewLimiter(WebRate, WebBurst)
+
+// badgeLimiter rate-limits badge and bridge history requests, which anyone can
+// send without a token.
+var badgeLimiter RateLimiter = rate.NewLimiter(BadgeRate, BadgeBurst)
+
+// BadgeTemplate is the SVG template of our status badges.  It takes as input
+// the badge's colour and its status text.
+const BadgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="bridge: %[3]s">
+<title>bridge: %[3]s</title>
+<rect width="50" height="20" fill="#555"/>
+<rect x="50" width="%[4]d" height="20" fill="%[2]s"/>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="25" y="14">bridge</text>
+<text x="%[5]d" y="14">%[3]s</text>
+</g>
+</svg>`
+
+// LoadHtmlTemplates loads all HTML templates from the given directory.
+func LoadHtmlTemplates(dir string) {
+
+	IndexPage = LoadHtmlTemplate(path.Join(dir, "index.html"))
+	BusyPage = LoadHtmlTemplate(path.Join(dir, "busy.html"))
+
+	var err error
+	if SuccessPage, err = template.ParseFiles(path.Join(dir, "success.html")); err != nil {
+		log.Fatal(err)
+	}
+	if FailurePage, err = template.ParseFiles(path.Join(dir, "failure.html")); err != nil {
+		log.Fatal(err)
+	}
+	if CachePage, err = template.ParseFiles(path.Join(dir, "cache.html")); err != nil {
+		log.Fatal(err)
+	}
+	if ConsolePage, err = template.ParseFiles(path.Join(dir, "console.html")); err != nil {
+		log.Fatal(err)
+	}
+	if BridgeHealthPage, err = template.ParseFiles(path.Join(dir, "bridge.html")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// LoadHtmlTemplate reads the content of the given filename and returns it as
+// string.  If the function is unable to read the file, it logs a fatal error.
+func LoadHtmlTemplate(filename string) string {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(content)
+}
+
+func SendResponse(w http.ResponseWriter, response string) {
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, response)
+}
+
+func SendHtmlResponse(w http.ResponseWriter, response string) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	SendResponse(w, response)
+}
+
+// gzipResponseWriter compresses everything that's written to it.
+type gzipResponseWriter struct {
+	io.Writer
+	http.ResponseWriter
+}
+
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.Writer.Write(b)
+}
+
+// Gzip wraps the given handler and compresses its responses if the client
+// supports gzip.
+func Gzip(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			inner(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		inner(gzipResponseWriter{Writer: gz, ResponseWriter: w}, r)
+	}
+}
+
+func SendJSONResponse(w http.ResponseWriter, response string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	SendResponse(w, response)
+}
+
+// SendJSONStatusResponse is like SendJSONResponse, but responds with the given
+// status code.
+func SendJSONStatusResponse(w http.ResponseWriter, status int, response string) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, response)
+}
+
+func Index(w http.ResponseWriter, r *http.Request) {
+
+	SendHtmlResponse(w, IndexPage)
+}
+
+// newTestResult returns a new test result that tells clients where we test
+// their bridges from.
+func newTestResult() *tester.TestResult {
+
+	result := tester.NewTestResult()
+	result.Origin = testOrigin()
+	if r := replica(); r != nil {
+		result.Replica = r.Status()
+	}
+	return result
+}
+
+// testBridgeLines tests the given request's bridge lines, using the given
+// (resolved) stages of our test pipeline.  The source tells us what interface
+// the request came from, e.g., "api".
+func testBridgeLines(req *tester.TestRequest, source string, stages []string) *tester.TestResult {
+
+	result, remainingBridgeLines := lookupBridgeLines(req.BridgeLines, source, stages)
+	return testUncachedBridgeLines(req, result, remainingBridgeLines, stages)
+}
+
+// cachedBridgeTest turns the given cache entry into a test result.
+func cachedBridgeTest(entry *testcache.Entry) *tester.BridgeTest {
+
+	bridgeTest := &tester.BridgeTest{
+		Functional: entry.Error == "",
+		Verdict:    tester.VerdictFunctional,
+		LastTested: entry.Time,
+		Error:      entry.Error,
+		ErrorCode:  entry.ErrorCode,
+	}
+	if bridgeTest.ErrorCode == "" {
+		bridgeTest.ErrorCode = tester.FailureCode(entry.Error)
+	}
+	if entry.Error != "" {
+		bridgeTest.Verdict = tester.VerdictDysfunctional
+	}
+	return bridgeTest
+}
+
+// lookupBridgeLines answers as many of the given bridge lines as it can from
+// our invalid cache and our test cache, and rejects bridge lines that point at
+// our own addresses.  Cached results only count if they're at least as
+// thorough as the given stages.  It returns the partial result, and the bridge
+// lines that we still have to test.
+func lookupBridgeLines(bridgeLines []string, source string, stages []string) (*tester.TestResult, []string) {
+
+	result := newTestResult()
+	remainingBridgeLines := []string{}
+	for _, bridgeLine := range bridgeLines {
+		if err := invalidCache.Check(bridgeLine, source); err != nil {
+			result.Bridges[bridgeLine] = &tester.BridgeTest{
+				Functional: false,
+				Verdict:    tester.VerdictDysfunctional,
+				LastTested: time.Now().UTC(),
+				Error:      fmt.Sprintf("invalid bridge line: %s", err),
+				ErrorCode:  tester.ErrorCodeUnparseableLine,
+			}
+		} else if bridgeTest := checkSelfProbe(bridgeLine, source); bridgeTest != nil {
+			result.Bridges[bridgeLine] = bridgeTest
+		} else if entry := cache.IsCached(bridgeLine); entry != nil && satisfiesStages(entry, stages) {
+			metrics.Cache.With(prometheus.Labels{"type": "hit"}).Inc()
+			result.Bridges[bridgeLine] = cachedBridgeTest(entry)
+		} else {
+			metrics.Cache.With(prometheus.Labels{"type": "miss"}).Inc()
+			remainingBridgeLines = append(remainingBridgeLines, bridgeLine)
+		}
+	}
+	return result, remainingBridgeLines
+}
+
+// satisfiesStages returns true if the given cache entry answers a request for
+// the given stages.  Functional bridges whose circuit we didn't test may still
+// fail our circuit stage, but dysfunctional bridges are dysfunctional either
+// way.
+func satisfiesStages(entry *testcache.Entry, stages []string) bool {
+
+	if !tester.HasStage(stages, tester.StageCircuit) || entry.Error != "" {
+		return true
+	}
+	return entry.Context != nil && tester.HasStage(entry.Context.Stages, tester.StageCircuit)
+}
+
+// reportProgress hands the given bridge's result to the given request's
+// progress function, if any.
+func reportProgress(req *tester.TestRequest, bridgeLine string, bridgeTest *tester.BridgeTest) {
+
+	if req.Progress != nil {
+		req.Progress(bridgeLine, bridgeTest)
+	}
+}
+
+// recordResult adds the given bridge's conclusive test result, which the
+// given stages of our test pipeline produced, to our cache and to the
+// bridge's history.
+func recordResult(bridgeLine string, bridgeTest *tester.BridgeTest, stages []string) {
+
+	var result error
+	if bridgeTest.Error != "" {
+		result = errors.New(bridgeTest.Error)
+	}
+	cache.AddResult(bridgeLine, result, bridgeTest.ErrorCode, bridgeTest.LastTested, resultContext(bridgeTest, stages))
+	if history != nil {
+		history.Add(bridgeLine, result, bridgeTest.LastTested)
+	}
+}
+
+// testUncachedBridgeLines tests the given bridge lines that weren't in our
+// cache, and adds their results to the given result of our cache lookup.
+func testUncachedBridgeLines(req *tester.TestRequest, result *tester.TestResult, remainingBridgeLines []string, stages []string) *tester.TestResult {
+
+	numCached := len(req.BridgeLines) - len(remainingBridgeLines)
+	if replica() != nil {
+		answerFromReplica(result, remainingBridgeLines)
+		for _, bridgeLine := range remainingBridgeLines {
+			reportProgress(req, bridgeLine, result.Bridges[bridgeLine])
+		}
+		return result
+	}
+	if stages == nil {
+		stages = tester.DefaultStages
+	}
+	showStages := len(req.Stages) > 0
+
+	// Run the stages of our test pipeline that precede the Tor stage.
+	// Bridges that fail a stage don't make it to the next one.
+	preTorResults := make(map[string][]*tester.StageResult)
+	if len(remainingBridgeLines) > 0 && (tester.HasStage(stages, tester.StageTCP) || tester.HasStage(stages, tester.StagePT)) {
+		start := time.Now()
+		preTorResults = tester.RunPreTorStages(remainingBridgeLines, stages)
+		passedBridgeLines := []string{}
+		for _, bridgeLine := range remainingBridgeLines {
+			stageResults := preTorResults[bridgeLine]
+			last := stageResults[len(stageResults)-1]
+			bridgeTest := &tester.BridgeTest{LastTested: time.Now().UTC()}
+			if showStages {
+				bridgeTest.Stages = stageResults
+			}
+			if !last.Passed {
+				bridgeTest.Error = fmt.Sprintf("%s stage failed: %s", last.Stage, last.Error)
+				bridgeTest.ErrorCode = tester.StageFailureCode(last.Stage)
+				bridgeTest.Verdict = tester.VerdictDysfunctional
+				if last.Inconclusive {
+					bridgeTest.Verdict = tester.VerdictInconclusive
+				} else {
+					recordResult(bridgeLine, bridgeTest, stages)
+				}
+				metrics.BridgeStatus.With(prometheus.Labels{"status": bridgeTest.Verdict}).Inc()
+				result.Bridges[bridgeLine] = bridgeTest
+				reportProgress(req, bridgeLine, bridgeTest)
+			} else if !tester.HasStage(stages, tester.StageTor) {
+				// The bridge passed all stages, but we don't cache the
+				// result because the client skipped the Tor stage.
+				bridgeTest.Functional = true
+				bridgeTest.Verdict = tester.VerdictFunctional
+				result.Bridges[bridgeLine] = bridgeTest
+				reportProgress(req, bridgeLine, bridgeTest)
+			} else {
+				passedBridgeLines = append(passedBridgeLines, bridgeLine)
+			}
+		}
+		remainingBridgeLines = passedBridgeLines
+		result.Time = time.Since(start).Seconds()
+	}
+
+	// Test whatever bridges remain.
+	if len(remainingBridgeLines) > 0 && tester.HasStage(stages, tester.StageTor) {
+		log.Printf("%d bridge lines served from cache; testing remaining %d bridge lines.",
+			numCached, len(remainingBridgeLines))
+
+		start := time.Now()
+		partialResult := testWithRetries(req, remainingBridgeLines, testWithTor)
+		testAddressFamilies(req, partialResult, torPool().Test)
+		result.Time += float64(time.Now().Sub(start).Seconds())
+		result.Error = partialResult.Error
+
+		// Cache partial test results and add them to our existing result
+		// object.  Inconclusive results say nothing about a bridge, so we
+		// don't cache them.
+		for bridgeLine, bridgeTest := range partialResult.Bridges {
+			if bridgeTest.Verdict != tester.VerdictInconclusive {
+				recordResult(bridgeLine, bridgeTest, stages)
+			}
+			metrics.BridgeStatus.With(prometheus.Labels{"status": bridgeTest.Verdict}).Inc()
+			if showStages {
+				stageResults, exists := preTorResults[bridgeLine]
+				if !exists {
+					stageResults = []*tester.StageResult{&tester.StageResult{Stage: tester.StageValidate, Passed: true}}
+				}
+				bridgeTest.Stages = append(stageResults, tester.TorStageResults(bridgeTest, partialResult.Time)...)
+			}
+			result.Bridges[bridgeLine] = bridgeTest
+		}
+	} else {
+		log.Printf("All %d bridge lines served from cache.  No need for testing.", numCached)
+	}
+	addORPortExposure(result, req.BridgeLines)
+
+	// Log fraction of bridges that are functional.
+	numFunctional, numDysfunctional := 0, 0
+	for _, bridgeTest := range result.Bridges {
+		if bridgeTest.Functional {
+			numFunctional++
+		} else {
+			numDysfunctional++
+		}
+	}
+	log.Printf("Tested %d bridges: %d (%.1f%%) functional; %d (%.1f%%) dysfunctional.",
+		len(result.Bridges),
+		numFunctional,
+		float64(numFunctional)/float64(len(result.Bridges))*100,
+		numDysfunctional,
+		float64(numDysfunctional)/float64(len(result.Bridges))*100)
+
+	metrics.FracFunctional.Set(cache.FracFunctional())
+
+	return result
+}
+
+// testBridgeLinesAtVantages tests the given request's bridge lines from each
+// of the given vantage points in parallel.  Results are not cached because
+// our cache doesn't distinguish between vantage points.
+func testBridgeLinesAtVantages(req *tester.TestRequest, source string, vantages []string) *tester.TestResult {
+
+	result := newTestResult()
+	result.VantageResults = make(map[string]*tester.TestResult)
+	log.Printf("Testing %d bridge lines from %d vantage point(s).", len(req.BridgeLines), len(vantages))
+
+	// Invalid bridge lines are invalid from everywhere, so we only report
+	// them (and bridge lines that point at us) once, in our top-level
+	// result.
+	validBridgeLines := []string{}
+	for _, bridgeLine := range req.BridgeLines {
+		if err := invalidCache.Check(bridgeLine, source); err != nil {
+			result.Bridges[bridgeLine] = &tester.BridgeTest{
+				Functional: false,
+				Verdict:    tester.VerdictDysfunctional,
+				LastTested: time.Now().UTC(),
+				Error:      fmt.Sprintf("invalid bridge line: %s", err),
+				ErrorCode:  tester.ErrorCodeUnparseableLine,
+			}
+		} else if bridgeTest := checkSelfProbe(bridgeLine, source); bridgeTest != nil {
+			result.Bridges[bridgeLine] = bridgeTest
+		} else {
+			validBridgeLines = append(validBridgeLines, bridgeLine)
+		}
+	}
+	if len(validBridgeLines) == 0 {
+		return result
+	}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	for _, vantage := range vantages {
+		subReq := &tester.TestRequest{
+			BridgeLines: validBridgeLines,
+			Circuit:     req.Circuit,
+			Vantage:     vantage,
+			Client:      req.Client,
+			Weight:      req.Weight,
+			Timeout:     req.Timeout,
+			Background:  req.Background,
+		}
+		wg.Add(1)
+		go func(vantage string) {
+			defer wg.Done()
+			vantageResult := testAtVantage(subReq)
+			l.Lock()
+			result.VantageResults[vantage] = vantageResult
+			l.Unlock()
+		}(vantage)
+	}
+	wg.Wait()
+	result.Time = float64(time.Now().Sub(start).Seconds())
+
+	return result
+}
+
+func BridgeState(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getClient(r)
+	if err != nil {
+		metrics.Requests.With(prometheus.Labels{"type": "api", "status": "invalid"}).Inc()
+		log.Printf("Failed to authenticate client: %s", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	serveBridgeState(w, r, client, "api")
+}
+
+// parseTestRequest reads the JSON test request in the given HTTP request's
+// body, on behalf of the given client, and resolves its stages and vantage
+// points.  If the test request is invalid, we respond with an error and return
+// a nil request.  The returned bool tells our metrics if the request contained
+// bridge lines, even if it turned out to be invalid otherwise.
+func parseTestRequest(w http.ResponseWriter, r *http.Request, client *Token) (*tester.TestRequest, []string, []string, bool) {
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read HTTP body: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil, nil, false
+	}
+
+	req := &tester.TestRequest{Client: client.Name, Weight: client.Weight}
+	if err := json.Unmarshal(b, &req); err != nil {
+		if redaction.Hides(ChannelLogs, FieldBridgeLine) {
+			log.Printf("Failed to unmarshal %d-byte HTTP body: %s", len(b), err)
+		} else {
+			log.Printf("Failed to unmarshal HTTP body %q: %s", b, err)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+	if err := applyTokenDefaults(req, client); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, true
+	}
+
+	// We check the size of the request before we look at its bridge lines, so
+	// oversized requests can't make us parse an unbounded number of lines.
+	if len(req.BridgeLines) > tester.MaxBridgesPerReq {
+		log.Printf("Got %d bridges in request but we only allow <= %d.", len(req.BridgeLines), tester.MaxBridgesPerReq)
+		abuseLog.Record(r, AbuseTooManyBridges, clientClass(client))
+		http.Error(w, fmt.Sprintf("maximum of %d bridge lines allowed", tester.MaxBridgesPerReq), http.StatusBadRequest)
+		return nil, nil, nil, true
+	}
+
+	// Malformed lines don't spoil the rest of the request.  Instead, we tell
+	// the client what's wrong with each of them, so clients don't have to
+	// bisect large batches to find the offending lines.
+	req.BridgeLines, req.Diagnostics = checkBridgeLines(req.BridgeLines)
+
+	if len(req.BridgeLines) == 0 && len(req.Diagnostics) == 0 {
+		log.Printf("Got request with no bridge lines.")
+		http.Error(w, "no bridge lines given", http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+
+	stages, err := tester.ResolveStages(req.Stages)
+	if err != nil {
+		log.Printf("Got request for invalid test stages: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, true
+	}
+	req.Circuit = tester.HasStage(stages, tester.StageCircuit)
+
+	if req.Format != "" && req.Format != FormatOONI {
+		http.Error(w, fmt.Sprintf("unknown format %q", req.Format), http.StatusBadRequest)
+		return nil, nil, nil, true
+	}
+
+	var vantages []string
+	if len(req.Vantages) > 0 && replica() != nil {
+		http.Error(w, "read-only replicas don't test bridges from vantage points", http.StatusBadRequest)
+		return nil, nil, nil, true
+	} else if len(req.Vantages) > 0 {
+		if vantages, err = resolveVantages(req.Vantages); err != nil {
+			log.Printf("Got request for invalid vantage points: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, nil, nil, true
+		}
+		if req.Format == FormatOONI {
+			http.Error(w, "OONI format doesn't support vantage points", http.StatusBadRequest)
+			return nil, nil, nil, true
+		}
+	}
+
+	return req, stages, vantages, true
+}
+
+// serveBridgeState tests the bridge lines in the given JSON request on behalf
+// of the given (authenticated) client, and responds with the JSON-encoded test
+// result.  If some of the request's bridge lines were malformed, we respond
+// with 207 Multi-Status and explain what's wrong with each of them in the
+// result's diagnostics.  The source tells us what interface the request came
+// from, e.g., "api".
+func serveBridgeState(w http.ResponseWriter, r *http.Request, client *Token, source string) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": source, "status": reqStatus}).Inc()
+	}()
+
+	req, stages, vantages, valid := parseTestRequest(w, r, client)
+	if valid {
+		reqStatus = "valid"
+	}
+	if req == nil {
+		return
+	}
+
+	log.Printf("Got %d bridge lines from %s.", len(req.BridgeLines), r.RemoteAddr)
+	telemetry.Record(client, len(req.BridgeLines), time.Now())
+	var result *tester.TestResult
+	if len(req.BridgeLines) == 0 {
+		// All of the request's bridge lines were malformed.
+		result = newTestResult()
+	} else if len(vantages) > 0 {
+		if queueFull() {
+			reqStatus = "queue_full"
+			sendQueueFull(w)
+			return
+		}
+		// We don't cache results of vantage point tests, so each bridge
+		// line counts once per vantage point.
+		quota, err := quotas.Reserve(client, len(req.BridgeLines)*len(vantages))
+		setQuotaHeaders(w, quota)
+		if err != nil {
+			log.Printf("Rejecting request of client %s: %s", client.Name, err)
+			abuseLog.Record(r, AbuseQuota, clientClass(client))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		result = testBridgeLinesAtVantages(req, source, vantages)
+		quotas.Refund(client, numRefundable(result, req.BridgeLines, vantages))
+	} else {
+		// Find out what bridge lines we can answer from our cache before
+		// we queue the rest, so we neither occupy our scheduler with
+		// requests that are all cache hits, nor queue requests that exceed
+		// the client's quota.
+		cachedResult, remainingBridgeLines := lookupBridgeLines(req.BridgeLines, source, stages)
+		// Clients whose bridge lines are all cached don't need our
+		// scheduler, so we answer them even while its queue is full.
+		if len(remainingBridgeLines) > 0 && queueFull() {
+			reqStatus = "queue_full"
+			sendQueueFull(w)
+			return
+		}
+		quota, err := quotas.Reserve(client, len(remainingBridgeLines))
+		setQuotaHeaders(w, quota)
+		if err != nil {
+			log.Printf("Rejecting request of client %s: %s", client.Name, err)
+			abuseLog.Record(r, AbuseQuota, clientClass(client))
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		result = testUncachedBridgeLines(req, cachedResult, remainingBridgeLines, stages)
+		quotas.Refund(client, numRefundable(result, remainingBridgeLines, nil))
+	}
+	result.Diagnostics = req.Diagnostics
+	metrics.RetiredResubs.Add(float64(tombstones.flagRetired(result, time.Now().UTC())))
+	geoIP.locateResult(result)
+	applyCheck(result, client)
+	w.Header().Add("Vary", "Accept-Language")
+	if lang := negotiateLanguage(r.Header.Get("Accept-Language")); lang != "" {
+		localise(result, lang)
+		w.Header().Set("Content-Language", lang)
+	}
+	redaction.RedactResult(result)
+
+	var jsonResult []byte
+	var err error
+	if req.Format == FormatOONI {
+		jsonResult, err = json.Marshal(newOONITorMeasurement(result, hasher, testOrigin(), time.Now()))
+	} else {
+		jsonResult, err = json.Marshal(result)
+	}
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal test tesult", http.StatusInternalServerError)
+		return
+	}
+	if len(result.Diagnostics) > 0 {
+		SendJSONStatusResponse(w, http.StatusMultiStatus, string(jsonResult))
+	} else {
+		SendJSONResponse(w, string(jsonResult))
+	}
+}
+
+func BridgeStateWeb(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "web", "status": reqStatus}).Inc()
+	}()
+
+	r.ParseForm()
+	// Rate-limit Web requests to prevent someone from abusing this service
+	// as a port scanner.
+	if limiter.Allow() == false {
+		abuseLog.Record(r, AbuseRateLimit, WebClient)
+		SendHtmlResponse(w, "Rate limit exceeded.")
+		return
+	}
+	// Keep our scheduler free for API clients while we're under pressure,
+	// and don't make users wait for a full queue.
+	if webShedder.Shedding() || queueFull() {
+		reqStatus = "shed"
+		sendBusyPage(w)
+		return
+	}
+	bridgeLine := strings.TrimSpace(r.Form.Get("bridge_line"))
+	if bridgeLine == "" {
+		SendHtmlResponse(w, "No bridge line given.")
+		return
+	}
+	// Operators may paste a bridge card instead of a bridge line.
+	if bridgeline.IsCard(bridgeLine) {
+		bridgeLines, err := bridgeline.Normalize(bridgeLine)
+		if err != nil {
+			SendHtmlResponse(w, html.EscapeString(fmt.Sprintf("Invalid bridge card: %s", err)))
+			return
+		}
+		if len(bridgeLines) != 1 {
+			SendHtmlResponse(w, "Please test one bridge at a time.")
+			return
+		}
+		bridgeLine = bridgeLines[0]
+	}
+	reqStatus = "valid"
+
+	bridgeResult, tested, recent := webSubmissions.Test(bridgeLine, func() *tester.BridgeTest {
+		result := testBridgeLines(&tester.TestRequest{
+			BridgeLines: []string{bridgeLine},
+			Client:      WebClient,
+			Weight:      tester.DefaultWeight,
+		}, "web", nil)
+		return result.Bridges[bridgeLine]
+	})
+	page := &webResultPage{}
+	if bridgeResult == nil {
+		log.Printf("Bug: Test result not part of our result map.")
+		sendResultPage(w, FailurePage, page)
+		return
+	}
+	if recent {
+		metrics.WebDeduplicated.Inc()
+		page.Recent = true
+		page.Seconds = int(time.Since(tested).Seconds())
+	}
+
+	if bridgeResult.Functional {
+		sendResultPage(w, SuccessPage, page)
+	} else {
+		sendResultPage(w, FailurePage, page)
+	}
+}
+
+// webResultPage is what our Web interface's success and failure pages show.
+type webResultPage struct {
+	// Recent is set if we served the result of someone else's recent
+	// submission of the same bridge line, which we tested the given
+	// number of seconds ago.
+	Recent  bool
+	Seconds int
+}
+
+// sendResultPage renders the given success or failure page.
+func sendResultPage(w http.ResponseWriter, tmpl *template.Template, page *webResultPage) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if err := tmpl.Execute(w, page); err != nil {
+		log.Printf("Failed to render result page: %s", err)
+	}
+}
+
+// renderBadge returns an SVG status badge for the given cache entry, which may
+// be nil if we don't know the bridge.
+func renderBadge(entry *testcache.Entry) string {
+
+	status, colour := "unknown", "#9f9f9f"
+	if entry != nil {
+		if entry.Error == "" {
+			status, colour = "working", "#4c1"
+		} else {
+			status, colour = "failing", "#e05d44"
+		}
+		status = fmt.Sprintf("%s (%s)", status, entry.Time.Format("2006-01-02"))
+	}
+
+	// Approximate the width of the status text, which is good enough for
+	// Verdana at 11px.
+	statusWidth := len(status)*7 + 10
+	return fmt.Sprintf(BadgeTemplate, 50+statusWidth, colour, html.EscapeString(status),
+		statusWidth, 50+statusWidth/2)
+}
+
+// BridgeBadge serves an SVG badge that shows the status of the bridge with the
+// given hashed identifier.  Bridge operators can embed these badges in their
+// dashboards.  We never test bridges on behalf of badge requests; the badge
+// only reflects what's in our cache.
+func BridgeBadge(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "badge", "status": reqStatus}).Inc()
+	}()
+
+	if !badgeLimiter.Allow() {
+		abuseLog.Record(r, AbuseRateLimit, AnonymousClient)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	reqStatus = "valid"
+
+	entry := cache.FindByHashedID(mux.Vars(r)["id"])
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "max-age=300")
+	SendResponse(w, renderBadge(entry))
+}
+
+// ExportBridgePoolAssignments exports our cache in the format of BridgeDB's
+// bridge pool assignments, which allows existing analysis scripts to ingest
+// our test results.  Clients can filter the export (see
+// ParseExportFilter).
+func ExportBridgePoolAssignments(w http.ResponseWriter, r *http.Request) {
+
+	f, err := ParseExportFilter(r.URL.Query())
+	if err != nil {
+		metrics.Requests.With(prometheus.Labels{"type": "export", "status": "invalid"}).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metrics.Requests.With(prometheus.Labels{"type": "export", "status": "valid"}).Inc()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := writeBridgePoolAssignments(w, cache.Snapshot(), hasher, time.Now(), f); err != nil {
+		log.Printf("Failed to write bridge pool assignments: %s", err)
+	}
+}
+
+// ExportOONIMeasurements exports our cache as OONI measurements, so external
+// measurement pipelines can ingest our results along with other censorship
+// datasets.  Like our bridge pool assignments, the export only identifies
+// bridges by their hashed identifier.
+func ExportOONIMeasurements(w http.ResponseWriter, r *http.Request) {
+
+	f, err := ParseExportFilter(r.URL.Query())
+	if err != nil {
+		metrics.Requests.With(prometheus.Labels{"type": "ooni-export", "status": "invalid"}).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metrics.Requests.With(prometheus.Labels{"type": "ooni-export", "status": "valid"}).Inc()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := writeOONIMeasurements(w, cache.Snapshot(), hasher, testOrigin(), time.Now(), f); err != nil {
+		log.Printf("Failed to write OONI measurements: %s", err)
+	}
+}
+
+// getMetricsConsumer determines the client that sent the given API request
+// and returns an error if the client isn't allowed to fetch our bridge
+// metrics.
+func getMetricsConsumer(r *http.Request) (*Token, error) {
+
+	client, err := getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Metrics && !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		return nil, errors.New("token is not allowed to fetch bridge metrics")
+	}
+	return client, nil
+}
+
+// BridgeMetrics exports our cache as bridge metrics for Tor Metrics.  The
+// metrics are more detailed than our public exports, so only clients whose
+// token allows it can fetch them.
+func BridgeMetrics(w http.ResponseWriter, r *http.Request) {
+
+	if _, err := getMetricsConsumer(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	f, err := ParseExportFilter(r.URL.Query())
+	if err != nil {
+		metrics.Requests.With(prometheus.Labels{"type": "bridge-metrics", "status": "invalid"}).Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metrics.Requests.With(prometheus.Labels{"type": "bridge-metrics", "status": "valid"}).Inc()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := writeBridgeMetrics(w, cache.Snapshot(), hasher, time.Now(), f); err != nil {
+		log.Printf("Failed to write bridge metrics: %s", err)
+	}
+}
+
+// Capacity responds with what our bridge tests cost us so far, per transport,
+// and how many bridges we could sustainably test per hour at our current
+// settings.
+func Capacity(w http.ResponseWriter, r *http.Request) {
+
+	metrics.Requests.With(prometheus.Labels{"type": "capacity", "status": "valid"}).Inc()
+
+	pool := torPool()
+	if pool == nil {
+		http.Error(w, "read-only replicas don't test bridges", http.StatusNotFound)
+		return
+	}
+
+	jsonResult, err := json.Marshal(pool.Capacity())
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal capacity report", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// Summary serves the aggregate reachability of our cached bridges, by
+// transport and address family, for status pages and other services that
+// only care about the big picture.  Our cache keeps the summary up to date as
+// it changes, so the request doesn't walk the cache.
+func Summary(w http.ResponseWriter, r *http.Request) {
+
+	metrics.Requests.With(prometheus.Labels{"type": "summary", "status": "valid"}).Inc()
+
+	jsonResult, err := json.Marshal(cache.Summary())
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal summary", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// CacheListingWeb serves an operator-facing Web page that lists our cached
+// bridges, which can be searched by hashed identifier, filtered by status,
+// sorted, and paginated.  The listing reveals which bridges we know, so only
+// admins may see it.
+func CacheListingWeb(w http.ResponseWriter, r *http.Request, client *Token) {
+
+	if !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		metrics.Requests.With(prometheus.Labels{"type": "cache-listing", "status": "invalid"}).Inc()
+		http.Error(w, "token is not allowed to list our cache", http.StatusForbidden)
+		return
+	}
+	metrics.Requests.With(prometheus.Labels{"type": "cache-listing", "status": "valid"}).Inc()
+
+	r.ParseForm()
+	page, err := strconv.Atoi(r.Form.Get("page"))
+	if err != nil {
+		page = 1
+	}
+	listing := listCache(cache.SnapshotByHashedID(),
+		r.Form.Get("q"), r.Form.Get("status"), r.Form.Get("sort"), page)
+	if redaction.Hides(ChannelCacheListing, FieldError) {
+		for _, row := range listing.Rows {
+			if row.Error != "" {
+				row.Error = RedactedError
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := CachePage.Execute(w, listing); err != nil {
+		log.Printf("Failed to render cache listing: %s", err)
+	}
+}
+
+// SnapshotIndex lists our signed snapshots, along with the public key that
+// verifies them.
+func SnapshotIndex(w http.ResponseWriter, r *http.Request) {
+
+	names, err := snapshotter.List()
+	if err != nil {
+		log.Printf("Failed to list snapshots: %s", err)
+		http.Error(w, "failed to list snapshots", http.StatusInternalServerError)
+		return
+	}
+
+	jsonResult, err := json.Marshal(struct {
+		PublicKey string   `json:"public_key"`
+		Snapshots []string `json:"snapshots"`
+	}{snapshotter.PublicKey(), names})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal snapshot index", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// SnapshotFile serves the snapshot or signature with the given name.
+func SnapshotFile(w http.ResponseWriter, r *http.Request) {
+
+	name := mux.Vars(r)["name"]
+	content, err := snapshotter.Read(name)
+	if err != nil {
+		http.Error(w, "snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	f, err := ParseExportFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !f.IsZero() {
+		if strings.HasSuffix(name, SignatureSuffix) {
+			http.Error(w, "signatures can't be filtered", http.StatusBadRequest)
+			return
+		}
+		if content, err = filterSnapshotContent(content, f); err != nil {
+			log.Printf("Failed to filter snapshot %q: %s", name, err)
+			http.Error(w, "failed to filter snapshot", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if strings.HasSuffix(name, SignatureSuffix) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	// Snapshots never change, so clients can cache them for as long as they
+	// want.
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(content)
+}
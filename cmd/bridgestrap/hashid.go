@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// HashKeyLen is the length of our HMAC key in bytes.
+	HashKeyLen = 32
+)
+
+var hasher *BridgeHasher
+
+// BridgeHasher turns bridge lines into hashed identifiers that we can safely
+// export.  We use a keyed HMAC instead of a plain hash because the IPv4
+// address space is small enough to brute-force plain hashes of addr:port
+// tuples.  To rotate the key without breaking consumers of our hashes, an
+// operator can configure the previous key, which we keep accepting during a
+// transition period.
+type BridgeHasher struct {
+	key    []byte
+	oldKey []byte
+}
+
+// NewBridgeHasher returns a new bridge hasher that uses the given key.  The
+// old key is optional and may be nil.
+func NewBridgeHasher(key, oldKey []byte) *BridgeHasher {
+	return &BridgeHasher{key: key, oldKey: oldKey}
+}
+
+// LoadHashKey reads a hex-encoded HMAC key from the given file.  If the file
+// doesn't exist and create is true, the function generates a new key and
+// writes it to the file, readable only by the current user.
+func LoadHashKey(filename string, create bool) ([]byte, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, HashKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filename, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new hash key in %q.", filename)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("hash key in %q is not hex-encoded: %v", filename, err)
+	}
+	if len(key) < HashKeyLen {
+		return nil, fmt.Errorf("hash key in %q must be at least %d bytes long", filename, HashKeyLen)
+	}
+	return key, nil
+}
+
+// hashWithKey returns the hex-encoded HMAC-SHA256 of the given identifier.
+func hashWithKey(key []byte, identifier string) string {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(identifier))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// HashAddrPort returns the hashed identifier of the given addr:port tuple.
+func (h *BridgeHasher) HashAddrPort(addrPort string) string {
+	return hashWithKey(h.key, addrPort)
+}
+
+// HashesOf returns the hashed identifiers of the given addr:port tuple under
+// our current key and, if we have one, our old key.
+func (h *BridgeHasher) HashesOf(addrPort string) []string {
+
+	hashes := []string{hashWithKey(h.key, addrPort)}
+	if h.oldKey != nil {
+		hashes = append(hashes, hashWithKey(h.oldKey, addrPort))
+	}
+	return hashes
+}
+
+// Hash returns the hashed identifier of the given bridge line.  The
+// identifier is derived from the bridge line's addr:port tuple, which our
+// cache keeps for each of its entries.
+func (h *BridgeHasher) Hash(bridgeLine string) (string, error) {
+
+	addrPort, err := bridgeline.AddrPort(bridgeLine)
+	if err != nil {
+		return "", errors.New("could not extract addr:port from bridge line")
+	}
+	return h.HashAddrPort(addrPort), nil
+}
+
+// Matches returns true if the given hashed identifier belongs to the given
+// addr:port tuple, using either our current or our old key.
+func (h *BridgeHasher) Matches(hashedID, addrPort string) bool {
+
+	hashedID = strings.ToUpper(hashedID)
+	if hmac.Equal([]byte(hashedID), []byte(hashWithKey(h.key, addrPort))) {
+		return true
+	}
+	if h.oldKey != nil && hmac.Equal([]byte(hashedID), []byte(hashWithKey(h.oldKey, addrPort))) {
+		return true
+	}
+	return false
+}
+
+// hashResponse represents our response to a request for a bridge line's
+// hashed identifier.
+type hashResponse struct {
+	HashedID string `json:"hashed_id"`
+	// PreviousHashedID is the bridge line's hashed identifier under our old
+	// key, while we're rotating keys.
+	PreviousHashedID string `json:"previous_hashed_id,omitempty"`
+}
+
+// HashBridgeLine responds with the hashed identifier of the bridge line that's
+// given in the "bridge_line" parameter, i.e., the identifier that our exports,
+// badges, and snapshots use for the bridge.  External systems can use it to
+// join their data with our exports without reimplementing our hashing.  Only
+// clients with a token may ask because the identifiers are only as secret as
+// our key.
+func HashBridgeLine(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "hash", "status": reqStatus}).Inc()
+	}()
+
+	client, err := getClient(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if client.Name == AnonymousClient {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		http.Error(w, "hashing bridge lines requires an API token", http.StatusForbidden)
+		return
+	}
+
+	addrPort, err := bridgeline.AddrPort(r.URL.Query().Get("bridge_line"))
+	if err != nil {
+		http.Error(w, "parameter \"bridge_line\" must contain a bridge line", http.StatusBadRequest)
+		return
+	}
+	reqStatus = "valid"
+
+	resp := &hashResponse{HashedID: hasher.HashAddrPort(addrPort)}
+	if hashes := hasher.HashesOf(addrPort); len(hashes) > 1 {
+		resp.PreviousHashedID = hashes[1]
+	}
+	jsonResult, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal hashed identifier", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLoadHashKey(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "hash-key-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for test: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyFile := path.Join(tmpDir, "key")
+
+	if _, err = LoadHashKey(keyFile, false); err == nil {
+		t.Errorf("Failed to return error for non-existing key file.")
+	}
+
+	key, err := LoadHashKey(keyFile, true)
+	if err != nil || len(key) != HashKeyLen {
+		t.Fatalf("Failed to generate new hash key: %s", err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Hash key file has unexpected permissions.")
+	}
+
+	// Loading the key again must result in the same key.
+	sameKey, err := LoadHashKey(keyFile, true)
+	if err != nil || string(key) != string(sameKey) {
+		t.Errorf("Failed to load existing hash key.")
+	}
+
+	ioutil.WriteFile(keyFile, []byte("not hex"), 0600)
+	if _, err = LoadHashKey(keyFile, false); err == nil {
+		t.Errorf("Failed to reject bogus hash key.")
+	}
+
+	ioutil.WriteFile(keyFile, []byte("0123"), 0600)
+	if _, err = LoadHashKey(keyFile, false); err == nil {
+		t.Errorf("Failed to reject short hash key.")
+	}
+}
+
+func TestBridgeHasher(t *testing.T) {
+
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+	bridgeLine := "obfs4 1.2.3.4:1234 cert=foo iat-mode=0"
+
+	oldHasher := NewBridgeHasher(oldKey, nil)
+	oldHash, err := oldHasher.Hash(bridgeLine)
+	if err != nil {
+		t.Fatalf("Failed to hash bridge line: %s", err)
+	}
+
+	h := NewBridgeHasher(newKey, oldKey)
+	newHash, err := h.Hash(bridgeLine)
+	if err != nil {
+		t.Fatalf("Failed to hash bridge line: %s", err)
+	}
+	if oldHash == newHash {
+		t.Errorf("Different keys resulted in identical hashes.")
+	}
+
+	// Hashes must only depend on a bridge's addr:port tuple.
+	if newHash != h.HashAddrPort("1.2.3.4:1234") {
+		t.Errorf("Hash of bridge line differs from hash of its addr:port.")
+	}
+
+	// During the transition period, both hashes must match.
+	if !h.Matches(newHash, "1.2.3.4:1234") || !h.Matches(oldHash, "1.2.3.4:1234") {
+		t.Errorf("Failed to match hashed identifier.")
+	}
+	if h.Matches(newHash, "4.3.2.1:1234") {
+		t.Errorf("Hashed identifier matched the wrong addr:port.")
+	}
+	if oldHasher.Matches(newHash, "1.2.3.4:1234") {
+		t.Errorf("Hashed identifier matched despite unknown key.")
+	}
+
+	if _, err = h.Hash("bogus"); err == nil {
+		t.Errorf("Failed to reject bogus bridge line.")
+	}
+}
+
+func TestHashBridgeLine(t *testing.T) {
+
+	tokens = map[string]*Token{"user": &Token{Token: "user", Name: "user", Weight: 1}}
+	defer func() { tokens = make(map[string]*Token) }()
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), []byte("fedcba9876543210fedcba9876543210"))
+	defer func() { hasher = nil }()
+
+	hash := func(token, bridgeLine string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/hash?bridge_line="+url.QueryEscape(bridgeLine), nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		HashBridgeLine(w, r)
+		return w
+	}
+
+	bridgeLine := "obfs4 1.2.3.4:1234 0123456789ABCDEF0123456789ABCDEF01234567 cert=foo iat-mode=0"
+	if w := hash("", bridgeLine); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d without token but got %d.", http.StatusForbidden, w.Code)
+	}
+	if w := hash("user", "bogus"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for invalid bridge line but got %d.", http.StatusBadRequest, w.Code)
+	}
+
+	w := hash("user", bridgeLine)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d.", http.StatusOK, w.Code)
+	}
+	resp := &hashResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Failed to parse response: %s", err)
+	}
+	expected, _ := hasher.Hash(bridgeLine)
+	if resp.HashedID != expected || resp.HashedID != hasher.HashAddrPort("1.2.3.4:1234") {
+		t.Errorf("Expected hashed identifier %s but got %s.", expected, resp.HashedID)
+	}
+	if resp.PreviousHashedID == "" || !hasher.Matches(resp.PreviousHashedID, "1.2.3.4:1234") {
+		t.Errorf("Unexpected previous hashed identifier %q.", resp.PreviousHashedID)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// healthResponse represents our response to health and readiness checks.
+type healthResponse struct {
+	State string `json:"state"`
+	Ready bool   `json:"ready"`
+	// Instances contains the health of our Tor instances, unless we're a
+	// read-only replica.
+	Instances []*tester.InstanceHealth `json:"instances,omitempty"`
+	// Replica tells how fresh our results are if we're a read-only
+	// replica.
+	Replica *tester.ReplicaStatus `json:"replica,omitempty"`
+	// Standby is true if we're a warm standby that didn't take over yet.
+	Standby bool `json:"standby,omitempty"`
+}
+
+// sendHealth responds with the given health response, using status code 200
+// if ok is true, and 503 otherwise.
+func sendHealth(w http.ResponseWriter, resp *healthResponse, ok bool) {
+
+	jsonResult, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal health", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(append(jsonResult, '\n'))
+}
+
+// checkReadiness determines if we can answer test requests: we must be
+// serving, and at least one of our Tor instances must have bootstrapped and
+// have a working control connection.  Read-only replicas are ready if their
+// results aren't stale.
+func checkReadiness() *healthResponse {
+
+	state := GetServingState()
+	resp := &healthResponse{State: state.String(), Ready: state == StateServing}
+	if pool := torPool(); pool != nil {
+		instances, ready := pool.Health()
+		resp.Instances = instances
+		resp.Ready = resp.Ready && ready
+	}
+	if r := replica(); r != nil {
+		resp.Replica = r.Status()
+		resp.Ready = resp.Ready && !resp.Replica.Stale
+		resp.Standby = standby != nil
+	}
+	return resp
+}
+
+// Healthz is our liveness check.  It succeeds unless we stopped, so process
+// supervisors only restart us if we're wedged.
+func Healthz(w http.ResponseWriter, r *http.Request) {
+
+	state := GetServingState()
+	sendHealth(w, &healthResponse{State: state.String(), Ready: state == StateServing}, state != StateStopped)
+}
+
+// Readyz is our readiness check.  It fails while we can't test bridges, so
+// load balancers can route requests elsewhere.
+func Readyz(w http.ResponseWriter, r *http.Request) {
+
+	resp := checkReadiness()
+	sendHealth(w, resp, resp.Ready)
+}
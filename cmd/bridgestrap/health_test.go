@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestHealthz(t *testing.T) {
+
+	defer SetServingState(StateStarting)
+	for state, code := range map[ServingState]int{
+		StateStarting: http.StatusOK,
+		StateServing:  http.StatusOK,
+		StateDraining: http.StatusOK,
+		StateStopped:  http.StatusServiceUnavailable,
+	} {
+		SetServingState(state)
+		w := httptest.NewRecorder()
+		Healthz(w, httptest.NewRequest("GET", "/healthz", nil))
+		if w.Code != code {
+			t.Errorf("Expected status code %d in state %s but got %d.", code, state, w.Code)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+
+	defer SetServingState(StateStarting)
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		Readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d while starting but got %d.", http.StatusServiceUnavailable, code)
+	}
+	SetServingState(StateServing)
+
+	// A Tor instance that hasn't bootstrapped can't test anything.
+	setRole(tester.NewTorPool(&tester.TorContext{}), nil, nil)
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d without bootstrapped instance but got %d.", http.StatusServiceUnavailable, code)
+	}
+
+	// Replicas are ready once they synced.
+	r := NewReplica("https://primary.example", "token", time.Minute, nil)
+	setRole(nil, nil, r)
+	defer setRole(nil, nil, nil)
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d for replica that never synced but got %d.", http.StatusServiceUnavailable, code)
+	}
+	r.lastSync = time.Now().UTC()
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("Expected status code %d for synced replica but got %d.", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+var fingerprintPattern = regexp.MustCompile(`^[A-F0-9]{40}$`)
+
+// historyResponse represents our response to /bridge-history requests.
+type historyResponse struct {
+	Fingerprint string               `json:"fingerprint"`
+	Results     []*tester.BridgeTest `json:"results"`
+}
+
+// newHistoryResponse turns the given history of the bridge with the given
+// fingerprint into our response, and applies our redaction policy.
+func newHistoryResponse(fingerprint string, results []testcache.HistoryResult) *historyResponse {
+
+	resp := &historyResponse{Fingerprint: fingerprint, Results: []*tester.BridgeTest{}}
+	for _, result := range results {
+		bridgeTest := &tester.BridgeTest{
+			Functional: result.Error == "",
+			Verdict:    tester.VerdictFunctional,
+			LastTested: result.Time,
+			Error:      result.Error,
+			ErrorCode:  tester.FailureCode(result.Error),
+		}
+		if result.Error != "" {
+			bridgeTest.Verdict = tester.VerdictDysfunctional
+			if redaction.Hides(ChannelHistory, FieldError) {
+				bridgeTest.Error = RedactedError
+			}
+		}
+		resp.Results = append(resp.Results, bridgeTest)
+	}
+	return resp
+}
+
+// BridgeHistory responds with the past test results of the bridge whose
+// fingerprint is given in the "fingerprint" parameter, sorted from oldest to
+// newest, so bridge operators can learn when their bridge started failing.
+func BridgeHistory(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "history", "status": reqStatus}).Inc()
+	}()
+
+	if !badgeLimiter.Allow() {
+		abuseLog.Record(r, AbuseRateLimit, AnonymousClient)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	fingerprint := strings.ToUpper(strings.TrimPrefix(r.URL.Query().Get("fingerprint"), "$"))
+	if !fingerprintPattern.MatchString(fingerprint) {
+		http.Error(w, "parameter \"fingerprint\" must contain a 40-character hex fingerprint", http.StatusBadRequest)
+		return
+	}
+	reqStatus = "valid"
+
+	jsonResult, err := json.Marshal(newHistoryResponse(fingerprint, history.Lookup(fingerprint)))
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal history", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
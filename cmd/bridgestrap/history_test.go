@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestBridgeHistory(t *testing.T) {
+
+	history = testcache.NewHistory(24 * time.Hour)
+	defer func() { history = nil }()
+	fingerprint := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	now := time.Now().UTC()
+	history.Add("1.2.3.4:1234 "+fingerprint, nil, now.Add(-time.Hour))
+	history.Add("1.2.3.4:1234 "+fingerprint, errors.New("bridge is on fire"), now)
+
+	for _, param := range []string{"", "bogus", "D9A82D2F"} {
+		w := httptest.NewRecorder()
+		BridgeHistory(w, httptest.NewRequest("GET", "/bridge-history?fingerprint="+param, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %q but got %d.", http.StatusBadRequest, param, w.Code)
+		}
+	}
+
+	// Fingerprints are case-insensitive and may carry a dollar sign.
+	w := httptest.NewRecorder()
+	BridgeHistory(w, httptest.NewRequest("GET", "/bridge-history?fingerprint=$d9a82d2f9c2f65a18407b1d2b764f130847f8b5d", nil))
+	resp := &historyResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to get history: %d %s", w.Code, w.Body.String())
+	}
+	if resp.Fingerprint != fingerprint || len(resp.Results) != 2 {
+		t.Fatalf("Unexpected history: %s", w.Body.String())
+	}
+	if !resp.Results[0].Functional || resp.Results[1].Verdict != tester.VerdictDysfunctional ||
+		resp.Results[1].Error != "bridge is on fire" {
+		t.Errorf("Unexpected results: %s", w.Body.String())
+	}
+
+	redaction = RedactionPolicy{ChannelHistory: {FieldError: true}}
+	defer func() { redaction = RedactionPolicy{} }()
+	resp = newHistoryResponse(fingerprint, history.Lookup(fingerprint))
+	if resp.Results[1].Error != RedactedError {
+		t.Errorf("Failed to redact error: %q", resp.Results[1].Error)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusRecorder remembers the status code of the response that's written to
+// it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes through to the underlying response writer, so our streaming
+// handler keeps working behind statusRecorder.
+func (w *statusRecorder) Flush() {
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Instrument wraps the given handler of the route with the given name, and
+// exposes the latency and status codes of the route's responses in our
+// Prometheus metrics.  Unlike our tester's metrics, these metrics cover the
+// entire request, including requests that we reject before they reach the
+// handler, so operators can tell a slow API from a slow tester.  We label by
+// route name rather than URL path, so our metrics neither grow with the
+// number of bridges nor reveal hashed bridge identifiers.
+func Instrument(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		inner.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		metrics.HTTPDuration.With(prometheus.Labels{
+			"route":  name,
+			"method": r.Method,
+		}).Observe(time.Since(start).Seconds())
+		metrics.HTTPRequests.With(prometheus.Labels{
+			"route":  name,
+			"method": r.Method,
+			"code":   strconv.Itoa(recorder.status),
+		}).Inc()
+	})
+}
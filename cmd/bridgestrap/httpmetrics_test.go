@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInstrument(t *testing.T) {
+
+	var flushed bool
+	handler := Instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder, ok := w.(*statusRecorder)
+		if !ok {
+			t.Fatalf("Expected our handler to get a status recorder.")
+		}
+		if _, ok := w.(http.Flusher); !ok {
+			t.Fatalf("Expected status recorder to support flushing.")
+		}
+		w.(http.Flusher).Flush()
+		flushed = true
+		w.WriteHeader(http.StatusTeapot)
+		w.WriteHeader(http.StatusOK)
+		if recorder.status != http.StatusTeapot {
+			t.Errorf("Expected status %d but got %d.", http.StatusTeapot, recorder.status)
+		}
+	}), "Test")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	if !flushed || !w.Flushed {
+		t.Errorf("Expected response to be flushed.")
+	}
+
+	// Handlers that only write a body implicitly respond with 200.
+	recorder := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+	recorder.Write([]byte("foo"))
+	if recorder.status != http.StatusOK {
+		t.Errorf("Expected status %d but got %d.", http.StatusOK, recorder.status)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+// The exit codes of our "cache inspect" subcommand follow grep's conventions,
+// so scripts can tell an empty result apart from a failure.
+const (
+	InspectExitMatches   = 0
+	InspectExitNoMatches = 1
+	InspectExitError     = 2
+)
+
+// inspectRecord represents a cache entry in the output of our "cache inspect"
+// subcommand.
+type inspectRecord struct {
+	Bridge     string    `json:"bridge"`
+	Transport  string    `json:"transport,omitempty"`
+	Functional bool      `json:"functional"`
+	Error      string    `json:"error,omitempty"`
+	LastTested time.Time `json:"last_tested"`
+	Hits       int       `json:"hits"`
+}
+
+// inspectFilter determines which cache entries our "cache inspect" subcommand
+// prints.
+type inspectFilter struct {
+	onlyFailed bool
+	transport  string
+	since      time.Time
+}
+
+// matches returns true if the given cache entry passes the filter.
+func (f *inspectFilter) matches(entry *testcache.Entry) bool {
+
+	if f.onlyFailed && entry.Error == "" {
+		return false
+	}
+	if f.transport != "" && !strings.EqualFold(f.transport, entry.Transport) {
+		return false
+	}
+	if !f.since.IsZero() && entry.Time.Before(f.since) {
+		return false
+	}
+	return true
+}
+
+// parseSince turns the argument of the -since switch into a point in time.
+// The argument is either a duration relative to now, e.g., "6h", or an
+// RFC 3339 timestamp.
+func parseSince(arg string, now time.Time) (time.Time, error) {
+
+	if arg == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(arg); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, arg)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a duration nor an RFC 3339 timestamp", arg)
+	}
+	return t, nil
+}
+
+// filterCache returns the cache entries that pass the given filter, sorted by
+// addr:port tuple and test time.  Our cache doesn't know bridge lines, so we
+// identify bridges by their addr:port tuple, or by their hashed identifier
+// once our janitor stripped their address.
+func filterCache(entries map[string]*testcache.Entry, f *inspectFilter) []*inspectRecord {
+
+	records := []*inspectRecord{}
+	for _, entry := range entries {
+		if !f.matches(entry) {
+			continue
+		}
+		bridge := entry.AddrPort
+		if bridge == "" {
+			bridge = entry.HashedID
+		}
+		records = append(records, &inspectRecord{
+			Bridge:     bridge,
+			Transport:  entry.Transport,
+			Functional: entry.Error == "",
+			Error:      entry.Error,
+			LastTested: entry.Time.UTC(),
+			Hits:       entry.Hits,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Bridge != records[j].Bridge {
+			return records[i].Bridge < records[j].Bridge
+		}
+		return records[i].LastTested.Before(records[j].LastTested)
+	})
+	return records
+}
+
+// writeRecords writes the given records to the given writer, in the given
+// format: "text", "json", or "csv".
+func writeRecords(w io.Writer, records []*inspectRecord, format string) error {
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case "csv":
+		writer := csv.NewWriter(w)
+		if err := writer.Write([]string{"bridge", "transport", "functional", "error", "last_tested", "hits"}); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := writer.Write([]string{r.Bridge, r.Transport, strconv.FormatBool(r.Functional),
+				r.Error, r.LastTested.Format(time.RFC3339), strconv.Itoa(r.Hits)}); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case "text":
+		numFunctional := 0
+		for _, r := range records {
+			status := "functional"
+			if r.Functional {
+				numFunctional++
+			} else {
+				status = r.Error
+			}
+			if _, err := fmt.Fprintf(w, "%-22s %-12s %s %s\n", r.Bridge, r.Transport,
+				r.LastTested.Format(time.RFC3339), status); err != nil {
+				return err
+			}
+		}
+		if len(records) > 0 {
+			_, err := fmt.Fprintf(w, "Found %d (%.2f%%) out of %d functional.\n", numFunctional,
+				float64(numFunctional)/float64(len(records))*100.0, len(records))
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// inspectCache implements our "cache inspect" subcommand, which prints the
+// entries of a cache file, e.g.:
+//
+//	bridgestrap cache inspect -cache bridgestrap-cache.bin -only-failed -since 6h -format json
+//
+// It returns one of our InspectExit* exit codes.
+func inspectCache(args []string, stdout, stderr io.Writer) int {
+
+	flags := flag.NewFlagSet("cache inspect", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	cacheFile := flags.String("cache", "bridgestrap-cache.bin", "Cache file to inspect.")
+	onlyFailed := flags.Bool("only-failed", false, "Only print bridges that failed their test.")
+	transport := flags.String("transport", "", "Only print bridges of the given transport, e.g., \"obfs4\".")
+	since := flags.String("since", "", "Only print bridges that were tested since the given duration (e.g., \"6h\") or RFC 3339 timestamp.")
+	format := flags.String("format", "text", "Output format: \"text\", \"json\", or \"csv\".")
+	if err := flags.Parse(args); err != nil {
+		return InspectExitError
+	}
+
+	sinceTime, err := parseSince(*since, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid -since argument: %s\n", err)
+		return InspectExitError
+	}
+
+	fh, err := os.Open(*cacheFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to open cache: %s\n", err)
+		return InspectExitError
+	}
+	defer fh.Close()
+	entries, err := testcache.Decode(fh)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to read cache: %s\n", err)
+		return InspectExitError
+	}
+
+	records := filterCache(entries, &inspectFilter{
+		onlyFailed: *onlyFailed,
+		transport:  *transport,
+		since:      sinceTime,
+	})
+	if err := writeRecords(stdout, records, *format); err != nil {
+		fmt.Fprintf(stderr, "Failed to write cache entries: %s\n", err)
+		return InspectExitError
+	}
+
+	if len(records) == 0 {
+		return InspectExitNoMatches
+	}
+	return InspectExitMatches
+}
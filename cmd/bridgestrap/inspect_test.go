@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+func TestParseSince(t *testing.T) {
+
+	now := time.Date(2020, 11, 12, 19, 40, 1, 0, time.UTC)
+
+	since, err := parseSince("6h", now)
+	if err != nil || !since.Equal(now.Add(-6*time.Hour)) {
+		t.Errorf("Expected %s but got %s (%v).", now.Add(-6*time.Hour), since, err)
+	}
+	since, err = parseSince("2020-11-01T00:00:00Z", now)
+	if err != nil || !since.Equal(time.Date(2020, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Failed to parse RFC 3339 timestamp: %s (%v).", since, err)
+	}
+	if since, err = parseSince("", now); err != nil || !since.IsZero() {
+		t.Errorf("Expected zero time for empty argument.")
+	}
+	if _, err = parseSince("yesterday", now); err == nil {
+		t.Errorf("Accepted invalid argument.")
+	}
+}
+
+func TestFilterCache(t *testing.T) {
+
+	now := time.Now().UTC()
+	entries := map[string]*testcache.Entry{
+		"a": {AddrPort: "1.1.1.1:1", Time: now, Transport: "obfs4"},
+		"b": {AddrPort: "2.2.2.2:2", Time: now, Transport: "vanilla", Error: "error"},
+		"c": {AddrPort: "3.3.3.3:3", Time: now.Add(-time.Hour * 24), Transport: "obfs4", Error: "error"},
+	}
+
+	records := filterCache(entries, &inspectFilter{})
+	if len(records) != 3 || records[0].Bridge != "1.1.1.1:1" {
+		t.Errorf("Expected all three entries, sorted, but got %d.", len(records))
+	}
+	records = filterCache(entries, &inspectFilter{onlyFailed: true})
+	if len(records) != 2 {
+		t.Errorf("Expected two failed entries but got %d.", len(records))
+	}
+	records = filterCache(entries, &inspectFilter{transport: "OBFS4", since: now.Add(-time.Hour)})
+	if len(records) != 1 || records[0].Bridge != "1.1.1.1:1" {
+		t.Errorf("Expected one recent obfs4 entry but got %d.", len(records))
+	}
+}
+
+func TestWriteRecords(t *testing.T) {
+
+	tested := time.Date(2020, 11, 12, 19, 40, 1, 0, time.UTC)
+	longError := strings.Repeat("x", 100)
+	records := []*inspectRecord{
+		{Bridge: "1.1.1.1:1", Transport: "obfs4", Functional: true, LastTested: tested},
+		{Bridge: "2.2.2.2:2", Transport: "vanilla", Error: longError, LastTested: tested, Hits: 3},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeRecords(buf, records, "csv"); err != nil {
+		t.Fatalf("Failed to write CSV: %s", err)
+	}
+	expected := "bridge,transport,functional,error,last_tested,hits\n" +
+		"1.1.1.1:1,obfs4,true,,2020-11-12T19:40:01Z,0\n" +
+		"2.2.2.2:2,vanilla,false," + longError + ",2020-11-12T19:40:01Z,3\n"
+	if buf.String() != expected {
+		t.Errorf("Expected CSV\n%s\nbut got\n%s", expected, buf.String())
+	}
+
+	buf.Reset()
+	if err := writeRecords(buf, records, "json"); err != nil {
+		t.Fatalf("Failed to write JSON: %s", err)
+	}
+	decoded := []*inspectRecord{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Failed to decode JSON: %s", err)
+	}
+	if len(decoded) != 2 || decoded[1].Error != longError || decoded[1].Hits != 3 {
+		t.Errorf("JSON output doesn't round-trip: %s", buf.String())
+	}
+
+	// Unlike our old pretty-printer, we don't truncate errors.
+	buf.Reset()
+	if err := writeRecords(buf, records, "text"); err != nil {
+		t.Fatalf("Failed to write text: %s", err)
+	}
+	if !strings.Contains(buf.String(), longError) {
+		t.Errorf("Text output truncated error: %s", buf.String())
+	}
+
+	if err := writeRecords(buf, records, "xml"); err == nil {
+		t.Errorf("Accepted unknown output format.")
+	}
+}
+
+func TestInspectCache(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-inspect-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.bin")
+
+	cache := testcache.New(time.Hour)
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=foo iat-mode=0", nil, time.Now().UTC())
+	cache.AddEntry("2.2.2.2:2", errors.New("error"), time.Now().UTC())
+	if err := cache.WriteToDisk(cacheFile); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := inspectCache([]string{"-cache", cacheFile, "-transport", "obfs4", "-format", "csv"}, stdout, stderr)
+	if code != InspectExitMatches {
+		t.Errorf("Expected exit code %d but got %d: %s", InspectExitMatches, code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "1.1.1.1:1,obfs4,true") {
+		t.Errorf("Unexpected output: %s", stdout.String())
+	}
+
+	stdout.Reset()
+	code = inspectCache([]string{"-cache", cacheFile, "-only-failed", "-transport", "obfs4"}, stdout, stderr)
+	if code != InspectExitNoMatches {
+		t.Errorf("Expected exit code %d but got %d.", InspectExitNoMatches, code)
+	}
+
+	code = inspectCache([]string{"-cache", filepath.Join(dir, "missing.bin")}, stdout, stderr)
+	if code != InspectExitError {
+		t.Errorf("Expected exit code %d but got %d.", InspectExitError, code)
+	}
+	code = inspectCache([]string{"-cache", cacheFile, "-format", "xml"}, stdout, stderr)
+	if code != InspectExitError {
+		t.Errorf("Expected exit code %d but got %d.", InspectExitError, code)
+	}
+}
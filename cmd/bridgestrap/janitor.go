@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// JanitorInterval determines how often our janitor strips addresses
+	// from our persisted artifacts.
+	JanitorInterval = time.Hour
+)
+
+// janitor is nil unless the operator enabled our address retention period.
+var janitor *Janitor
+
+// Janitor enforces our address retention period, for operators who have to
+// minimise the measurement data that they keep long-term.  Once a test result
+// is older than the retention period, the janitor replaces the bridge's
+// address in our cache and history with the bridge's hashed identifier.  What
+// remains are hashed identifiers and aggregates.  Snapshots, exports, the
+// abuse log, and tombstones only contain hashed identifiers or aggregates in
+// the first place, and checkRetention makes sure that we don't keep bridge
+// lines anywhere else.
+type Janitor struct {
+	retention   time.Duration
+	cacheFile   string
+	historyFile string
+	stripped    *prometheus.CounterVec
+}
+
+// NewJanitor returns a new janitor that strips addresses after the given
+// retention period, rewrites the given cache and history files whenever it
+// stripped any, and counts stripped results in the given counter.
+func NewJanitor(retention time.Duration, cacheFile, historyFile string, stripped *prometheus.CounterVec) *Janitor {
+	return &Janitor{retention: retention, cacheFile: cacheFile, historyFile: historyFile, stripped: stripped}
+}
+
+// checkRetention returns an error if the given configuration keeps bridge
+// lines in places that our janitor can't strip, so we refuse to start with an
+// address retention period.  Subscriptions and canaries are bridge lines that
+// we keep re-testing, so stripping them would defeat their purpose, and unsafe
+// logging writes addresses to our logs.
+func checkRetention(subscriptionFile, canaryFile string, unsafeLogging bool) error {
+
+	switch {
+	case subscriptionFile != "":
+		return errors.New("subscriptions keep bridge lines indefinitely")
+	case canaryFile != "":
+		return errors.New("canaries keep bridge lines indefinitely")
+	case unsafeLogging:
+		return errors.New("unsafe logging writes bridge addresses to our logs")
+	}
+	return nil
+}
+
+// startJanitor creates our janitor and starts it in the background, until the
+// given channel is closed.  Our janitor sweeps right away, so we must only call
+// this after InitMetrics.
+func startJanitor(retention time.Duration, cacheFile, historyFile string, shutdown chan bool) {
+
+	janitor = NewJanitor(retention, cacheFile, historyFile, metrics.StrippedResults)
+	log.Printf("Stripping bridge addresses after %s.", retention)
+	go janitor.Run(shutdown)
+}
+
+// Sweep strips the addresses of test results that we got before our retention
+// period, and persists the stripped cache and history, so the addresses don't
+// linger on disk until we shut down.
+func (j *Janitor) Sweep(now time.Time) {
+
+	cutoff := now.Add(-j.retention)
+	numCached := cache.StripAddresses(cutoff, hasher.HashAddrPort)
+	numStripped := history.StripAddresses(cutoff, hasher.HashAddrPort)
+	j.stripped.With(prometheus.Labels{"artifact": "cache"}).Add(float64(numCached))
+	j.stripped.With(prometheus.Labels{"artifact": "history"}).Add(float64(numStripped))
+	if numCached == 0 && numStripped == 0 {
+		return
+	}
+	log.Printf("Janitor stripped the addresses of %d cache entries and %d history results older than %s.",
+		numCached, numStripped, j.retention)
+
+	if numCached > 0 {
+		if err := cache.WriteToDisk(j.cacheFile); err != nil {
+			log.Printf("Failed to write stripped cache to disk: %s", err)
+		}
+	}
+	if numStripped > 0 {
+		if err := history.WriteToDisk(j.historyFile); err != nil {
+			log.Printf("Failed to write stripped history to disk: %s", err)
+		}
+	}
+}
+
+// Run sweeps right away, to take care of artifacts that we loaded from disk,
+// and every JanitorInterval after that, until the given channel is closed.
+// Unlike our other background jobs, every instance sweeps because every
+// instance has its own files.
+func (j *Janitor) Run(shutdown chan bool) {
+
+	ticker := time.NewTicker(JanitorInterval)
+	defer ticker.Stop()
+	for {
+		j.Sweep(time.Now().UTC())
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+func TestJanitorSweep(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-janitor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "cache.bin")
+	historyFile := filepath.Join(dir, "history.bin")
+
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	cache = testcache.New(24 * time.Hour)
+	history = testcache.NewHistory(24 * time.Hour)
+	defer func() { hasher, cache, history = nil, nil, nil }()
+
+	now := time.Now().UTC()
+	fingerprint := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	old := "1.2.3.4:1234 " + fingerprint
+	cache.AddEntry(old, nil, now.Add(-2*time.Hour))
+	cache.AddEntry("5.6.7.8:5678", nil, now)
+	history.Add(old, nil, now.Add(-2*time.Hour))
+
+	NewJanitor(time.Hour, cacheFile, historyFile, metrics.StrippedResults).Sweep(now)
+	if entry := cache.Peek(old); entry == nil || entry.AddrPort != "" || entry.HashedID != hasher.HashAddrPort("1.2.3.4:1234") {
+		t.Errorf("Janitor didn't strip address from old cache entry: %+v", entry)
+	}
+	if entry := cache.Peek("5.6.7.8:5678"); entry == nil || entry.AddrPort != "5.6.7.8:5678" {
+		t.Errorf("Janitor stripped address from recent cache entry: %+v", entry)
+	}
+
+	// The stripped history must have made it to disk.
+	h := testcache.NewHistory(24 * time.Hour)
+	if err := h.ReadFromDisk(historyFile); err != nil {
+		t.Fatalf("Failed to read stripped history: %s", err)
+	}
+	results := h.Lookup(fingerprint)
+	if len(results) != 1 || results[0].AddrPort != "" || results[0].HashedID != hasher.HashAddrPort("1.2.3.4:1234") {
+		t.Errorf("Janitor didn't strip address from history: %v", results)
+	}
+	c := testcache.New(24 * time.Hour)
+	if err := c.ReadFromDisk(cacheFile); err != nil {
+		t.Fatalf("Failed to read stripped cache: %s", err)
+	}
+	if entry := c.Peek(old); entry == nil || entry.AddrPort != "" {
+		t.Errorf("Janitor didn't write stripped cache to disk.")
+	}
+}
+
+func TestStartJanitor(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-janitor-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	cache = testcache.New(24 * time.Hour)
+	history = testcache.NewHistory(24 * time.Hour)
+	defer func() { hasher, cache, history, janitor = nil, nil, nil, nil }()
+	cache.AddEntry("1.2.3.4:1234", nil, time.Now().UTC().Add(-2*time.Hour))
+
+	// We start our janitor the way main does, i.e., after InitMetrics, and
+	// it must count its first sweep.
+	counter := metrics.StrippedResults.With(prometheus.Labels{"artifact": "cache"})
+	before := testutil.ToFloat64(counter)
+	shutdown := make(chan bool)
+	defer close(shutdown)
+	cacheFile := filepath.Join(dir, "cache.bin")
+	startJanitor(time.Hour, cacheFile, filepath.Join(dir, "history.bin"), shutdown)
+	if janitor == nil {
+		t.Fatalf("Didn't create janitor.")
+	}
+
+	// The janitor writes the stripped cache last, so it's done sweeping once
+	// the file exists.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(cacheFile); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Janitor didn't sweep after starting.")
+		}
+	}
+	if entry := cache.Peek("1.2.3.4:1234"); entry == nil || entry.AddrPort != "" {
+		t.Errorf("Janitor's first sweep didn't strip old cache entry.")
+	}
+	if testutil.ToFloat64(counter) != before+1 {
+		t.Errorf("Janitor didn't count its first sweep.")
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+
+	if err := checkRetention("", "", false); err != nil {
+		t.Errorf("Rejected configuration without bridge lines: %s", err)
+	}
+	for _, test := range []struct {
+		subscriptionFile, canaryFile string
+		unsafeLogging                bool
+	}{
+		{"subscriptions.json", "", false},
+		{"", "canaries.json", false},
+		{"", "", true},
+	} {
+		if err := checkRetention(test.subscriptionFile, test.canaryFile, test.unsafeLogging); err == nil {
+			t.Errorf("Accepted configuration that keeps bridge lines: %+v", test)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// JobLease is the time for which a worker may hold on to a job that it
+	// claimed without sending us a heartbeat.  Once its lease expires, the
+	// job returns to our queue, so another worker can claim it.
+	JobLease = 2 * time.Minute
+	// JobTimeout is the time that we give our workers to report a job's
+	// result, from the moment that we queued it.  Like WorkerTimeout, it's
+	// generous because workers schedule jobs according to their own policy.
+	JobTimeout = 10 * time.Minute
+)
+
+var (
+	errUnknownJob = errors.New("unknown job")
+	errJobClaimed = errors.New("job is claimed by another worker")
+)
+
+// jobs is nil unless external workers claim tests from our job queue.
+var jobs *JobQueue
+
+// Job is a test request that waits in our job queue for an external worker,
+// e.g., a worker of a Celery-like fleet that drives its own bridgestrap
+// instance.  Its stages are the stages that the client requested.
+type Job struct {
+	ID          string    `json:"id"`
+	Vantage     string    `json:"vantage"`
+	BridgeLines []string  `json:"bridge_lines"`
+	Stages      []string  `json:"stages,omitempty"`
+	Expires     time.Time `json:"lease_expires"`
+	worker      string
+	deadline    time.Time
+	done        chan *tester.TestResult
+	// adopted is true if another bridgestrap instance queued the job, so
+	// nobody here waits for its result.  See Adopt.
+	adopted bool
+}
+
+// SyncedJob represents a job in the job state that a primary and its warm
+// standby sync, so workers keep their jobs when the standby takes over, or
+// hands back to its primary.
+type SyncedJob struct {
+	Job
+	Worker   string    `json:"worker,omitempty"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// JobQueue holds the test requests of the vantage points that external
+// workers test for us.  Unlike our federation, which pushes requests to its
+// workers, the queue lets workers pull requests, i.e., claim the next pending
+// job, send heartbeats while they test it, and report its result.  This way,
+// an external scheduler decides which worker tests what, and when.  It's safe
+// for concurrent use.
+type JobQueue struct {
+	vantages map[string]bool
+	pending  []*Job
+	claimed  map[string]*Job
+	sync.Mutex
+}
+
+// NewJobQueue returns a new job queue for the given vantage points, which can't
+// take the name of the vantage point of our own Tor instances or of our
+// workers.
+func NewJobQueue(vantages []string, localVantage string) (*JobQueue, error) {
+
+	q := &JobQueue{vantages: make(map[string]bool), claimed: make(map[string]*Job)}
+	for _, vantage := range vantages {
+		vantage = strings.ToLower(strings.TrimSpace(vantage))
+		if vantage == "" {
+			continue
+		}
+		if vantage == tester.AllVantages || vantage == strings.ToLower(localVantage) || isRemoteVantage(vantage) {
+			return nil, fmt.Errorf("job queue can't take reserved vantage point %q", vantage)
+		}
+		q.vantages[vantage] = true
+	}
+	if len(q.vantages) == 0 {
+		return nil, errors.New("job queue needs at least one vantage point")
+	}
+	return q, nil
+}
+
+// Vantages returns the sorted vantage points of our job queue.
+func (q *JobQueue) Vantages() []string {
+
+	vantages := []string{}
+	for vantage := range q.vantages {
+		vantages = append(vantages, vantage)
+	}
+	sort.Strings(vantages)
+	return vantages
+}
+
+// newJobID returns a random job identifier.
+func newJobID() (string, error) {
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Test queues the given request as a job, waits until a worker reported the
+// job's result, and returns the result.  Bridge lines that no worker tested
+// in time are inconclusive.
+func (q *JobQueue) Test(req *tester.TestRequest) *tester.TestResult {
+
+	result := tester.NewTestResult()
+	id, err := newJobID()
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to create job: %s", err)
+		completeWorkerResult(result, req.BridgeLines)
+		return result
+	}
+	job := &Job{
+		ID:          id,
+		Vantage:     req.Vantage,
+		BridgeLines: req.BridgeLines,
+		Stages:      req.Stages,
+		deadline:    time.Now().Add(JobTimeout),
+		done:        make(chan *tester.TestResult, 1),
+	}
+	q.Lock()
+	q.pending = append(q.pending, job)
+	q.Unlock()
+	q.count(job, "queued")
+
+	select {
+	case result = <-job.done:
+	case <-time.After(JobTimeout):
+		q.remove(job)
+		q.count(job, "timed_out")
+		result.Error = "no worker reported the job's result in time"
+	}
+	completeWorkerResult(result, req.BridgeLines)
+	return result
+}
+
+// count increments our job metric for the given job and status.
+func (q *JobQueue) count(job *Job, status string) {
+
+	metrics.Jobs.With(prometheus.Labels{"vantage": job.Vantage, "status": status}).Inc()
+}
+
+// remove removes the given job from our queue, whether it's pending or
+// claimed.
+func (q *JobQueue) remove(job *Job) {
+
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.claimed, job.ID)
+	for i, j := range q.pending {
+		if j == job {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			break
+		}
+	}
+}
+
+// requeueExpired returns the claimed jobs whose lease expired before the given
+// time to the front of our queue, and drops adopted jobs whose deadline
+// passed.  The caller must hold the lock.
+func (q *JobQueue) requeueExpired(now time.Time) {
+
+	pending := []*Job{}
+	for _, job := range q.pending {
+		if job.adopted && now.After(job.deadline) {
+			q.count(job, "timed_out")
+			continue
+		}
+		pending = append(pending, job)
+	}
+	q.pending = pending
+
+	expired := []*Job{}
+	for id, job := range q.claimed {
+		if job.adopted && now.After(job.deadline) {
+			delete(q.claimed, id)
+			q.count(job, "timed_out")
+		} else if now.After(job.Expires) {
+			delete(q.claimed, id)
+			expired = append(expired, job)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool { return expired[i].deadline.Before(expired[j].deadline) })
+	for _, job := range expired {
+		log.Printf("Lease of job %s expired; worker %s stopped sending heartbeats.", job.ID, job.worker)
+		job.worker = ""
+		job.Expires = time.Time{}
+		q.count(job, "requeued")
+	}
+	q.pending = append(expired, q.pending...)
+}
+
+// Claim assigns the oldest pending job of the given vantage points to the
+// given worker, and returns a copy of it.  An empty list of vantage points
+// matches all of them.  If no job is pending, Claim returns nil.
+func (q *JobQueue) Claim(worker string, vantages []string) *Job {
+
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	q.requeueExpired(now)
+	for i, job := range q.pending {
+		if len(vantages) > 0 && !containsString(vantages, job.Vantage) {
+			continue
+		}
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		job.worker = worker
+		job.Expires = now.Add(JobLease)
+		q.claimed[job.ID] = job
+		q.count(job, "claimed")
+		claimed := *job
+		return &claimed
+	}
+	return nil
+}
+
+// claimedBy returns the job with the given identifier if the given worker
+// holds its lease.  The caller must hold the lock.
+func (q *JobQueue) claimedBy(id, worker string) (*Job, error) {
+
+	q.requeueExpired(time.Now())
+	job, exists := q.claimed[id]
+	if !exists {
+		return nil, errUnknownJob
+	}
+	if job.worker != worker {
+		return nil, errJobClaimed
+	}
+	return job, nil
+}
+
+// Heartbeat extends the lease that the given worker holds on the job with the
+// given identifier, and returns the lease's new expiry.
+func (q *JobQueue) Heartbeat(id, worker string) (time.Time, error) {
+
+	q.Lock()
+	defer q.Unlock()
+
+	job, err := q.claimedBy(id, worker)
+	if err != nil {
+		return time.Time{}, err
+	}
+	job.Expires = time.Now().Add(JobLease)
+	return job.Expires, nil
+}
+
+// Report hands the given result of the job with the given identifier, which
+// the given worker claimed, to the client that waits for it.
+func (q *JobQueue) Report(id, worker string, result *tester.TestResult) error {
+
+	q.Lock()
+	defer q.Unlock()
+
+	job, err := q.claimedBy(id, worker)
+	if err != nil {
+		return err
+	}
+	delete(q.claimed, id)
+	if result.Bridges == nil {
+		result.Bridges = make(map[string]*tester.BridgeTest)
+	}
+	// Workers may only report the bridges that we asked them to test.
+	for bridgeLine := range result.Bridges {
+		if !containsString(job.BridgeLines, bridgeLine) {
+			delete(result.Bridges, bridgeLine)
+		}
+	}
+	if job.adopted {
+		log.Printf("Dropping result of job %s because its client waited for another instance.", id)
+	}
+	job.done <- result
+	q.count(job, "reported")
+	return nil
+}
+
+// export returns a copy of our pending and claimed jobs, for our warm standby.
+func (q *JobQueue) export() []*SyncedJob {
+
+	q.Lock()
+	defer q.Unlock()
+
+	synced := []*SyncedJob{}
+	for _, job := range q.pending {
+		synced = append(synced, &SyncedJob{Job: *job, Deadline: job.deadline})
+	}
+	for _, job := range q.claimed {
+		synced = append(synced, &SyncedJob{Job: *job, Worker: job.worker, Deadline: job.deadline})
+	}
+	return synced
+}
+
+// Adopt replaces the jobs that we adopted from another instance with the given
+// ones.  Adopted jobs keep their identifiers and leases, so workers can keep
+// sending heartbeats and results as if nothing happened.  Warm standbys adopt
+// the jobs of their primary on every sync, and primaries adopt the jobs of a
+// standby that hands back to them.  Our own jobs, whose clients wait for us,
+// stay as they are, and so do jobs of vantage points that we don't queue.
+func (q *JobQueue) Adopt(synced []*SyncedJob) {
+
+	q.Lock()
+	defer q.Unlock()
+
+	own := make(map[string]bool)
+	pending := []*Job{}
+	for _, job := range q.pending {
+		if !job.adopted {
+			own[job.ID] = true
+			pending = append(pending, job)
+		}
+	}
+	for id, job := range q.claimed {
+		if job.adopted {
+			delete(q.claimed, id)
+		} else {
+			own[id] = true
+		}
+	}
+
+	now := time.Now()
+	for _, s := range synced {
+		if own[s.ID] || !q.vantages[s.Vantage] || now.After(s.Deadline) {
+			continue
+		}
+		job := s.Job
+		job.worker = s.Worker
+		job.deadline = s.Deadline
+		job.done = make(chan *tester.TestResult, 1)
+		job.adopted = true
+		if job.worker == "" {
+			job.Expires = time.Time{}
+			pending = append(pending, &job)
+		} else {
+			q.claimed[job.ID] = &job
+		}
+	}
+	q.pending = pending
+}
+
+// getJobWorker determines the client that sent the given API request and
+// returns an error if the client isn't allowed to claim jobs.
+func getJobWorker(r *http.Request) (*Token, error) {
+
+	client, err := getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Worker && !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		return nil, errors.New("token is not allowed to claim jobs")
+	}
+	return client, nil
+}
+
+// claimRequest represents a worker's request for a job.
+type claimRequest struct {
+	// Vantages limits the jobs that the worker wants to the given vantage
+	// points.  It's empty if the worker takes jobs of all vantage points.
+	Vantages []string `json:"vantages,omitempty"`
+}
+
+// heartbeatResponse represents our response to a worker's heartbeat.
+type heartbeatResponse struct {
+	Expires time.Time `json:"lease_expires"`
+}
+
+// sendJobError responds with the HTTP status code that fits the given error
+// of our job queue.
+func sendJobError(w http.ResponseWriter, err error) {
+
+	switch err {
+	case errUnknownJob:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errJobClaimed:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// ClaimJob assigns the oldest pending job to the worker that sent the
+// request, and responds with the job.  If no job is pending, we respond with
+// 204 No Content, and the worker should try again later.
+func ClaimJob(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getJobWorker(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	req := &claimRequest{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for i, vantage := range req.Vantages {
+		req.Vantages[i] = strings.ToLower(vantage)
+	}
+	job := jobs.Claim(client.Name, req.Vantages)
+	if job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	jsonResult, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal job", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Worker %s claimed job %s with %d bridge lines.", client.Name, job.ID, len(job.BridgeLines))
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// JobHeartbeat extends the lease on a job that the worker that sent the
+// request claimed.
+func JobHeartbeat(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getJobWorker(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	expires, err := jobs.Heartbeat(mux.Vars(r)["id"], client.Name)
+	if err != nil {
+		sendJobError(w, err)
+		return
+	}
+	jsonResult, err := json.Marshal(&heartbeatResponse{Expires: expires})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal lease", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// ReportJob accepts the result of a job that the worker that sent the request
+// claimed.  The result has the format of our own responses to test requests.
+func ReportJob(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getJobWorker(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	result := tester.NewTestResult()
+	if err := json.NewDecoder(r.Body).Decode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := jobs.Report(id, client.Name, result); err != nil {
+		sendJobError(w, err)
+		return
+	}
+	log.Printf("Worker %s reported the result of job %s.", client.Name, id)
+	w.WriteHeader(http.StatusNoContent)
+}
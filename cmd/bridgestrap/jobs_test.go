@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestNewJobQueue(t *testing.T) {
+
+	q, err := NewJobQueue([]string{"IR", " cn", ""}, tester.DefaultVantage)
+	if err != nil {
+		t.Fatalf("Failed to create job queue: %s", err)
+	}
+	if !reflect.DeepEqual(q.Vantages(), []string{"cn", "ir"}) {
+		t.Errorf("Unexpected vantage points: %v", q.Vantages())
+	}
+
+	for _, vantages := range [][]string{{}, {"all"}, {tester.DefaultVantage}} {
+		if _, err := NewJobQueue(vantages, tester.DefaultVantage); err == nil {
+			t.Errorf("Failed to reject invalid vantage points %v.", vantages)
+		}
+	}
+}
+
+// waitForJob claims the next job of the given queue on behalf of the given
+// worker, giving the job's client time to queue it.
+func waitForJob(t *testing.T, q *JobQueue, worker string) *Job {
+
+	for i := 0; i < 100; i++ {
+		if job := q.Claim(worker, nil); job != nil {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job never got queued.")
+	return nil
+}
+
+func TestJobQueue(t *testing.T) {
+
+	q, _ := NewJobQueue([]string{"ir"}, tester.DefaultVantage)
+	req := &tester.TestRequest{BridgeLines: []string{"1.1.1.1:1", "2.2.2.2:2"}, Vantage: "ir"}
+	done := make(chan *tester.TestResult)
+	go func() { done <- q.Test(req) }()
+
+	if job := q.Claim("worker1", []string{"cn"}); job != nil {
+		t.Errorf("Claimed job of other vantage point.")
+	}
+	job := waitForJob(t, q, "worker1")
+	if job.Vantage != "ir" || len(job.BridgeLines) != 2 || job.Expires.IsZero() {
+		t.Errorf("Unexpected job: %+v", job)
+	}
+	if q.Claim("worker2", nil) != nil {
+		t.Errorf("Claimed job twice.")
+	}
+	if _, err := q.Heartbeat(job.ID, "worker2"); err != errJobClaimed {
+		t.Errorf("Other worker sent heartbeat for job: %v", err)
+	}
+	if _, err := q.Heartbeat(job.ID, "worker1"); err != nil {
+		t.Errorf("Failed to send heartbeat: %s", err)
+	}
+
+	// Once its lease expires, another worker can claim the job.
+	q.Lock()
+	q.claimed[job.ID].Expires = time.Now().Add(-time.Second)
+	q.Unlock()
+	if _, err := q.Heartbeat(job.ID, "worker1"); err != errUnknownJob {
+		t.Errorf("Sent heartbeat for expired job: %v", err)
+	}
+	if job = q.Claim("worker2", nil); job == nil {
+		t.Fatalf("Failed to claim job with expired lease.")
+	}
+
+	result := tester.NewTestResult()
+	result.Bridges["1.1.1.1:1"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	result.Bridges["3.3.3.3:3"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	if err := q.Report(job.ID, "worker1", result); err != errJobClaimed {
+		t.Errorf("Worker reported job that it lost: %v", err)
+	}
+	if err := q.Report(job.ID, "worker2", result); err != nil {
+		t.Fatalf("Failed to report job: %s", err)
+	}
+	result = <-done
+	if !result.Bridges["1.1.1.1:1"].Functional {
+		t.Errorf("Lost worker's result.")
+	}
+	if b := result.Bridges["2.2.2.2:2"]; b == nil || b.Verdict != tester.VerdictInconclusive || b.ErrorCode != WorkerCode {
+		t.Errorf("Bridge that worker didn't test isn't inconclusive: %+v", b)
+	}
+	if _, exists := result.Bridges["3.3.3.3:3"]; exists {
+		t.Errorf("Worker reported bridge that we didn't ask for.")
+	}
+	if err := q.Report(job.ID, "worker2", result); err != errUnknownJob {
+		t.Errorf("Worker reported job twice: %v", err)
+	}
+}
+
+func TestJobHandlers(t *testing.T) {
+
+	tokens = map[string]*Token{
+		"worker": &Token{Token: "worker", Name: "fleet", Weight: 1, Worker: true},
+		"user":   &Token{Token: "user", Name: "user", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+	jobs, _ = NewJobQueue([]string{"ir"}, tester.DefaultVantage)
+	defer func() { jobs = nil }()
+
+	r := httptest.NewRequest("POST", "/jobs/claim", nil)
+	r.Header.Set("Authorization", "Bearer user")
+	w := httptest.NewRecorder()
+	ClaimJob(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d but got %d.", http.StatusForbidden, w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/jobs/claim", nil)
+	r.Header.Set("Authorization", "Bearer worker")
+	w = httptest.NewRecorder()
+	ClaimJob(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d without jobs but got %d.", http.StatusNoContent, w.Code)
+	}
+
+	done := make(chan *tester.TestResult)
+	go func() {
+		done <- testAtVantage(&tester.TestRequest{BridgeLines: []string{"1.1.1.1:1"}, Vantage: "ir"})
+	}()
+	var job *Job
+	for i := 0; i < 100 && job == nil; i++ {
+		r = httptest.NewRequest("POST", "/jobs/claim", strings.NewReader(`{"vantages": ["IR"]}`))
+		r.Header.Set("Authorization", "Bearer worker")
+		w = httptest.NewRecorder()
+		ClaimJob(w, r)
+		if w.Code == http.StatusOK {
+			job = &Job{}
+			if err := json.Unmarshal(w.Body.Bytes(), job); err != nil {
+				t.Fatalf("Failed to parse job: %s", err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if job == nil || !reflect.DeepEqual(job.BridgeLines, []string{"1.1.1.1:1"}) {
+		t.Fatalf("Failed to claim job: %+v", job)
+	}
+
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/jobs/"+job.ID+"/heartbeat", nil), map[string]string{"id": job.ID})
+	r.Header.Set("Authorization", "Bearer worker")
+	w = httptest.NewRecorder()
+	JobHeartbeat(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "lease_expires") {
+		t.Errorf("Failed to send heartbeat: %d %s", w.Code, w.Body.String())
+	}
+
+	body := `{"bridge_results": {"1.1.1.1:1": {"functional": false, "verdict": "dysfunctional", "error_code": "CONNECTREFUSED"}}}`
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/jobs/"+job.ID+"/result", strings.NewReader(body)), map[string]string{"id": job.ID})
+	r.Header.Set("Authorization", "Bearer worker")
+	w = httptest.NewRecorder()
+	ReportJob(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Failed to report result: %d %s", w.Code, w.Body.String())
+	}
+	if result := <-done; result.Bridges["1.1.1.1:1"].ErrorCode != "CONNECTREFUSED" {
+		t.Errorf("Client didn't get worker's result: %+v", result.Bridges["1.1.1.1:1"])
+	}
+
+	r = mux.SetURLVars(httptest.NewRequest("POST", "/jobs/"+job.ID+"/heartbeat", nil), map[string]string{"id": job.ID})
+	r.Header.Set("Authorization", "Bearer worker")
+	w = httptest.NewRecorder()
+	JobHeartbeat(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for finished job but got %d.", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestJobQueueAdopt(t *testing.T) {
+
+	primary, _ := NewJobQueue([]string{"ir"}, tester.DefaultVantage)
+	done := make(chan *tester.TestResult, 2)
+	for _, bridgeLine := range []string{"1.1.1.1:1", "2.2.2.2:2"} {
+		req := &tester.TestRequest{BridgeLines: []string{bridgeLine}, Vantage: "ir"}
+		go func() { done <- primary.Test(req) }()
+		time.Sleep(10 * time.Millisecond)
+	}
+	claimed := waitForJob(t, primary, "worker1")
+
+	// The standby's own jobs survive adoption.
+	standby, _ := NewJobQueue([]string{"ir"}, tester.DefaultVantage)
+	go standby.Test(&tester.TestRequest{BridgeLines: []string{"3.3.3.3:3"}, Vantage: "ir"})
+	time.Sleep(10 * time.Millisecond)
+	standby.Adopt(primary.export())
+	if len(standby.pending) != 2 || len(standby.claimed) != 1 {
+		t.Fatalf("Expected 2 pending and 1 claimed job but got %d and %d.", len(standby.pending), len(standby.claimed))
+	}
+
+	// Workers keep their jobs, and can report their results, even though
+	// nobody waits for them.
+	if _, err := standby.Heartbeat(claimed.ID, "worker1"); err != nil {
+		t.Errorf("Worker lost adopted job: %s", err)
+	}
+	if err := standby.Report(claimed.ID, "worker1", tester.NewTestResult()); err != nil {
+		t.Errorf("Failed to report adopted job: %s", err)
+	}
+
+	// Adopting again replaces the adopted jobs, but not our own.
+	standby.Adopt(nil)
+	if len(standby.pending) != 1 || standby.pending[0].adopted {
+		t.Errorf("Adoption didn't replace adopted jobs: %+v", standby.pending)
+	}
+
+	// Adopted jobs whose deadline passed are dropped.
+	synced := primary.export()
+	standby.Adopt(synced)
+	for _, job := range standby.pending {
+		job.deadline = time.Now().Add(-time.Second)
+	}
+	if job := standby.Claim("worker2", nil); job == nil || job.BridgeLines[0] != "3.3.3.3:3" {
+		t.Errorf("Claimed adopted job past its deadline: %+v", job)
+	}
+	if len(standby.pending) != 0 {
+		t.Errorf("Adopted jobs past their deadline weren't dropped.")
+	}
+
+	// Let the primary's clients finish.
+	primary.Report(claimed.ID, "worker1", tester.NewTestResult())
+	job := waitForJob(t, primary, "worker1")
+	primary.Report(job.ID, "worker1", tester.NewTestResult())
+	<-done
+	<-done
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// LeaderLeaseTTL is how long a leader's lease lasts unless the leader
+	// renews it.  If a leader dies, another instance takes over after at
+	// most this long.
+	LeaderLeaseTTL = 30 * time.Second
+	// LeaderKey is the Redis key that holds the current leader's ID.
+	LeaderKey = RedisKeyPrefix + "leader"
+
+	// renewLeaseScript extends the lease if (and only if) we still hold it.
+	renewLeaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	// releaseLeaseScript deletes the lease if (and only if) we hold it.
+	releaseLeaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// leader elects the instance that runs our background jobs.  It's nil if we
+// run on our own, in which case we're always the leader.
+var leader *LeaderElector
+
+// isLeader returns true if this instance should run background jobs, e.g.,
+// writing snapshots.  All instances serve requests, regardless of who leads.
+func isLeader() bool {
+	return leader == nil || leader.IsLeader()
+}
+
+// LeaderElector elects a single leader among all bridgestrap instances that
+// share a Redis server, using a lease that expires unless the leader keeps
+// renewing it.  If Redis becomes unreachable, we step down, so at worst,
+// background jobs pause instead of running twice.
+type LeaderElector struct {
+	client *redisClient
+	id     string
+	leads  int32
+}
+
+// NewLeaderElector returns a new leader elector that is backed by the Redis
+// server at the given address.
+func NewLeaderElector(addr string) (*LeaderElector, error) {
+
+	id, err := newInstanceID()
+	if err != nil {
+		return nil, err
+	}
+	return &LeaderElector{client: newRedisClient(addr), id: id}, nil
+}
+
+// newInstanceID returns an ID that's unique among our instances.
+func newInstanceID() (string, error) {
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(nonce)), nil
+}
+
+// IsLeader returns true if we currently hold the lease.
+func (e *LeaderElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leads) == 1
+}
+
+// setLeader records whether we lead, and logs changes.
+func (e *LeaderElector) setLeader(leads bool) {
+
+	var v int32
+	if leads {
+		v = 1
+	}
+	if atomic.SwapInt32(&e.leads, v) != v {
+		if leads {
+			log.Printf("Became leader %s.", e.id)
+		} else {
+			log.Printf("Stepped down as leader %s.", e.id)
+		}
+	}
+	metrics.Leader.Set(float64(v))
+}
+
+// campaign acquires the lease if it's free, or renews it if we hold it, and
+// returns true if we hold the lease afterwards.
+func (e *LeaderElector) campaign() (bool, error) {
+
+	ttl := strconv.FormatInt(int64(LeaderLeaseTTL/time.Millisecond), 10)
+	if e.IsLeader() {
+		replies, err := e.client.do([]string{"EVAL", renewLeaseScript, "1", LeaderKey, e.id, ttl})
+		if err != nil {
+			return false, err
+		}
+		return replies[0].Int == 1, nil
+	}
+
+	replies, err := e.client.do([]string{"SET", LeaderKey, e.id, "NX", "PX", ttl})
+	if err != nil {
+		return false, err
+	}
+	return !replies[0].Null, nil
+}
+
+// Run campaigns for leadership until the given channel is closed, at which
+// point we give up the lease, so another instance can take over right away.
+func (e *LeaderElector) Run(shutdown chan bool) {
+
+	// We renew the lease well before it expires, so a single slow round trip
+	// doesn't cost us the lease.
+	ticker := time.NewTicker(LeaderLeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		leads, err := e.campaign()
+		if err != nil {
+			log.Printf("Failed to campaign for leadership: %s", err)
+		}
+		e.setLeader(leads)
+
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			if e.IsLeader() {
+				if _, err := e.client.do([]string{"EVAL", releaseLeaseScript, "1", LeaderKey, e.id}); err != nil {
+					log.Printf("Failed to release leadership: %s", err)
+				}
+				e.setLeader(false)
+			}
+			return
+		}
+	}
+}
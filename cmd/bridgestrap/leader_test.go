@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLeaderElector(t *testing.T) {
+
+	r := newFakeRedis(t)
+	defer r.ln.Close()
+
+	e1, err := NewLeaderElector(r.ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to create leader elector: %s", err)
+	}
+	e2, _ := NewLeaderElector(r.ln.Addr().String())
+	if e1.id == e2.id {
+		t.Fatalf("Instances share ID %s.", e1.id)
+	}
+
+	if leads, err := e1.campaign(); err != nil || !leads {
+		t.Fatalf("First instance failed to become leader: %v", err)
+	}
+	e1.setLeader(true)
+	if leads, _ := e2.campaign(); leads {
+		t.Errorf("Second instance became leader while first one leads.")
+	}
+	// The leader must be able to renew its lease.
+	if leads, err := e1.campaign(); err != nil || !leads {
+		t.Errorf("Leader failed to renew lease: %v", err)
+	}
+
+	// Once the leader shuts down, the other instance can take over.
+	shutdown := make(chan bool)
+	close(shutdown)
+	e1.Run(shutdown)
+	if e1.IsLeader() {
+		t.Errorf("Leader didn't step down during shutdown.")
+	}
+	if leads, _ := e2.campaign(); !leads {
+		t.Errorf("Second instance failed to take over after leader stepped down.")
+	}
+}
+
+func TestIsLeader(t *testing.T) {
+
+	if !isLeader() {
+		t.Errorf("Standalone instance is not the leader.")
+	}
+}
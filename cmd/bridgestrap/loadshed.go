@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// ShedRetryAfter is the number of seconds after which we ask Web users
+	// to try again while we shed load.
+	ShedRetryAfter = 300
+	// QueueFullRetryAfter is the number of seconds after which we ask API
+	// clients to try again while our scheduler's queue is full.
+	QueueFullRetryAfter = 60
+)
+
+// webShedder is nil unless the operator set a queue threshold at which we
+// shed the load of our Web interface.
+var webShedder *LoadShedder
+
+// LoadShedder protects our API clients, e.g., rdsys, from spikes of public
+// traffic.  Once our scheduler's queue exceeds a threshold, we stop testing
+// bridges that users submit through our Web interface, and show them a static
+// "try later" page instead.  We resume once the queue has shrunk to half the
+// threshold, so we don't flap between both states.  The authenticated API is
+// never shed.  It's safe for concurrent use.
+type LoadShedder struct {
+	threshold int
+	shedding  bool
+	// queueLength returns the current length of our scheduler's queue.
+	queueLength func() int
+	sync.Mutex
+}
+
+// NewLoadShedder returns a new load shedder that sheds load once our
+// scheduler's queue is longer than the given threshold.
+func NewLoadShedder(threshold int) *LoadShedder {
+	return &LoadShedder{threshold: threshold, queueLength: tester.QueueLength}
+}
+
+// Shedding returns true if we currently shed the load of our Web interface.
+// A nil load shedder never sheds load.
+func (s *LoadShedder) Shedding() bool {
+
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+
+	queueLength := s.queueLength()
+	if !s.shedding && queueLength > s.threshold {
+		log.Printf("Shedding Web load because %d requests are queued.", queueLength)
+		s.shedding = true
+	} else if s.shedding && queueLength <= s.threshold/2 {
+		log.Printf("Resuming Web tests because only %d requests are queued.", queueLength)
+		s.shedding = false
+	}
+	if s.shedding {
+		metrics.WebShedding.Set(1)
+	} else {
+		metrics.WebShedding.Set(0)
+	}
+	return s.shedding
+}
+
+// sendBusyPage tells a Web user to try again later.
+func sendBusyPage(w http.ResponseWriter) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(ShedRetryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(BusyPage))
+}
+
+// queueFull returns true if our scheduler's queue is full, so a new test
+// request would have to wait for the queue to drain.  Read-only replicas have
+// no queue.
+func queueFull() bool {
+
+	pool := torPool()
+	return pool != nil && pool.Full()
+}
+
+// sendQueueFull tells an API client to try again later, and hints at how many
+// requests are queued, so clients can back off instead of piling up blocked
+// connections.  Only call it after queueFull returned true.
+func sendQueueFull(w http.ResponseWriter) {
+
+	w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetryAfter))
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(torPool().QueueDepth()))
+	w.Header().Set("X-Queue-Limit", strconv.Itoa(tester.MaxQueueLength))
+	http.Error(w, "test queue is full", http.StatusTooManyRequests)
+}
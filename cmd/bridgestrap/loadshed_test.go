@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestLoadShedder(t *testing.T) {
+
+	var nilShedder *LoadShedder
+	if nilShedder.Shedding() {
+		t.Errorf("Nil load shedder sheds load.")
+	}
+
+	queueLength := 0
+	s := NewLoadShedder(10)
+	s.queueLength = func() int { return queueLength }
+
+	for _, test := range []struct {
+		queueLength int
+		shedding    bool
+	}{
+		{0, false},
+		{10, false},
+		{11, true},
+		// We only resume once the queue has shrunk to half the threshold.
+		{8, true},
+		{5, false},
+		{8, false},
+	} {
+		queueLength = test.queueLength
+		if s.Shedding() != test.shedding {
+			t.Errorf("Expected shedding to be %v at queue length %d.", test.shedding, test.queueLength)
+		}
+	}
+}
+
+func TestSendBusyPage(t *testing.T) {
+
+	BusyPage = "busy"
+	defer func() { BusyPage = "" }()
+
+	w := httptest.NewRecorder()
+	sendBusyPage(w)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || w.Body.String() != "busy" {
+		t.Errorf("Unexpected busy page: %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+}
+
+func TestSendQueueFull(t *testing.T) {
+
+	if queueFull() {
+		t.Errorf("Replicas without a Tor pool have a full queue.")
+	}
+
+	oldMax := tester.MaxQueueLength
+	tester.MaxQueueLength = 1
+	pool := tester.NewTorPool()
+	pool.RequestQueue = make(chan *tester.TestRequest, tester.MaxQueueLength)
+	setRole(pool, nil, nil)
+	defer func() {
+		tester.MaxQueueLength = oldMax
+		setRole(nil, nil, nil)
+	}()
+
+	if queueFull() {
+		t.Errorf("Empty queue is full.")
+	}
+	pool.RequestQueue <- &tester.TestRequest{}
+	if !queueFull() {
+		t.Errorf("Full queue isn't full.")
+	}
+
+	w := httptest.NewRecorder()
+	sendQueueFull(w)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Unexpected response to full queue: %d %v", w.Code, w.Header())
+	}
+	if w.Header().Get("X-Queue-Depth") != "1" || w.Header().Get("X-Queue-Limit") != "1" {
+		t.Errorf("Unexpected queue headers: %v", w.Header())
+	}
+}
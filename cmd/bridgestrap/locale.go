@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// translations maps language tags, e.g., "de", to translations of the
+// descriptive strings of error codes.  English needs no translation.
+var translations = make(map[string]map[string]string)
+
+// LoadTranslations reads all JSON files in the given directory.  Each file is
+// named after a language tag, e.g., "de.json", and maps error codes (see
+// tester.FailureReasons) to their translated description.
+func LoadTranslations(dir string) (map[string]map[string]string, error) {
+
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string]string)
+	for _, filename := range filenames {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		messages := make(map[string]string)
+		if err = json.Unmarshal(content, &messages); err != nil {
+			return nil, err
+		}
+		lang := strings.ToLower(strings.TrimSuffix(filepath.Base(filename), ".json"))
+		result[lang] = messages
+	}
+	return result, nil
+}
+
+// preferredLanguages parses the given Accept-Language header and returns the
+// client's languages, most preferred first, e.g., "de-at;q=0.8, fr" results
+// in ["fr", "de-at"].
+func preferredLanguages(header string) []string {
+
+	type weightedLang struct {
+		lang string
+		q    float64
+	}
+	langs := []weightedLang{}
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weightedLang{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	result := []string{}
+	for _, l := range langs {
+		result = append(result, l.lang)
+	}
+	return result
+}
+
+// negotiateLanguage returns the most preferred language in the given
+// Accept-Language header that we have translations for, or the empty string
+// if there is none, in which case we stick to English.  "de-at" falls back to
+// "de".
+func negotiateLanguage(header string) string {
+
+	for _, lang := range preferredLanguages(header) {
+		if strings.HasPrefix(lang, "en") {
+			return ""
+		}
+		if _, exists := translations[lang]; exists {
+			return lang
+		}
+		if i := strings.Index(lang, "-"); i > 0 {
+			if _, exists := translations[lang[:i]]; exists {
+				return lang[:i]
+			}
+		}
+	}
+	return ""
+}
+
+// localise translates the error descriptions of the given result (including
+// its per-vantage results) into the given language.  Error codes remain
+// untouched, so clients can keep relying on them.
+func localise(result *tester.TestResult, lang string) {
+
+	messages, exists := translations[lang]
+	if !exists {
+		return
+	}
+	for _, bridgeTest := range result.Bridges {
+		if msg, exists := messages[bridgeTest.ErrorCode]; exists && bridgeTest.ErrorCode != "" {
+			bridgeTest.Error = msg
+		}
+	}
+	for _, vantageResult := range result.VantageResults {
+		localise(vantageResult, lang)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestLoadTranslations(t *testing.T) {
+
+	result, err := LoadTranslations("../../locales")
+	if err != nil {
+		t.Fatalf("Failed to load translations: %s", err)
+	}
+	if len(result) == 0 {
+		t.Fatalf("Found no translations.")
+	}
+	// Each translation must cover all of our error codes, and nothing else.
+	for lang, messages := range result {
+		for code := range tester.FailureReasons {
+			if messages[code] == "" {
+				t.Errorf("Translation %q lacks error code %q.", lang, code)
+			}
+		}
+		for code := range messages {
+			if _, exists := tester.FailureReasons[code]; !exists {
+				t.Errorf("Translation %q contains unknown error code %q.", lang, code)
+			}
+		}
+	}
+}
+
+func TestPreferredLanguages(t *testing.T) {
+
+	langs := preferredLanguages("de-AT;q=0.8, fr, *;q=0.1, es;q=0")
+	expected := []string{"fr", "de-at"}
+	if !reflect.DeepEqual(langs, expected) {
+		t.Errorf("Expected %v but got %v.", expected, langs)
+	}
+}
+
+func TestLocalise(t *testing.T) {
+
+	translations = map[string]map[string]string{"de": {"IOERROR": "Anderer E/A-Fehler."}}
+	defer func() { translations = make(map[string]map[string]string) }()
+
+	for header, expected := range map[string]string{
+		"de-AT":          "de",
+		"fr, de;q=0.5":   "de",
+		"en, de;q=0.5":   "",
+		"fr":             "",
+		"":               "",
+		"de;q=0, en-US ": "",
+	} {
+		if lang := negotiateLanguage(header); lang != expected {
+			t.Errorf("Expected %q for %q but got %q.", expected, header, lang)
+		}
+	}
+
+	result := tester.NewTestResult()
+	result.Bridges["1.2.3.4:1234"] = &tester.BridgeTest{
+		Error:     tester.FailureReasons["IOERROR"],
+		ErrorCode: "IOERROR",
+	}
+	result.Bridges["5.6.7.8:1234"] = &tester.BridgeTest{Error: "timed out waiting for bridge descriptor"}
+	localise(result, "de")
+	if b := result.Bridges["1.2.3.4:1234"]; b.Error != "Anderer E/A-Fehler." || b.ErrorCode != "IOERROR" {
+		t.Errorf("Failed to localise error: %+v", b)
+	}
+	if b := result.Bridges["5.6.7.8:1234"]; b.Error != "timed out waiting for bridge descriptor" {
+		t.Errorf("Changed error without code: %+v", b)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	PrometheusNamespace = tester.PrometheusNamespace
+)
+
+type Metrics struct {
+	BuildInfo         *prometheus.GaugeVec
+	ConfigInfo        *prometheus.GaugeVec
+	CacheSize         prometheus.Gauge
+	CacheBytes        prometheus.Gauge
+	FracFunctional    prometheus.Gauge
+	Cache             *prometheus.CounterVec
+	Requests          *prometheus.CounterVec
+	BridgeStatus      *prometheus.CounterVec
+	InvalidLines      *prometheus.CounterVec
+	Leader            prometheus.Gauge
+	Canary            *prometheus.GaugeVec
+	ReplicaLastSync   prometheus.Gauge
+	Standby           prometheus.Gauge
+	Failovers         prometheus.Counter
+	DualPrimary       prometheus.Gauge
+	PrimaryChecks     *prometheus.CounterVec
+	SubscribedBridges prometheus.Gauge
+	ExpeditedRetests  prometheus.Counter
+	RetiredBridges    prometheus.Gauge
+	RetiredResubs     prometheus.Counter
+	Retries           *prometheus.CounterVec
+	RequestSize       *prometheus.HistogramVec
+	InterArrival      *prometheus.HistogramVec
+	SelfProbes        *prometheus.CounterVec
+	RejectedRequests  *prometheus.CounterVec
+	HTTPRequests      *prometheus.CounterVec
+	HTTPDuration      *prometheus.HistogramVec
+	WorkerRequests    *prometheus.CounterVec
+	Jobs              *prometheus.CounterVec
+	RdsysRequests     *prometheus.CounterVec
+	StrippedResults   *prometheus.CounterVec
+	WebDeduplicated   prometheus.Counter
+	WebShedding       prometheus.Gauge
+}
+
+var metrics *Metrics
+
+// configInfoLabels are the runtime settings that our config_info metric
+// exposes.
+var configInfoLabels = []string{
+	"test_timeout",
+	"cache_timeout",
+	"cache_timeout_failure",
+	"vantage",
+	"web",
+	"shared_rate_limits",
+	"snapshots",
+	"tor_instances",
+	"canaries",
+	"replica",
+	"standby",
+	"subscriptions",
+	"workers",
+	"job_vantages",
+	"rdsys",
+	"address_retention",
+	"web_shed_threshold",
+	"max_queue_length",
+}
+
+// InitMetrics initialises our Prometheus metrics, including the ones of our
+// tester.
+func InitMetrics() {
+
+	metrics = &Metrics{}
+	if err := tester.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("Failed to register tester metrics: %s", err)
+	}
+
+	// Build and configuration metadata lets dashboards correlate changes in
+	// behaviour with deployments and configuration changes.
+	metrics.BuildInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "build_info",
+			Help:      "Bridgestrap's version, as a constant 1 labelled by version",
+		},
+		[]string{"version", "goversion"},
+	)
+	metrics.BuildInfo.With(prometheus.Labels{
+		"version":   BridgestrapVersion,
+		"goversion": runtime.Version(),
+	}).Set(1)
+
+	metrics.ConfigInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "config_info",
+			Help:      "Bridgestrap's key runtime settings, as a constant 1 labelled by setting",
+		},
+		configInfoLabels,
+	)
+
+	metrics.Leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "leader",
+		Help:      "Set to 1 if this instance runs our background jobs, and to 0 otherwise",
+	})
+
+	// We label canaries by their hashed identifier, so our metrics don't
+	// reveal bridges that aren't public.
+	metrics.Canary = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "canary_functional",
+			Help:      "Set to 1 if a canary bridge works, and to 0 otherwise",
+		},
+		[]string{"bridge"},
+	)
+
+	metrics.SubscribedBridges = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "subscribed_bridges",
+		Help:      "The number of distinct bridge lines that clients subscribed to",
+	})
+
+	metrics.ExpeditedRetests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "expedited_retests_total",
+		Help:      "The number of subscribed bridge lines that clients asked us to re-test ahead of routine re-tests",
+	})
+
+	metrics.RetiredBridges = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "retired_bridges",
+		Help:      "The number of bridges that distributors retired within our tombstone window",
+	})
+
+	metrics.RetiredResubs = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "retired_resubmissions_total",
+		Help:      "The number of retired bridges that clients submitted for testing within our tombstone window",
+	})
+
+	metrics.Retries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "retries_total",
+			Help:      "The number of bridge lines that we re-tested after a transient failure, by their eventual verdict",
+		},
+		[]string{"verdict"},
+	)
+
+	metrics.RequestSize = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "client_request_bridges",
+			Help:      "The number of bridge lines per request of clients that opted into telemetry, per consumer class",
+			Buckets:   []float64{1, 2, 5, 10, 20, 50, 100},
+		},
+		[]string{"class"},
+	)
+
+	metrics.InterArrival = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "client_interarrival_seconds",
+			Help:      "The time between consecutive requests of clients that opted into telemetry, per consumer class",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+		},
+		[]string{"class"},
+	)
+
+	metrics.ReplicaLastSync = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "replica_last_sync_timestamp_seconds",
+		Help:      "The Unix time of a read-only replica's last successful sync with its primary",
+	})
+
+	metrics.Standby = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "standby",
+		Help:      "Whether we're a warm standby that waits for its primary to fail (1) or not (0)",
+	})
+
+	metrics.Failovers = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "failovers_total",
+		Help:      "The number of times that a warm standby took over from its failed primary",
+	})
+
+	metrics.DualPrimary = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "dual_primary",
+		Help:      "Whether a warm standby took over but its old primary is ready again (1) or not (0)",
+	})
+
+	metrics.PrimaryChecks = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "primary_checks_total",
+			Help:      "The number of readiness checks that a warm standby ran against its primary, by result",
+		},
+		[]string{"status"},
+	)
+
+	metrics.WorkerRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "worker_requests_total",
+			Help:      "The number of test requests that we forwarded to remote workers, per vantage point and status",
+		},
+		[]string{"vantage", "status"},
+	)
+
+	metrics.Jobs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "jobs_total",
+			Help:      "The number of job queue events, per vantage point and status, e.g., \"claimed\" or \"requeued\"",
+		},
+		[]string{"vantage", "status"},
+	)
+
+	metrics.RdsysRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "rdsys_requests_total",
+			Help:      "The number of requests that we sent to rdsys, per type (\"fetch\" or \"push\") and status",
+		},
+		[]string{"type", "status"},
+	)
+
+	metrics.StrippedResults = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "stripped_results_total",
+			Help:      "The number of test results whose address our janitor stripped, per artifact (\"cache\" or \"history\")",
+		},
+		[]string{"artifact"},
+	)
+
+	metrics.WebDeduplicated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "web_deduplicated_total",
+		Help:      "The number of Web submissions that we answered with the result of a recent submission of the same bridge line",
+	})
+
+	metrics.WebShedding = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "web_shedding",
+		Help:      "Whether we currently turn away Web submissions (1) because our scheduler's queue is too long, or not (0)",
+	})
+
+	metrics.FracFunctional = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "fraction_functional",
+		Help:      "The fraction of functional bridges currently in the cache",
+	})
+
+	metrics.CacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "cache_size",
+		Help:      "The number of cached elements",
+	})
+
+	metrics.CacheBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "cache_bytes_estimated",
+		Help:      "An estimate of the memory that cached elements take up, in bytes",
+	})
+
+	metrics.Cache = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "cache_total",
+			Help:      "The number of cache hits and misses",
+		},
+		[]string{"type"},
+	)
+
+	metrics.Requests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "requests_total",
+			Help:      "The type and status of requests",
+		},
+		[]string{"type", "status"},
+	)
+
+	metrics.BridgeStatus = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "bridge_status_total",
+			Help:      "The number of functional and dysfunctional bridges",
+		},
+		[]string{"status"},
+	)
+
+	// We don't label invalid bridge lines by client IP address because we
+	// don't keep track of our clients' IP addresses.  Instead, we label them
+	// by the interface that they were submitted over.
+	metrics.InvalidLines = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "invalid_bridge_lines_total",
+			Help:      "The number of invalid bridge lines that clients submitted",
+		},
+		[]string{"source", "cache"},
+	)
+
+	metrics.SelfProbes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "self_probes_total",
+			Help:      "The number of bridge lines that clients submitted which point at our own address",
+		},
+		[]string{"source"},
+	)
+
+	metrics.RejectedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "rejected_requests_total",
+			Help:      "The number of requests that we rejected or throttled, per reason",
+		},
+		[]string{"reason"},
+	)
+
+	// Our HTTP metrics are labelled by route name, e.g., "BridgeState", and
+	// not by URL path, which may contain hashed bridge identifiers.
+	metrics.HTTPRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "http_requests_total",
+			Help:      "The number of HTTP requests that we responded to, per route, method, and status code",
+		},
+		[]string{"route", "method", "code"},
+	)
+
+	metrics.HTTPDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "The time that we took to respond to HTTP requests, per route and method",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+		},
+		[]string{"route", "method"},
+	)
+}
+
+// observeCacheSize updates our cache metrics whenever our test cache grows or
+// shrinks.
+func observeCacheSize(numEntries, numBytes int) {
+
+	metrics.CacheSize.Set(float64(numEntries))
+	metrics.CacheBytes.Set(float64(numBytes))
+}
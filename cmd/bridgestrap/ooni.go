@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// OONITestName and OONITestVersion identify our measurements in OONI's
+	// data format.  We reuse the name of OONI's retired bridge reachability
+	// test, whose measurements ours resemble.
+	OONITestName    = "bridge_reachability"
+	OONITestVersion = "0.1.0"
+	// OONITorTestName and OONITorTestVersion identify the measurements that
+	// we return to clients who ask for FormatOONI.  They follow the test
+	// keys of OONI's tor test, which tests a list of targets, e.g., obfs4
+	// bridges:
+	// https://github.com/ooni/spec/blob/master/nettests/ts-023-tor.md
+	OONITorTestName    = "tor"
+	OONITorTestVersion = "0.4.0"
+	// OONIDataFormatVersion is the version of OONI's base data format that
+	// our export follows:
+	// https://github.com/ooni/spec/blob/master/data-formats/df-000-base.md
+	OONIDataFormatVersion = "0.2.0"
+	// OONIProbeIP, OONIProbeASN, and OONIProbeCC are the values that OONI
+	// uses for a probe's IP address, ASN, and country if it doesn't know or
+	// doesn't reveal them.  We never reveal our IP address.
+	OONIProbeIP  = "127.0.0.1"
+	OONIProbeASN = "AS0"
+	OONIProbeCC  = "ZZ"
+	// OONIUnknownFailure is the failure of dysfunctional bridges for which
+	// we have no error code.
+	OONIUnknownFailure = "unknown_failure"
+
+	// FormatOONI asks for the result of a test request as an OONI
+	// measurement rather than in our own format.
+	FormatOONI = "ooni"
+)
+
+// ooniTestKeys contains the test-specific part of an OONI measurement.  It
+// identifies the bridge by its hashed identifier and only reveals our error
+// code, because bridge lines and detailed errors may contain the bridge's
+// address.
+type ooniTestKeys struct {
+	BridgeID      string  `json:"bridge_id"`
+	TransportName string  `json:"transport_name"`
+	Success       bool    `json:"success"`
+	Failure       *string `json:"failure"`
+}
+
+// ooniHeader contains the fields of OONI's base data format that all of our
+// measurements share.  Input is nil for tests without input.
+type ooniHeader struct {
+	Annotations          map[string]string `json:"annotations"`
+	DataFormatVersion    string            `json:"data_format_version"`
+	Input                *string           `json:"input"`
+	MeasurementStartTime string            `json:"measurement_start_time"`
+	ProbeASN             string            `json:"probe_asn"`
+	ProbeCC              string            `json:"probe_cc"`
+	ProbeIP              string            `json:"probe_ip"`
+	ReportID             string            `json:"report_id"`
+	SoftwareName         string            `json:"software_name"`
+	SoftwareVersion      string            `json:"software_version"`
+	TestName             string            `json:"test_name"`
+	TestRuntime          float64           `json:"test_runtime"`
+	TestStartTime        string            `json:"test_start_time"`
+	TestVersion          string            `json:"test_version"`
+}
+
+// ooniMeasurement is a bridge test result in OONI's base data format.
+type ooniMeasurement struct {
+	ooniHeader
+	TestKeys *ooniTestKeys `json:"test_keys"`
+}
+
+// ooniTorTarget is the result of a single bridge in OONI's tor test.
+type ooniTorTarget struct {
+	Failure        *string `json:"failure"`
+	TargetAddress  string  `json:"target_address"`
+	TargetProtocol string  `json:"target_protocol"`
+}
+
+// ooniTorTestKeys contains the test keys of OONI's tor test.  We don't test
+// directory authorities, so their counters are always zero.
+type ooniTorTestKeys struct {
+	DirPortTotal            int                       `json:"dir_port_total"`
+	DirPortAccessible       int                       `json:"dir_port_accessible"`
+	OBFS4Total              int                       `json:"obfs4_total"`
+	OBFS4Accessible         int                       `json:"obfs4_accessible"`
+	ORPortDirauthTotal      int                       `json:"or_port_dirauth_total"`
+	ORPortDirauthAccessible int                       `json:"or_port_dirauth_accessible"`
+	ORPortTotal             int                       `json:"or_port_total"`
+	ORPortAccessible        int                       `json:"or_port_accessible"`
+	Targets                 map[string]*ooniTorTarget `json:"targets"`
+}
+
+// ooniTorMeasurement is the result of a test request in the format of OONI's
+// tor test.
+type ooniTorMeasurement struct {
+	ooniHeader
+	TestKeys *ooniTorTestKeys `json:"test_keys"`
+}
+
+// ooniProbe returns the ASN and the upper-case country code of the given
+// origin, in OONI's format.  Unknown values are OONI's placeholders.
+func ooniProbe(origin *tester.Origin) (string, string) {
+
+	asn, cc := OONIProbeASN, OONIProbeCC
+	if origin != nil && origin.ASN != "" {
+		asn = origin.ASN
+	}
+	if origin != nil && origin.Country != "" {
+		cc = strings.ToUpper(origin.Country)
+	}
+	return asn, cc
+}
+
+// newOONIMeasurement turns the given cache entry of the bridge with the given
+// hashed identifier into an OONI measurement of the given report.
+func newOONIMeasurement(hashedID string, entry *testcache.Entry, origin *tester.Origin,
+	reportID string, published time.Time) *ooniMeasurement {
+
+	asn, cc := ooniProbe(origin)
+	transport := entry.Transport
+	if transport == "" {
+		transport = testcache.UnknownGroup
+	}
+	keys := &ooniTestKeys{BridgeID: hashedID, TransportName: transport, Success: entry.Error == ""}
+	if entry.Error != "" {
+		keys.Failure = ooniFailure(entry.Error, entry.ErrorCode)
+	}
+	annotations := map[string]string{}
+	if entry.Context != nil && entry.Context.Vantage != "" {
+		annotations["vantage"] = entry.Context.Vantage
+	}
+
+	return &ooniMeasurement{
+		ooniHeader: ooniHeader{
+			Annotations:          annotations,
+			DataFormatVersion:    OONIDataFormatVersion,
+			Input:                &hashedID,
+			MeasurementStartTime: entry.Time.UTC().Format(ExportTimeFormat),
+			ProbeASN:             asn,
+			ProbeCC:              cc,
+			ProbeIP:              OONIProbeIP,
+			ReportID:             reportID,
+			SoftwareName:         "bridgestrap",
+			SoftwareVersion:      BridgestrapVersion,
+			TestName:             OONITestName,
+			TestStartTime:        published.UTC().Format(ExportTimeFormat),
+			TestVersion:          OONITestVersion,
+		},
+		TestKeys: keys,
+	}
+}
+
+// ooniFailure returns the OONI failure of a dysfunctional bridge with the
+// given error and error code: its lower-case error code, rather than its
+// detailed error message.
+func ooniFailure(err, errorCode string) *string {
+
+	failure := errorCode
+	if failure == "" {
+		failure = tester.FailureCode(err)
+	}
+	if failure == "" {
+		failure = OONIUnknownFailure
+	}
+	failure = strings.ToLower(failure)
+	return &failure
+}
+
+// newOONITorMeasurement turns the given test result into a measurement of
+// OONI's tor test, which finished at the given time.  Each bridge becomes a
+// target, keyed by its hashed identifier.  Bridges whose test was
+// inconclusive and bridge lines without address are left out.
+func newOONITorMeasurement(result *tester.TestResult, h *BridgeHasher,
+	origin *tester.Origin, finished time.Time) *ooniTorMeasurement {
+
+	asn, cc := ooniProbe(origin)
+	keys := &ooniTorTestKeys{Targets: make(map[string]*ooniTorTarget)}
+	for bridgeLine, bridgeTest := range result.Bridges {
+		addrPort, err := bridgeline.AddrPort(bridgeLine)
+		if err != nil || bridgeTest.Verdict == tester.VerdictInconclusive {
+			continue
+		}
+		// OONI's tor test only knows obfs4 bridges and plain ORPorts, so
+		// we use the names of other transports as their protocol.
+		target := &ooniTorTarget{TargetAddress: addrPort, TargetProtocol: "or_port"}
+		if transport := bridgeline.Transport(bridgeLine); transport != bridgeline.VanillaTransport {
+			target.TargetProtocol = transport
+		}
+		if !bridgeTest.Functional {
+			target.Failure = ooniFailure(bridgeTest.Error, bridgeTest.ErrorCode)
+		}
+		switch target.TargetProtocol {
+		case "obfs4":
+			keys.OBFS4Total++
+			if bridgeTest.Functional {
+				keys.OBFS4Accessible++
+			}
+		case "or_port":
+			keys.ORPortTotal++
+			if bridgeTest.Functional {
+				keys.ORPortAccessible++
+			}
+		}
+		keys.Targets[h.HashAddrPort(addrPort)] = target
+	}
+
+	started := finished.Add(-time.Duration(result.Time * float64(time.Second)))
+	return &ooniTorMeasurement{
+		ooniHeader: ooniHeader{
+			Annotations:          map[string]string{},
+			DataFormatVersion:    OONIDataFormatVersion,
+			MeasurementStartTime: started.UTC().Format(ExportTimeFormat),
+			ProbeASN:             asn,
+			ProbeCC:              cc,
+			ProbeIP:              OONIProbeIP,
+			ReportID:             ooniReportID(OONITorTestName, origin, started),
+			SoftwareName:         "bridgestrap",
+			SoftwareVersion:      BridgestrapVersion,
+			TestName:             OONITorTestName,
+			TestRuntime:          result.Time,
+			TestStartTime:        started.UTC().Format(ExportTimeFormat),
+			TestVersion:          OONITorTestVersion,
+		},
+		TestKeys: keys,
+	}
+}
+
+// ooniReportID returns the identifier of the OONI report of the given test
+// that we publish at the given time, following OONI's report ID format, e.g.,
+// "20201112T194216Z_bridgereachability_DE_3320_n1_bridgestrap".
+func ooniReportID(testName string, origin *tester.Origin, published time.Time) string {
+
+	asn, cc := ooniProbe(origin)
+	return strings.Join([]string{
+		published.UTC().Format("20060102T150405Z"),
+		strings.Replace(testName, "_", "", -1),
+		cc,
+		strings.TrimPrefix(asn, "AS"),
+		"n1",
+		"bridgestrap",
+	}, "_")
+}
+
+// writeOONIMeasurements writes the given cache snapshot to the given writer as
+// OONI measurements, one JSON object per line, sorted by hashed identifier.
+// The measurements belong to a single report, which we publish at the given
+// time.  We only write bridges that pass the given filter.
+func writeOONIMeasurements(w io.Writer, snapshot map[string]testcache.Entry,
+	h *BridgeHasher, origin *tester.Origin, published time.Time, f *ExportFilter) error {
+
+	hashedIDs := []string{}
+	entries := make(map[string]testcache.Entry)
+	for addrPort, entry := range snapshot {
+		if !f.matches(entry.Transport, entry.Error == "", entry.Time, published) {
+			continue
+		}
+		hashedID := h.HashAddrPort(addrPort)
+		hashedIDs = append(hashedIDs, hashedID)
+		entries[hashedID] = entry
+	}
+	sort.Strings(hashedIDs)
+
+	reportID := ooniReportID(OONITestName, origin, published)
+	encoder := json.NewEncoder(w)
+	for _, hashedID := range hashedIDs {
+		entry := entries[hashedID]
+		if err := encoder.Encode(newOONIMeasurement(hashedID, &entry, origin, reportID, published)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestWriteOONIMeasurements(t *testing.T) {
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	tested := time.Date(2020, 11, 12, 19, 40, 1, 0, time.UTC)
+	published := time.Date(2020, 11, 12, 19, 42, 16, 0, time.UTC)
+
+	cache := testcache.New(time.Since(tested) + time.Hour)
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=foo iat-mode=0", nil, tested)
+	cache.AddResult("2.2.2.2:2", errors.New("connection refused at 2.2.2.2"), "CONNECTREFUSED", tested, nil)
+	cache.AddEntry("3.3.3.3:3", errors.New("bridge is on fire"), tested)
+
+	buf := new(bytes.Buffer)
+	origin := tester.NewOrigin("3320", "de")
+	if err := writeOONIMeasurements(buf, cache.Snapshot(), h, origin, published, &ExportFilter{}); err != nil {
+		t.Fatalf("Failed to write OONI measurements: %s", err)
+	}
+	for _, secret := range []string{"1.1.1.1", "2.2.2.2", "cert=foo", "on fire"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("OONI measurements reveal %q.", secret)
+		}
+	}
+
+	measurements := make(map[string]*ooniMeasurement)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	for _, line := range lines {
+		m := &ooniMeasurement{}
+		if err := json.Unmarshal([]byte(line), m); err != nil {
+			t.Fatalf("Failed to parse measurement %q: %s", line, err)
+		}
+		measurements[*m.Input] = m
+	}
+	if len(measurements) != 3 {
+		t.Fatalf("Expected 3 measurements but got %d.", len(measurements))
+	}
+
+	m := measurements[h.HashAddrPort("1.1.1.1:1")]
+	if m == nil || !m.TestKeys.Success || m.TestKeys.Failure != nil || m.TestKeys.TransportName != "obfs4" {
+		t.Fatalf("Unexpected measurement of functional bridge: %+v", m)
+	}
+	if m.ProbeASN != "AS3320" || m.ProbeCC != "DE" || m.ProbeIP != OONIProbeIP {
+		t.Errorf("Unexpected probe %s, %s, and %s.", m.ProbeASN, m.ProbeCC, m.ProbeIP)
+	}
+	if m.MeasurementStartTime != "2020-11-12 19:40:01" || m.TestStartTime != "2020-11-12 19:42:16" {
+		t.Errorf("Unexpected times %q and %q.", m.MeasurementStartTime, m.TestStartTime)
+	}
+	if m.ReportID != "20201112T194216Z_bridgereachability_DE_3320_n1_bridgestrap" {
+		t.Errorf("Unexpected report ID %q.", m.ReportID)
+	}
+
+	if m = measurements[h.HashAddrPort("2.2.2.2:2")]; m.TestKeys.Success || *m.TestKeys.Failure != "connectrefused" {
+		t.Errorf("Unexpected failure of dysfunctional bridge: %+v", m.TestKeys)
+	}
+	if m = measurements[h.HashAddrPort("3.3.3.3:3")]; *m.TestKeys.Failure != OONIUnknownFailure {
+		t.Errorf("Unexpected failure of bridge without error code: %+v", m.TestKeys)
+	}
+
+	// Without an origin, we use OONI's placeholders.
+	if asn, cc := ooniProbe(nil); asn != OONIProbeASN || cc != OONIProbeCC {
+		t.Errorf("Unexpected probe %s and %s without origin.", asn, cc)
+	}
+}
+
+func TestNewOONITorMeasurement(t *testing.T) {
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	finished := time.Date(2020, 11, 12, 19, 42, 16, 0, time.UTC)
+
+	result := tester.NewTestResult()
+	result.Time = 15
+	result.Bridges["obfs4 1.1.1.1:1 cert=foo iat-mode=0"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	result.Bridges["2.2.2.2:2"] = &tester.BridgeTest{Verdict: tester.VerdictDysfunctional,
+		Error: "connection refused", ErrorCode: "CONNECTREFUSED"}
+	result.Bridges["webtunnel 3.3.3.3:3 url=https://example.com"] = &tester.BridgeTest{Verdict: tester.VerdictDysfunctional,
+		Error: "bridge is on fire"}
+	result.Bridges["4.4.4.4:4"] = &tester.BridgeTest{Verdict: tester.VerdictInconclusive}
+
+	m := newOONITorMeasurement(result, h, tester.NewOrigin("3320", "de"), finished)
+	if m.TestName != OONITorTestName || m.Input != nil || m.TestRuntime != 15 {
+		t.Errorf("Unexpected measurement header: %+v", m.ooniHeader)
+	}
+	if m.TestStartTime != "2020-11-12 19:42:01" || m.ReportID != "20201112T194201Z_tor_DE_3320_n1_bridgestrap" {
+		t.Errorf("Unexpected start time %q and report ID %q.", m.TestStartTime, m.ReportID)
+	}
+
+	keys := m.TestKeys
+	if len(keys.Targets) != 3 {
+		t.Fatalf("Expected 3 targets but got %d.", len(keys.Targets))
+	}
+	if keys.OBFS4Total != 1 || keys.OBFS4Accessible != 1 || keys.ORPortTotal != 1 || keys.ORPortAccessible != 0 {
+		t.Errorf("Unexpected counters: %+v", keys)
+	}
+	if target := keys.Targets[h.HashAddrPort("1.1.1.1:1")]; target == nil ||
+		target.Failure != nil || target.TargetProtocol != "obfs4" || target.TargetAddress != "1.1.1.1:1" {
+		t.Errorf("Unexpected target of functional bridge: %+v", target)
+	}
+	if target := keys.Targets[h.HashAddrPort("2.2.2.2:2")]; target == nil ||
+		*target.Failure != "connectrefused" || target.TargetProtocol != "or_port" {
+		t.Errorf("Unexpected target of dysfunctional bridge: %+v", target)
+	}
+	if target := keys.Targets[h.HashAddrPort("3.3.3.3:3")]; target == nil ||
+		*target.Failure != OONIUnknownFailure || target.TargetProtocol != "webtunnel" {
+		t.Errorf("Unexpected target of webtunnel bridge: %+v", target)
+	}
+
+	// The measurement never contains detailed error messages.
+	b, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal measurement: %s", err)
+	}
+	if strings.Contains(string(b), "on fire") || !strings.Contains(string(b), `"input":null`) {
+		t.Errorf("Unexpected measurement: %s", b)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// orportPair is a vanilla bridge line and a pluggable transport bridge line
+// of the same bridge.
+type orportPair struct {
+	vanilla   string
+	transport string
+}
+
+// findORPortPairs returns the bridges, keyed by fingerprint, for which the
+// given bridge lines contain both a vanilla bridge line and a pluggable
+// transport bridge line.  If a bridge has several lines of either kind, we
+// pair the first ones.
+func findORPortPairs(bridgeLines []string) map[string]*orportPair {
+
+	vanilla := make(map[string]string)
+	transport := make(map[string]string)
+	for _, bridgeLine := range bridgeLines {
+		fingerprint, err := bridgeline.Fingerprint(bridgeLine)
+		if err != nil {
+			continue
+		}
+		if bridgeline.Transport(bridgeLine) == bridgeline.VanillaTransport {
+			if _, exists := vanilla[fingerprint]; !exists {
+				vanilla[fingerprint] = bridgeLine
+			}
+		} else if _, exists := transport[fingerprint]; !exists {
+			transport[fingerprint] = bridgeLine
+		}
+	}
+
+	pairs := make(map[string]*orportPair)
+	for fingerprint, vanillaLine := range vanilla {
+		if transportLine, exists := transport[fingerprint]; exists {
+			pairs[fingerprint] = &orportPair{vanilla: vanillaLine, transport: transportLine}
+		}
+	}
+	return pairs
+}
+
+// splitORPortLines separates the vanilla bridge lines of the bridges that
+// findORPortPairs finds from the rest of the given bridge lines.
+func splitORPortLines(bridgeLines []string) ([]string, []string) {
+
+	vanillaLines := make(map[string]bool)
+	for _, pair := range findORPortPairs(bridgeLines) {
+		vanillaLines[pair.vanilla] = true
+	}
+
+	vanilla, rest := []string{}, []string{}
+	for _, bridgeLine := range bridgeLines {
+		if vanillaLines[bridgeLine] {
+			vanilla = append(vanilla, bridgeLine)
+		} else {
+			rest = append(rest, bridgeLine)
+		}
+	}
+	return vanilla, rest
+}
+
+// testWithTor has our Tor instances test the given bridge lines on behalf of
+// the given request.  Tor's events identify bridges by their fingerprint, so
+// a bridge's vanilla and pluggable transport bridge lines can't share a
+// batch: we couldn't tell their results apart.  We therefore test such
+// vanilla bridge lines in a separate request, concurrently, and merge the
+// results.
+func testWithTor(req *tester.TestRequest, bridgeLines []string) *tester.TestResult {
+
+	newRequest := func(bridgeLines []string) *tester.TestRequest {
+		return &tester.TestRequest{
+			BridgeLines: bridgeLines,
+			Circuit:     req.Circuit,
+			Client:      req.Client,
+			Weight:      req.Weight,
+			Timeout:     req.Timeout,
+			Background:  req.Background,
+			Progress:    req.Progress,
+		}
+	}
+
+	vanilla, rest := splitORPortLines(bridgeLines)
+	if len(vanilla) == 0 {
+		return torPool().Test(newRequest(bridgeLines))
+	}
+
+	var vanillaResult *tester.TestResult
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		vanillaResult = torPool().Test(newRequest(vanilla))
+	}()
+	result := torPool().Test(newRequest(rest))
+	wg.Wait()
+
+	for bridgeLine, bridgeTest := range vanillaResult.Bridges {
+		result.Bridges[bridgeLine] = bridgeTest
+	}
+	if result.Error == "" {
+		result.Error = vanillaResult.Error
+	}
+	if vanillaResult.Time > result.Time {
+		result.Time = vanillaResult.Time
+	}
+	return result
+}
+
+// addORPortExposure adds the combined result of each bridge for which the
+// given bridge lines contain both a vanilla and a pluggable transport bridge
+// line to the given result.  We skip bridges for which either result is
+// inconclusive.
+func addORPortExposure(result *tester.TestResult, bridgeLines []string) {
+
+	for fingerprint, pair := range findORPortPairs(bridgeLines) {
+		vanillaTest, transportTest := result.Bridges[pair.vanilla], result.Bridges[pair.transport]
+		if vanillaTest == nil || transportTest == nil ||
+			vanillaTest.Verdict == tester.VerdictInconclusive ||
+			transportTest.Verdict == tester.VerdictInconclusive {
+			continue
+		}
+		if result.ORPortExposure == nil {
+			result.ORPortExposure = make(map[string]*tester.ORPortExposure)
+		}
+		result.ORPortExposure[fingerprint] = &tester.ORPortExposure{
+			VanillaBridgeLine:   pair.vanilla,
+			TransportBridgeLine: pair.transport,
+			ORPortReachable:     vanillaTest.Functional,
+			TransportReachable:  transportTest.Functional,
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	testFingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	vanillaLine     = "1.2.3.4:9001 " + testFingerprint
+	obfs4Line       = "obfs4 1.2.3.4:443 " + testFingerprint + " cert=foo iat-mode=0"
+)
+
+func TestSplitORPortLines(t *testing.T) {
+
+	otherLine := "2.2.2.2:2 FEDCBA9876543210FEDCBA9876543210FEDCBA98"
+	vanilla, rest := splitORPortLines([]string{obfs4Line, otherLine, vanillaLine, "3.3.3.3:3"})
+	if !reflect.DeepEqual(vanilla, []string{vanillaLine}) {
+		t.Errorf("Unexpected vanilla bridge lines: %v", vanilla)
+	}
+	if !reflect.DeepEqual(rest, []string{obfs4Line, otherLine, "3.3.3.3:3"}) {
+		t.Errorf("Unexpected remaining bridge lines: %v", rest)
+	}
+
+	// Without a matching transport line, vanilla lines stay where they are.
+	if vanilla, _ = splitORPortLines([]string{vanillaLine, otherLine}); len(vanilla) != 0 {
+		t.Errorf("Unexpected vanilla bridge lines: %v", vanilla)
+	}
+}
+
+func TestAddORPortExposure(t *testing.T) {
+
+	result := tester.NewTestResult()
+	result.Bridges[vanillaLine] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	result.Bridges[obfs4Line] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	addORPortExposure(result, []string{vanillaLine, obfs4Line})
+
+	exposure, exists := result.ORPortExposure[testFingerprint]
+	if !exists {
+		t.Fatalf("Result lacks ORPort exposure.")
+	}
+	if !exposure.ORPortReachable || !exposure.TransportReachable ||
+		exposure.VanillaBridgeLine != vanillaLine || exposure.TransportBridgeLine != obfs4Line {
+		t.Errorf("Unexpected ORPort exposure: %+v", exposure)
+	}
+
+	// Inconclusive results say nothing about the ORPort.
+	result = tester.NewTestResult()
+	result.Bridges[vanillaLine] = &tester.BridgeTest{Verdict: tester.VerdictInconclusive}
+	result.Bridges[obfs4Line] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	addORPortExposure(result, []string{vanillaLine, obfs4Line})
+	if result.ORPortExposure != nil {
+		t.Errorf("Added ORPort exposure despite inconclusive result.")
+	}
+}
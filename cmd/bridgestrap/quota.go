@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// QuotaWindow is the period over which we count the bridge tests of
+	// clients that have a quota.
+	QuotaWindow = 24 * time.Hour
+	// QuotaSchemaVersion is the version of our quota file's format.
+	QuotaSchemaVersion = 1
+
+	// reserveQuotaScript charges ARGV[1] tests to the quota usage in
+	// KEYS[1] unless that would exceed the limit in ARGV[2], and makes new
+	// usage expire after ARGV[3] milliseconds.  It returns the usage after
+	// charging, or -1 minus the usage if it charged nothing.
+	reserveQuotaScript = `local used = tonumber(redis.call("GET", KEYS[1]) or "0") if used + tonumber(ARGV[1]) > tonumber(ARGV[2]) then return -1 - used end used = redis.call("INCRBY", KEYS[1], ARGV[1]) if redis.call("PTTL", KEYS[1]) < 0 then redis.call("PEXPIRE", KEYS[1], ARGV[3]) end return used`
+	// refundQuotaScript takes ARGV[1] tests off the quota usage in KEYS[1],
+	// if it still exists, without going below zero.
+	refundQuotaScript = `if redis.call("EXISTS", KEYS[1]) == 0 then return 0 end local used = redis.call("DECRBY", KEYS[1], ARGV[1]) if used < 0 then used = redis.call("INCRBY", KEYS[1], -used) end return used`
+)
+
+// quotas keeps track of how much of their quota our clients have used.
+var quotas = NewQuotaTracker()
+
+// QuotaState represents how much of its quota a client has left.
+type QuotaState struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// quotaUsage represents how many bridge tests a client requested in the
+// current window.
+type quotaUsage struct {
+	Used        int
+	WindowStart time.Time
+}
+
+// persistedQuotas is the on-disk representation of our quota usage.
+type persistedQuotas struct {
+	Version int
+	Usage   map[string]*quotaUsage
+}
+
+// QuotaTracker enforces per-client quotas on bridge tests.  Only bridge lines
+// that we actually test count towards a client's quota; cache hits are free,
+// and we refund tests that told us nothing about a bridge.  If we share a
+// Redis server with other instances, we keep usage in Redis, so quotas hold
+// across all instances.  If Redis is unreachable, we fall back to our local
+// usage, which we persist to disk.  It's safe for concurrent use.
+type QuotaTracker struct {
+	usage map[string]*quotaUsage
+	// redis is nil unless we share quotas via Redis.
+	redis *redisClient
+	sync.Mutex
+}
+
+// NewQuotaTracker returns a new quota tracker.
+func NewQuotaTracker() *QuotaTracker {
+
+	return &QuotaTracker{usage: make(map[string]*quotaUsage)}
+}
+
+// UseRedis makes us keep quota usage in the Redis server at the given
+// address, so all instances that share the server enforce quotas together.
+func (q *QuotaTracker) UseRedis(addr string) {
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.redis = newRedisClient(addr)
+}
+
+// quotaKey returns the Redis key that holds the given client's usage.
+func quotaKey(client string) string {
+	return RedisKeyPrefix + "quota:" + client
+}
+
+// current returns the given client's usage in the current window, and starts
+// a new window if the previous one is over.  The caller must hold the lock.
+func (q *QuotaTracker) current(client string, now time.Time) *quotaUsage {
+
+	u, exists := q.usage[client]
+	if !exists || now.Sub(u.WindowStart) >= QuotaWindow {
+		u = &quotaUsage{WindowStart: now}
+		q.usage[client] = u
+	}
+	return u
+}
+
+// Reserve charges the given number of bridge tests to the given client's
+// quota and returns the client's remaining quota.  If the client doesn't have
+// enough quota left, nothing is charged and the function returns an error
+// that tells the client how much quota it has left.  Clients without a quota
+// can test as many bridges as they want, and get a nil state.
+func (q *QuotaTracker) Reserve(t *Token, n int) (*QuotaState, error) {
+
+	if t.Quota == 0 {
+		return nil, nil
+	}
+
+	q.Lock()
+	client := q.redis
+	q.Unlock()
+
+	var state *QuotaState
+	var charged bool
+	if client != nil {
+		var err error
+		if state, charged, err = reserveInRedis(client, t, n, time.Now()); err != nil {
+			log.Printf("Falling back to local quota of client %s: %s", t.Name, err)
+			state = nil
+		}
+	}
+	if state == nil {
+		state, charged = q.reserveLocally(t, n, time.Now())
+	}
+	if !charged {
+		return state, fmt.Errorf("request contains %d uncached bridge lines but only %d of your quota of %d remain until %s",
+			n, state.Remaining, state.Limit, state.Reset.Format(time.RFC3339))
+	}
+	return state, nil
+}
+
+// reserveLocally charges the given number of bridge tests to the given
+// client's local usage, if it has enough quota left, and returns the client's
+// remaining quota and whether we charged it.
+func (q *QuotaTracker) reserveLocally(t *Token, n int, now time.Time) (*QuotaState, bool) {
+
+	q.Lock()
+	defer q.Unlock()
+
+	u := q.current(t.Name, now)
+	state := &QuotaState{
+		Limit:     t.Quota,
+		Remaining: t.Quota - u.Used,
+		Reset:     u.WindowStart.Add(QuotaWindow).UTC(),
+	}
+	if n > state.Remaining {
+		return state, false
+	}
+	u.Used += n
+	state.Remaining -= n
+	return state, true
+}
+
+// reserveInRedis is like reserveLocally, but charges the client's usage in
+// Redis, atomically, via the given client.
+func reserveInRedis(client *redisClient, t *Token, n int, now time.Time) (*QuotaState, bool, error) {
+
+	key := quotaKey(t.Name)
+	ttl := strconv.FormatInt(int64(QuotaWindow/time.Millisecond), 10)
+	replies, err := client.do(
+		[]string{"EVAL", reserveQuotaScript, "1", key, strconv.Itoa(n), strconv.Itoa(t.Quota), ttl},
+		[]string{"PTTL", key},
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	used, charged := int(replies[0].Int), true
+	if used < 0 {
+		used, charged = -1-used, false
+	}
+	reset := now.Add(QuotaWindow)
+	if pttl := replies[1].Int; pttl >= 0 {
+		reset = now.Add(time.Duration(pttl) * time.Millisecond)
+	}
+	return &QuotaState{Limit: t.Quota, Remaining: t.Quota - used, Reset: reset.UTC()}, charged, nil
+}
+
+// Refund gives the given number of bridge tests back to the given client,
+// e.g., because their results were inconclusive.
+func (q *QuotaTracker) Refund(t *Token, n int) {
+
+	if t.Quota == 0 || n <= 0 {
+		return
+	}
+
+	q.Lock()
+	client := q.redis
+	q.Unlock()
+
+	if client != nil {
+		_, err := client.do([]string{"EVAL", refundQuotaScript, "1", quotaKey(t.Name), strconv.Itoa(n)})
+		if err == nil {
+			return
+		}
+		log.Printf("Falling back to local quota of client %s: %s", t.Name, err)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	// Refunds after the window is over would eat into the next window.
+	if u, exists := q.usage[t.Name]; exists && time.Since(u.WindowStart) < QuotaWindow {
+		u.Used -= n
+		if u.Used < 0 {
+			u.Used = 0
+		}
+	}
+}
+
+// refundable returns true if the given test of the given bridge line
+// shouldn't count towards a client's quota: we have no result for it, its
+// result is inconclusive, the bridge line points at us, or a distributor
+// retired the bridge.
+func refundable(bridgeLine string, bridgeTest *tester.BridgeTest, now time.Time) bool {
+
+	switch {
+	case bridgeTest == nil:
+		return true
+	case bridgeTest.Verdict == tester.VerdictInconclusive:
+		return true
+	case bridgeTest.ErrorCode == SelfProbeCode:
+		return true
+	case tombstones != nil && tombstones.RetiredAt(bridgeLine, now) != nil:
+		return true
+	}
+	return false
+}
+
+// numRefundable returns the number of tests in the given result that we
+// charged to a client's quota for the given bridge lines, once per given
+// vantage point, or once if there are none, but that are refundable.
+func numRefundable(result *tester.TestResult, bridgeLines, vantages []string) int {
+
+	now := time.Now().UTC()
+	n := 0
+	for _, bridgeLine := range bridgeLines {
+		bridgeTest := result.Bridges[bridgeLine]
+		if len(vantages) == 0 {
+			if refundable(bridgeLine, bridgeTest, now) {
+				n++
+			}
+			continue
+		}
+		// Results of vantage point tests only contain the bridge lines
+		// that we didn't test anywhere, e.g., because they point at us.
+		if bridgeTest != nil {
+			n += len(vantages)
+			continue
+		}
+		for _, vantage := range vantages {
+			bridgeTest = nil
+			if vantageResult := result.VantageResults[vantage]; vantageResult != nil {
+				bridgeTest = vantageResult.Bridges[bridgeLine]
+			}
+			if refundable(bridgeLine, bridgeTest, now) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// WriteToDisk writes our local quota usage to disk, allowing it to persist
+// across program restarts.  We leave out usage whose window is over.
+func (q *QuotaTracker) WriteToDisk(quotaFile string) error {
+
+	q.Lock()
+	defer q.Unlock()
+
+	now := time.Now()
+	usage := make(map[string]*quotaUsage)
+	for client, u := range q.usage {
+		if now.Sub(u.WindowStart) < QuotaWindow {
+			usage[client] = u
+		}
+	}
+	err := testcache.WriteFileAtomically(quotaFile, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(persistedQuotas{
+			Version: QuotaSchemaVersion,
+			Usage:   usage,
+		})
+	})
+	if err == nil {
+		log.Printf("Wrote quota usage of %d clients to %q.", len(usage), quotaFile)
+	}
+
+	return err
+}
+
+// ReadFromDisk reads our local quota usage from disk.
+func (q *QuotaTracker) ReadFromDisk(quotaFile string) error {
+
+	fh, err := os.Open(quotaFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	pq := &persistedQuotas{}
+	if err := gob.NewDecoder(fh).Decode(pq); err != nil {
+		return err
+	}
+	if pq.Version > QuotaSchemaVersion {
+		return fmt.Errorf("quota schema version %d is newer than ours (%d)",
+			pq.Version, QuotaSchemaVersion)
+	}
+
+	q.Lock()
+	q.usage = make(map[string]*quotaUsage)
+	for client, u := range pq.Usage {
+		q.usage[client] = u
+	}
+	log.Printf("Read quota usage of %d clients from %q.", len(q.usage), quotaFile)
+	q.Unlock()
+
+	return nil
+}
+
+// setQuotaHeaders tells the client about its quota state, if it has a quota.
+func setQuotaHeaders(w http.ResponseWriter, state *QuotaState) {
+
+	if state == nil {
+		return
+	}
+	w.Header().Set("X-Quota-Limit", strconv.Itoa(state.Limit))
+	w.Header().Set("X-Quota-Remaining", strconv.Itoa(state.Remaining))
+	w.Header().Set("X-Quota-Reset", state.Reset.Format(time.RFC3339))
+}
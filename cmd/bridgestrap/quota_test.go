@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestQuotaTracker(t *testing.T) {
+
+	q := NewQuotaTracker()
+
+	unlimited := &Token{Name: "unlimited"}
+	if state, err := q.Reserve(unlimited, 1000); err != nil || state != nil {
+		t.Errorf("Client without quota was limited.")
+	}
+
+	client := &Token{Name: "limited", Quota: 10}
+	state, err := q.Reserve(client, 7)
+	if err != nil {
+		t.Fatalf("Rejected request within quota: %s", err)
+	}
+	if state.Limit != 10 || state.Remaining != 3 {
+		t.Errorf("Expected 3 of 10 remaining but got %d of %d.", state.Remaining, state.Limit)
+	}
+
+	// Requests that exceed the remaining quota must be rejected without
+	// being charged.
+	if _, err = q.Reserve(client, 4); err == nil {
+		t.Errorf("Failed to reject request that exceeds quota.")
+	}
+	if state, err = q.Reserve(client, 3); err != nil || state.Remaining != 0 {
+		t.Errorf("Rejected request that uses up remaining quota.")
+	}
+
+	// Cache hits are free, so requests without uncached bridge lines must
+	// pass even if the quota is used up.
+	if _, err = q.Reserve(client, 0); err != nil {
+		t.Errorf("Rejected request without uncached bridge lines.")
+	}
+
+	// Once the window is over, the client gets a fresh quota.
+	q.usage[client.Name].WindowStart = time.Now().Add(-QuotaWindow)
+	if state, err = q.Reserve(client, 10); err != nil || state.Remaining != 0 {
+		t.Errorf("Quota was not reset after window.")
+	}
+}
+
+func TestQuotaRefund(t *testing.T) {
+
+	q := NewQuotaTracker()
+	client := &Token{Name: "limited", Quota: 10}
+	if _, err := q.Reserve(client, 10); err != nil {
+		t.Fatalf("Rejected request within quota: %s", err)
+	}
+	q.Refund(client, 3)
+	state, err := q.Reserve(client, 3)
+	if err != nil || state.Remaining != 0 {
+		t.Errorf("Refund didn't restore quota.")
+	}
+	q.Refund(client, 20)
+	if q.usage[client.Name].Used != 0 {
+		t.Errorf("Refund made usage negative.")
+	}
+}
+
+func TestNumRefundable(t *testing.T) {
+
+	result := newTestResult()
+	result.Bridges["1.1.1.1:1"] = &tester.BridgeTest{Verdict: tester.VerdictFunctional}
+	result.Bridges["2.2.2.2:2"] = &tester.BridgeTest{Verdict: tester.VerdictInconclusive}
+	result.Bridges["3.3.3.3:3"] = &tester.BridgeTest{Verdict: tester.VerdictDysfunctional, ErrorCode: SelfProbeCode}
+	result.Bridges["4.4.4.4:4"] = &tester.BridgeTest{Verdict: tester.VerdictDysfunctional}
+	bridgeLines := []string{"1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3", "4.4.4.4:4", "5.5.5.5:5"}
+	if n := numRefundable(result, bridgeLines, nil); n != 3 {
+		t.Errorf("Expected 3 refundable tests but got %d.", n)
+	}
+
+	// Each vantage point counts separately, and bridge lines that we
+	// didn't test anywhere count once per vantage point.
+	result = newTestResult()
+	result.Bridges["3.3.3.3:3"] = &tester.BridgeTest{Verdict: tester.VerdictDysfunctional, ErrorCode: SelfProbeCode}
+	result.VantageResults = map[string]*tester.TestResult{
+		"de": &tester.TestResult{Bridges: map[string]*tester.BridgeTest{
+			"1.1.1.1:1": &tester.BridgeTest{Verdict: tester.VerdictFunctional},
+		}},
+		"ru": &tester.TestResult{Bridges: map[string]*tester.BridgeTest{
+			"1.1.1.1:1": &tester.BridgeTest{Verdict: tester.VerdictInconclusive},
+		}},
+	}
+	if n := numRefundable(result, []string{"1.1.1.1:1", "3.3.3.3:3"}, []string{"de", "ru"}); n != 3 {
+		t.Errorf("Expected 3 refundable vantage point tests but got %d.", n)
+	}
+}
+
+func TestQuotaTrackerRedis(t *testing.T) {
+
+	r := newFakeRedis(t)
+	defer r.ln.Close()
+
+	// Two instances that share Redis must share quotas, too.
+	q1, q2 := NewQuotaTracker(), NewQuotaTracker()
+	q1.UseRedis(r.ln.Addr().String())
+	q2.UseRedis(r.ln.Addr().String())
+	client := &Token{Name: "limited", Quota: 10}
+	if _, err := q1.Reserve(client, 7); err != nil {
+		t.Fatalf("Rejected request within quota: %s", err)
+	}
+	state, err := q2.Reserve(client, 4)
+	if err == nil {
+		t.Errorf("Second instance ignored shared quota.")
+	}
+	if state.Remaining != 3 {
+		t.Errorf("Expected 3 remaining but got %d.", state.Remaining)
+	}
+	q2.Refund(client, 1)
+	if _, err := q1.Reserve(client, 4); err != nil {
+		t.Errorf("Refund didn't restore shared quota: %s", err)
+	}
+	if len(q1.usage) != 0 || len(q2.usage) != 0 {
+		t.Errorf("Used local quota even though Redis is reachable.")
+	}
+
+	// Without Redis, we fall back to our local quota.
+	r.ln.Close()
+	q1.UseRedis(r.ln.Addr().String())
+	if _, err := q1.Reserve(client, 10); err != nil || q1.usage[client.Name].Used != 10 {
+		t.Errorf("Failed to fall back to local quota.")
+	}
+}
+
+func TestQuotaTrackerPersistence(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-quota-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	quotaFile := filepath.Join(dir, "quotas.bin")
+
+	q := NewQuotaTracker()
+	client := &Token{Name: "limited", Quota: 10}
+	q.Reserve(client, 7)
+	q.Reserve(&Token{Name: "expired", Quota: 10}, 5)
+	q.usage["expired"].WindowStart = time.Now().Add(-QuotaWindow)
+	if err := q.WriteToDisk(quotaFile); err != nil {
+		t.Fatalf("Failed to write quota usage: %s", err)
+	}
+
+	// A restart must not reset quotas.
+	q = NewQuotaTracker()
+	if err := q.ReadFromDisk(quotaFile); err != nil {
+		t.Fatalf("Failed to read quota usage: %s", err)
+	}
+	if _, err := q.Reserve(client, 4); err == nil {
+		t.Errorf("Restart reset quota.")
+	}
+	if _, exists := q.usage["expired"]; exists {
+		t.Errorf("Persisted usage whose window is over.")
+	}
+}
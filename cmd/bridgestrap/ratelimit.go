@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// incrementScript increments a counter and makes it expire after the
+	// given number of milliseconds unless it already expires.  Scripts run
+	// atomically, so unlike a pipeline of INCR and PEXPIRE, a dropped
+	// connection can't leave us with a counter that never expires.
+	incrementScript = `local n = redis.call("INCR", KEYS[1]) if redis.call("PTTL", KEYS[1]) < 0 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end return n`
+)
+
+// RateLimiter decides if we can serve another request.  Both rate.Limiter
+// and RedisLimiter implement it.
+type RateLimiter interface {
+	Allow() bool
+}
+
+// RedisLimiter enforces a rate limit across all bridgestrap instances that
+// share a Redis server.  It counts requests in fixed windows: in each window,
+// we allow up to burst requests, and windows last burst/rate seconds, so
+// requests are allowed at the given rate on average.  If Redis is
+// unreachable, the limiter falls back to the given local limiter.
+type RedisLimiter struct {
+	client   *redisClient
+	name     string
+	burst    int
+	window   time.Duration
+	fallback RateLimiter
+}
+
+// NewRedisLimiter returns a new rate limiter that is backed by the Redis
+// server at the given address.  The name distinguishes the limiter from our
+// other limiters in Redis.
+func NewRedisLimiter(addr, name string, rate float64, burst int, fallback RateLimiter) *RedisLimiter {
+
+	return &RedisLimiter{
+		client:   newRedisClient(addr),
+		name:     name,
+		burst:    burst,
+		window:   time.Duration(float64(burst) / rate * float64(time.Second)),
+		fallback: fallback,
+	}
+}
+
+// Allow returns true if we can serve another request.
+func (rl *RedisLimiter) Allow() bool {
+
+	key := fmt.Sprintf("%sratelimit:%s:%d", RedisKeyPrefix, rl.name, time.Now().UnixNano()/int64(rl.window))
+	expiry := strconv.FormatInt(int64(2*rl.window/time.Millisecond), 10)
+	replies, err := rl.client.do([]string{"EVAL", incrementScript, "1", key, expiry})
+	if err != nil {
+		log.Printf("Falling back to local %s rate limiter: %s", rl.name, err)
+		return rl.fallback.Allow()
+	}
+	return replies[0].Int <= int64(rl.burst)
+}
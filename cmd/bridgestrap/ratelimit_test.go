@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+type countingLimiter struct {
+	calls int
+}
+
+func (c *countingLimiter) Allow() bool {
+	c.calls++
+	return true
+}
+
+func TestRedisLimiter(t *testing.T) {
+
+	r := newFakeRedis(t)
+	defer r.ln.Close()
+
+	fallback := &countingLimiter{}
+	// A long window makes sure that our requests all end up in the same
+	// window.
+	rl := NewRedisLimiter(r.ln.Addr().String(), "test", 0.001, 3, fallback)
+	for i := 0; i < 3; i++ {
+		if !rl.Allow() {
+			t.Errorf("Rejected request %d within burst.", i)
+		}
+	}
+	if rl.Allow() {
+		t.Errorf("Allowed request beyond burst.")
+	}
+	if fallback.calls != 0 {
+		t.Errorf("Used fallback limiter even though Redis is reachable.")
+	}
+
+	// A second limiter with the same name must share the first one's limit.
+	other := NewRedisLimiter(r.ln.Addr().String(), "test", 0.001, 3, fallback)
+	if other.Allow() {
+		t.Errorf("Second limiter ignored shared limit.")
+	}
+}
+
+func TestRedisLimiterFallback(t *testing.T) {
+
+	// Find an address that nobody listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	fallback := &countingLimiter{}
+	rl := NewRedisLimiter(addr, "test", 1, 5, fallback)
+	if !rl.Allow() {
+		t.Errorf("Fallback limiter's decision was ignored.")
+	}
+	if fallback.calls != 1 {
+		t.Errorf("Did not use fallback limiter even though Redis is unreachable.")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// RdsysInterval determines how often we fetch bridges from rdsys.
+	// Between fetches, we re-test bridges before their results expire,
+	// like our subscriptions.
+	RdsysInterval = 10 * time.Minute
+	// RdsysTimeout is the time that we give rdsys to respond to a request.
+	RdsysTimeout = time.Minute
+	// RdsysClient is the client name of the tests that we run for rdsys.
+	RdsysClient = "rdsys"
+	// RdsysResourcesPath is the path of rdsys's backend endpoint that
+	// hands out bridge resources.
+	RdsysResourcesPath = "/resources"
+	// RdsysResultsPath is the path of rdsys's backend endpoint that accepts
+	// our test results.
+	RdsysResultsPath = "/bridgestrap-results"
+)
+
+// rdsys is nil unless we pull bridges from an rdsys backend.
+var rdsys *RdsysBackend
+
+// RdsysConfig represents our rdsys configuration file.
+type RdsysConfig struct {
+	// URL is the base URL of rdsys's backend, e.g.,
+	// "https://rdsys.example.org".
+	URL string `json:"url"`
+	// Token is the API token that we use to authenticate to rdsys.
+	Token string `json:"token"`
+	// ResourceTypes are the types of bridge resources that we test, e.g.,
+	// "obfs4".  We test all of them if it's empty.
+	ResourceTypes []string `json:"resource_types,omitempty"`
+}
+
+// rdsysRequest is our request for bridge resources, in the format of rdsys's
+// distributors.
+type rdsysRequest struct {
+	RequestOrigin string   `json:"request_origin"`
+	ResourceTypes []string `json:"resource_types"`
+}
+
+// rdsysResource is a bridge resource as rdsys hands it out.
+type rdsysResource struct {
+	Type        string            `json:"type"`
+	Address     string            `json:"address"`
+	Port        int               `json:"port"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	Params      map[string]string `json:"params,omitempty"`
+}
+
+// BridgeLine turns the resource into a bridge line.
+func (r *rdsysResource) BridgeLine() string {
+
+	fields := []string{}
+	if r.Type != "" && !strings.EqualFold(r.Type, bridgeline.VanillaTransport) {
+		fields = append(fields, r.Type)
+	}
+	fields = append(fields, net.JoinHostPort(r.Address, strconv.Itoa(r.Port)))
+	if r.Fingerprint != "" {
+		fields = append(fields, r.Fingerprint)
+	}
+	keys := []string{}
+	for key := range r.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, key+"="+r.Params[key])
+	}
+	return strings.Join(fields, " ")
+}
+
+// RdsysBackend turns bridgestrap into a self-driving tester for rdsys: instead
+// of waiting for rdsys to ask us about bridges, we periodically pull rdsys's
+// bridges, test the ones whose results are missing or about to expire, and
+// push the results back to rdsys.
+type RdsysBackend struct {
+	config *RdsysConfig
+	client *http.Client
+}
+
+// LoadRdsysConfig reads the given JSON rdsys configuration file and returns
+// the rdsys backend that it describes.
+func LoadRdsysConfig(filename string) (*RdsysBackend, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &RdsysConfig{}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+	if config.URL == "" || config.Token == "" {
+		return nil, errors.New("rdsys needs a URL and a token")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	return &RdsysBackend{
+		config: config,
+		client: &http.Client{Timeout: RdsysTimeout},
+	}, nil
+}
+
+// do sends the given JSON body to the given endpoint of rdsys, authenticated
+// with our token, and returns rdsys's response.  The caller must close the
+// response's body.
+func (b *RdsysBackend) do(method, path string, body interface{}) (*http.Response, error) {
+
+	content, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, b.config.URL+path, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+b.config.Token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("rdsys responded with status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// count increments our rdsys metric for the given request type and error.
+func (b *RdsysBackend) count(reqType string, err error) {
+
+	status := "ok"
+	if err != nil {
+		status = "failed"
+	}
+	metrics.RdsysRequests.With(prometheus.Labels{"type": reqType, "status": status}).Inc()
+}
+
+// Fetch returns the canonical bridge lines of the bridge resources that rdsys
+// currently has.  We skip resources that don't make valid bridge lines.
+func (b *RdsysBackend) Fetch() ([]string, error) {
+
+	resp, err := b.do("GET", RdsysResourcesPath, &rdsysRequest{
+		RequestOrigin: "bridgestrap",
+		ResourceTypes: b.config.ResourceTypes,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	resources := []*rdsysResource{}
+	if err := json.NewDecoder(resp.Body).Decode(&resources); err != nil {
+		return nil, err
+	}
+	bridgeLines := []string{}
+	for _, r := range resources {
+		bridgeLine := r.BridgeLine()
+		if err := bridgeline.Validate(bridgeLine); err != nil {
+			log.Printf("Skipping invalid resource of type %q from rdsys: %s", r.Type, err)
+			continue
+		}
+		bridgeLines = append(bridgeLines, bridgeline.Canonicalize(bridgeLine))
+	}
+	return bridgeLines, nil
+}
+
+// Push sends our cached results of the given bridge lines to rdsys, in the
+// format of our responses to test requests, which rdsys already understands.
+// Bridge lines that aren't in our cache are left out.
+func (b *RdsysBackend) Push(bridgeLines []string) error {
+
+	result := newTestResult()
+	for _, bridgeLine := range bridgeLines {
+		if entry := cache.Peek(bridgeLine); entry != nil {
+			result.Bridges[bridgeLine] = cachedBridgeTest(entry)
+		}
+	}
+	resp, err := b.do("POST", RdsysResultsPath, result)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// sync fetches rdsys's bridges, re-tests the ones that are due, and pushes
+// our results back to rdsys.
+func (b *RdsysBackend) sync(shutdown chan bool) {
+
+	bridgeLines, err := b.Fetch()
+	b.count("fetch", err)
+	if err != nil {
+		log.Printf("Failed to fetch bridges from rdsys: %s", err)
+		return
+	}
+	due := dueBridgeLines(cache, bridgeLines, time.Now().UTC())
+	log.Printf("Fetched %d bridge(s) from rdsys, %d of which are due for a test.", len(bridgeLines), len(due))
+	retest(due, RdsysClient, false, shutdown)
+
+	err = b.Push(bridgeLines)
+	b.count("push", err)
+	if err != nil {
+		log.Printf("Failed to push results to rdsys: %s", err)
+	}
+}
+
+// Run syncs with rdsys every RdsysInterval, until the given channel is
+// closed.  If we share our work with other instances, only the leader syncs.
+func (b *RdsysBackend) Run(shutdown chan bool) {
+
+	ticker := time.NewTicker(RdsysInterval)
+	defer ticker.Stop()
+	for {
+		if isLeader() {
+			b.sync(shutdown)
+		} else {
+			log.Printf("Not syncing with rdsys because we're not the leader.")
+		}
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestRdsysResourceBridgeLine(t *testing.T) {
+
+	for r, expected := range map[*rdsysResource]string{
+		&rdsysResource{Type: "vanilla", Address: "1.2.3.4", Port: 443, Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567"}: "1.2.3.4:443 0123456789ABCDEF0123456789ABCDEF01234567",
+		&rdsysResource{Type: "obfs4", Address: "::1", Port: 80, Params: map[string]string{"iat-mode": "0", "cert": "foo"}}:      "obfs4 [::1]:80 cert=foo iat-mode=0",
+	} {
+		if bridgeLine := r.BridgeLine(); bridgeLine != expected {
+			t.Errorf("Expected bridge line %q but got %q.", expected, bridgeLine)
+		}
+	}
+}
+
+func TestLoadRdsysConfig(t *testing.T) {
+
+	tmpFh, err := ioutil.TempFile(os.TempDir(), "rdsys-")
+	if err != nil {
+		t.Fatalf("Could not create temporary file for test: %s", err)
+	}
+	defer os.Remove(tmpFh.Name())
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"url": "https://rdsys.example/", "token": "secret"}`), 0600)
+	b, err := LoadRdsysConfig(tmpFh.Name())
+	if err != nil {
+		t.Fatalf("Failed to load rdsys configuration: %s", err)
+	}
+	if b.config.URL != "https://rdsys.example" || b.config.Token != "secret" {
+		t.Errorf("Configuration was not loaded correctly: %+v", b.config)
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"url": "https://rdsys.example"}`), 0600)
+	if _, err := LoadRdsysConfig(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject configuration without token.")
+	}
+}
+
+func TestRdsysSync(t *testing.T) {
+
+	pushed := make(chan *tester.TestResult, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case RdsysResourcesPath:
+			req := &rdsysRequest{}
+			if err := json.NewDecoder(r.Body).Decode(req); err != nil || req.ResourceTypes[0] != "obfs4" {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`[
+				{"type": "obfs4", "address": "1.1.1.1", "port": 1, "fingerprint": "0123456789ABCDEF0123456789ABCDEF01234567", "params": {"cert": "foo", "iat-mode": "0"}},
+				{"type": "obfs4", "address": "bogus", "port": 2}
+			]`))
+		case RdsysResultsPath:
+			result := tester.NewTestResult()
+			json.NewDecoder(r.Body).Decode(result)
+			pushed <- result
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// We tested the bridge recently, so it's not due for a test.
+	bridgeLine := "obfs4 1.1.1.1:1 0123456789ABCDEF0123456789ABCDEF01234567 cert=foo iat-mode=0"
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	cache.AddResult(bridgeLine, errors.New("connection refused"), "CONNECTREFUSED", time.Now().UTC(), nil)
+
+	b := &RdsysBackend{
+		config: &RdsysConfig{URL: server.URL, Token: "secret", ResourceTypes: []string{"obfs4"}},
+		client: server.Client(),
+	}
+	bridgeLines, err := b.Fetch()
+	if err != nil {
+		t.Fatalf("Failed to fetch bridges: %s", err)
+	}
+	if len(bridgeLines) != 1 || bridgeLines[0] != bridgeLine {
+		t.Errorf("Unexpected bridge lines: %v", bridgeLines)
+	}
+
+	b.sync(make(chan bool))
+	result := <-pushed
+	if bridgeTest := result.Bridges[bridgeLine]; bridgeTest == nil || bridgeTest.ErrorCode != "CONNECTREFUSED" {
+		t.Errorf("Unexpected result pushed to rdsys: %+v", result.Bridges)
+	}
+
+	b.config.Token = "bogus"
+	if _, err := b.Fetch(); err == nil {
+		t.Errorf("Failed to return error for rejected request.")
+	}
+}
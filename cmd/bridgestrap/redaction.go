@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// ChannelAPI covers the test results that we send to API clients,
+	// including our API console.
+	ChannelAPI = "api"
+	// ChannelCacheListing covers our cache listing Web page.
+	ChannelCacheListing = "cache-listing"
+	// ChannelLogs covers our log messages.
+	ChannelLogs = "logs"
+	// ChannelHistory covers the past test results that we serve at
+	// /bridge-history.
+	ChannelHistory = "history"
+	// ChannelBridgePage covers our public bridge health pages at /b/.
+	ChannelBridgePage = "bridge-page"
+
+	// FieldBridgeLine is a bridge line as it was submitted to us.
+	FieldBridgeLine = "bridge_line"
+	// FieldError is the detailed error message of a dysfunctional bridge.
+	FieldError = "error"
+	// FieldErrorCode is the machine-readable reason why a bridge failed.
+	FieldErrorCode = "error_code"
+	// FieldStages contains the results of our test pipeline's stages.
+	FieldStages = "stages"
+	// FieldDescriptor describes a functional bridge's descriptor.
+	FieldDescriptor = "descriptor"
+	// FieldObservedFingerprint is the fingerprint of the bridge that Tor
+	// connected to.
+	FieldObservedFingerprint = "observed_fingerprint"
+	// FieldCircuit describes the circuit that we built through a bridge.
+	FieldCircuit = "circuit"
+	// FieldLocation is the country and autonomous system of a bridge's
+	// address.
+	FieldLocation = "location"
+
+	// RedactedError replaces error messages that our policy hides.
+	RedactedError = "redacted"
+)
+
+// redactableFields maps each output channel to the fields that a redaction
+// policy may hide in it.  Exports and snapshots only ever contain hashed
+// identifiers and verdicts, and our metrics contain no per-bridge data, so
+// there's nothing to redact in them.
+var redactableFields = map[string][]string{
+	ChannelAPI:          {FieldError, FieldStages, FieldDescriptor, FieldObservedFingerprint, FieldCircuit, FieldLocation},
+	ChannelCacheListing: {FieldError},
+	ChannelLogs:         {FieldBridgeLine},
+	ChannelHistory:      {FieldError},
+	ChannelBridgePage:   {FieldErrorCode},
+}
+
+// redaction is our redaction policy.  By default, we hide nothing.
+var redaction = RedactionPolicy{}
+
+// RedactionPolicy maps output channels to the fields that we hide in them.
+type RedactionPolicy map[string]map[string]bool
+
+// LoadRedactionPolicy reads the given JSON file, which maps output channels
+// to the list of fields to hide in them, e.g.:
+//
+//	{"api": ["stages"], "logs": ["bridge_line"]}
+func LoadRedactionPolicy(filename string) (RedactionPolicy, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := make(map[string][]string)
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	return NewRedactionPolicy(config)
+}
+
+// NewRedactionPolicy turns the given map from output channels to fields into
+// a redaction policy.  Unknown channels and fields that can't be redacted in
+// their channel result in an error, so typos don't go unnoticed.
+func NewRedactionPolicy(config map[string][]string) (RedactionPolicy, error) {
+
+	p := make(RedactionPolicy)
+	for channel, fields := range config {
+		allowed, exists := redactableFields[channel]
+		if !exists {
+			return nil, fmt.Errorf("unknown output channel %q", channel)
+		}
+		p[channel] = make(map[string]bool)
+		for _, field := range fields {
+			if !containsString(allowed, field) {
+				return nil, fmt.Errorf("field %q can't be redacted in channel %q", field, channel)
+			}
+			p[channel][field] = true
+		}
+	}
+	return p, nil
+}
+
+// containsString returns true if the given slice contains the given string.
+func containsString(slice []string, s string) bool {
+
+	for _, e := range slice {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Hides returns true if our policy hides the given field in the given output
+// channel.
+func (p RedactionPolicy) Hides(channel, field string) bool {
+	return p[channel][field]
+}
+
+// Hide makes our policy hide the given field in the given output channel, in
+// addition to the fields that it already hides.
+func (p RedactionPolicy) Hide(channel, field string) {
+
+	if p[channel] == nil {
+		p[channel] = make(map[string]bool)
+	}
+	p[channel][field] = true
+}
+
+// RedactResult removes the fields that our policy hides in API responses
+// from the given test result, including its per-vantage results.
+func (p RedactionPolicy) RedactResult(result *tester.TestResult) {
+
+	for _, bridgeTest := range result.Bridges {
+		if p.Hides(ChannelAPI, FieldError) && bridgeTest.Error != "" {
+			bridgeTest.Error = RedactedError
+		}
+		if p.Hides(ChannelAPI, FieldStages) {
+			bridgeTest.Stages = nil
+		}
+		if p.Hides(ChannelAPI, FieldDescriptor) {
+			bridgeTest.Descriptor = nil
+		}
+		if p.Hides(ChannelAPI, FieldObservedFingerprint) {
+			bridgeTest.ObservedFingerprint = ""
+		}
+		if p.Hides(ChannelAPI, FieldCircuit) {
+			bridgeTest.Circuit = nil
+		}
+		if p.Hides(ChannelAPI, FieldLocation) {
+			bridgeTest.Country, bridgeTest.ASN = "", ""
+		}
+	}
+	if p.Hides(ChannelAPI, FieldError) {
+		for _, diagnostic := range result.Diagnostics {
+			diagnostic.Error = RedactedError
+		}
+	}
+	for _, vantageResult := range result.VantageResults {
+		p.RedactResult(vantageResult)
+	}
+}
+
+// LogBridgeLine returns a representation of the given bridge line that our
+// policy allows us to log: either the bridge line itself, or its hashed
+// identifier.
+func (p RedactionPolicy) LogBridgeLine(bridgeLine string) string {
+
+	if !p.Hides(ChannelLogs, FieldBridgeLine) {
+		return bridgeLine
+	}
+	if hasher == nil {
+		return "[redacted bridge line]"
+	}
+	id, err := hasher.Hash(bridgeLine)
+	if err != nil {
+		return "[redacted bridge line]"
+	}
+	return "bridge " + id
+}
+
+// apply makes our packages follow the policy.
+func (p RedactionPolicy) apply() {
+	tester.LogBridgeLine = p.LogBridgeLine
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestLoadRedactionPolicy(t *testing.T) {
+
+	tmpFh, err := ioutil.TempFile(os.TempDir(), "redaction-")
+	if err != nil {
+		t.Fatalf("Could not create temporary file for test: %s", err)
+	}
+	defer os.Remove(tmpFh.Name())
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"api": ["stages", "error"], "logs": ["bridge_line"]}`), 0600)
+	p, err := LoadRedactionPolicy(tmpFh.Name())
+	if err != nil {
+		t.Fatalf("Failed to load redaction policy: %s", err)
+	}
+	if !p.Hides(ChannelAPI, FieldStages) || !p.Hides(ChannelAPI, FieldError) || !p.Hides(ChannelLogs, FieldBridgeLine) {
+		t.Errorf("Redaction policy was not loaded correctly.")
+	}
+	if p.Hides(ChannelAPI, FieldDescriptor) || p.Hides(ChannelCacheListing, FieldError) {
+		t.Errorf("Redaction policy hides fields that it shouldn't.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"webhooks": ["error"]}`), 0600)
+	if _, err = LoadRedactionPolicy(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject unknown channel.")
+	}
+
+	// Bridge lines are the keys of our API results, so we can't hide them.
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"api": ["bridge_line"]}`), 0600)
+	if _, err = LoadRedactionPolicy(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject field that can't be redacted.")
+	}
+}
+
+func TestRedactResult(t *testing.T) {
+
+	newResult := func() *tester.TestResult {
+		r := tester.NewTestResult()
+		r.Bridges["1.2.3.4:1234"] = &tester.BridgeTest{
+			Error:               "connection refused",
+			Stages:              []*tester.StageResult{&tester.StageResult{Stage: tester.StageTCP}},
+			Descriptor:          &tester.Descriptor{Size: 1},
+			ObservedFingerprint: "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D",
+			Circuit:             &tester.CircuitTest{Built: true},
+			Country:             "de",
+			ASN:                 "AS3320",
+		}
+		r.VantageResults = map[string]*tester.TestResult{"de": tester.NewTestResult()}
+		r.VantageResults["de"].Bridges["1.2.3.4:1234"] = &tester.BridgeTest{Error: "connection refused"}
+		return r
+	}
+
+	// The default policy hides nothing.
+	r := newResult()
+	RedactionPolicy{}.RedactResult(r)
+	if b := r.Bridges["1.2.3.4:1234"]; b.Error != "connection refused" || b.Stages == nil || b.Descriptor == nil || b.ObservedFingerprint == "" || b.Circuit == nil || b.Country == "" {
+		t.Errorf("Default policy redacted result.")
+	}
+
+	p, _ := NewRedactionPolicy(map[string][]string{ChannelAPI: {FieldError, FieldStages, FieldDescriptor, FieldObservedFingerprint, FieldCircuit, FieldLocation}})
+	r = newResult()
+	p.RedactResult(r)
+	if b := r.Bridges["1.2.3.4:1234"]; b.Error != RedactedError || b.Stages != nil || b.Descriptor != nil || b.ObservedFingerprint != "" || b.Circuit != nil || b.Country != "" || b.ASN != "" {
+		t.Errorf("Failed to redact result.")
+	}
+	if r.VantageResults["de"].Bridges["1.2.3.4:1234"].Error != RedactedError {
+		t.Errorf("Failed to redact vantage result.")
+	}
+}
+
+func TestLogBridgeLine(t *testing.T) {
+
+	hasher = NewBridgeHasher([]byte("key"), nil)
+	defer func() { hasher = nil }()
+
+	bridgeLine := "obfs4 1.2.3.4:1234 cert=foo iat-mode=0"
+	if s := (RedactionPolicy{}).LogBridgeLine(bridgeLine); s != bridgeLine {
+		t.Errorf("Default policy redacted bridge line in logs.")
+	}
+
+	p, _ := NewRedactionPolicy(map[string][]string{ChannelLogs: {FieldBridgeLine}})
+	s := p.LogBridgeLine(bridgeLine)
+	if strings.Contains(s, "1.2.3.4") || !strings.Contains(s, hasher.HashAddrPort("1.2.3.4:1234")) {
+		t.Errorf("Failed to replace bridge line with hashed identifier: %s", s)
+	}
+
+	// Our address retention period makes us hide bridge lines in our logs,
+	// regardless of the operator's policy.
+	p = RedactionPolicy{}
+	p.Hide(ChannelLogs, FieldBridgeLine)
+	if s := p.LogBridgeLine(bridgeLine); strings.Contains(s, "1.2.3.4") {
+		t.Errorf("Failed to hide bridge line in logs: %s", s)
+	}
+}
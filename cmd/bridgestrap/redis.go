@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RedisTimeout is the amount of time we give Redis to answer.  If Redis
+	// is slow, we would rather fall back to local decisions than make
+	// clients wait.
+	RedisTimeout = time.Second
+	// RedisKeyPrefix is the prefix of all keys that we create in Redis.
+	RedisKeyPrefix = "bridgestrap:"
+)
+
+// redisReply represents a reply from Redis.  Null replies, e.g., to a GET of
+// a key that doesn't exist, have Null set.
+type redisReply struct {
+	Str  string
+	Int  int64
+	Null bool
+}
+
+// redisClient is a minimal Redis client that speaks just enough of the Redis
+// protocol for our rate limiters and our leader election.  It connects
+// lazily and reconnects after errors.
+type redisClient struct {
+	addr string
+	conn net.Conn
+	rd   *bufio.Reader
+	sync.Mutex
+}
+
+// newRedisClient returns a new client for the Redis server at the given
+// address.
+func newRedisClient(addr string) *redisClient {
+	return &redisClient{addr: addr}
+}
+
+// do sends the given commands in a single pipeline and returns their replies.
+// If anything goes wrong, we close our connection, so the next call starts
+// from a clean slate.
+func (c *redisClient) do(cmds ...[]string) ([]*redisReply, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	replies, err := c.doLocked(cmds)
+	if err != nil && c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return replies, err
+}
+
+func (c *redisClient) doLocked(cmds [][]string) ([]*redisReply, error) {
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, RedisTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+		c.rd = bufio.NewReader(conn)
+	}
+	c.conn.SetDeadline(time.Now().Add(RedisTimeout))
+
+	var b strings.Builder
+	for _, cmd := range cmds {
+		b.WriteString(encodeRedisCommand(cmd...))
+	}
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	replies := []*redisReply{}
+	for range cmds {
+		reply, err := readRedisReply(c.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// encodeRedisCommand encodes the given command and its arguments as an array
+// of bulk strings, as described in the Redis protocol specification:
+// <https://redis.io/topics/protocol>
+func encodeRedisCommand(args ...string) string {
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// readRedisReply reads a simple string, integer, or bulk string reply from
+// the given reader.  Error replies and other types result in an error.
+func readRedisReply(rd *bufio.Reader) (*redisReply, error) {
+
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("empty reply from Redis")
+	}
+
+	switch line[0] {
+	case '+':
+		return &redisReply{Str: line[1:]}, nil
+	case ':':
+		i, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &redisReply{Int: i}, nil
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return &redisReply{Null: true}, nil
+		}
+		// Read the string and its trailing CRLF.
+		buf := make([]byte, length+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return &redisReply{Str: string(buf[:length])}, nil
+	case '-':
+		return nil, fmt.Errorf("Redis error: %s", line[1:])
+	default:
+		return nil, fmt.Errorf("unexpected reply from Redis: %q", line)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRedis implements just enough of Redis for our rate limiters and our
+// leader election.  Keys never expire.
+type fakeRedis struct {
+	ln     net.Listener
+	values map[string]string
+	l      sync.Mutex
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	r := &fakeRedis{ln: ln, values: make(map[string]string)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		r.l.Lock()
+		conn.Write([]byte(r.handle(args)))
+		r.l.Unlock()
+	}
+}
+
+// handle executes the given command and returns the encoded reply.
+func (r *fakeRedis) handle(args []string) string {
+
+	switch strings.ToUpper(args[0]) {
+	case "INCR":
+		i, _ := strconv.ParseInt(r.values[args[1]], 10, 64)
+		r.values[args[1]] = strconv.FormatInt(i+1, 10)
+		return ":" + r.values[args[1]] + "\r\n"
+	case "SET":
+		// We only support SET key value NX PX ttl.
+		if _, exists := r.values[args[1]]; exists {
+			return "$-1\r\n"
+		}
+		r.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "PTTL":
+		return ":-1\r\n"
+	case "EVAL":
+		switch args[1] {
+		case incrementScript:
+			return r.handle([]string{"INCR", args[3]})
+		case reserveQuotaScript:
+			used, _ := strconv.Atoi(r.values[args[3]])
+			n, _ := strconv.Atoi(args[4])
+			limit, _ := strconv.Atoi(args[5])
+			if used+n > limit {
+				return ":" + strconv.Itoa(-1-used) + "\r\n"
+			}
+			r.values[args[3]] = strconv.Itoa(used + n)
+			return ":" + r.values[args[3]] + "\r\n"
+		case refundQuotaScript:
+			used, _ := strconv.Atoi(r.values[args[3]])
+			n, _ := strconv.Atoi(args[4])
+			if used -= n; used < 0 {
+				used = 0
+			}
+			r.values[args[3]] = strconv.Itoa(used)
+			return ":" + r.values[args[3]] + "\r\n"
+		}
+		// Otherwise, we only support our lease scripts, which do nothing
+		// unless the caller holds the lease.
+		key, id := args[3], args[4]
+		if r.values[key] != id {
+			return ":0\r\n"
+		}
+		if args[1] == releaseLeaseScript {
+			delete(r.values, key)
+		}
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// readCommand reads an array of bulk strings.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for i := 0; i < n; i++ {
+		// Skip the length of the bulk string.
+		if _, err := rd.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimRight(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func TestEncodeRedisCommand(t *testing.T) {
+
+	expected := "*2\r\n$4\r\nINCR\r\n$3\r\nfoo\r\n"
+	if cmd := encodeRedisCommand("INCR", "foo"); cmd != expected {
+		t.Errorf("Expected %q but got %q.", expected, cmd)
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+
+	rd := bufio.NewReader(strings.NewReader(":42\r\n+OK\r\n$5\r\nhello\r\n$-1\r\n-ERR wrong type\r\n*1\r\n"))
+	if reply, err := readRedisReply(rd); err != nil || reply.Int != 42 {
+		t.Errorf("Failed to read integer reply: %+v (%v)", reply, err)
+	}
+	if reply, err := readRedisReply(rd); err != nil || reply.Str != "OK" {
+		t.Errorf("Failed to read simple string reply: %+v (%v)", reply, err)
+	}
+	if reply, err := readRedisReply(rd); err != nil || reply.Str != "hello" {
+		t.Errorf("Failed to read bulk string reply: %+v (%v)", reply, err)
+	}
+	if reply, err := readRedisReply(rd); err != nil || !reply.Null {
+		t.Errorf("Failed to read null reply: %+v (%v)", reply, err)
+	}
+	if _, err := readRedisReply(rd); err == nil {
+		t.Errorf("Failed to turn error reply into error.")
+	}
+	if _, err := readRedisReply(rd); err == nil {
+		t.Errorf("Failed to reject unsupported reply.")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// SyncVersion is the format version of the cache dumps that primaries
+	// send to their replicas.
+	SyncVersion = 1
+	// SyncPath is the path of the primary's sync endpoint.
+	SyncPath = "/sync/cache"
+	// ReplicaStaleSyncs is the number of sync intervals after which we
+	// consider a replica's results stale.
+	ReplicaStaleSyncs = 3
+	// ReplicaError is the error of bridges that a replica can't answer.
+	ReplicaError = "bridge not in cache of read-only replica"
+	// ReplicaCode is the error code of bridges that a replica can't answer.
+	ReplicaCode = "NOT_IN_REPLICA"
+)
+
+// SyncDump represents the cache entries that a primary sends to its
+// replicas.  Entries are keyed like our cache's entries, i.e., by the hash of
+// their bridge line, so bridge lines never leave the primary.  The only
+// exception is our job state, i.e., our subscriptions and the jobs in our job
+// queue, which we only send to warm standbys that authenticate with an admin
+// token.  Warm standbys that hand back to their primary send it a SyncDump,
+// too.
+type SyncDump struct {
+	Version       int                         `json:"version"`
+	Published     time.Time                   `json:"published"`
+	Entries       map[string]*testcache.Entry `json:"entries"`
+	Subscriptions map[string][]string         `json:"subscriptions,omitempty"`
+	Jobs          []*SyncedJob                `json:"jobs,omitempty"`
+}
+
+// Replica periodically replaces a cache with the cache of a primary
+// bridgestrap instance.  Replicas never test bridges; they answer requests
+// from their cache only, which makes them cheap read endpoints that can sit
+// close to their clients.
+type Replica struct {
+	// Primary is the base URL of the primary, e.g., "https://bridges.torproject.org".
+	Primary  string
+	cache    *testcache.Cache
+	token    string
+	interval time.Duration
+	client   *http.Client
+	lastSync time.Time
+	// jobs and queue, if set, receive the primary's subscriptions and the
+	// jobs in its job queue on every sync.  Only warm standbys sync job
+	// state.
+	jobs  *SubscriptionList
+	queue *JobQueue
+	sync.Mutex
+}
+
+// NewReplica returns a new replica that syncs the given cache with the given
+// primary every given interval, authenticating with the given token.
+func NewReplica(primary, token string, interval time.Duration, c *testcache.Cache) *Replica {
+
+	return &Replica{
+		Primary:  strings.TrimSuffix(primary, "/"),
+		cache:    c,
+		token:    token,
+		interval: interval,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+// LoadReplicaToken reads the API token that a replica uses to authenticate
+// to its primary from the given file.
+func LoadReplicaToken(filename string) (string, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("replica token file %q is empty", filename)
+	}
+	return token, nil
+}
+
+// Sync fetches the primary's cache and replaces our cache with it.
+func (r *Replica) Sync() error {
+
+	url := r.Primary + SyncPath
+	if r.jobs != nil || r.queue != nil {
+		url += "?jobs=true"
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.token)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded with status code %d", resp.StatusCode)
+	}
+
+	dump := &SyncDump{}
+	if err := json.NewDecoder(resp.Body).Decode(dump); err != nil {
+		return err
+	}
+	if dump.Version != SyncVersion {
+		return fmt.Errorf("primary sent sync version %d but we only understand %d", dump.Version, SyncVersion)
+	}
+	if dump.Entries == nil {
+		dump.Entries = make(map[string]*testcache.Entry)
+	}
+	r.cache.Load(dump.Entries)
+	if r.jobs != nil && dump.Subscriptions != nil {
+		if err := r.jobs.Replace(dump.Subscriptions); err != nil {
+			return fmt.Errorf("failed to sync subscriptions: %v", err)
+		}
+	}
+	if r.queue != nil {
+		r.queue.Adopt(dump.Jobs)
+	}
+
+	r.Lock()
+	r.lastSync = time.Now().UTC()
+	r.Unlock()
+	metrics.ReplicaLastSync.Set(float64(time.Now().Unix()))
+	log.Printf("Synced %d cache entries from primary.", len(dump.Entries))
+
+	return nil
+}
+
+// Run syncs with our primary right away, and then every sync interval, until
+// the given channel is closed.
+func (r *Replica) Run(shutdown chan bool) {
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Sync(); err != nil {
+			log.Printf("Failed to sync with primary: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// Status tells clients how fresh our results are.  Our results are stale if
+// we never synced, or if we failed to sync for ReplicaStaleSyncs intervals.
+func (r *Replica) Status() *tester.ReplicaStatus {
+
+	r.Lock()
+	defer r.Unlock()
+
+	return &tester.ReplicaStatus{
+		LastSync: r.lastSync,
+		Stale:    time.Since(r.lastSync) > ReplicaStaleSyncs*r.interval,
+	}
+}
+
+// answerFromReplica marks the given bridge lines, which weren't in our cache,
+// as inconclusive because replicas don't test bridges.
+func answerFromReplica(result *tester.TestResult, bridgeLines []string) {
+
+	for _, bridgeLine := range bridgeLines {
+		result.Bridges[bridgeLine] = &tester.BridgeTest{
+			Verdict:    tester.VerdictInconclusive,
+			LastTested: time.Now().UTC(),
+			Error:      ReplicaError,
+			ErrorCode:  ReplicaCode,
+		}
+	}
+}
+
+// getReplica determines the client that sent the given API request and
+// returns an error if the client isn't allowed to sync our cache.
+func getReplica(r *http.Request) (*Token, error) {
+
+	client, err := getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Replica && !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		return nil, errors.New("token is not allowed to sync our cache")
+	}
+	return client, nil
+}
+
+// SyncCache responds with a dump of our unexpired cache entries, which our
+// replicas fetch periodically.  If the client asks for our job state, we also
+// include our subscriptions, but only for admin tokens because they contain
+// bridge lines.
+func SyncCache(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "sync", "status": reqStatus}).Inc()
+	}()
+
+	client, err := getReplica(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	withJobs := r.URL.Query().Get("jobs") == "true"
+	if withJobs && !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		http.Error(w, "only admin tokens may sync our job state", http.StatusForbidden)
+		return
+	}
+	reqStatus = "valid"
+
+	dump := &SyncDump{
+		Version:   SyncVersion,
+		Published: time.Now().UTC(),
+		Entries:   cache.Export(),
+	}
+	if withJobs && subscriptions != nil {
+		dump.Subscriptions = subscriptions.export()
+	}
+	if withJobs && jobs != nil {
+		dump.Jobs = jobs.export()
+	}
+	jsonResult, err := json.Marshal(dump)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal cache", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %s synced our cache.", client.Name)
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// HandBack accepts the cache entries and job state of a warm standby that
+// acted as primary in our stead and now hands back to us.  We merge the
+// standby's results into our cache, so we don't lose the results that it
+// collected, take over its subscriptions, which its clients may have changed
+// in the meantime, and adopt its jobs, so workers keep their jobs.  Only admin
+// tokens may hand back.
+func HandBack(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "handback", "status": reqStatus}).Inc()
+	}()
+
+	client, err := getAdmin(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	dump := &SyncDump{}
+	if err := json.NewDecoder(r.Body).Decode(dump); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if dump.Version != SyncVersion {
+		http.Error(w, fmt.Sprintf("sync version %d isn't %d", dump.Version, SyncVersion), http.StatusBadRequest)
+		return
+	}
+	reqStatus = "valid"
+
+	merged := cache.Merge(dump.Entries)
+	if subscriptions != nil && dump.Subscriptions != nil {
+		if err := subscriptions.Replace(dump.Subscriptions); err != nil {
+			log.Printf("Failed to take over subscriptions from standby: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if jobs != nil {
+		jobs.Adopt(dump.Jobs)
+	}
+	log.Printf("Client %s handed back %d new cache entries and %d jobs.", client.Name, merged, len(dump.Jobs))
+	w.WriteHeader(http.StatusNoContent)
+}
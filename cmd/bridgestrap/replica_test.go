@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestReplicaSync(t *testing.T) {
+
+	// Our primary has two cache entries, one of which expired.
+	primaryCache := testcache.New(time.Hour)
+	primaryCache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	primaryCache.AddEntry("2.2.2.2:2", errors.New("error"), time.Now().UTC().Add(-2*time.Hour))
+	tokens = map[string]*Token{
+		"replica": &Token{Token: "replica", Name: "replica", Weight: 1, Replica: true},
+		"user":    &Token{Token: "user", Name: "rdsys", Weight: 1},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != SyncPath {
+			http.NotFound(w, r)
+			return
+		}
+		cache = primaryCache
+		SyncCache(w, r)
+	}))
+	defer primary.Close()
+
+	replicaCache := testcache.New(time.Hour)
+	r := NewReplica(primary.URL+"/", "user", time.Minute, replicaCache)
+	if err := r.Sync(); err == nil {
+		t.Errorf("Synced with token that lacks permission.")
+	}
+	if !r.Status().Stale {
+		t.Errorf("Replica that never synced isn't stale.")
+	}
+
+	r = NewReplica(primary.URL, "replica", time.Minute, replicaCache)
+	if err := r.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %s", err)
+	}
+	defer func() { cache = nil }()
+	if n, _ := replicaCache.Size(); n != 1 {
+		t.Errorf("Expected 1 synced entry but got %d.", n)
+	}
+	if replicaCache.IsCached("1.1.1.1:1") == nil {
+		t.Errorf("Synced entry isn't in replica's cache.")
+	}
+	if status := r.Status(); status.Stale || status.LastSync.IsZero() {
+		t.Errorf("Unexpected replica status: %+v", status)
+	}
+}
+
+func TestTestBridgeLinesReplica(t *testing.T) {
+
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	setRole(nil, nil, NewReplica("https://primary.example", "token", time.Minute, cache))
+	defer setRole(nil, nil, nil)
+
+	result := testBridgeLines(&tester.TestRequest{BridgeLines: []string{"1.1.1.1:1", "2.2.2.2:2"}}, "api", nil)
+	if !result.Bridges["1.1.1.1:1"].Functional {
+		t.Errorf("Failed to answer bridge from replica's cache.")
+	}
+	bridgeTest := result.Bridges["2.2.2.2:2"]
+	if bridgeTest.Verdict != tester.VerdictInconclusive || bridgeTest.Error != ReplicaError || bridgeTest.ErrorCode != ReplicaCode {
+		t.Errorf("Unexpected result for uncached bridge: %+v", bridgeTest)
+	}
+	if result.Replica == nil || !result.Replica.Stale {
+		t.Errorf("Result lacks staleness indicator.")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// resultContextResponse represents our response to requests for the context
+// of a bridge's published result.
+type resultContextResponse struct {
+	HashedID   string             `json:"hashed_id"`
+	Verdict    string             `json:"verdict"`
+	LastTested time.Time          `json:"last_tested"`
+	Context    *testcache.Context `json:"context,omitempty"`
+}
+
+// ResultContext responds with the context in which we tested the bridge with
+// the given hashed identifier, which lets researchers reproduce the
+// measurement behind the bridge's published result: the versions of
+// bridgestrap and Tor, the consensus that Tor used, our pluggable transport
+// configuration, the stages of our test pipeline, and our timeouts.  Like our
+// badges, this never triggers a bridge test.
+func ResultContext(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "result-context", "status": reqStatus}).Inc()
+	}()
+
+	if !badgeLimiter.Allow() {
+		abuseLog.Record(r, AbuseRateLimit, AnonymousClient)
+		http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+	reqStatus = "valid"
+
+	hashedID := mux.Vars(r)["id"]
+	entry := cache.FindByHashedID(hashedID)
+	if entry == nil {
+		http.Error(w, "no result for the given bridge", http.StatusNotFound)
+		return
+	}
+
+	verdict := tester.VerdictFunctional
+	if entry.Error != "" {
+		verdict = tester.VerdictDysfunctional
+	}
+	jsonResult, err := json.Marshal(&resultContextResponse{
+		HashedID:   strings.ToUpper(hashedID),
+		Verdict:    verdict,
+		LastTested: entry.Time,
+		Context:    entry.Context,
+	})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal result context", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// resultContext returns the context in which we tested the given bridge with
+// the given stages of our test pipeline, for our cache.
+func resultContext(bridgeTest *tester.BridgeTest, stages []string) *testcache.Context {
+
+	ctx := &testcache.Context{
+		BridgestrapVersion: BridgestrapVersion,
+		Stages:             stages,
+	}
+	if c := bridgeTest.Context; c != nil {
+		ctx.Instance = c.Instance
+		ctx.Vantage = c.Vantage
+		ctx.TorVersion = c.TorVersion
+		ctx.ConsensusValidAfter = c.ConsensusValidAfter
+		ctx.PluginsHash = c.PluginsHash
+		ctx.TestTimeout = c.TestTimeout
+		ctx.ClockSkew = c.ClockSkew
+	}
+	return ctx
+}
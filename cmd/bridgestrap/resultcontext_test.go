@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestResultContext(t *testing.T) {
+
+	cache = testcache.New(time.Hour)
+	defer func() { cache, hasher = nil, nil }()
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	cache.SetHasher(hasher)
+
+	bridgeTest := &tester.BridgeTest{
+		Error:      "bridge is on fire",
+		ErrorCode:  tester.ErrorCodeDescriptorTimeout,
+		LastTested: time.Now().UTC(),
+		Context:    &tester.TestContext{Instance: "tor0", TorVersion: "0.4.8.10", TestTimeout: 60},
+	}
+	recordResult("1.2.3.4:1234", bridgeTest, tester.DefaultStages)
+	if cached := cachedBridgeTest(cache.IsCached("1.2.3.4:1234")); cached.ErrorCode != tester.ErrorCodeDescriptorTimeout {
+		t.Errorf("Cache lost error code: %+v", cached)
+	}
+
+	get := func(hashedID string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/results/"+hashedID+"/context", nil),
+			map[string]string{"id": hashedID})
+		w := httptest.NewRecorder()
+		ResultContext(w, r)
+		return w
+	}
+
+	w := get(hasher.HashAddrPort("1.2.3.4:1234"))
+	resp := &resultContextResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+		t.Fatalf("Failed to unmarshal response %q: %s", w.Body.String(), err)
+	}
+	if resp.Verdict != tester.VerdictDysfunctional || resp.Context == nil {
+		t.Fatalf("Unexpected response: %s", w.Body.String())
+	}
+	ctx := resp.Context
+	if ctx.BridgestrapVersion != BridgestrapVersion || ctx.TorVersion != "0.4.8.10" ||
+		ctx.Instance != "tor0" || ctx.TestTimeout != 60 || len(ctx.Stages) != len(tester.DefaultStages) {
+		t.Errorf("Unexpected context: %+v", ctx)
+	}
+
+	if w = get(hasher.HashAddrPort("5.6.7.8:5678")); w.Code != 404 {
+		t.Errorf("Expected 404 for unknown bridge but got %d.", w.Code)
+	}
+
+	// Entries that we cached before we kept track of contexts lack one.
+	cache.AddEntry("5.6.7.8:5678", errors.New("bridge is on fire"), time.Now().UTC())
+	w = get(hasher.HashAddrPort("5.6.7.8:5678"))
+	if resp = (&resultContextResponse{}); json.Unmarshal(w.Body.Bytes(), resp) != nil || resp.Context != nil {
+		t.Errorf("Unexpected response for entry without context: %s", w.Body.String())
+	}
+}
+
+func TestSatisfiesStages(t *testing.T) {
+
+	circuitStages := []string{tester.StageValidate, tester.StageTor, tester.StageCircuit}
+	shallow := &testcache.Entry{Context: &testcache.Context{Stages: tester.DefaultStages}}
+	deep := &testcache.Entry{Context: &testcache.Context{Stages: circuitStages}}
+	broken := &testcache.Entry{Error: "bridge is on fire", Context: shallow.Context}
+
+	if !satisfiesStages(shallow, tester.DefaultStages) || !satisfiesStages(&testcache.Entry{}, nil) {
+		t.Errorf("Cached result must answer requests for default stages.")
+	}
+	if satisfiesStages(shallow, circuitStages) || satisfiesStages(&testcache.Entry{}, circuitStages) {
+		t.Errorf("Functional bridge whose circuit we didn't test must not answer circuit requests.")
+	}
+	if !satisfiesStages(deep, circuitStages) || !satisfiesStages(broken, circuitStages) {
+		t.Errorf("Cached result must answer circuit requests.")
+	}
+}
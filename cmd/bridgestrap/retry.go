@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// DefaultRetries is the default number of times that we re-test a bridge that
+// failed with a transient error.
+const DefaultRetries = 1
+
+// RetryBackoff is how long we wait before we re-test bridges for the first
+// time.  We double the wait for each further attempt.
+var RetryBackoff = 5 * time.Second
+
+// maxRetries is the number of times that we re-test a bridge that failed with
+// a transient error before we declare it dysfunctional.
+var maxRetries = DefaultRetries
+
+// TransientFailures contains the error codes of failures that may well go
+// away if we test the bridge again, e.g., because of packet loss on our side.
+var TransientFailures = map[string]bool{
+	"TIMEOUT": true,
+	"IOERROR": true,
+}
+
+// isTransientFailure returns true if the given result is a failure that's
+// worth re-testing.
+func isTransientFailure(bridgeTest *tester.BridgeTest) bool {
+
+	return bridgeTest.Verdict == tester.VerdictDysfunctional && TransientFailures[bridgeTest.ErrorCode]
+}
+
+// testWithRetries tests the given bridge lines of the given request using the
+// given test function, e.g., testWithTor, and re-tests bridges that failed
+// with a transient error up to maxRetries times, with an exponential backoff.
+// The request's progress function only learns about a transient failure once
+// we ran out of retries.
+func testWithRetries(req *tester.TestRequest, bridgeLines []string,
+	test func(*tester.TestRequest, []string) *tester.TestResult) *tester.TestResult {
+
+	var result *tester.TestResult
+	retried := make(map[string]bool)
+	for attempt := 0; ; attempt++ {
+		final := attempt >= maxRetries
+		attemptReq := &tester.TestRequest{
+			Circuit:    req.Circuit,
+			Client:     req.Client,
+			Weight:     req.Weight,
+			Timeout:    req.Timeout,
+			Background: req.Background,
+			Progress: func(bridgeLine string, bridgeTest *tester.BridgeTest) {
+				if req.Progress != nil && (final || !isTransientFailure(bridgeTest)) {
+					req.Progress(bridgeLine, bridgeTest)
+				}
+			},
+		}
+		partialResult := test(attemptReq, bridgeLines)
+		if result == nil {
+			result = partialResult
+		} else {
+			for bridgeLine, bridgeTest := range partialResult.Bridges {
+				result.Bridges[bridgeLine] = bridgeTest
+			}
+			if result.Error == "" {
+				result.Error = partialResult.Error
+			}
+			result.Time += partialResult.Time
+		}
+
+		bridgeLines = []string{}
+		for bridgeLine, bridgeTest := range partialResult.Bridges {
+			if isTransientFailure(bridgeTest) {
+				bridgeLines = append(bridgeLines, bridgeLine)
+			}
+		}
+		if final || len(bridgeLines) == 0 {
+			break
+		}
+		log.Printf("Re-testing %d bridge line(s) that failed with a transient error.", len(bridgeLines))
+		for _, bridgeLine := range bridgeLines {
+			retried[bridgeLine] = true
+		}
+		time.Sleep(RetryBackoff << uint(attempt))
+	}
+
+	for bridgeLine := range retried {
+		metrics.Retries.With(prometheus.Labels{"verdict": result.Bridges[bridgeLine].Verdict}).Inc()
+	}
+	return result
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestTestWithRetries(t *testing.T) {
+
+	defer func(d time.Duration) { RetryBackoff = d }(RetryBackoff)
+	RetryBackoff = time.Millisecond
+
+	flaky, broken, fine := "1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3"
+	attempts := make(map[string]int)
+	test := func(req *tester.TestRequest, bridgeLines []string) *tester.TestResult {
+		result := tester.NewTestResult()
+		for _, bridgeLine := range bridgeLines {
+			attempts[bridgeLine]++
+			bridgeTest := &tester.BridgeTest{Verdict: tester.VerdictDysfunctional, ErrorCode: "TIMEOUT"}
+			if bridgeLine == fine || (bridgeLine == flaky && attempts[bridgeLine] > 1) {
+				bridgeTest = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+			}
+			result.Bridges[bridgeLine] = bridgeTest
+			req.Progress(bridgeLine, bridgeTest)
+		}
+		return result
+	}
+
+	reported := make(map[string]int)
+	req := &tester.TestRequest{Progress: func(bridgeLine string, bridgeTest *tester.BridgeTest) {
+		reported[bridgeLine]++
+	}}
+
+	maxRetries = 2
+	defer func() { maxRetries = DefaultRetries }()
+	result := testWithRetries(req, []string{flaky, broken, fine}, test)
+	if result.Bridges[flaky].Verdict != tester.VerdictFunctional {
+		t.Errorf("Flaky bridge isn't functional after retry: %+v", result.Bridges[flaky])
+	}
+	if result.Bridges[broken].Verdict != tester.VerdictDysfunctional {
+		t.Errorf("Broken bridge isn't dysfunctional after retries: %+v", result.Bridges[broken])
+	}
+	expected := map[string]int{flaky: 2, broken: 3, fine: 1}
+	for bridgeLine, n := range expected {
+		if attempts[bridgeLine] != n {
+			t.Errorf("Expected %d attempts for %s but got %d.", n, bridgeLine, attempts[bridgeLine])
+		}
+		// Clients learn about each bridge exactly once.
+		if reported[bridgeLine] != 1 {
+			t.Errorf("Reported %s %d times.", bridgeLine, reported[bridgeLine])
+		}
+	}
+
+	// We never re-test bridges if retries are disabled.
+	attempts = make(map[string]int)
+	maxRetries = 0
+	testWithRetries(req, []string{broken}, test)
+	if attempts[broken] != 1 {
+		t.Errorf("Re-tested bridge despite disabled retries.")
+	}
+}
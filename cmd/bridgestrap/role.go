@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// role holds the parts of our state that change when a warm standby takes
+// over from its primary: the Tor instances that we test bridges with, where we
+// test bridges from, and the primary that we sync with.  We never modify a
+// role once setRole published it, so handlers and background jobs can read it
+// while a standby takes over.
+type role struct {
+	pool    *tester.TorPool
+	origin  *tester.Origin
+	replica *Replica
+}
+
+// currentRole holds our current *role.
+var currentRole atomic.Value
+
+func init() {
+	currentRole.Store(&role{})
+}
+
+// setRole atomically replaces our Tor instances, our origin, and our primary,
+// so requests never see a mix of our old and new role.
+func setRole(pool *tester.TorPool, origin *tester.Origin, replica *Replica) {
+	currentRole.Store(&role{pool: pool, origin: origin, replica: replica})
+}
+
+// torPool returns our Tor instances.  It's nil if we're a read-only replica.
+func torPool() *tester.TorPool {
+	return currentRole.Load().(*role).pool
+}
+
+// testOrigin describes where we test bridges from.  It's nil if the operator
+// configured no origin, or if we don't test bridges.
+func testOrigin() *tester.Origin {
+	return currentRole.Load().(*role).origin
+}
+
+// replica returns the primary that we sync with.  It's nil unless we're a
+// read-only replica or a warm standby that hasn't taken over yet.
+func replica() *Replica {
+	return currentRole.Load().(*role).replica
+}
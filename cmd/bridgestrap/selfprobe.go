@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// SelfProbeError is the error of bridge lines that point at one of our
+	// own addresses.
+	SelfProbeError = "bridge line points at bridgestrap's own address"
+	// SelfProbeCode is the error code of bridge lines that point at one of
+	// our own addresses.
+	SelfProbeCode = "SELF_PROBE"
+)
+
+// ownAddrs contains the addresses that bridge lines must not point at.  It's
+// empty until main calls LoadOwnAddrs.
+var ownAddrs = NewOwnAddrs()
+
+// OwnAddrs is the set of IP addresses that belong to us: the addresses of our
+// network interfaces (public and private), and the public addresses that the
+// operator told us about, e.g., because we sit behind a NAT.  Bridge lines
+// that point at one of these addresses would make our Tor instances probe
+// bridgestrap's own host.  It's safe for concurrent use.
+type OwnAddrs struct {
+	addrs map[string]bool
+	sync.RWMutex
+}
+
+// NewOwnAddrs returns a new set that contains the given IP addresses.
+func NewOwnAddrs(addrs ...net.IP) *OwnAddrs {
+
+	o := &OwnAddrs{addrs: make(map[string]bool)}
+	for _, addr := range addrs {
+		o.addrs[addr.String()] = true
+	}
+	return o
+}
+
+// LoadOwnAddrs returns the addresses of our network interfaces, plus the
+// given comma-separated list of public IP addresses.
+func LoadOwnAddrs(publicAddrs string) (*OwnAddrs, error) {
+
+	addrs := []net.IP{}
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifaceAddr := range ifaceAddrs {
+		if ipNet, ok := ifaceAddr.(*net.IPNet); ok {
+			addrs = append(addrs, ipNet.IP)
+		}
+	}
+
+	for _, publicAddr := range strings.Split(publicAddrs, ",") {
+		publicAddr = strings.TrimSpace(publicAddr)
+		if publicAddr == "" {
+			continue
+		}
+		addr := net.ParseIP(publicAddr)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid IP address %q", publicAddr)
+		}
+		addrs = append(addrs, addr)
+	}
+
+	return NewOwnAddrs(addrs...), nil
+}
+
+// Len returns the number of addresses in our set.
+func (o *OwnAddrs) Len() int {
+
+	o.RLock()
+	defer o.RUnlock()
+
+	return len(o.addrs)
+}
+
+// Contains returns true if the given bridge line points at one of our
+// addresses.  Bridge lines whose address isn't an IP address never do.
+func (o *OwnAddrs) Contains(bridgeLine string) bool {
+
+	addrPort, err := bridgeline.AddrPort(bridgeLine)
+	if err != nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addrPort)
+	if err != nil {
+		return false
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		return false
+	}
+
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.addrs[addr.String()]
+}
+
+// checkSelfProbe returns a test result that rejects the given bridge line if
+// it points at one of our own addresses, and nil otherwise.  The source tells
+// us where the bridge line came from and is used for our logs and metrics.
+func checkSelfProbe(bridgeLine, source string) *tester.BridgeTest {
+
+	if !ownAddrs.Contains(bridgeLine) {
+		return nil
+	}
+	metrics.SelfProbes.With(prometheus.Labels{"source": source}).Inc()
+	if redaction.Hides(ChannelLogs, FieldBridgeLine) {
+		log.Printf("Rejecting bridge line from %s that points at our own address.", source)
+	} else {
+		log.Printf("Rejecting bridge line from %s that points at our own address: %s", source, bridgeLine)
+	}
+	return &tester.BridgeTest{
+		Functional: false,
+		Verdict:    tester.VerdictDysfunctional,
+		LastTested: time.Now().UTC(),
+		Error:      SelfProbeError,
+		ErrorCode:  SelfProbeCode,
+	}
+}
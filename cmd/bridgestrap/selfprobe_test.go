@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+func TestOwnAddrs(t *testing.T) {
+
+	o := NewOwnAddrs(net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1"))
+
+	for _, bridgeLine := range []string{
+		"1.2.3.4:1234",
+		"obfs4 1.2.3.4:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=foo iat-mode=0",
+		"[2001:db8::1]:443",
+		"[2001:db8:0::1]:443",
+	} {
+		if !o.Contains(bridgeLine) {
+			t.Errorf("Failed to detect self-probe %q.", bridgeLine)
+		}
+	}
+	for _, bridgeLine := range []string{
+		"1.2.3.5:1234",
+		"[2001:db8::2]:443",
+		"bogus",
+	} {
+		if o.Contains(bridgeLine) {
+			t.Errorf("Mistook %q for a self-probe.", bridgeLine)
+		}
+	}
+
+	if _, err := LoadOwnAddrs("1.2.3.4, bogus"); err == nil {
+		t.Errorf("Accepted invalid public address.")
+	}
+	o, err := LoadOwnAddrs("1.2.3.4")
+	if err != nil {
+		t.Fatalf("Failed to load own addresses: %s", err)
+	}
+	if !o.Contains("1.2.3.4:1234") || !o.Contains("127.0.0.1:1234") {
+		t.Errorf("Failed to include public or loopback address.")
+	}
+}
+
+func TestLookupSelfProbe(t *testing.T) {
+
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	ownAddrs = NewOwnAddrs(net.ParseIP("1.2.3.4"))
+	defer func() { ownAddrs = NewOwnAddrs() }()
+
+	result, remaining := lookupBridgeLines([]string{"1.2.3.4:1234", "2.2.2.2:2"}, "api", nil)
+	if len(remaining) != 1 || remaining[0] != "2.2.2.2:2" {
+		t.Errorf("Unexpected remaining bridge lines: %v", remaining)
+	}
+	bridgeTest := result.Bridges["1.2.3.4:1234"]
+	if bridgeTest == nil || bridgeTest.Functional || bridgeTest.ErrorCode != SelfProbeCode {
+		t.Errorf("Failed to reject self-probe: %+v", bridgeTest)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+const (
+	// SnapshotVersion is the format version of our snapshots.
+	SnapshotVersion = 1
+	// SnapshotTimeFormat determines the file names of our snapshots, which
+	// sort chronologically.
+	SnapshotTimeFormat = "2006-01-02-15-04-05"
+	// SignatureSuffix is the file name suffix of our detached signatures.
+	SignatureSuffix = ".sig"
+)
+
+// SnapshotName matches the file names of our snapshots and their signatures.
+var SnapshotName = regexp.MustCompile(`^[0-9]{4}(-[0-9]{2}){5}\.json(\.sig)?$`)
+
+// snapshotter is nil unless the operator enabled snapshots.
+var snapshotter *Snapshotter
+
+// SnapshotBridge represents a bridge in a snapshot.
+type SnapshotBridge struct {
+	HashedID   string    `json:"hashed_id"`
+	Transport  string    `json:"transport,omitempty"`
+	Functional bool      `json:"functional"`
+	LastTested time.Time `json:"last_tested"`
+}
+
+// Snapshot represents the aggregate test results that we publish for
+// researchers.  Bridges are identified by their hashed identifier.
+type Snapshot struct {
+	Version       int               `json:"version"`
+	Published     time.Time         `json:"published"`
+	NumBridges    int               `json:"num_bridges"`
+	NumFunctional int               `json:"num_functional"`
+	Bridges       []*SnapshotBridge `json:"bridges"`
+	// Filter is the filter that we applied to the snapshot, e.g.,
+	// "status=functional".  Filtered snapshots don't match their signature.
+	Filter string `json:"filter,omitempty"`
+}
+
+// Snapshotter periodically writes signed snapshots of our cache to a
+// directory.  Each snapshot is a JSON file whose name is its publication
+// time, accompanied by a detached, base64-encoded Ed25519 signature over the
+// file's content.
+type Snapshotter struct {
+	Dir string
+	key ed25519.PrivateKey
+}
+
+// LoadSigningKey reads a base64-encoded Ed25519 private key seed from the
+// given file.  If the file doesn't exist, the function generates a new key
+// and writes it to the file, readable only by the current user.
+func LoadSigningKey(filename string) (ed25519.PrivateKey, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key.Seed())
+		if err := ioutil.WriteFile(filename, []byte(encoded+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated new snapshot signing key in %q.", filename)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("signing key in %q is not base64-encoded: %v", filename, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key in %q must be %d bytes long", filename, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// NewSnapshotter returns a new snapshotter that writes snapshots to the given
+// directory and signs them with the given key.
+func NewSnapshotter(dir string, key ed25519.PrivateKey) (*Snapshotter, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Snapshotter{Dir: dir, key: key}, nil
+}
+
+// PublicKey returns the base64-encoded public key that researchers can use to
+// verify our snapshots.
+func (s *Snapshotter) PublicKey() string {
+	return base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// makeSnapshot turns the given cache snapshot into a research snapshot.
+func makeSnapshot(entries map[string]testcache.Entry, h *BridgeHasher, published time.Time) *Snapshot {
+
+	snapshot := &Snapshot{
+		Version:   SnapshotVersion,
+		Published: published.UTC(),
+		Bridges:   []*SnapshotBridge{},
+	}
+	for addrPort, entry := range entries {
+		b := &SnapshotBridge{
+			HashedID:   h.HashAddrPort(addrPort),
+			Transport:  entry.Transport,
+			Functional: entry.Error == "",
+			LastTested: entry.Time.UTC(),
+		}
+		if b.Functional {
+			snapshot.NumFunctional++
+		}
+		snapshot.Bridges = append(snapshot.Bridges, b)
+	}
+	sort.Slice(snapshot.Bridges, func(i, j int) bool {
+		return snapshot.Bridges[i].HashedID < snapshot.Bridges[j].HashedID
+	})
+	snapshot.NumBridges = len(snapshot.Bridges)
+
+	return snapshot
+}
+
+// filterSnapshotContent returns the given snapshot content, limited to the
+// bridges that pass the given filter.  A bridge's age is relative to the
+// snapshot's publication time.
+func filterSnapshotContent(content []byte, f *ExportFilter) ([]byte, error) {
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(content, snapshot); err != nil {
+		return nil, err
+	}
+	bridges := []*SnapshotBridge{}
+	snapshot.NumFunctional = 0
+	for _, b := range snapshot.Bridges {
+		if !f.matches(b.Transport, b.Functional, b.LastTested, snapshot.Published) {
+			continue
+		}
+		if b.Functional {
+			snapshot.NumFunctional++
+		}
+		bridges = append(bridges, b)
+	}
+	snapshot.Bridges = bridges
+	snapshot.NumBridges = len(bridges)
+	snapshot.Filter = f.String()
+
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+// Write signs the given snapshot and writes it, along with its signature, to
+// our directory.  It returns the snapshot's file name.
+func (s *Snapshotter) Write(snapshot *Snapshot) (string, error) {
+
+	content, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, content))
+
+	name := snapshot.Published.Format(SnapshotTimeFormat) + ".json"
+	filename := path.Join(s.Dir, name)
+	if err = testcache.WriteFileAtomically(filename, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	if err = testcache.WriteFileAtomically(filename+SignatureSuffix, func(w io.Writer) error {
+		_, err := fmt.Fprintln(w, signature)
+		return err
+	}); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// List returns the file names of all snapshots in our directory, oldest
+// first.
+func (s *Snapshotter) List() ([]string, error) {
+
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, f := range files {
+		if SnapshotName.MatchString(f.Name()) && !strings.HasSuffix(f.Name(), SignatureSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Read returns the content of the snapshot (or signature) with the given file
+// name.
+func (s *Snapshotter) Read(name string) ([]byte, error) {
+
+	if !SnapshotName.MatchString(name) {
+		return nil, errors.New("invalid snapshot name")
+	}
+	return ioutil.ReadFile(path.Join(s.Dir, name))
+}
+
+// Run writes a snapshot of our cache every interval, until the given channel
+// is closed.  If we share our work with other instances, only the leader
+// writes snapshots.
+func (s *Snapshotter) Run(interval time.Duration, shutdown chan bool) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !isLeader() {
+				log.Printf("Not writing snapshot because we're not the leader.")
+				continue
+			}
+			name, err := s.Write(makeSnapshot(cache.Snapshot(), hasher, time.Now()))
+			if err != nil {
+				log.Printf("Failed to write snapshot: %s", err)
+			} else {
+				log.Printf("Wrote snapshot %q.", name)
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// VerifySnapshot verifies the given snapshot content against the given
+// base64-encoded signature and public key.
+func VerifySnapshot(content []byte, signature, publicKey string) error {
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return err
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil {
+		return err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), content, sig) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+)
+
+func TestSnapshots(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "snapshots-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for test: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key, err := LoadSigningKey(path.Join(tmpDir, "key"))
+	if err != nil {
+		t.Fatalf("Failed to generate signing key: %s", err)
+	}
+	sameKey, err := LoadSigningKey(path.Join(tmpDir, "key"))
+	if err != nil || string(key) != string(sameKey) {
+		t.Fatalf("Failed to load existing signing key.")
+	}
+
+	s, err := NewSnapshotter(path.Join(tmpDir, "snapshots"), key)
+	if err != nil {
+		t.Fatalf("Failed to create snapshotter: %s", err)
+	}
+
+	h := NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	published := time.Date(2020, 11, 12, 19, 42, 16, 0, time.UTC)
+	entries := map[string]testcache.Entry{
+		"1.1.1.1:1": testcache.Entry{Time: published},
+		"2.2.2.2:2": testcache.Entry{Error: errors.New("error").Error(), Time: published},
+	}
+	snapshot := makeSnapshot(entries, h, published)
+	if snapshot.NumBridges != 2 || snapshot.NumFunctional != 1 {
+		t.Errorf("Unexpected snapshot aggregates.")
+	}
+
+	name, err := s.Write(snapshot)
+	if err != nil || name != "2020-11-12-19-42-16.json" {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+	names, err := s.List()
+	if err != nil || len(names) != 1 || names[0] != name {
+		t.Errorf("Failed to list snapshots: %v", names)
+	}
+
+	content, err := s.Read(name)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+	signature, err := s.Read(name + SignatureSuffix)
+	if err != nil {
+		t.Fatalf("Failed to read signature: %s", err)
+	}
+	if err = VerifySnapshot(content, string(signature), s.PublicKey()); err != nil {
+		t.Errorf("Failed to verify snapshot: %s", err)
+	}
+	if err = VerifySnapshot(append(content, ' '), string(signature), s.PublicKey()); err == nil {
+		t.Errorf("Failed to reject tampered snapshot.")
+	}
+
+	decoded := &Snapshot{}
+	if err = json.Unmarshal(content, decoded); err != nil || !decoded.Published.Equal(published) {
+		t.Errorf("Failed to decode snapshot.")
+	}
+
+	filtered, err := filterSnapshotContent(content, &ExportFilter{Status: "functional"})
+	if err != nil {
+		t.Fatalf("Failed to filter snapshot: %s", err)
+	}
+	decoded = &Snapshot{}
+	if err = json.Unmarshal(filtered, decoded); err != nil {
+		t.Fatalf("Failed to decode filtered snapshot: %s", err)
+	}
+	if decoded.NumBridges != 1 || decoded.NumFunctional != 1 || decoded.Filter != "status=functional" {
+		t.Errorf("Unexpected filtered snapshot: %+v", decoded)
+	}
+
+	if _, err = s.Read("../key"); err == nil {
+		t.Errorf("Failed to reject invalid snapshot name.")
+	}
+}
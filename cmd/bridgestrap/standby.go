@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// StandbyCheckInterval determines how often a warm standby checks if its
+	// primary is ready.
+	StandbyCheckInterval = 10 * time.Second
+	// DefaultFailoverChecks is the number of consecutive failed readiness
+	// checks after which a warm standby takes over.
+	DefaultFailoverChecks = 3
+)
+
+// standby is nil unless we're a warm standby of another bridgestrap instance.
+// A warm standby is also a replica, so replica is set as well until we take
+// over.
+var standby *Standby
+
+// Standby is a read-only replica that also mirrors its primary's job state,
+// i.e., its subscriptions and the jobs in its job queue, and keeps checking its
+// primary's readiness endpoint.  Once the primary failed enough consecutive
+// checks, the standby takes over: it starts its own Tor instances and begins
+// testing bridges.  After taking over, the standby keeps checking its old
+// primary.  While the old primary is ready again, both instances act as
+// primary, so the standby steps down once the old primary passed as many
+// consecutive checks as it took to fail over.  When it steps down, the standby
+// hands its cache and job state back to its old primary, and becomes its
+// standby again.
+type Standby struct {
+	*Replica
+	checkInterval  time.Duration
+	failoverChecks int
+	failures       int
+	recoveries     int
+}
+
+// NewStandby turns the given replica into a warm standby that mirrors its
+// primary's subscriptions and jobs into the given list and queue, which may be
+// nil, and takes over after the given number of consecutive failed readiness
+// checks.
+func NewStandby(r *Replica, jobs *SubscriptionList, queue *JobQueue, failoverChecks int) *Standby {
+
+	r.jobs = jobs
+	r.queue = queue
+	return &Standby{
+		Replica:        r,
+		checkInterval:  StandbyCheckInterval,
+		failoverChecks: failoverChecks,
+	}
+}
+
+// CheckPrimary returns an error if our primary isn't ready to test bridges.
+func (s *Standby) CheckPrimary() error {
+
+	resp, err := s.client.Get(s.Primary + "/readyz")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// check checks our primary's readiness once, and returns true if it failed
+// often enough in a row for us to take over.
+func (s *Standby) check() bool {
+
+	if err := s.CheckPrimary(); err != nil {
+		s.failures++
+		metrics.PrimaryChecks.With(prometheus.Labels{"status": "failed"}).Inc()
+		log.Printf("Primary failed readiness check (%d/%d): %s", s.failures, s.failoverChecks, err)
+		return s.failures >= s.failoverChecks
+	}
+	if s.failures > 0 {
+		log.Printf("Primary is ready again after %d failed readiness check(s).", s.failures)
+	}
+	s.failures = 0
+	metrics.PrimaryChecks.With(prometheus.Labels{"status": "ok"}).Inc()
+	return false
+}
+
+// checkRecovered checks our old primary's readiness once after we took over,
+// and returns true if it succeeded often enough in a row for us to step down.
+func (s *Standby) checkRecovered() bool {
+
+	if err := s.CheckPrimary(); err != nil {
+		if s.recoveries > 0 {
+			log.Printf("Old primary failed readiness check again: %s", err)
+		}
+		s.recoveries = 0
+		metrics.DualPrimary.Set(0)
+		metrics.PrimaryChecks.With(prometheus.Labels{"status": "failed"}).Inc()
+		return false
+	}
+	s.recoveries++
+	metrics.DualPrimary.Set(1)
+	metrics.PrimaryChecks.With(prometheus.Labels{"status": "ok"}).Inc()
+	log.Printf("Old primary %s is ready again, so we're both acting as primary (%d/%d).",
+		s.Primary, s.recoveries, s.failoverChecks)
+	return s.recoveries >= s.failoverChecks
+}
+
+// HandBack sends our cache entries and job state to our old primary, so it
+// doesn't lose the results that we collected while we acted as primary in its
+// stead.  See the primary's HandBack handler.
+func (s *Standby) HandBack() error {
+
+	dump := &SyncDump{
+		Version:   SyncVersion,
+		Published: time.Now().UTC(),
+		Entries:   s.cache.Export(),
+	}
+	if s.jobs != nil {
+		dump.Subscriptions = s.jobs.export()
+	}
+	if s.queue != nil {
+		dump.Jobs = s.queue.export()
+	}
+	body, err := json.Marshal(dump)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.Primary+SyncPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("primary responded with status code %d", resp.StatusCode)
+	}
+	log.Printf("Handed back %d cache entries to primary.", len(dump.Entries))
+	return nil
+}
+
+// sync syncs with our primary once, and logs failures.
+func (s *Standby) sync() {
+
+	if err := s.Sync(); err != nil {
+		log.Printf("Failed to sync with primary: %s", err)
+	}
+}
+
+// Run syncs with our primary every sync interval and checks its readiness
+// every check interval, until the given channel is closed.  Once our primary
+// failed, we call the given takeOver function, stop syncing, and keep checking
+// our old primary.  Once it's back, we hand back to it, call the given
+// stepDown function, which should stop our Tor instances and make us a
+// replica of our primary again, and resume syncing.  If we fail to hand back,
+// we step down anyway: our old primary re-tests what it lacks, whereas two
+// primaries would keep diverging.
+func (s *Standby) Run(shutdown chan bool, takeOver, stepDown func()) {
+
+	metrics.Standby.Set(1)
+	syncTicker := time.NewTicker(s.interval)
+	defer syncTicker.Stop()
+	checkTicker := time.NewTicker(s.checkInterval)
+	defer checkTicker.Stop()
+	tookOver := false
+
+	s.sync()
+	for {
+		select {
+		case <-syncTicker.C:
+			if !tookOver {
+				s.sync()
+			}
+		case <-checkTicker.C:
+			if tookOver {
+				if s.checkRecovered() {
+					log.Printf("Old primary %s passed %d readiness checks in a row.  Stepping down.",
+						s.Primary, s.recoveries)
+					if err := s.HandBack(); err != nil {
+						log.Printf("Failed to hand back to old primary: %s", err)
+					}
+					stepDown()
+					tookOver = false
+					s.failures, s.recoveries = 0, 0
+					metrics.DualPrimary.Set(0)
+					metrics.Standby.Set(1)
+					s.sync()
+				}
+			} else if s.check() {
+				log.Printf("Primary %s failed %d readiness checks in a row.  Taking over.",
+					s.Primary, s.failures)
+				metrics.Failovers.Inc()
+				metrics.Standby.Set(0)
+				takeOver()
+				tookOver = true
+			}
+		case <-shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestStandbySync(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-standby-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primaryCache := testcache.New(time.Hour)
+	primaryCache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	primarySubscriptions, err := LoadSubscriptionList(filepath.Join(dir, "primary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := primarySubscriptions.Add("rdsys", []string{"2.2.2.2:2"}); err != nil {
+		t.Fatal(err)
+	}
+	tokens = map[string]*Token{
+		"replica": &Token{Token: "replica", Name: "replica", Weight: 1, Replica: true},
+		"admin":   &Token{Token: "admin", Name: "admin", Weight: 1, Admin: true},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	primaryJobs, _ := NewJobQueue([]string{"ir"}, tester.DefaultVantage)
+	standbyJobs, _ := NewJobQueue([]string{"ir"}, tester.DefaultVantage)
+	go primaryJobs.Test(&tester.TestRequest{BridgeLines: []string{"3.3.3.3:3"}, Vantage: "ir"})
+	job := waitForJob(t, primaryJobs, "worker")
+	defer primaryJobs.Report(job.ID, "worker", tester.NewTestResult())
+
+	cache = primaryCache
+	subscriptions = primarySubscriptions
+	jobs = primaryJobs
+	defer func() { cache = nil; subscriptions = nil; jobs = nil }()
+	primary := httptest.NewServer(http.HandlerFunc(SyncCache))
+	defer primary.Close()
+
+	standbySubscriptions, err := LoadSubscriptionList(filepath.Join(dir, "standby.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	standbyCache := testcache.New(time.Hour)
+
+	// Job state contains bridge lines, so replica tokens can't sync it.
+	s := NewStandby(NewReplica(primary.URL, "replica", time.Minute, standbyCache), standbySubscriptions, nil, 1)
+	if err := s.Sync(); err == nil {
+		t.Errorf("Synced job state with token that lacks permission.")
+	}
+
+	s = NewStandby(NewReplica(primary.URL, "admin", time.Minute, standbyCache), standbySubscriptions, standbyJobs, 1)
+	if err := s.Sync(); err != nil {
+		t.Fatalf("Failed to sync: %s", err)
+	}
+	if standbyCache.IsCached("1.1.1.1:1") == nil {
+		t.Errorf("Synced entry isn't in standby's cache.")
+	}
+	if bridgeLines := standbySubscriptions.BridgeLines("rdsys"); len(bridgeLines) != 1 || bridgeLines[0] != "2.2.2.2:2" {
+		t.Errorf("Unexpected synced subscriptions: %v", bridgeLines)
+	}
+	if _, err := standbyJobs.Heartbeat(job.ID, "worker"); err != nil {
+		t.Errorf("Synced job isn't in standby's job queue: %s", err)
+	}
+
+	// The synced subscriptions must survive a restart.
+	reloaded, err := LoadSubscriptionList(filepath.Join(dir, "standby.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.BridgeLines("rdsys")) != 1 {
+		t.Errorf("Synced subscriptions weren't persisted.")
+	}
+}
+
+func TestStandbyFailover(t *testing.T) {
+
+	var ready int32 = 1
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/readyz" && atomic.LoadInt32(&ready) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+
+	s := NewStandby(NewReplica(primary.URL, "token", time.Hour, testcache.New(time.Hour)), nil, nil, 2)
+	if err := s.CheckPrimary(); err != nil {
+		t.Errorf("Ready primary failed check: %s", err)
+	}
+
+	// A single failed check must not make us take over, and a successful
+	// check resets our count.
+	atomic.StoreInt32(&ready, 0)
+	if s.check() {
+		t.Errorf("Took over after a single failed check.")
+	}
+	atomic.StoreInt32(&ready, 1)
+	if s.check() || s.failures != 0 {
+		t.Errorf("Successful check didn't reset failures.")
+	}
+
+	atomic.StoreInt32(&ready, 0)
+	s.checkInterval = 10 * time.Millisecond
+	tookOver := make(chan bool, 1)
+	shutdown := make(chan bool)
+	defer close(shutdown)
+	go s.Run(shutdown, func() { tookOver <- true }, func() {})
+	select {
+	case <-tookOver:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Standby didn't take over from failed primary.")
+	}
+	if s.failures != 2 {
+		t.Errorf("Expected to take over after 2 failed checks but took %d.", s.failures)
+	}
+}
+
+func TestStandbyStepDown(t *testing.T) {
+
+	tokens = map[string]*Token{"admin": &Token{Token: "admin", Name: "admin", Weight: 1, Admin: true}}
+	defer func() { tokens = make(map[string]*Token) }()
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+
+	var ready int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == SyncPath && r.Method == "POST":
+			HandBack(w, r)
+		case r.URL.Path == SyncPath:
+			SyncCache(w, r)
+		case r.URL.Path == "/readyz" && atomic.LoadInt32(&ready) == 1:
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer primary.Close()
+
+	standbyCache := testcache.New(time.Hour)
+	s := NewStandby(NewReplica(primary.URL, "admin", time.Hour, standbyCache), nil, nil, 2)
+	s.checkInterval = 10 * time.Millisecond
+	tookOver := make(chan bool, 1)
+	steppedDown := make(chan int, 1)
+	shutdown := make(chan bool)
+	defer close(shutdown)
+	go s.Run(shutdown, func() {
+		// We test a bridge while we act as primary.
+		standbyCache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+		tookOver <- true
+	}, func() { steppedDown <- s.recoveries })
+	select {
+	case <-tookOver:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Standby didn't take over from failed primary.")
+	}
+
+	// Once our old primary is back, we're both acting as primary until we
+	// step down, and hand back our results.
+	atomic.StoreInt32(&ready, 1)
+	select {
+	case recoveries := <-steppedDown:
+		if recoveries != 2 {
+			t.Errorf("Expected to step down after 2 successful checks but took %d.", recoveries)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Standby didn't step down after its primary came back.")
+	}
+	if cache.IsCached("1.1.1.1:1") == nil {
+		t.Errorf("Standby didn't hand back its results.")
+	}
+
+	// We're a standby again, so we take over again once our primary fails
+	// again.
+	atomic.StoreInt32(&ready, 0)
+	select {
+	case <-tookOver:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Standby didn't take over again after stepping down.")
+	}
+}
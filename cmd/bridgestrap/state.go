@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// ServingState represents the life cycle of our service.
+type ServingState int32
+
+const (
+	// StateStarting means that we're still starting our Tor instances.
+	StateStarting ServingState = iota
+	// StateServing means that we're handling requests.
+	StateServing
+	// StateDraining means that we're shutting down and only finish requests
+	// that are already in flight.
+	StateDraining
+	// StateStopped means that we're done.
+	StateStopped
+)
+
+const (
+	// RetryAfterStarting tells clients how many seconds to wait if we're
+	// still starting.
+	RetryAfterStarting = 10
+	// RetryAfterStopping tells clients how many seconds to wait if we're
+	// shutting down.
+	RetryAfterStopping = 60
+)
+
+// servingState holds our current ServingState.  It must only be accessed
+// atomically.
+var servingState int32
+
+func (s ServingState) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateServing:
+		return "serving"
+	case StateDraining:
+		return "draining"
+	case StateStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// SetServingState sets our serving state to the given state.
+func SetServingState(s ServingState) {
+	atomic.StoreInt32(&servingState, int32(s))
+}
+
+// GetServingState returns our current serving state.
+func GetServingState() ServingState {
+	return ServingState(atomic.LoadInt32(&servingState))
+}
+
+// RequireServing wraps the given handler and only passes requests to it while
+// we're serving.  Otherwise, it responds with 503 and a Retry-After header, so
+// handlers never run while our Tor instances or our cache aren't ready.
+func RequireServing(inner http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := GetServingState()
+		if state == StateServing {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter := RetryAfterStopping
+		if state == StateStarting {
+			retryAfter = RetryAfterStarting
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "service is "+state.String(), http.StatusServiceUnavailable)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireServing(t *testing.T) {
+
+	defer SetServingState(StateStarting)
+	handler := RequireServing(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	expected := map[ServingState]struct {
+		code       int
+		retryAfter string
+	}{
+		StateStarting: {http.StatusServiceUnavailable, "10"},
+		StateServing:  {http.StatusOK, ""},
+		StateDraining: {http.StatusServiceUnavailable, "60"},
+		StateStopped:  {http.StatusServiceUnavailable, "60"},
+	}
+	for state, e := range expected {
+		SetServingState(state)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/bridge-state", nil))
+		if w.Code != e.code {
+			t.Errorf("Expected status code %d in state %s but got %d.", e.code, state, w.Code)
+		}
+		if w.Header().Get("Retry-After") != e.retryAfter {
+			t.Errorf("Expected Retry-After %q in state %s but got %q.",
+				e.retryAfter, state, w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// StreamEventBridge is the name of the server-sent event that carries a
+	// single bridge's result.
+	StreamEventBridge = "bridge"
+	// StreamEventResult is the name of the server-sent event that carries
+	// the entire test result.  It's always the last event.
+	StreamEventResult = "result"
+)
+
+// bridgeEvent is the payload of a StreamEventBridge event.
+type bridgeEvent struct {
+	BridgeLine string             `json:"bridge_line"`
+	Result     *tester.BridgeTest `json:"result"`
+}
+
+// writeEvent writes a server-sent event of the given name, whose data is the
+// given JSON payload.
+func writeEvent(w io.Writer, name string, data []byte) error {
+
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+	return err
+}
+
+// marshalBridgeEvent localises and redacts a copy of the given bridge's result
+// and returns the JSON payload of its StreamEventBridge event.  Working on a
+// copy lets us marshal results while our tester still holds on to them.
+func marshalBridgeEvent(bridgeLine string, bridgeTest *tester.BridgeTest, client *Token, lang string) ([]byte, error) {
+
+	bridgeTestCopy := *bridgeTest
+	result := tester.NewTestResult()
+	result.Bridges[bridgeLine] = &bridgeTestCopy
+	tombstones.flagRetired(result, time.Now().UTC())
+	geoIP.locateResult(result)
+	applyCheck(result, client)
+	localise(result, lang)
+	redaction.RedactResult(result)
+	return json.Marshal(&bridgeEvent{BridgeLine: bridgeLine, Result: &bridgeTestCopy})
+}
+
+// BridgeStateStream is like BridgeState but streams results as server-sent
+// events: one StreamEventBridge event as soon as each bridge's test is done,
+// followed by a StreamEventResult event that contains the entire result, just
+// like BridgeState's response.  Streaming doesn't support vantage points.
+func BridgeStateStream(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "stream", "status": reqStatus}).Inc()
+	}()
+
+	client, err := getClient(r)
+	if err != nil {
+		log.Printf("Failed to authenticate client: %s", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Printf("Bug: Response writer doesn't support flushing.")
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	req, stages, vantages, valid := parseTestRequest(w, r, client)
+	if valid {
+		reqStatus = "valid"
+	}
+	if req == nil {
+		return
+	}
+	if len(vantages) > 0 {
+		http.Error(w, "streaming doesn't support vantage points", http.StatusBadRequest)
+		return
+	}
+	if req.Format != "" {
+		http.Error(w, "streaming only supports our own format", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Got %d bridge lines from %s for streaming.", len(req.BridgeLines), r.RemoteAddr)
+	telemetry.Record(client, len(req.BridgeLines), time.Now())
+	cachedResult, remainingBridgeLines := lookupBridgeLines(req.BridgeLines, "stream", stages)
+	cachedResult.Diagnostics = req.Diagnostics
+	quota, err := quotas.Reserve(client, len(remainingBridgeLines))
+	setQuotaHeaders(w, quota)
+	if err != nil {
+		log.Printf("Rejecting request of client %s: %s", client.Name, err)
+		abuseLog.Record(r, AbuseQuota, clientClass(client))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Add("Vary", "Accept-Language")
+	if lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// Our progress function is called from our tester's goroutines, so it
+	// marshals events right away and hands them to us.  Each bridge is
+	// reported at most once, so the channel's buffer ensures that the
+	// progress function never blocks, even if our client went away.
+	events := make(chan []byte, len(req.BridgeLines))
+	req.Progress = func(bridgeLine string, bridgeTest *tester.BridgeTest) {
+		data, err := marshalBridgeEvent(bridgeLine, bridgeTest, client, lang)
+		if err != nil {
+			log.Printf("Bug: %s", err)
+			return
+		}
+		events <- data
+	}
+	for bridgeLine, bridgeTest := range cachedResult.Bridges {
+		req.Progress(bridgeLine, bridgeTest)
+	}
+
+	done := make(chan *tester.TestResult, 1)
+	go func() {
+		result := testUncachedBridgeLines(req, cachedResult, remainingBridgeLines, stages)
+		quotas.Refund(client, numRefundable(result, remainingBridgeLines, nil))
+		done <- result
+	}()
+
+	for {
+		select {
+		case data := <-events:
+			if err := writeEvent(w, StreamEventBridge, data); err != nil {
+				log.Printf("Failed to write event: %s", err)
+				return
+			}
+			flusher.Flush()
+		case result := <-done:
+			// Send whatever events are left before the final result.
+			for len(events) > 0 {
+				if err := writeEvent(w, StreamEventBridge, <-events); err != nil {
+					log.Printf("Failed to write event: %s", err)
+					return
+				}
+			}
+			metrics.RetiredResubs.Add(float64(tombstones.flagRetired(result, time.Now().UTC())))
+			geoIP.locateResult(result)
+			applyCheck(result, client)
+			localise(result, lang)
+			redaction.RedactResult(result)
+			data, err := json.Marshal(result)
+			if err != nil {
+				log.Printf("Bug: %s", err)
+				return
+			}
+			if err := writeEvent(w, StreamEventResult, data); err != nil {
+				log.Printf("Failed to write event: %s", err)
+			}
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			log.Printf("Client went away while we were streaming results.")
+			return
+		}
+	}
+}
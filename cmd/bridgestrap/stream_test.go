@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestWriteEvent(t *testing.T) {
+
+	buf := new(bytes.Buffer)
+	if err := writeEvent(buf, StreamEventResult, []byte(`{"time":0}`)); err != nil {
+		t.Fatalf("Failed to write event: %s", err)
+	}
+	expected := "event: result\ndata: {\"time\":0}\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q but got %q.", expected, buf.String())
+	}
+}
+
+func TestBridgeStateStream(t *testing.T) {
+
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+
+	body := `{"bridge_lines": ["1.1.1.1:1", "bogus"]}`
+	r := httptest.NewRequest("GET", "/bridge-state/stream", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	BridgeStateStream(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Unexpected content type %q.", w.Header().Get("Content-Type"))
+	}
+
+	// Both bridges are answered from our caches, so we expect one event per
+	// bridge, followed by the entire result.
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events but got %d: %q", len(events), w.Body.String())
+	}
+	seen := make(map[string]bool)
+	for _, event := range events[:2] {
+		prefix := "event: " + StreamEventBridge + "\ndata: "
+		if !strings.HasPrefix(event, prefix) {
+			t.Fatalf("Unexpected event %q.", event)
+		}
+		e := &bridgeEvent{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(event, prefix)), e); err != nil {
+			t.Fatalf("Failed to unmarshal event: %s", err)
+		}
+		seen[e.BridgeLine] = true
+		if e.BridgeLine == "bogus" && e.Result.Verdict != tester.VerdictDysfunctional {
+			t.Errorf("Invalid bridge line isn't dysfunctional.")
+		}
+	}
+	if !seen["1.1.1.1:1"] || !seen["bogus"] {
+		t.Errorf("Missing bridge events: %v", seen)
+	}
+
+	prefix := "event: " + StreamEventResult + "\ndata: "
+	if !strings.HasPrefix(events[2], prefix) {
+		t.Fatalf("Last event isn't the entire result: %q", events[2])
+	}
+	result := tester.NewTestResult()
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(events[2], prefix)), result); err != nil {
+		t.Fatalf("Failed to unmarshal result: %s", err)
+	}
+	if len(result.Bridges) != 2 {
+		t.Errorf("Expected 2 bridges in result but got %d.", len(result.Bridges))
+	}
+
+	r = httptest.NewRequest("GET", "/bridge-state/stream", strings.NewReader(`{"bridge_lines": []}`))
+	w = httptest.NewRecorder()
+	BridgeStateStream(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d but got %d.", http.StatusBadRequest, w.Code)
+	}
+}
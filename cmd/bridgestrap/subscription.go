@@ -0,0 +1,528 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// SubscriptionCheckInterval determines how often we look for subscribed
+	// bridges that are due for a re-test.
+	SubscriptionCheckInterval = time.Minute
+	// SubscriptionClient is the client name of our subscription re-tests.
+	SubscriptionClient = "subscriptions"
+	// MaxSubscribedBridges is the maximum number of bridge lines that a
+	// client may subscribe to.
+	MaxSubscribedBridges = 5000
+)
+
+// subscriptions is our list of subscribed bridges.  It's nil if the operator
+// didn't configure a subscription file.
+var subscriptions *SubscriptionList
+
+// subscriptionSchema is the schema of our subscription file.
+var subscriptionSchema = &testcache.Schema{
+	Name:    "subscription",
+	Version: 1,
+	Migrations: map[int]testcache.Migration{
+		0: testcache.NoMigration,
+	},
+}
+
+// SubscriptionConfig represents our subscription file.
+type SubscriptionConfig struct {
+	// Subscriptions maps client names to their subscribed bridge lines.
+	Subscriptions map[string][]string `json:"subscriptions"`
+}
+
+// subscriptionRequest represents an API request to subscribe to bridge lines,
+// or to unsubscribe from them.
+type subscriptionRequest struct {
+	BridgeLines []string `json:"bridge_lines"`
+}
+
+// retestRequest represents an API request to re-test subscribed bridges ahead
+// of routine re-tests.  Identifiers are hashed identifiers or fingerprints.
+type retestRequest struct {
+	Identifiers []string `json:"identifiers"`
+}
+
+// retestResponse represents our response to re-test requests.  Unknown
+// contains the identifiers that match none of the client's subscribed bridge
+// lines.
+type retestResponse struct {
+	Scheduled []string `json:"scheduled"`
+	Unknown   []string `json:"unknown"`
+}
+
+// subscriptionResponse represents our response to subscription API requests.
+type subscriptionResponse struct {
+	BridgeLines []string                      `json:"bridge_lines"`
+	Results     map[string]*tester.BridgeTest `json:"bridge_results"`
+}
+
+// SubscriptionList contains the bridge lines that API clients asked us to keep
+// testing, so they can query fresh results at any time.  We re-test a
+// subscribed bridge before its cache entry expires, using background requests
+// that only run while our Tor instances are otherwise idle.  We persist the
+// list to disk.  It's safe for concurrent use.
+type SubscriptionList struct {
+	// clients maps client names to their subscribed (canonical) bridge
+	// lines.
+	clients  map[string][]string
+	filename string
+	// changed tells our monitor that the list changed.
+	changed chan bool
+	sync.Mutex
+}
+
+// LoadSubscriptionList reads our subscriptions from the given JSON file.  If
+// the file doesn't exist, we start without subscriptions.
+func LoadSubscriptionList(filename string) (*SubscriptionList, error) {
+
+	l := &SubscriptionList{
+		clients:  make(map[string][]string),
+		filename: filename,
+		changed:  make(chan bool, 1),
+	}
+
+	config := &SubscriptionConfig{}
+	err := subscriptionSchema.ReadFile(filename, config)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for client, bridgeLines := range config.Subscriptions {
+		for _, bridgeLine := range bridgeLines {
+			if err := bridgeline.Validate(bridgeLine); err != nil {
+				return nil, fmt.Errorf("invalid subscription of client %s: %v", client, err)
+			}
+			l.clients[client] = append(l.clients[client], bridgeline.Canonicalize(bridgeLine))
+		}
+	}
+	return l, nil
+}
+
+// save writes our list to disk.  The caller must hold our lock.
+func (l *SubscriptionList) save() error {
+
+	return subscriptionSchema.WriteFile(l.filename, &SubscriptionConfig{Subscriptions: l.clients})
+}
+
+// notify tells our monitor that the list changed, unless it already knows.
+func (l *SubscriptionList) notify() {
+
+	select {
+	case l.changed <- true:
+	default:
+	}
+}
+
+// BridgeLines returns a copy of the given client's subscribed bridge lines.
+func (l *SubscriptionList) BridgeLines(client string) []string {
+
+	l.Lock()
+	defer l.Unlock()
+
+	return append([]string{}, l.clients[client]...)
+}
+
+// all returns the sorted bridge lines that at least one client subscribed
+// to.
+func (l *SubscriptionList) all() []string {
+
+	l.Lock()
+	defer l.Unlock()
+
+	seen := make(map[string]bool)
+	bridgeLines := []string{}
+	for _, clientLines := range l.clients {
+		for _, bridgeLine := range clientLines {
+			if !seen[bridgeLine] {
+				seen[bridgeLine] = true
+				bridgeLines = append(bridgeLines, bridgeLine)
+			}
+		}
+	}
+	sort.Strings(bridgeLines)
+	return bridgeLines
+}
+
+// export returns a copy of all clients' subscribed bridge lines.
+func (l *SubscriptionList) export() map[string][]string {
+
+	l.Lock()
+	defer l.Unlock()
+
+	clients := make(map[string][]string)
+	for client, bridgeLines := range l.clients {
+		clients[client] = append([]string{}, bridgeLines...)
+	}
+	return clients
+}
+
+// Replace replaces all subscriptions with the given ones and persists the
+// list.  Warm standbys use it to mirror the subscriptions of their primary.
+func (l *SubscriptionList) Replace(clients map[string][]string) error {
+
+	canonical := make(map[string][]string)
+	for client, bridgeLines := range clients {
+		for _, bridgeLine := range bridgeLines {
+			if err := bridgeline.Validate(bridgeLine); err != nil {
+				return fmt.Errorf("invalid subscription of client %s: %v", client, err)
+			}
+			canonical[client] = append(canonical[client], bridgeline.Canonicalize(bridgeLine))
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	old := l.clients
+	l.clients = canonical
+	if err := l.save(); err != nil {
+		l.clients = old
+		return err
+	}
+	l.notify()
+	return nil
+}
+
+// update replaces the given client's bridge lines and persists the list.  The
+// caller must hold our lock.
+func (l *SubscriptionList) update(client string, bridgeLines []string) error {
+
+	old, existed := l.clients[client]
+	if len(bridgeLines) == 0 {
+		delete(l.clients, client)
+	} else {
+		l.clients[client] = bridgeLines
+	}
+	if err := l.save(); err != nil {
+		if existed {
+			l.clients[client] = old
+		} else {
+			delete(l.clients, client)
+		}
+		return err
+	}
+	l.notify()
+	return nil
+}
+
+// Add subscribes the given client to the given bridge lines.  Bridge lines
+// that the client already subscribed to are ignored, and bridge lines that
+// point at our own addresses are rejected.
+func (l *SubscriptionList) Add(client string, bridgeLines []string) error {
+
+	canonical := []string{}
+	for _, bridgeLine := range bridgeLines {
+		if err := bridgeline.Validate(bridgeLine); err != nil {
+			return err
+		}
+		if ownAddrs.Contains(bridgeLine) {
+			return errors.New(SelfProbeError)
+		}
+		canonical = append(canonical, bridgeline.Canonicalize(bridgeLine))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	updated := append([]string{}, l.clients[client]...)
+	for _, bridgeLine := range canonical {
+		if !containsString(updated, bridgeLine) {
+			updated = append(updated, bridgeLine)
+		}
+	}
+	if len(updated) > MaxSubscribedBridges {
+		return fmt.Errorf("clients may subscribe to at most %d bridge lines", MaxSubscribedBridges)
+	}
+	return l.update(client, updated)
+}
+
+// Remove unsubscribes the given client from the given bridge lines.
+func (l *SubscriptionList) Remove(client string, bridgeLines []string) error {
+
+	removed := []string{}
+	for _, bridgeLine := range bridgeLines {
+		removed = append(removed, bridgeline.Canonicalize(bridgeLine))
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	updated := []string{}
+	for _, bridgeLine := range l.clients[client] {
+		if !containsString(removed, bridgeLine) {
+			updated = append(updated, bridgeLine)
+		}
+	}
+	return l.update(client, updated)
+}
+
+// due returns the subscribed bridge lines that are due for a re-test.
+func (l *SubscriptionList) due(c *testcache.Cache, now time.Time) []string {
+	return dueBridgeLines(c, l.all(), now)
+}
+
+// dueBridgeLines returns the given bridge lines whose result is missing from
+// the given cache, or that we tested more than three quarters of their cache
+// timeout ago.  Re-testing bridges before their result expires means that
+// nobody has to wait for a test.
+func dueBridgeLines(c *testcache.Cache, bridgeLines []string, now time.Time) []string {
+
+	due := []string{}
+	for _, bridgeLine := range bridgeLines {
+		entry := c.Peek(bridgeLine)
+		if entry == nil || now.Sub(entry.Time) > c.Timeout(entry)*3/4 {
+			due = append(due, bridgeLine)
+		}
+	}
+	return due
+}
+
+// Resolve returns the given client's subscribed bridge lines that match the
+// given identifiers, which are either hashed identifiers (see BridgeHasher) or
+// fingerprints, along with the identifiers that match none of them.
+func (l *SubscriptionList) Resolve(client string, identifiers []string) ([]string, []string) {
+
+	bridgeLines := []string{}
+	unknown := []string{}
+	for _, identifier := range identifiers {
+		id := strings.ToUpper(strings.TrimPrefix(identifier, "$"))
+		matched := false
+		for _, bridgeLine := range l.BridgeLines(client) {
+			var matches bool
+			if fingerprintPattern.MatchString(id) {
+				fingerprint, err := bridgeline.Fingerprint(bridgeLine)
+				matches = err == nil && fingerprint == id
+			} else if addrPort, err := bridgeline.AddrPort(bridgeLine); err == nil {
+				matches = hasher.Matches(id, addrPort)
+			}
+			if matches {
+				matched = true
+				if !containsString(bridgeLines, bridgeLine) {
+					bridgeLines = append(bridgeLines, bridgeLine)
+				}
+			}
+		}
+		if !matched {
+			unknown = append(unknown, identifier)
+		}
+	}
+	return bridgeLines, unknown
+}
+
+// check re-tests subscribed bridges that are due, in batches, until they're
+// all done or the given channel is closed.
+func (l *SubscriptionList) check(shutdown chan bool) {
+
+	due := l.due(cache, time.Now().UTC())
+	metrics.SubscribedBridges.Set(float64(len(l.all())))
+	if len(due) == 0 {
+		return
+	}
+	log.Printf("Re-testing %d subscribed bridge(s).", len(due))
+	retest(due, SubscriptionClient, false, shutdown)
+}
+
+// retest re-tests the given bridge lines on behalf of the given client, in
+// batches of background requests, until they're all done or the given channel
+// is closed.  Expedited re-tests go ahead of routine ones.
+func retest(bridgeLines []string, client string, expedited bool, shutdown chan bool) {
+
+	bridgeLines = tombstones.active(bridgeLines, time.Now().UTC())
+	for len(bridgeLines) > 0 {
+		select {
+		case <-shutdown:
+			return
+		default:
+		}
+		batch := bridgeLines
+		if len(batch) > tester.MaxBridgesPerReq {
+			batch = batch[:tester.MaxBridgesPerReq]
+		}
+		bridgeLines = bridgeLines[len(batch):]
+
+		result := torPool().Test(&tester.TestRequest{
+			BridgeLines: batch,
+			Client:      client,
+			Weight:      tester.DefaultWeight,
+			Background:  true,
+			Expedited:   expedited,
+		})
+		for bridgeLine, bridgeTest := range result.Bridges {
+			if bridgeTest.Verdict != tester.VerdictInconclusive {
+				recordResult(bridgeLine, bridgeTest, tester.DefaultStages)
+			}
+			metrics.BridgeStatus.With(prometheus.Labels{"status": bridgeTest.Verdict}).Inc()
+		}
+	}
+}
+
+// Monitor re-tests subscribed bridges that are due every
+// SubscriptionCheckInterval, and right away whenever our list changes, until
+// the given channel is closed.
+func (l *SubscriptionList) Monitor(shutdown chan bool) {
+
+	ticker := time.NewTicker(SubscriptionCheckInterval)
+	defer ticker.Stop()
+	for {
+		l.check(shutdown)
+		select {
+		case <-ticker.C:
+		case <-l.changed:
+		case <-shutdown:
+			return
+		}
+	}
+}
+
+// getSubscriber determines the client that sent the given API request and
+// returns an error if the client may not have subscriptions.  Subscriptions
+// belong to tokens, so anonymous clients can't have any.
+func getSubscriber(r *http.Request) (*Token, error) {
+
+	client, err := getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if client.Name == AnonymousClient {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		return nil, errors.New("subscriptions require an API token")
+	}
+	return client, nil
+}
+
+// sendSubscriptions responds with the given client's subscribed bridge lines
+// and the latest results that we have for them.
+func sendSubscriptions(w http.ResponseWriter, client *Token) {
+
+	result := tester.NewTestResult()
+	bridgeLines := subscriptions.BridgeLines(client.Name)
+	for _, bridgeLine := range bridgeLines {
+		if entry := cache.Peek(bridgeLine); entry != nil {
+			result.Bridges[bridgeLine] = cachedBridgeTest(entry)
+		}
+	}
+	geoIP.locateResult(result)
+	applyCheck(result, client)
+	redaction.RedactResult(result)
+
+	jsonResult, err := json.Marshal(&subscriptionResponse{
+		BridgeLines: bridgeLines,
+		Results:     result.Bridges,
+	})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal subscriptions", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
+
+// Subscriptions responds with the client's subscribed bridge lines and their
+// latest results.
+func Subscriptions(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getSubscriber(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	sendSubscriptions(w, client)
+}
+
+// EditSubscriptions subscribes the client to bridge lines (for POST requests)
+// or unsubscribes it (for DELETE requests), and responds with the client's
+// updated subscriptions.
+func EditSubscriptions(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getSubscriber(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	req := &subscriptionRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		err = subscriptions.Remove(client.Name, req.BridgeLines)
+	} else {
+		err = subscriptions.Add(client.Name, req.BridgeLines)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Client %s changed its subscriptions (%s, %d bridge lines).",
+		client.Name, r.Method, len(req.BridgeLines))
+	sendSubscriptions(w, client)
+}
+
+// RetestSubscriptions re-tests the client's subscribed bridges that match the
+// given identifiers ahead of our routine re-tests, e.g., because a
+// distributor is about to hand them out.  We respond right away; clients
+// fetch the fresh results via /subscriptions once the re-tests are done.
+func RetestSubscriptions(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getSubscriber(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if torPool() == nil {
+		http.Error(w, "we don't test bridges right now", http.StatusServiceUnavailable)
+		return
+	}
+
+	req := &retestRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Identifiers) > MaxSubscribedBridges {
+		http.Error(w, fmt.Sprintf("clients may re-test at most %d bridges at once", MaxSubscribedBridges),
+			http.StatusBadRequest)
+		return
+	}
+
+	bridgeLines, unknown := subscriptions.Resolve(client.Name, req.Identifiers)
+	resp := &retestResponse{Scheduled: []string{}, Unknown: unknown}
+	for _, identifier := range req.Identifiers {
+		if !containsString(unknown, identifier) {
+			resp.Scheduled = append(resp.Scheduled, identifier)
+		}
+	}
+	if len(bridgeLines) > 0 {
+		log.Printf("Client %s asked us to re-test %d subscribed bridge line(s).", client.Name, len(bridgeLines))
+		metrics.ExpeditedRetests.Add(float64(len(bridgeLines)))
+		go retest(bridgeLines, client.Name, true, nil)
+	}
+
+	jsonResult, err := json.Marshal(resp)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal re-test response", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestSubscriptionList(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-subscriptions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "subscriptions.json")
+
+	l, err := LoadSubscriptionList(filename)
+	if err != nil {
+		t.Fatalf("Failed to load subscriptions: %s", err)
+	}
+	if err := l.Add("rdsys", []string{"1.1.1.1:1", "bogus"}); err == nil {
+		t.Errorf("Accepted invalid bridge line.")
+	}
+	if err := l.Add("rdsys", []string{"Bridge 1.1.1.1:1", "2.2.2.2:2", "1.1.1.1:1"}); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+	if err := l.Add("operator", []string{"2.2.2.2:2", "3.3.3.3:3"}); err != nil {
+		t.Fatalf("Failed to subscribe: %s", err)
+	}
+	if err := l.Remove("operator", []string{"3.3.3.3:3"}); err != nil {
+		t.Fatalf("Failed to unsubscribe: %s", err)
+	}
+	select {
+	case <-l.changed:
+	default:
+		t.Errorf("Failed to notify monitor of new subscriptions.")
+	}
+
+	// Changes must survive restarts.
+	l, err = LoadSubscriptionList(filename)
+	if err != nil {
+		t.Fatalf("Failed to reload subscriptions: %s", err)
+	}
+	if strings.Join(l.BridgeLines("rdsys"), " ") != "1.1.1.1:1 2.2.2.2:2" {
+		t.Errorf("Unexpected subscriptions: %v", l.BridgeLines("rdsys"))
+	}
+	if strings.Join(l.all(), " ") != "1.1.1.1:1 2.2.2.2:2" {
+		t.Errorf("Unexpected subscribed bridge lines: %v", l.all())
+	}
+
+	// Bridges without fresh result are due for a re-test.
+	c := testcache.New(4 * time.Hour)
+	now := time.Now().UTC()
+	c.AddEntry("1.1.1.1:1", nil, now.Add(-time.Hour))
+	c.AddEntry("2.2.2.2:2", nil, now.Add(-3*time.Hour-time.Minute))
+	if due := l.due(c, now); len(due) != 1 || due[0] != "2.2.2.2:2" {
+		t.Errorf("Unexpected bridges due for a re-test: %v", due)
+	}
+
+	// Failures are due sooner if they expire sooner.
+	c.SetTimeouts(4*time.Hour, 2*time.Hour)
+	c.AddEntry("1.1.1.1:1", errors.New("bridge is on fire"), now.Add(-2*time.Hour+time.Minute))
+	if due := l.due(c, now); len(due) != 2 {
+		t.Errorf("Dysfunctional bridge isn't due for a re-test: %v", due)
+	}
+}
+
+func TestEditSubscriptions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-subscriptions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if subscriptions, err = LoadSubscriptionList(filepath.Join(dir, "subscriptions.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { subscriptions = nil }()
+	cache = testcache.New(time.Hour)
+	defer func() { cache = nil }()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	tokens = map[string]*Token{"user": &Token{Token: "user", Name: "rdsys", Weight: 1}}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	body := `{"bridge_lines": ["1.1.1.1:1", "2.2.2.2:2"]}`
+	r := httptest.NewRequest("POST", "/subscriptions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	EditSubscriptions(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for anonymous client but got %d.", http.StatusForbidden, w.Code)
+	}
+
+	r = httptest.NewRequest("POST", "/subscriptions", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer user")
+	w = httptest.NewRecorder()
+	EditSubscriptions(w, r)
+	resp := &subscriptionResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to subscribe: %d %s", w.Code, w.Body.String())
+	}
+	if len(resp.BridgeLines) != 2 || len(resp.Results) != 1 || !resp.Results["1.1.1.1:1"].Functional {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+
+	r = httptest.NewRequest("DELETE", "/subscriptions", strings.NewReader(`{"bridge_lines": ["2.2.2.2:2"]}`))
+	r.Header.Set("Authorization", "Bearer user")
+	w = httptest.NewRecorder()
+	EditSubscriptions(w, r)
+	if w.Code != http.StatusOK || len(subscriptions.BridgeLines("rdsys")) != 1 {
+		t.Errorf("Failed to unsubscribe: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRetestSubscriptions(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-subscriptions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if subscriptions, err = LoadSubscriptionList(filepath.Join(dir, "subscriptions.json")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { subscriptions = nil }()
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	defer func() { hasher = nil }()
+	tokens = map[string]*Token{"user": &Token{Token: "user", Name: "rdsys", Weight: 1}}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	fingerprint := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	bridgeLines := []string{"1.1.1.1:1 " + fingerprint, "2.2.2.2:2"}
+	if err := subscriptions.Add("rdsys", bridgeLines); err != nil {
+		t.Fatal(err)
+	}
+
+	// Identifiers may be fingerprints or hashed identifiers, and only match
+	// the client's own subscriptions.
+	hashedID := hasher.HashAddrPort("2.2.2.2:2")
+	resolved, unknown := subscriptions.Resolve("rdsys", []string{"$" + strings.ToLower(fingerprint), hashedID, "bogus"})
+	if len(resolved) != 2 || len(unknown) != 1 || unknown[0] != "bogus" {
+		t.Errorf("Unexpected resolution: %v %v", resolved, unknown)
+	}
+	if resolved, _ = subscriptions.Resolve("someone-else", []string{hashedID}); len(resolved) != 0 {
+		t.Errorf("Resolved identifier of another client's subscription.")
+	}
+
+	body := `{"identifiers": ["` + hashedID + `", "bogus"]}`
+	r := httptest.NewRequest("POST", "/subscriptions/retest", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer user")
+	w := httptest.NewRecorder()
+	RetestSubscriptions(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d without Tor pool but got %d.", http.StatusServiceUnavailable, w.Code)
+	}
+
+	pool := tester.NewTorPool(&tester.TorContext{})
+	pool.RequestQueue = make(chan *tester.TestRequest, 1)
+	setRole(pool, nil, nil)
+	defer setRole(nil, nil, nil)
+	r = httptest.NewRequest("POST", "/subscriptions/retest", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer user")
+	w = httptest.NewRecorder()
+	RetestSubscriptions(w, r)
+	resp := &retestResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to request re-test: %d %s", w.Code, w.Body.String())
+	}
+	if len(resp.Scheduled) != 1 || resp.Scheduled[0] != hashedID || len(resp.Unknown) != 1 {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+
+	req := <-pool.RequestQueue
+	if !req.Background || !req.Expedited || req.Client != "rdsys" ||
+		len(req.BridgeLines) != 1 || req.BridgeLines[0] != "2.2.2.2:2" {
+		t.Errorf("Unexpected re-test request: %+v", req)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// telemetry records the demand of the API clients that opted into it, so we
+// can size our Tor pool based on real demand patterns.  It always exists.
+var telemetry = NewTelemetry()
+
+// Telemetry keeps track of the arrival of requests per consumer class, and
+// feeds the sizes and inter-arrival times of these requests into our
+// Prometheus metrics.  Like our abuse log, it never records who sent a
+// request; only the client's consumer class.  It's safe for concurrent use.
+type Telemetry struct {
+	// lastArrival maps a consumer class to the arrival time of its most
+	// recent request.
+	lastArrival map[string]time.Time
+	l           sync.Mutex
+}
+
+// NewTelemetry returns a new telemetry that hasn't seen any requests yet.
+func NewTelemetry() *Telemetry {
+	return &Telemetry{lastArrival: make(map[string]time.Time)}
+}
+
+// telemetryClass returns the consumer class under which our telemetry records
+// the requests of the given client, or the empty string if the client didn't
+// opt into telemetry.
+func telemetryClass(client *Token) string {
+
+	if client == nil || !client.Telemetry {
+		return ""
+	}
+	if client.Class != "" {
+		return client.Class
+	}
+	return clientClass(client)
+}
+
+// Record records a request of the given client that arrived at the given time
+// and contained the given number of bridge lines, if the client opted into
+// telemetry.
+func (t *Telemetry) Record(client *Token, numBridges int, now time.Time) {
+
+	class := telemetryClass(client)
+	if class == "" {
+		return
+	}
+	metrics.RequestSize.With(prometheus.Labels{"class": class}).Observe(float64(numBridges))
+	if interArrival, ok := t.interArrival(class, now); ok {
+		metrics.InterArrival.With(prometheus.Labels{"class": class}).Observe(interArrival.Seconds())
+	}
+}
+
+// interArrival remembers that a request of the given consumer class arrived at
+// the given time, and returns the time that passed since the class's previous
+// request.  The returned bool is false if this is the class's first request.
+func (t *Telemetry) interArrival(class string, now time.Time) (time.Duration, bool) {
+
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	last, exists := t.lastArrival[class]
+	if !exists {
+		t.lastArrival[class] = now
+		return 0, false
+	}
+	// Concurrent requests may reach us out of order.
+	if now.Before(last) {
+		return 0, true
+	}
+	t.lastArrival[class] = now
+	return now.Sub(last), true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTelemetryClass(t *testing.T) {
+
+	for client, expected := range map[*Token]string{
+		nil:                                    "",
+		&Token{Name: "rdsys"}:                  "",
+		&Token{Name: "rdsys", Telemetry: true}: ClassToken,
+		&Token{Name: "rdsys", Telemetry: true, Class: "distributor"}: "distributor",
+		&Token{Name: "operator", Admin: true, Telemetry: true}:       ClassAdmin,
+	} {
+		if class := telemetryClass(client); class != expected {
+			t.Errorf("Expected class %q for %+v but got %q.", expected, client, class)
+		}
+	}
+}
+
+func TestTelemetryInterArrival(t *testing.T) {
+
+	tel := NewTelemetry()
+	now := time.Now()
+	if _, ok := tel.interArrival("distributor", now); ok {
+		t.Errorf("First request has an inter-arrival time.")
+	}
+	if d, ok := tel.interArrival("distributor", now.Add(time.Minute)); !ok || d != time.Minute {
+		t.Errorf("Expected inter-arrival time of a minute but got %s.", d)
+	}
+	// Classes don't affect each other.
+	if _, ok := tel.interArrival("researcher", now.Add(2*time.Minute)); ok {
+		t.Errorf("First request of another class has an inter-arrival time.")
+	}
+	// Requests that reach us out of order arrived at about the same time.
+	if d, ok := tel.interArrival("distributor", now); !ok || d != 0 {
+		t.Errorf("Expected inter-arrival time of 0 but got %s.", d)
+	}
+	if d, _ := tel.interArrival("distributor", now.Add(3*time.Minute)); d != 2*time.Minute {
+		t.Errorf("Out-of-order request affected inter-arrival time: %s", d)
+	}
+
+	// Records of clients that didn't opt in are dropped.
+	tel.Record(&Token{Name: "rdsys"}, 10, now)
+	if _, exists := tel.lastArrival[ClassToken]; exists {
+		t.Errorf("Recorded request of client that didn't opt into telemetry.")
+	}
+	tel.Record(&Token{Name: "rdsys", Telemetry: true}, 10, now)
+	if _, exists := tel.lastArrival[ClassToken]; !exists {
+		t.Errorf("Failed to record request of client that opted into telemetry.")
+	}
+}
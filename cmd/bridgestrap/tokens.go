@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// AnonymousClient is the client name of API requests without token.
+	AnonymousClient = "anonymous"
+	// WebClient is the client name of requests to our Web interface.
+	WebClient = "web"
+)
+
+// priorities ranks the priorities of test requests, from lowest to highest.
+var priorities = map[string]int{
+	tester.PriorityBackground: 0,
+	tester.PriorityNormal:     1,
+}
+
+// tokens maps API tokens to their configuration.  It's empty if the operator
+// configured no tokens.
+var tokens = make(map[string]*Token)
+
+// Token represents the configuration of an API client that authenticates
+// with a bearer token.
+type Token struct {
+	Token string `json:"token"`
+	// Name identifies the client in logs and metrics, e.g., "rdsys".
+	Name string `json:"name"`
+	// Weight determines the client's share of our test capacity, relative to
+	// other clients.
+	Weight int `json:"weight"`
+	// Quota is the number of bridges that the client may have us test per
+	// QuotaWindow.  Cache hits don't count towards the quota.  Clients
+	// without quota may test as many bridges as they want.
+	Quota int `json:"quota,omitempty"`
+	// Admin allows the client to administer bridgestrap at runtime, e.g.,
+	// to change our canary bridges.
+	Admin bool `json:"admin,omitempty"`
+	// Replica allows the client to sync our cache, which is what our
+	// read-only replicas do.
+	Replica bool `json:"replica,omitempty"`
+	// Distributor allows the client to retire bridges, e.g., when it stops
+	// handing them out.
+	Distributor bool `json:"distributor,omitempty"`
+	// Worker allows the client to claim jobs from our job queue, send
+	// heartbeats for them, and report their results.  See JobQueue.
+	Worker bool `json:"worker,omitempty"`
+	// Metrics allows the client to fetch our bridge metrics, e.g., Tor
+	// Metrics' CollecTor.
+	Metrics bool `json:"metrics,omitempty"`
+	// Telemetry opts the client into our anonymised telemetry, which
+	// records the sizes and inter-arrival times of its requests under its
+	// consumer class, but never the client's name.
+	Telemetry bool `json:"telemetry,omitempty"`
+	// Class is the client's consumer class in our telemetry, e.g.,
+	// "distributor".  It defaults to the client's class in our abuse log,
+	// e.g., "token".
+	Class string `json:"class,omitempty"`
+	// Stages and Vantages are the test stages and vantage points that we
+	// use for the client's requests that don't specify their own, so
+	// simple clients can omit them.
+	Stages   []string `json:"stages,omitempty"`
+	Vantages []string `json:"vantages,omitempty"`
+	// Timeout is the number of seconds that Tor may take to test the
+	// bridges of the client's requests that don't specify their own, and
+	// MaxTimeout is the longest timeout that the client may ask for.  Both
+	// default to our global test timeout.
+	Timeout    float64 `json:"timeout,omitempty"`
+	MaxTimeout float64 `json:"max_timeout,omitempty"`
+	// Priority is the priority of the client's requests that don't specify
+	// their own, and MaxPriority is the highest priority that the client may
+	// ask for, e.g., "background".  MaxPriority defaults to "normal", and
+	// Priority to MaxPriority.
+	Priority    string `json:"priority,omitempty"`
+	MaxPriority string `json:"max_priority,omitempty"`
+	// Check is the name of the composite check that decides the verdicts
+	// that the client gets, instead of our own notion of functional.  See
+	// TokenConfig's Checks.
+	Check string `json:"check,omitempty"`
+	check *tester.Check
+}
+
+// TokenConfig represents our token configuration file.
+type TokenConfig struct {
+	Tokens []*Token `json:"tokens"`
+	// Checks maps the names of composite checks to their expressions, e.g.,
+	// "tcp_ok AND pt_ok AND descriptor_ok AND bandwidth > 1Mbps".  See
+	// tester.Check.
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// LoadTokens reads the given JSON token configuration file and returns a map
+// from tokens to their configuration.
+func LoadTokens(filename string) (map[string]*Token, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &TokenConfig{}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, err
+	}
+
+	checks := make(map[string]*tester.Check)
+	for name, expr := range config.Checks {
+		if checks[name], err = tester.ParseCheck(name, expr); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(map[string]*Token)
+	for _, t := range config.Tokens {
+		if t.Token == "" || t.Name == "" {
+			return nil, errors.New("tokens must have a token and a name")
+		}
+		if _, exists := result[t.Token]; exists {
+			return nil, fmt.Errorf("duplicate token for client %q", t.Name)
+		}
+		if t.Weight == 0 {
+			t.Weight = tester.DefaultWeight
+		} else if t.Weight < 0 {
+			return nil, fmt.Errorf("negative weight for client %q", t.Name)
+		}
+		if t.Quota < 0 {
+			return nil, fmt.Errorf("negative quota for client %q", t.Name)
+		}
+		if _, err := tester.ResolveStages(t.Stages); err != nil {
+			return nil, fmt.Errorf("invalid default stages for client %q: %s", t.Name, err)
+		}
+		if t.Timeout < 0 || t.MaxTimeout < 0 {
+			return nil, fmt.Errorf("negative timeout for client %q", t.Name)
+		}
+		if t.MaxTimeout > 0 && t.Timeout > t.MaxTimeout {
+			return nil, fmt.Errorf("timeout exceeds maximum timeout for client %q", t.Name)
+		}
+		if t.MaxPriority == "" {
+			t.MaxPriority = tester.PriorityNormal
+		}
+		if t.Priority == "" {
+			t.Priority = t.MaxPriority
+		}
+		maxRank, validMax := priorities[t.MaxPriority]
+		rank, valid := priorities[t.Priority]
+		if !valid || !validMax {
+			return nil, fmt.Errorf("unknown priority for client %q", t.Name)
+		}
+		if rank > maxRank {
+			return nil, fmt.Errorf("priority exceeds maximum priority for client %q", t.Name)
+		}
+		if t.Check != "" {
+			if t.check = checks[t.Check]; t.check == nil {
+				return nil, fmt.Errorf("unknown check %q for client %q", t.Check, t.Name)
+			}
+		}
+		result[t.Token] = t
+	}
+	return result, nil
+}
+
+// applyTokenDefaults fills in the test stages, vantage points, timeout, and
+// priority of the given request with the defaults of the given client's
+// token, unless the request contains its own.  Clients can opt out of their
+// default vantage points by asking for an empty list of vantage points.
+// Read-only replicas don't test bridges from vantage points, so they ignore
+// default vantage points.  The function returns an error if the request asks
+// for a longer timeout or a higher priority than the client's token allows.
+func applyTokenDefaults(req *tester.TestRequest, client *Token) error {
+
+	if req.Stages == nil {
+		req.Stages = client.Stages
+	}
+	if req.Vantages == nil && replica() == nil {
+		req.Vantages = client.Vantages
+	}
+	if req.Timeout == 0 {
+		req.Timeout = client.Timeout
+	}
+	if req.Priority == "" {
+		req.Priority = client.Priority
+	}
+
+	maxTimeout := client.MaxTimeout
+	if maxTimeout == 0 {
+		maxTimeout = tester.TestTimeout().Seconds()
+	}
+	if req.Timeout < 0 || req.Timeout > maxTimeout {
+		return fmt.Errorf("timeout must be between 0 and %g seconds", maxTimeout)
+	}
+
+	// Clients without token can't ask for more than normal priority.
+	maxPriority := client.MaxPriority
+	if maxPriority == "" {
+		maxPriority = tester.PriorityNormal
+	}
+	if req.Priority == "" {
+		req.Priority = maxPriority
+	}
+	rank, exists := priorities[req.Priority]
+	if !exists {
+		return fmt.Errorf("unknown priority %q", req.Priority)
+	}
+	if rank > priorities[maxPriority] {
+		return fmt.Errorf("priority %q exceeds maximum priority %q", req.Priority, maxPriority)
+	}
+	req.Background = req.Priority == tester.PriorityBackground
+
+	return nil
+}
+
+// applyCheck decides the verdicts of the bridges in the given result,
+// including its per-vantage results, with the given client's composite check,
+// if it has one.  We leave inconclusive results alone, and results whose
+// check outcome we don't know, e.g., because the check is about descriptors
+// and the result came from our cache.
+func applyCheck(result *tester.TestResult, client *Token) {
+
+	if client == nil || client.check == nil {
+		return
+	}
+	for _, bridgeTest := range result.Bridges {
+		if bridgeTest.Verdict == tester.VerdictInconclusive {
+			continue
+		}
+		passed, known := client.check.Evaluate(bridgeTest)
+		if !known {
+			continue
+		}
+		bridgeTest.Check = client.check.Name
+		bridgeTest.Functional = passed
+		if passed {
+			bridgeTest.Verdict = tester.VerdictFunctional
+			bridgeTest.Error = ""
+			bridgeTest.ErrorCode = ""
+		} else {
+			bridgeTest.Verdict = tester.VerdictDysfunctional
+			if bridgeTest.Error == "" {
+				bridgeTest.Error = fmt.Sprintf("bridge failed check %q", client.check.Name)
+				bridgeTest.ErrorCode = tester.ErrorCodeCheckFailed
+			}
+		}
+	}
+	for _, vantageResult := range result.VantageResults {
+		applyCheck(vantageResult, client)
+	}
+}
+
+// getClient determines which client sent the given API request, based on its
+// bearer token.  Requests without token belong to AnonymousClient.  If the
+// request contains a token that we don't know, the function returns an error.
+func getClient(r *http.Request) (*Token, error) {
+
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return &Token{Name: AnonymousClient, Weight: tester.DefaultWeight}, nil
+	}
+
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		abuseLog.Record(r, AbuseInvalidToken, ClassUnauthenticated)
+		return nil, errors.New("authorization header must contain bearer token")
+	}
+	t, exists := tokens[strings.TrimPrefix(auth, prefix)]
+	if !exists {
+		abuseLog.Record(r, AbuseInvalidToken, ClassUnauthenticated)
+		return nil, errors.New("invalid token")
+	}
+	return t, nil
+}
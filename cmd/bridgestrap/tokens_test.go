@@ -0,0 +1,235 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestLoadTokens(t *testing.T) {
+
+	tmpFh, err := ioutil.TempFile(os.TempDir(), "tokens-")
+	if err != nil {
+		t.Fatalf("Could not create temporary file for test: %s", err)
+	}
+	defer os.Remove(tmpFh.Name())
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [
+		{"token": "secret1", "name": "rdsys", "weight": 10},
+		{"token": "secret2", "name": "user"}
+	]}`), 0600)
+	result, err := LoadTokens(tmpFh.Name())
+	if err != nil {
+		t.Fatalf("Failed to load tokens: %s", err)
+	}
+	if result["secret1"].Name != "rdsys" || result["secret1"].Weight != 10 {
+		t.Errorf("Token was not loaded correctly.")
+	}
+	if result["secret2"].Weight != tester.DefaultWeight {
+		t.Errorf("Token without weight did not get default weight.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo", "weight": -1}]}`), 0600)
+	if _, err = LoadTokens(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject negative weight.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo", "quota": -1}]}`), 0600)
+	if _, err = LoadTokens(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject negative quota.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo", "stages": ["bogus"]}]}`), 0600)
+	if _, err = LoadTokens(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject invalid default stages.")
+	}
+
+	for _, token := range []string{
+		`{"token": "secret1", "name": "foo", "timeout": -1}`,
+		`{"token": "secret1", "name": "foo", "timeout": 60, "max_timeout": 30}`,
+		`{"token": "secret1", "name": "foo", "priority": "bogus"}`,
+		`{"token": "secret1", "name": "foo", "priority": "normal", "max_priority": "background"}`,
+	} {
+		ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [`+token+`]}`), 0600)
+		if _, err = LoadTokens(tmpFh.Name()); err == nil {
+			t.Errorf("Failed to reject token %s.", token)
+		}
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo", "max_priority": "background"}]}`), 0600)
+	if result, err = LoadTokens(tmpFh.Name()); err != nil {
+		t.Fatalf("Failed to load tokens with maximum priority: %s", err)
+	}
+	if result["secret1"].Priority != tester.PriorityBackground {
+		t.Errorf("Token's priority didn't default to its maximum priority.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo"}, {"token": "secret1", "name": "bar"}]}`), 0600)
+	if _, err = LoadTokens(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject duplicate token.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo", "check": "fast"}],
+		"checks": {"fast": "functional AND bandwidth > 1Mbps"}}`), 0600)
+	if result, err = LoadTokens(tmpFh.Name()); err != nil {
+		t.Fatalf("Failed to load tokens with check: %s", err)
+	}
+	if result["secret1"].check == nil || result["secret1"].check.Name != "fast" {
+		t.Errorf("Token's check was not loaded correctly.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [{"token": "secret1", "name": "foo", "check": "bogus"}]}`), 0600)
+	if _, err = LoadTokens(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject unknown check.")
+	}
+
+	ioutil.WriteFile(tmpFh.Name(), []byte(`{"tokens": [], "checks": {"fast": "bandwidth >"}}`), 0600)
+	if _, err = LoadTokens(tmpFh.Name()); err == nil {
+		t.Errorf("Failed to reject invalid check.")
+	}
+}
+
+func TestApplyCheck(t *testing.T) {
+
+	check, err := tester.ParseCheck("fast", "functional AND bandwidth > 1Mbps")
+	if err != nil {
+		t.Fatalf("Failed to parse check: %s", err)
+	}
+	client := &Token{Name: "rdsys", Check: "fast", check: check}
+
+	result := tester.NewTestResult()
+	result.Bridges["slow"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional,
+		Descriptor: &tester.Descriptor{Bandwidth: 100000}}
+	result.Bridges["fast"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional,
+		Descriptor: &tester.Descriptor{Bandwidth: 1000000}}
+	result.Bridges["cached"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional}
+	result.Bridges["inconclusive"] = &tester.BridgeTest{Verdict: tester.VerdictInconclusive}
+	result.VantageResults = map[string]*tester.TestResult{"ru": tester.NewTestResult()}
+	result.VantageResults["ru"].Bridges["slow"] = &tester.BridgeTest{Functional: true,
+		Verdict: tester.VerdictFunctional, Descriptor: &tester.Descriptor{Bandwidth: 100000}}
+
+	applyCheck(result, client)
+	if b := result.Bridges["slow"]; b.Functional || b.Verdict != tester.VerdictDysfunctional ||
+		b.ErrorCode != tester.ErrorCodeCheckFailed || b.Check != "fast" {
+		t.Errorf("Slow bridge passed check: %+v", b)
+	}
+	if b := result.Bridges["fast"]; !b.Functional || b.Check != "fast" {
+		t.Errorf("Fast bridge failed check: %+v", b)
+	}
+	// Our cache doesn't keep descriptors, so we can't tell.
+	if b := result.Bridges["cached"]; !b.Functional || b.Check != "" {
+		t.Errorf("Check changed result it doesn't know about: %+v", b)
+	}
+	if b := result.Bridges["inconclusive"]; b.Verdict != tester.VerdictInconclusive || b.Check != "" {
+		t.Errorf("Check changed inconclusive result: %+v", b)
+	}
+	if b := result.VantageResults["ru"].Bridges["slow"]; b.Functional {
+		t.Errorf("Slow bridge of per-vantage result passed check.")
+	}
+
+	// Clients without check get our own verdicts.
+	result = tester.NewTestResult()
+	result.Bridges["slow"] = &tester.BridgeTest{Functional: true, Verdict: tester.VerdictFunctional,
+		Descriptor: &tester.Descriptor{Bandwidth: 100000}}
+	applyCheck(result, &Token{Name: "user"})
+	if !result.Bridges["slow"].Functional {
+		t.Errorf("Client without check got check's verdict.")
+	}
+}
+
+func TestApplyTokenDefaults(t *testing.T) {
+
+	client := &Token{Name: "rdsys", Stages: []string{"tcp", "tor"}, Vantages: []string{"ru"}}
+
+	req := &tester.TestRequest{}
+	applyTokenDefaults(req, client)
+	if len(req.Stages) != 2 || len(req.Vantages) != 1 {
+		t.Errorf("Request did not get token's defaults: %+v", req)
+	}
+
+	// Requests override their token's defaults, even with an empty list.
+	req = &tester.TestRequest{Stages: []string{"pt"}, Vantages: []string{}}
+	applyTokenDefaults(req, client)
+	if len(req.Stages) != 1 || req.Stages[0] != "pt" || len(req.Vantages) != 0 {
+		t.Errorf("Token's defaults overrode request: %+v", req)
+	}
+
+	oldRole := currentRole.Load().(*role)
+	defer currentRole.Store(oldRole)
+	setRole(nil, nil, &Replica{})
+	req = &tester.TestRequest{}
+	applyTokenDefaults(req, client)
+	if req.Vantages != nil {
+		t.Errorf("Replica applied default vantage points: %+v", req)
+	}
+
+	// Requests can override their token's timeout and priority, but only
+	// within the token's limits.
+	defer tester.SetTestTimeout(tester.TestTimeout())
+	tester.SetTestTimeout(time.Minute)
+	client = &Token{Name: "rdsys", Timeout: 30, MaxTimeout: 120,
+		Priority: tester.PriorityBackground, MaxPriority: tester.PriorityNormal}
+	req = &tester.TestRequest{}
+	if err := applyTokenDefaults(req, client); err != nil || req.Timeout != 30 || !req.Background {
+		t.Errorf("Request did not get token's timeout and priority: %+v", req)
+	}
+	req = &tester.TestRequest{Timeout: 90, Priority: tester.PriorityNormal}
+	if err := applyTokenDefaults(req, client); err != nil || req.Timeout != 90 || req.Background {
+		t.Errorf("Request could not override token's timeout and priority: %+v", req)
+	}
+	for _, req := range []*tester.TestRequest{
+		&tester.TestRequest{Timeout: 180},
+		&tester.TestRequest{Timeout: -1},
+		&tester.TestRequest{Priority: "bogus"},
+	} {
+		if err := applyTokenDefaults(req, client); err == nil {
+			t.Errorf("Failed to reject request %+v.", req)
+		}
+	}
+
+	// Clients without token are bound by our own timeout, and can't ask for
+	// more than normal priority.
+	anonymous := &Token{Name: AnonymousClient}
+	if err := applyTokenDefaults(&tester.TestRequest{Timeout: 30}, anonymous); err != nil {
+		t.Errorf("Rejected shorter timeout: %s", err)
+	}
+	if err := applyTokenDefaults(&tester.TestRequest{Timeout: 90}, anonymous); err == nil {
+		t.Errorf("Failed to reject timeout that exceeds our own.")
+	}
+	client = &Token{Name: "bulk", Priority: tester.PriorityBackground, MaxPriority: tester.PriorityBackground}
+	if err := applyTokenDefaults(&tester.TestRequest{Priority: tester.PriorityNormal}, client); err == nil {
+		t.Errorf("Failed to reject priority that exceeds token's maximum.")
+	}
+}
+
+func TestGetClient(t *testing.T) {
+
+	tokens = map[string]*Token{"secret": &Token{Token: "secret", Name: "rdsys", Weight: 10}}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	r := httptest.NewRequest("GET", "/bridge-state", nil)
+	client, err := getClient(r)
+	if err != nil || client.Name != AnonymousClient {
+		t.Errorf("Request without token was not considered anonymous.")
+	}
+
+	r.Header.Set("Authorization", "Bearer secret")
+	client, err = getClient(r)
+	if err != nil || client.Name != "rdsys" || client.Weight != 10 {
+		t.Errorf("Failed to map token to client.")
+	}
+
+	r.Header.Set("Authorization", "Bearer bogus")
+	if _, err = getClient(r); err == nil {
+		t.Errorf("Failed to reject invalid token.")
+	}
+
+	r.Header.Set("Authorization", "Basic secret")
+	if _, err = getClient(r); err == nil {
+		t.Errorf("Failed to reject non-bearer authorization.")
+	}
+}
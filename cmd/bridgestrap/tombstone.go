@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// tombstones is our list of retired bridges.  It's nil if the operator didn't
+// configure a tombstone file.
+var tombstones *TombstoneList
+
+// tombstoneSchema is the schema of our tombstone file.
+var tombstoneSchema = &testcache.Schema{
+	Name:    "tombstone",
+	Version: 1,
+	Migrations: map[int]testcache.Migration{
+		0: testcache.NoMigration,
+	},
+}
+
+// TombstoneConfig represents our tombstone file.
+type TombstoneConfig struct {
+	// Tombstones maps the hashed identifiers of retired bridges to the time
+	// at which a distributor retired them.
+	Tombstones map[string]time.Time `json:"tombstones"`
+}
+
+// tombstoneResponse represents our response to requests that retire a bridge.
+type tombstoneResponse struct {
+	HashedID  string    `json:"hashed_id"`
+	RetiredAt time.Time `json:"retired_at"`
+	Expires   time.Time `json:"expires"`
+}
+
+// TombstoneList remembers the bridges that distributors retired, keyed by
+// their hashed identifier, for a window of time.  We don't re-test retired
+// bridges in the background, and we flag clients' attempts to test them, but
+// we keep their cache entries and history.  We persist the list to disk.
+// It's safe for concurrent use.
+type TombstoneList struct {
+	retired  map[string]time.Time
+	window   time.Duration
+	filename string
+	sync.Mutex
+}
+
+// LoadTombstoneList reads our tombstones from the given JSON file and forgets
+// the ones that are older than the given window.  If the file doesn't exist,
+// we start without tombstones.
+func LoadTombstoneList(filename string, window time.Duration) (*TombstoneList, error) {
+
+	l := &TombstoneList{
+		retired:  make(map[string]time.Time),
+		window:   window,
+		filename: filename,
+	}
+
+	config := &TombstoneConfig{}
+	err := tombstoneSchema.ReadFile(filename, config)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	for hashedID, retiredAt := range config.Tombstones {
+		if now.Sub(retiredAt) < window {
+			l.retired[strings.ToUpper(hashedID)] = retiredAt
+		}
+	}
+	return l, nil
+}
+
+// save writes our list to disk.  The caller must hold our lock.
+func (l *TombstoneList) save() error {
+
+	return tombstoneSchema.WriteFile(l.filename, &TombstoneConfig{Tombstones: l.retired})
+}
+
+// Len returns the number of bridges that we remember as retired.
+func (l *TombstoneList) Len() int {
+
+	l.Lock()
+	defer l.Unlock()
+
+	return len(l.retired)
+}
+
+// Retire marks the bridge with the given hashed identifier as retired at the
+// given time, and returns the time at which it was retired.  Retiring a bridge
+// again doesn't renew its tombstone.
+func (l *TombstoneList) Retire(hashedID string, now time.Time) (time.Time, error) {
+
+	hashedID = strings.ToUpper(hashedID)
+
+	l.Lock()
+	defer l.Unlock()
+
+	if retiredAt, exists := l.retired[hashedID]; exists && now.Sub(retiredAt) < l.window {
+		return retiredAt, nil
+	}
+	l.retired[hashedID] = now
+	for id, retiredAt := range l.retired {
+		if now.Sub(retiredAt) >= l.window {
+			delete(l.retired, id)
+		}
+	}
+	if err := l.save(); err != nil {
+		delete(l.retired, hashedID)
+		return time.Time{}, err
+	}
+	return now, nil
+}
+
+// RetiredAt returns the time at which a distributor retired the given bridge
+// line's bridge, and nil if it didn't do so within our window.
+func (l *TombstoneList) RetiredAt(bridgeLine string, now time.Time) *time.Time {
+
+	addrPort, err := bridgeline.AddrPort(bridgeLine)
+	if err != nil {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for _, hashedID := range hasher.HashesOf(addrPort) {
+		if retiredAt, exists := l.retired[hashedID]; exists && now.Sub(retiredAt) < l.window {
+			return &retiredAt
+		}
+	}
+	return nil
+}
+
+// active returns the given bridge lines whose bridges weren't retired.  We
+// don't re-test retired bridges in the background.
+func (l *TombstoneList) active(bridgeLines []string, now time.Time) []string {
+
+	if l == nil {
+		return bridgeLines
+	}
+	active := []string{}
+	for _, bridgeLine := range bridgeLines {
+		if l.RetiredAt(bridgeLine, now) == nil {
+			active = append(active, bridgeLine)
+		}
+	}
+	return active
+}
+
+// flagRetired sets the RetiredAt field of the bridges in the given result,
+// including its per-vantage results, that a distributor retired, and returns
+// their number.
+func (l *TombstoneList) flagRetired(result *tester.TestResult, now time.Time) int {
+
+	if l == nil {
+		return 0
+	}
+	flagged := 0
+	for bridgeLine, bridgeTest := range result.Bridges {
+		if retiredAt := l.RetiredAt(bridgeLine, now); retiredAt != nil {
+			bridgeTest.RetiredAt = retiredAt
+			flagged++
+		}
+	}
+	for _, vantageResult := range result.VantageResults {
+		l.flagRetired(vantageResult, now)
+	}
+	return flagged
+}
+
+// getDistributor determines the client that sent the given API request and
+// returns an error if the client isn't allowed to retire bridges.
+func getDistributor(r *http.Request) (*Token, error) {
+
+	client, err := getClient(r)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Distributor && !client.Admin {
+		abuseLog.Record(r, AbuseForbidden, clientClass(client))
+		return nil, errors.New("token is not allowed to retire bridges")
+	}
+	return client, nil
+}
+
+// RetireBridge marks the bridge with the given hashed identifier as retired,
+// e.g., because a distributor stopped handing it out.  We stop re-testing the
+// bridge in the background and flag resubmissions, but keep its history.
+func RetireBridge(w http.ResponseWriter, r *http.Request) {
+
+	client, err := getDistributor(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	hashedID := strings.ToUpper(mux.Vars(r)["id"])
+	retiredAt, err := tombstones.Retire(hashedID, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to retire bridge %s: %s", hashedID, err)
+		http.Error(w, "failed to retire bridge", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Client %s retired bridge %s.", client.Name, hashedID)
+	metrics.RetiredBridges.Set(float64(tombstones.Len()))
+
+	jsonResult, err := json.Marshal(&tombstoneResponse{
+		HashedID:  hashedID,
+		RetiredAt: retiredAt,
+		Expires:   retiredAt.Add(tombstones.window),
+	})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal tombstone", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
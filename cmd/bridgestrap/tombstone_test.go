@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestTombstoneList(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-tombstones-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tombstones.json")
+	hasher = NewBridgeHasher([]byte("0123456789abcdef0123456789abcdef"), nil)
+	defer func() { hasher = nil }()
+
+	l, err := LoadTombstoneList(filename, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to load tombstones: %s", err)
+	}
+	now := time.Now().UTC()
+	retiredAt, err := l.Retire(hasher.HashAddrPort("1.1.1.1:1"), now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to retire bridge: %s", err)
+	}
+	// Retiring a bridge again doesn't renew its tombstone.
+	if again, _ := l.Retire(hasher.HashAddrPort("1.1.1.1:1"), now); !again.Equal(retiredAt) {
+		t.Errorf("Retiring bridge again changed its tombstone from %s to %s.", retiredAt, again)
+	}
+
+	// Tombstones must survive restarts.
+	if l, err = LoadTombstoneList(filename, 24*time.Hour); err != nil {
+		t.Fatalf("Failed to reload tombstones: %s", err)
+	}
+	if l.Len() != 1 {
+		t.Fatalf("Expected 1 tombstone but got %d.", l.Len())
+	}
+	if r := l.RetiredAt("obfs4 1.1.1.1:1 cert=foo iat-mode=0", now); r == nil || !r.Equal(retiredAt) {
+		t.Errorf("Failed to find tombstone of bridge line with retired address.")
+	}
+	if l.RetiredAt("2.2.2.2:2", now) != nil {
+		t.Errorf("Found tombstone of bridge that we never retired.")
+	}
+	if active := l.active([]string{"1.1.1.1:1", "2.2.2.2:2"}, now); len(active) != 1 || active[0] != "2.2.2.2:2" {
+		t.Errorf("Unexpected active bridge lines: %v", active)
+	}
+
+	result := tester.NewTestResult()
+	result.Bridges["1.1.1.1:1"] = &tester.BridgeTest{Functional: true}
+	result.Bridges["2.2.2.2:2"] = &tester.BridgeTest{Functional: true}
+	if flagged := l.flagRetired(result, now); flagged != 1 || result.Bridges["1.1.1.1:1"].RetiredAt == nil {
+		t.Errorf("Failed to flag resubmitted bridge.")
+	}
+
+	// Tombstones expire after our window.
+	if l.RetiredAt("1.1.1.1:1", now.Add(24*time.Hour)) != nil {
+		t.Errorf("Tombstone outlived our window.")
+	}
+
+	// Without tombstones, every bridge is active.
+	var none *TombstoneList
+	if active := none.active([]string{"1.1.1.1:1"}, now); len(active) != 1 {
+		t.Errorf("Unexpected active bridge lines: %v", active)
+	}
+}
+
+func TestRetireBridge(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-tombstones-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if tombstones, err = LoadTombstoneList(filepath.Join(dir, "tombstones.json"), 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { tombstones = nil }()
+	tokens = map[string]*Token{
+		"user":  &Token{Token: "user", Name: "user", Weight: 1},
+		"rdsys": &Token{Token: "rdsys", Name: "rdsys", Weight: 1, Distributor: true},
+	}
+	defer func() { tokens = make(map[string]*Token) }()
+
+	hashedID := "ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789ABCDEF0123456789"
+	retire := func(token string) *httptest.ResponseRecorder {
+		r := mux.SetURLVars(httptest.NewRequest("DELETE", "/bridges/"+hashedID, nil), map[string]string{"id": hashedID})
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		RetireBridge(w, r)
+		return w
+	}
+
+	if w := retire("user"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for client without permission but got %d.", http.StatusForbidden, w.Code)
+	}
+	w := retire("rdsys")
+	resp := &tombstoneResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Failed to retire bridge: %d %s", w.Code, w.Body.String())
+	}
+	if resp.HashedID != hashedID || resp.Expires.Sub(resp.RetiredAt) != 24*time.Hour || tombstones.Len() != 1 {
+		t.Errorf("Unexpected response: %s", w.Body.String())
+	}
+}
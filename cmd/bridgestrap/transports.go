@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// transportsResponse tells clients which transports we can test, and why we
+// can't test the transports of our unavailable plugins.
+type transportsResponse struct {
+	Transports []string               `json:"transports"`
+	Plugins    []*tester.PluginStatus `json:"plugins"`
+}
+
+// newTransportsResponse turns the given plugin statuses into our response.
+// We can always test vanilla bridges.
+func newTransportsResponse(statuses []*tester.PluginStatus) *transportsResponse {
+
+	resp := &transportsResponse{Transports: []string{bridgeline.VanillaTransport}, Plugins: statuses}
+	for _, status := range statuses {
+		if status.Available {
+			resp.Transports = append(resp.Transports, status.Transports...)
+		}
+	}
+	return resp
+}
+
+// Transports serves the transports whose bridges we can test, and the status
+// of the plugins that implement them.
+func Transports(w http.ResponseWriter, r *http.Request) {
+
+	metrics.Requests.With(prometheus.Labels{"type": "transports", "status": "valid"}).Inc()
+
+	if torPool() == nil {
+		http.Error(w, "read-only replicas don't test bridges", http.StatusNotFound)
+		return
+	}
+
+	jsonResult, err := json.Marshal(newTransportsResponse(tester.PluginStatuses()))
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal transports", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
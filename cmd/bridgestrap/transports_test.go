@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestNewTransportsResponse(t *testing.T) {
+
+	resp := newTransportsResponse([]*tester.PluginStatus{
+		{Transports: []string{"obfs4", "meek_lite"}, Binary: "/usr/bin/lyrebird", Available: true},
+		{Transports: []string{"snowflake"}, Binary: "/usr/bin/snowflake-client", Error: "executable file not found"},
+	})
+	expected := []string{"vanilla", "obfs4", "meek_lite"}
+	if !reflect.DeepEqual(resp.Transports, expected) {
+		t.Errorf("Expected transports %v but got %v.", expected, resp.Transports)
+	}
+	if len(resp.Plugins) != 2 {
+		t.Errorf("Expected the status of 2 plugins but got %d.", len(resp.Plugins))
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+const (
+	// InvalidCacheTimeout determines how long we remember invalid bridge
+	// lines.  A bridge line that's invalid today will be invalid tomorrow,
+	// so we can afford a long timeout.
+	InvalidCacheTimeout = 7 * 24 * time.Hour
+	// MaxInvalidCacheEntries bounds the memory that invalid bridge lines can
+	// take up.
+	MaxInvalidCacheEntries = 10000
+)
+
+var invalidCache = NewInvalidCache()
+
+// InvalidCache remembers bridge lines that failed validation, so we don't
+// have to validate (and log) the same garbage over and over again.
+type InvalidCache struct {
+	// Entries maps an invalid bridge line to a cache entry.
+	Entries map[string]*testcache.Entry
+	l       sync.Mutex
+}
+
+// NewInvalidCache returns a new cache for invalid bridge lines.
+func NewInvalidCache() *InvalidCache {
+	return &InvalidCache{Entries: make(map[string]*testcache.Entry)}
+}
+
+// Check returns nil if the given bridge line is valid, and otherwise the
+// reason why it's invalid.  The source tells us where the bridge line came
+// from and is used for our metrics.
+func (ic *InvalidCache) Check(bridgeLine, source string) error {
+
+	now := time.Now().UTC()
+	ic.l.Lock()
+	defer ic.l.Unlock()
+
+	if entry, exists := ic.Entries[bridgeLine]; exists {
+		if entry.Time.After(now.Add(-InvalidCacheTimeout)) {
+			metrics.InvalidLines.With(prometheus.Labels{"source": source, "cache": "hit"}).Inc()
+			return errors.New(entry.Error)
+		}
+		delete(ic.Entries, bridgeLine)
+	}
+
+	err := bridgeline.Validate(bridgeLine)
+	if err == nil {
+		return nil
+	}
+	metrics.InvalidLines.With(prometheus.Labels{"source": source, "cache": "miss"}).Inc()
+	if redaction.Hides(ChannelLogs, FieldBridgeLine) {
+		// Validation errors may contain parts of the bridge line.
+		log.Printf("Rejecting invalid bridge line.")
+	} else {
+		log.Printf("Rejecting invalid bridge line: %s", err)
+	}
+
+	// Make room for the new entry by pruning expired entries.
+	if len(ic.Entries) >= MaxInvalidCacheEntries {
+		for line, entry := range ic.Entries {
+			if entry.Time.Before(now.Add(-InvalidCacheTimeout)) {
+				delete(ic.Entries, line)
+			}
+		}
+	}
+	if len(ic.Entries) < MaxInvalidCacheEntries {
+		ic.Entries[bridgeLine] = &testcache.Entry{Error: err.Error(), Time: now}
+	}
+
+	return err
+}
+
+// supportsTransport returns true if our Tor instances can test bridges of the
+// given transport.  Read-only replicas don't test bridges, so they don't
+// reject any transport.
+func supportsTransport(transport string) bool {
+
+	pool := torPool()
+	return pool == nil || pool.SupportsTransport(transport)
+}
+
+// checkBridgeLines normalises the given bridge lines of a client's request,
+// which may be bridge cards or QR code payloads, and returns the resulting
+// bridge lines, along with diagnostics of the malformed ones.  We keep invalid
+// bridge lines, which our invalid cache reports as dysfunctional, but drop
+// cards that we failed to normalise, and bridge lines whose transport none of
+// our Tor instances supports, because our scheduler would reject the entire
+// request because of them.
+func checkBridgeLines(lines []string) ([]string, []*tester.LineDiagnostic) {
+
+	bridgeLines := []string{}
+	diagnostics := []*tester.LineDiagnostic{}
+	for i, line := range lines {
+		normalised := []string{line}
+		if bridgeline.IsCard(line) {
+			var err error
+			if normalised, err = bridgeline.Normalize(line); err != nil {
+				log.Printf("Failed to normalise bridge card: %s", err)
+				diagnostics = append(diagnostics, &tester.LineDiagnostic{
+					Index: i,
+					Field: bridgeline.FieldLine,
+					Error: err.Error(),
+				})
+				continue
+			}
+		}
+		for _, bridgeLine := range normalised {
+			if err := bridgeline.Validate(bridgeLine); err != nil {
+				diagnostic := &tester.LineDiagnostic{Index: i, Error: fmt.Sprintf("invalid bridge line: %s", err)}
+				if v, ok := err.(*bridgeline.ValidationError); ok {
+					diagnostic.Field = v.Field
+				}
+				diagnostics = append(diagnostics, diagnostic)
+			} else if transport := bridgeline.Transport(bridgeLine); !supportsTransport(transport) {
+				diagnostics = append(diagnostics, &tester.LineDiagnostic{
+					Index: i,
+					Field: bridgeline.FieldTransport,
+					Error: fmt.Sprintf("no client for transport %q", transport),
+				})
+				continue
+			}
+			bridgeLines = append(bridgeLines, bridgeLine)
+		}
+	}
+	return bridgeLines, diagnostics
+}
+
+// validationResponse represents our response to validation requests.
+type validationResponse struct {
+	Valid       bool                     `json:"valid"`
+	Diagnostics []*tester.LineDiagnostic `json:"diagnostics"`
+}
+
+// ValidateBridgeLines checks the bridge lines in the given JSON request
+// without testing them, so clients can find malformed lines before they
+// submit a batch.  We respond with 200 if all lines are well-formed, and
+// otherwise with 400 and a diagnostic per malformed line.
+func ValidateBridgeLines(w http.ResponseWriter, r *http.Request) {
+
+	reqStatus := "invalid"
+	defer func() {
+		metrics.Requests.With(prometheus.Labels{"type": "validate", "status": reqStatus}).Inc()
+	}()
+
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		log.Printf("Failed to read HTTP body: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req := &tester.TestRequest{}
+	if err := json.Unmarshal(b, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.BridgeLines) == 0 {
+		http.Error(w, "no bridge lines given", http.StatusBadRequest)
+		return
+	}
+	if len(req.BridgeLines) > tester.MaxBridgesPerReq {
+		http.Error(w, fmt.Sprintf("maximum of %d bridge lines allowed", tester.MaxBridgesPerReq), http.StatusBadRequest)
+		return
+	}
+	reqStatus = "valid"
+
+	_, diagnostics := checkBridgeLines(req.BridgeLines)
+	if redaction.Hides(ChannelAPI, FieldError) {
+		for _, diagnostic := range diagnostics {
+			diagnostic.Error = RedactedError
+		}
+	}
+	jsonResult, err := json.Marshal(&validationResponse{Valid: len(diagnostics) == 0, Diagnostics: diagnostics})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal validation result", http.StatusInternalServerError)
+		return
+	}
+	if len(diagnostics) > 0 {
+		SendJSONStatusResponse(w, http.StatusBadRequest, string(jsonResult))
+	} else {
+		SendJSONResponse(w, string(jsonResult))
+	}
+}
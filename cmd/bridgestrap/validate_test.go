@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/testcache"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func init() {
+	InitMetrics()
+}
+
+func TestInvalidCache(t *testing.T) {
+
+	ic := NewInvalidCache()
+
+	if err := ic.Check("1.2.3.4:1234", "api"); err != nil {
+		t.Errorf("Rejected valid bridge line: %s", err)
+	}
+	if len(ic.Entries) != 0 {
+		t.Errorf("Valid bridge line made it into invalid cache.")
+	}
+
+	err := ic.Check("bogus", "api")
+	if err == nil || len(ic.Entries) != 1 {
+		t.Fatalf("Failed to cache invalid bridge line.")
+	}
+
+	// The cached error must be identical to the original one.
+	cachedErr := ic.Check("bogus", "api")
+	if cachedErr == nil || cachedErr.Error() != err.Error() {
+		t.Errorf("Cached error %q differs from original error %q.", cachedErr, err)
+	}
+
+	// Expired entries must be re-validated.
+	ic.Entries["bogus"].Time = time.Now().UTC().Add(-InvalidCacheTimeout - time.Hour)
+	ic.Entries["bogus"].Error = "stale"
+	if err = ic.Check("bogus", "api"); err == nil || err.Error() == "stale" {
+		t.Errorf("Failed to re-validate expired entry.")
+	}
+}
+
+func TestLineDiagnostics(t *testing.T) {
+
+	cache = testcache.New(time.Hour)
+	setRole(tester.NewTorPool(&tester.TorContext{}), nil, nil)
+	defer func() { cache = nil; setRole(nil, nil, nil) }()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+
+	body := `{"bridge_lines": ["1.1.1.1:1", "bogus", "[not json", "foo 2.2.2.2:2"]}`
+	w := httptest.NewRecorder()
+	BridgeState(w, httptest.NewRequest("GET", "/bridge-state", strings.NewReader(body)))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("Expected status code %d but got %d: %s", http.StatusMultiStatus, w.Code, w.Body.String())
+	}
+	result := tester.NewTestResult()
+	if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+		t.Fatalf("Failed to unmarshal result: %s", err)
+	}
+
+	// The invalid bridge line is still reported as dysfunctional, but the
+	// malformed QR code payload and the bridge line whose transport we can't
+	// test are dropped.
+	if len(result.Bridges) != 2 || result.Bridges["1.1.1.1:1"] == nil || result.Bridges["bogus"] == nil {
+		t.Fatalf("Unexpected bridge results: %s", w.Body.String())
+	}
+	if code := result.Bridges["bogus"].ErrorCode; code != tester.ErrorCodeUnparseableLine {
+		t.Errorf("Expected error code %q but got %q.", tester.ErrorCodeUnparseableLine, code)
+	}
+	if len(result.Diagnostics) != 3 {
+		t.Fatalf("Expected 3 diagnostics but got %d: %s", len(result.Diagnostics), w.Body.String())
+	}
+	for i, field := range []string{bridgeline.FieldAddrPort, bridgeline.FieldLine, bridgeline.FieldTransport} {
+		if d := result.Diagnostics[i]; d.Index != i+1 || d.Error == "" || d.Field != field {
+			t.Errorf("Unexpected diagnostic %+v.", d)
+		}
+	}
+
+	// A request whose bridge lines are all malformed still gets diagnostics.
+	w = httptest.NewRecorder()
+	BridgeState(w, httptest.NewRequest("GET", "/bridge-state", strings.NewReader(`{"bridge_lines": ["foo 2.2.2.2:2"]}`)))
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), `no client for transport \"foo\"`) {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	// Well-formed requests get a plain 200.
+	w = httptest.NewRecorder()
+	BridgeState(w, httptest.NewRequest("GET", "/bridge-state", strings.NewReader(`{"bridge_lines": ["1.1.1.1:1"]}`)))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "diagnostics") {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+
+	// Oversized requests are rejected before we parse their bridge lines, even
+	// if all of them are malformed.
+	lines := make([]string, tester.MaxBridgesPerReq+1)
+	for i := range lines {
+		lines[i] = "foo 2.2.2.2:2"
+	}
+	b, _ := json.Marshal(map[string][]string{"bridge_lines": lines})
+	w = httptest.NewRecorder()
+	BridgeState(w, httptest.NewRequest("GET", "/bridge-state", strings.NewReader(string(b))))
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "diagnostics") {
+		t.Errorf("Unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestValidateBridgeLines(t *testing.T) {
+
+	validate := func(body string) (int, *validationResponse) {
+		w := httptest.NewRecorder()
+		ValidateBridgeLines(w, httptest.NewRequest("POST", "/bridge-lines/validate", strings.NewReader(body)))
+		resp := &validationResponse{}
+		json.Unmarshal(w.Body.Bytes(), resp)
+		return w.Code, resp
+	}
+
+	code, resp := validate(`{"bridge_lines": ["1.2.3.4:1234", "obfs4 1.2.3.4:1234 cert=foo iat-mode=0"]}`)
+	if code != http.StatusOK || !resp.Valid || len(resp.Diagnostics) != 0 {
+		t.Errorf("Unexpected response to valid bridge lines: %d %+v", code, resp)
+	}
+
+	code, resp = validate(`{"bridge_lines": ["1.2.3.4:1234", "1.2.3.4:0", "obfs4 1.2.3.4:1234 cert=foo"]}`)
+	if code != http.StatusBadRequest || resp.Valid || len(resp.Diagnostics) != 2 {
+		t.Fatalf("Unexpected response to invalid bridge lines: %d %+v", code, resp)
+	}
+	if d := resp.Diagnostics[0]; d.Index != 1 || d.Field != bridgeline.FieldPort {
+		t.Errorf("Unexpected diagnostic %+v.", d)
+	}
+	if d := resp.Diagnostics[1]; d.Index != 2 || d.Field != bridgeline.FieldArgs {
+		t.Errorf("Unexpected diagnostic %+v.", d)
+	}
+
+	if code, _ = validate(`{"bridge_lines": []}`); code != http.StatusBadRequest {
+		t.Errorf("Accepted request without bridge lines.")
+	}
+}
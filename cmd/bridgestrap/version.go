@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// torBinary is the Tor executable that we resolved at startup.  It's nil on
+// read-only replicas, which don't run Tor.
+var torBinary *tester.TorBinary
+
+// versionResponse tells clients which version of bridgestrap they're talking
+// to, and which Tor executable it runs.
+type versionResponse struct {
+	Version string            `json:"version"`
+	Tor     *tester.TorBinary `json:"tor,omitempty"`
+}
+
+// Version serves our version and the path and version of our Tor executable,
+// which helps operators debug misconfigured containers.
+func Version(w http.ResponseWriter, r *http.Request) {
+
+	metrics.Requests.With(prometheus.Labels{"type": "version", "status": "valid"}).Inc()
+
+	jsonResult, err := json.Marshal(&versionResponse{Version: BridgestrapVersion, Tor: torBinary})
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		http.Error(w, "failed to marshal version", http.StatusInternalServerError)
+		return
+	}
+	SendJSONResponse(w, string(jsonResult))
+}
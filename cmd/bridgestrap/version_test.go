@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestVersion(t *testing.T) {
+
+	for _, binary := range []*tester.TorBinary{nil, {Path: "/usr/bin/tor", Version: "0.4.8.10"}} {
+		torBinary = binary
+		w := httptest.NewRecorder()
+		Version(w, httptest.NewRequest("GET", "/version", nil))
+
+		resp := &versionResponse{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil {
+			t.Fatalf("Failed to unmarshal version: %s", err)
+		}
+		if resp.Version != BridgestrapVersion {
+			t.Errorf("Expected version %s but got %s.", BridgestrapVersion, resp.Version)
+		}
+		if (binary == nil) != (resp.Tor == nil) || (binary != nil && *resp.Tor != *binary) {
+			t.Errorf("Expected Tor executable %+v but got %+v.", binary, resp.Tor)
+		}
+	}
+	torBinary = nil
+}
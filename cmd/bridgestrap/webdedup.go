@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+// WebDedupWindow is the time for which our Web interface serves the result of
+// a bridge's test to everyone who submits the same bridge line, instead of
+// testing it again.
+const WebDedupWindow = 2 * time.Minute
+
+// webSubmissions remembers the recent submissions of our Web interface.
+var webSubmissions = NewSubmissions(WebDedupWindow)
+
+// submission is a bridge line that someone recently submitted over our Web
+// interface.  The done channel is closed once the bridge's test is done.
+type submission struct {
+	done   chan bool
+	result *tester.BridgeTest
+	tested time.Time
+}
+
+// Submissions deduplicates submissions of the same bridge line, regardless of
+// who submitted it.  Links to our Web interface get shared widely, and
+// without deduplication, every visitor who submits the same bridge line would
+// queue another test of the same bridge.
+type Submissions struct {
+	window  time.Duration
+	entries map[string]*submission
+	sync.Mutex
+}
+
+// NewSubmissions returns a new Submissions that remembers submissions for the
+// given window.
+func NewSubmissions(window time.Duration) *Submissions {
+
+	return &Submissions{
+		window:  window,
+		entries: make(map[string]*submission),
+	}
+}
+
+// prune removes submissions whose test is done and older than our window.
+// The caller must hold our lock.
+func (s *Submissions) prune(now time.Time) {
+
+	for bridgeLine, sub := range s.entries {
+		if !sub.tested.IsZero() && now.Sub(sub.tested) > s.window {
+			delete(s.entries, bridgeLine)
+		}
+	}
+}
+
+// Test returns the result of the given bridge line's test.  If someone
+// submitted the bridge line within our window, we return the result of their
+// test, waiting for it if it's still in progress.  Otherwise, we run the given
+// test function.  Test also returns when the bridge was tested, and whether
+// the result came from an earlier submission.
+func (s *Submissions) Test(bridgeLine string, test func() *tester.BridgeTest) (*tester.BridgeTest, time.Time, bool) {
+
+	s.Lock()
+	s.prune(time.Now())
+	if sub, exists := s.entries[bridgeLine]; exists {
+		s.Unlock()
+		<-sub.done
+		if sub.result != nil {
+			return sub.result, sub.tested, true
+		}
+		// The earlier test failed to produce a result, so we run our own.
+		return s.Test(bridgeLine, test)
+	}
+	sub := &submission{done: make(chan bool)}
+	s.entries[bridgeLine] = sub
+	s.Unlock()
+
+	result := test()
+	s.Lock()
+	sub.result, sub.tested = result, time.Now()
+	if result == nil {
+		delete(s.entries, bridgeLine)
+	}
+	s.Unlock()
+	close(sub.done)
+
+	return result, sub.tested, false
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"html/template"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/tester"
+)
+
+func TestSubmissions(t *testing.T) {
+
+	s := NewSubmissions(time.Minute)
+	var l sync.Mutex
+	numTests := 0
+	release := make(chan bool)
+	test := func() *tester.BridgeTest {
+		l.Lock()
+		numTests++
+		l.Unlock()
+		<-release
+		return &tester.BridgeTest{Functional: true}
+	}
+
+	// Concurrent submissions of the same bridge line share a single test.
+	var wg sync.WaitGroup
+	numRecent := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, _, recent := s.Test("1.2.3.4:1234", test)
+			if result == nil || !result.Functional {
+				t.Errorf("Unexpected result: %+v", result)
+			}
+			if recent {
+				l.Lock()
+				numRecent++
+				l.Unlock()
+			}
+		}()
+	}
+	// Give all submissions a chance to arrive before the test finishes.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if numTests != 1 || numRecent != 4 {
+		t.Errorf("Expected 1 test and 4 recent results but got %d and %d.", numTests, numRecent)
+	}
+
+	// Other bridge lines get their own test.
+	if _, _, recent := s.Test("2.3.4.5:2345", test); recent || numTests != 2 {
+		t.Errorf("Served result of another bridge line.")
+	}
+
+	// Submissions are forgotten after our window.
+	s.entries["1.2.3.4:1234"].tested = time.Now().Add(-2 * time.Minute)
+	if _, _, recent := s.Test("1.2.3.4:1234", test); recent || numTests != 3 {
+		t.Errorf("Served result of expired submission.")
+	}
+
+	// Tests without result aren't remembered.
+	s.Test("3.4.5.6:3456", func() *tester.BridgeTest { return nil })
+	if _, exists := s.entries["3.4.5.6:3456"]; exists {
+		t.Errorf("Remembered submission without result.")
+	}
+}
+
+func TestSendResultPage(t *testing.T) {
+
+	tmpl, err := template.ParseFiles("../../templates/success.html")
+	if err != nil {
+		t.Fatalf("Failed to parse template: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	sendResultPage(w, tmpl, &webResultPage{})
+	if strings.Contains(w.Body.String(), "seconds ago") {
+		t.Errorf("Page of fresh test mentions earlier test.")
+	}
+
+	w = httptest.NewRecorder()
+	sendResultPage(w, tmpl, &webResultPage{Recent: true, Seconds: 42})
+	if !strings.Contains(w.Body.String(), "42 seconds ago") {
+		t.Errorf("Page of recent test doesn't mention when we tested the bridge.")
+	}
+}
@@ -0,0 +1,331 @@
+// Package geoip reads MaxMind DB files, e.g., GeoLite2-Country.mmdb and
+// GeoLite2-ASN.mmdb, so we can learn where the bridges that we test are
+// located.  It implements just enough of the MaxMind DB format
+// <https://maxmind.github.io/MaxMind-DB/> to look up IP addresses.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net"
+)
+
+// metadataMarker precedes the metadata at the end of a MaxMind DB file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// maxMetadataSize is the maximum size of a MaxMind DB file's metadata.
+const maxMetadataSize = 128 * 1024
+
+// dataSectionSeparator is the number of zero bytes between a MaxMind DB
+// file's search tree and its data section.
+const dataSectionSeparator = 16
+
+// Data types of the MaxMind DB format.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Metadata describes a MaxMind DB file.
+type Metadata struct {
+	DatabaseType string
+	IPVersion    uint
+	NodeCount    uint
+	RecordSize   uint
+}
+
+// Reader looks up IP addresses in a MaxMind DB file.
+type Reader struct {
+	Metadata Metadata
+	tree     []byte
+	data     []byte
+	// ipv4Start is the node at which IPv4 addresses start in the search
+	// tree of an IPv6 database, i.e., the node of ::/96.
+	ipv4Start uint
+}
+
+// Open reads the given MaxMind DB file.
+func Open(filename string) (*Reader, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := New(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MaxMind DB file %q: %v", filename, err)
+	}
+	return r, nil
+}
+
+// New returns a reader for the given content of a MaxMind DB file.
+func New(content []byte) (*Reader, error) {
+
+	searchStart := 0
+	if len(content) > maxMetadataSize {
+		searchStart = len(content) - maxMetadataSize
+	}
+	i := bytes.LastIndex(content[searchStart:], metadataMarker)
+	if i < 0 {
+		return nil, errors.New("metadata marker not found")
+	}
+	metadataStart := searchStart + i + len(metadataMarker)
+	value, _, err := decode(content[metadataStart:], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %v", err)
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	r := &Reader{}
+	r.Metadata.DatabaseType, _ = m["database_type"].(string)
+	for key, field := range map[string]*uint{
+		"ip_version":  &r.Metadata.IPVersion,
+		"node_count":  &r.Metadata.NodeCount,
+		"record_size": &r.Metadata.RecordSize,
+	} {
+		v, ok := m[key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("metadata lacks %q", key)
+		}
+		*field = uint(v)
+	}
+	if r.Metadata.IPVersion != 4 && r.Metadata.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.Metadata.IPVersion)
+	}
+	if r.Metadata.RecordSize != 24 && r.Metadata.RecordSize != 28 && r.Metadata.RecordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.Metadata.RecordSize)
+	}
+
+	treeSize := r.Metadata.NodeCount * r.Metadata.RecordSize / 4
+	if treeSize+dataSectionSeparator > uint(searchStart+i) {
+		return nil, errors.New("search tree exceeds file")
+	}
+	r.tree = content[:treeSize]
+	r.data = content[treeSize+dataSectionSeparator : searchStart+i]
+
+	if r.Metadata.IPVersion == 6 {
+		node := uint(0)
+		for bit := 0; bit < 96 && node < r.Metadata.NodeCount; bit++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the given node's left (0) or right (1) record.
+func (r *Reader) record(node uint, side uint) uint {
+
+	switch r.Metadata.RecordSize {
+	case 24:
+		b := r.tree[node*6+side*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if side == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+side*4:]))
+	}
+}
+
+// Lookup returns the record of the given IP address, or nil if the database
+// has no record for it.  Records are typically maps, e.g., {"country":
+// {"iso_code": "DE", ...}, ...}.  Maps and arrays decode to
+// map[string]interface{} and []interface{}, and all unsigned integers decode
+// to uint64, except for 128-bit integers, which decode to *big.Int.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if ip = ip.To16(); ip == nil {
+		return nil, errors.New("invalid IP address")
+	} else if r.Metadata.IPVersion == 4 {
+		return nil, nil
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.Metadata.NodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node == r.Metadata.NodeCount {
+		return nil, nil
+	} else if node < r.Metadata.NodeCount {
+		return nil, errors.New("search tree ends in a node")
+	}
+
+	offset := node - r.Metadata.NodeCount - dataSectionSeparator
+	value, _, err := decode(r.data, offset, 0)
+	return value, err
+}
+
+// maxDepth limits how deeply nested the values that we decode may be, so
+// malicious files can't make us recurse forever.
+const maxDepth = 32
+
+// decode decodes the value at the given offset of the given data section,
+// and returns the value and the offset that follows it.
+func decode(data []byte, offset uint, depth int) (interface{}, uint, error) {
+
+	if depth > maxDepth {
+		return nil, 0, errors.New("values nested too deeply")
+	}
+	next := func() (byte, error) {
+		if offset >= uint(len(data)) {
+			return 0, errors.New("unexpected end of data")
+		}
+		offset++
+		return data[offset-1], nil
+	}
+	read := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(data)) {
+			return nil, errors.New("unexpected end of data")
+		}
+		offset += n
+		return data[offset-n : offset], nil
+	}
+
+	ctrl, err := next()
+	if err != nil {
+		return nil, 0, err
+	}
+	kind := uint(ctrl >> 5)
+
+	if kind == typePointer {
+		size := uint(ctrl>>3) & 0x3
+		b, err := read(size + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		pointer := uint(0)
+		if size < 3 {
+			pointer = uint(ctrl & 0x7)
+		}
+		for _, c := range b {
+			pointer = pointer<<8 | uint(c)
+		}
+		pointer += []uint{0, 2048, 526336, 0}[size]
+		value, _, err := decode(data, pointer, depth+1)
+		return value, offset, err
+	}
+
+	if kind == typeExtended {
+		b, err := next()
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(b)
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		b, err := read(size - 28)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := uint(0)
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[size-29] + n
+	}
+
+	switch kind {
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = decode(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if value, offset, err = decode(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case typeArray:
+		a := []interface{}{}
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = decode(data, offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case typeBool:
+		return size != 0, offset, nil
+	}
+
+	b, err := read(size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch kind {
+	case typeString:
+		return string(b), offset, nil
+	case typeBytes:
+		return append([]byte{}, b...), offset, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("double must have 8 bytes")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("float must have 4 bytes")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errors.New("unsigned integer too large")
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errors.New("signed integer too large")
+		}
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	case typeUint128:
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
@@ -0,0 +1,231 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// encode appends the MaxMind DB encoding of the given value to the given
+// buffer.  It supports the types that our tests need.
+func encode(buf *bytes.Buffer, value interface{}) {
+
+	header := func(kind, size int) {
+		ctrl := byte(size)
+		if size >= 285 {
+			panic("value too large for our test encoder")
+		} else if size >= 29 {
+			ctrl = 29
+		}
+		if kind > 7 {
+			buf.WriteByte(ctrl)
+			buf.WriteByte(byte(kind - 7))
+		} else {
+			buf.WriteByte(byte(kind<<5) | ctrl)
+		}
+		if size >= 29 {
+			buf.WriteByte(byte(size - 29))
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		header(typeString, len(v))
+		buf.WriteString(v)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		b = bytes.TrimLeft(b, "\x00")
+		header(typeUint32, len(b))
+		buf.Write(b)
+	case uint16:
+		b := []byte{byte(v >> 8), byte(v)}
+		b = bytes.TrimLeft(b, "\x00")
+		header(typeUint16, len(b))
+		buf.Write(b)
+	case bool:
+		size := 0
+		if v {
+			size = 1
+		}
+		header(typeBool, size)
+	case []interface{}:
+		header(typeArray, len(v))
+		for _, e := range v {
+			encode(buf, e)
+		}
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		header(typeMap, len(keys))
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	default:
+		panic(fmt.Sprintf("unsupported type %T", value))
+	}
+}
+
+// buildDB returns an IPv6 MaxMind DB with the given record size that maps the
+// given networks to the given records.  IPv4 networks live under ::/96.
+func buildDB(recordSize int, networks map[string]interface{}) []byte {
+
+	// Our search tree's nodes hold the indices of their children, or -1 if
+	// there's no child, or -2-i if the child is the ith record.
+	nodes := [][2]int{{-1, -1}}
+	records := []interface{}{}
+	for cidr, record := range networks {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if ipNet.IP.To4() != nil {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := 0
+		for i := 0; i < ones-1; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		bit := int(ip[(ones-1)/8]>>(7-uint((ones-1)%8))) & 1
+		records = append(records, record)
+		nodes[node][bit] = -2 - (len(records) - 1)
+	}
+
+	data := new(bytes.Buffer)
+	offsets := []int{}
+	for _, record := range records {
+		offsets = append(offsets, data.Len())
+		encode(data, record)
+	}
+
+	buf := new(bytes.Buffer)
+	value := func(child int) uint32 {
+		switch {
+		case child == -1:
+			return uint32(len(nodes))
+		case child < -1:
+			return uint32(len(nodes) + dataSectionSeparator + offsets[-2-child])
+		}
+		return uint32(child)
+	}
+	for _, node := range nodes {
+		left, right := value(node[0]), value(node[1])
+		switch recordSize {
+		case 24:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+				byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			buf.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left),
+				byte(left>>20)&0xf0 | byte(right>>24)&0x0f,
+				byte(right >> 16), byte(right >> 8), byte(right)})
+		case 32:
+			binary.Write(buf, binary.BigEndian, []uint32{left, right})
+		}
+	}
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(data.Bytes())
+	buf.Write(metadataMarker)
+	encode(buf, map[string]interface{}{
+		"database_type": "Test",
+		"ip_version":    uint16(6),
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint16(recordSize),
+	})
+	return buf.Bytes()
+}
+
+func TestLookup(t *testing.T) {
+
+	germany := map[string]interface{}{"country": map[string]interface{}{"iso_code": "DE"}}
+	asn := map[string]interface{}{
+		"autonomous_system_number":       uint32(3320),
+		"autonomous_system_organization": "Deutsche Telekom AG",
+		"anycast":                        false,
+		"tags":                           []interface{}{"a", "b"},
+	}
+	for _, recordSize := range []int{24, 28, 32} {
+		r, err := New(buildDB(recordSize, map[string]interface{}{
+			"1.2.3.0/24":    germany,
+			"5.6.0.0/16":    asn,
+			"2001:db8::/32": germany,
+		}))
+		if err != nil {
+			t.Fatalf("Failed to read %d-bit database: %s", recordSize, err)
+		}
+		if r.Metadata.DatabaseType != "Test" || r.Metadata.RecordSize != uint(recordSize) {
+			t.Errorf("Unexpected metadata: %+v", r.Metadata)
+		}
+
+		for ip, expected := range map[string]interface{}{
+			"1.2.3.4": germany,
+			"1.2.4.4": nil,
+			"5.6.7.8": map[string]interface{}{
+				"autonomous_system_number":       uint64(3320),
+				"autonomous_system_organization": "Deutsche Telekom AG",
+				"anycast":                        false,
+				"tags":                           []interface{}{"a", "b"},
+			},
+			"2001:db8::1":    germany,
+			"2001:db9::1":    nil,
+			"::ffff:1.2.3.4": germany,
+		} {
+			record, err := r.Lookup(net.ParseIP(ip))
+			if err != nil {
+				t.Errorf("Failed to look up %s: %s", ip, err)
+			}
+			if !reflect.DeepEqual(record, expected) {
+				t.Errorf("Expected %v for %s in %d-bit database but got %v.", expected, ip, recordSize, record)
+			}
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+
+	valid := buildDB(24, map[string]interface{}{"1.2.3.0/24": "foo"})
+	for name, content := range map[string][]byte{
+		"empty":          []byte{},
+		"no metadata":    valid[:len(valid)-50],
+		"truncated tree": valid[len(valid)-60:],
+	} {
+		if _, err := New(content); err == nil {
+			t.Errorf("Failed to reject invalid database (%s).", name)
+		}
+	}
+}
+
+func TestDecodePointer(t *testing.T) {
+
+	// A map whose value is a pointer to the string at offset 0.
+	data := []byte{
+		typeString<<5 | 3, 'f', 'o', 'o',
+		typeMap<<5 | 1, typeString<<5 | 1, 'k', typePointer << 5, 0,
+	}
+	value, offset, err := decode(data, 4, 0)
+	if err != nil {
+		t.Fatalf("Failed to decode pointer: %s", err)
+	}
+	if !reflect.DeepEqual(value, map[string]interface{}{"k": "foo"}) || offset != uint(len(data)) {
+		t.Errorf("Unexpected value %v at offset %d.", value, offset)
+	}
+
+	// A pointer to itself must not make us recurse forever.
+	if _, _, err := decode([]byte{typePointer << 5, 0}, 0, 0); err == nil {
+		t.Errorf("Failed to reject pointer loop.")
+	}
+}
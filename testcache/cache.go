@@ -0,0 +1,790 @@
+// Package testcache implements a cache of bridge test results, keyed by the
+// hashes of the bridges' canonical bridge lines, that can be persisted to disk.
+package testcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+// Entry represents an entry in our cache of bridges that we recently
+// tested.  Error is nil if a bridge works, and otherwise holds an error
+// string.  Time determines when we tested the bridge, and Hits counts how
+// often we served the entry from our cache.  AddrPort is the bridge's
+// addr:port tuple, which is what our hashed identifiers are based on.  Once
+// StripAddresses removed it, HashedID holds the bridge's hashed identifier
+// instead, and Family the address family that our summary needs.  Transport
+// is the bridge's transport, and empty for entries that we cached before we
+// kept track of transports.  Context describes how we tested the bridge, and
+// is nil for entries that we cached before we kept track of contexts.
+type Entry struct {
+	// We're using a string instead of an error here because golang's gob
+	// package doesn't know how to deal with an error:
+	// <https://github.com/golang/go/issues/23340>
+	Error string
+	// ErrorCode is the machine-readable code of Error, if we have one.  It's
+	// empty for entries that we cached before we kept track of codes.
+	ErrorCode string
+	Time      time.Time
+	Hits      int
+	Transport string
+	AddrPort  string
+	HashedID  string
+	Family    string
+	Context   *Context
+}
+
+// Context describes the conditions under which we tested a bridge, so
+// researchers can understand the measurement behind a published result.
+type Context struct {
+	BridgestrapVersion string `json:"bridgestrap_version"`
+	// Stages are the stages of our test pipeline that the bridge went
+	// through.
+	Stages     []string `json:"stages"`
+	Instance   string   `json:"instance,omitempty"`
+	Vantage    string   `json:"vantage,omitempty"`
+	TorVersion string   `json:"tor_version,omitempty"`
+	// ConsensusValidAfter is the valid-after time of the consensus that Tor
+	// used, if it had one.
+	ConsensusValidAfter *time.Time `json:"consensus_valid_after,omitempty"`
+	// PluginsHash identifies our pluggable transport configuration.
+	PluginsHash string `json:"plugins_hash,omitempty"`
+	// TestTimeout is the number of seconds that Tor had to test the bridge,
+	// and ClockSkew is our clock's skew in seconds.
+	TestTimeout float64 `json:"test_timeout,omitempty"`
+	ClockSkew   float64 `json:"clock_skew"`
+}
+
+// EntryOverhead is our estimate of the bytes that a cache entry takes up in
+// addition to its key, its addr:port tuple, and its error string and code:
+// the Entry struct itself, the pointer to it, and the map's bookkeeping.
+const EntryOverhead = 96
+
+// ContextOverhead is our estimate of the bytes that an entry's context takes
+// up.
+const ContextOverhead = 256
+
+// ResizeFunc is called whenever entries are added to or removed from a
+// cache.  It receives the number of entries and an estimate of the bytes
+// that they take up.
+type ResizeFunc func(numEntries, numBytes int)
+
+// NumShards is the number of shards that we split our cache into.  Each
+// shard has its own lock, so the request path, pruning, and exports rarely
+// wait for each other.
+const NumShards = 32
+
+// Cache is a cache of bridge test results.  It's safe for concurrent use.
+type Cache struct {
+	// successTimeout and failureTimeout determine how long the entries of
+	// functional and dysfunctional bridges are valid for.  They're in
+	// nanoseconds and must only be accessed atomically.  numEntries and
+	// numBytes are our size, which we update whenever a shard changes.  All
+	// four must be the first fields to guarantee 64-bit alignment for
+	// atomic operations on 32-bit platforms.
+	successTimeout int64
+	failureTimeout int64
+	numEntries     int64
+	numBytes       int64
+	// shards contain our entries, keyed by the key of a bridge line (see
+	// Key).  Each key lives in the shard that shardFor returns.
+	shards []*shard
+	// summary tallies our entries by transport and address family.
+	summary summary
+	// onResize is called (with our lock held) whenever our size changes.
+	onResize ResizeFunc
+	// format is the format in which we write our cache file, FormatGob
+	// unless SetFormat says otherwise.
+	format string
+	// l protects onResize and format.
+	l sync.Mutex
+	// hasher turns our entries' addr:port tuples into hashed identifiers,
+	// and is nil until SetHasher is called.  index maps hashed identifiers
+	// to the keys of the entries that they belong to, so FindByHashedID
+	// doesn't have to hash all of our entries, and indexed maps our keys to
+	// their hashed identifiers, so we can remove them from the index.
+	// idLock protects all three.  We only acquire it while holding a shard
+	// lock, never the other way around.
+	hasher  IDHasher
+	index   map[string]map[string]bool
+	indexed map[string][]string
+	idLock  sync.Mutex
+}
+
+// shard is a part of our cache, with its own lock.
+type shard struct {
+	entries map[string]*Entry
+	sync.Mutex
+}
+
+// IDMatcher decides if a hashed bridge identifier belongs to an addr:port
+// tuple.
+type IDMatcher interface {
+	Matches(hashedID, addrPort string) bool
+}
+
+// IDHasher turns an addr:port tuple into the hashed identifiers that we
+// accept for it, e.g., one for our current key and one for our old key.
+type IDHasher interface {
+	HashesOf(addrPort string) []string
+}
+
+// Key returns the key under which we cache the given bridge line's test
+// result: the hex-encoded SHA-256 hash of its canonical form.  Keying entries
+// by their entire bridge line prevents bridge lines that share an addr:port
+// tuple but differ in, e.g., their certificate from colliding, and hashing
+// bridge lines keeps their secrets out of our cache file.
+func Key(bridgeLine string) (string, error) {
+
+	if _, err := bridgeline.AddrPort(bridgeLine); err != nil {
+		return "", err
+	}
+	canonical := bridgeline.Canonicalize(bridgeLine)
+	if canonical == "" {
+		return "", errors.New("bridge line is empty")
+	}
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// New returns a new test cache whose entries are valid for the given
+// duration.  Use SetTimeouts to let failures expire sooner than successes.
+func New(entryTimeout time.Duration) *Cache {
+	return newShardedCache(entryTimeout, NumShards)
+}
+
+// newShardedCache returns a new test cache with the given number of shards.
+func newShardedCache(entryTimeout time.Duration, numShards int) *Cache {
+
+	tc := &Cache{
+		successTimeout: int64(entryTimeout),
+		failureTimeout: int64(entryTimeout),
+		format:         FormatGob,
+	}
+	for i := 0; i < numShards; i++ {
+		tc.shards = append(tc.shards, &shard{entries: make(map[string]*Entry)})
+	}
+	return tc
+}
+
+// shardFor returns the shard that contains the given key.
+func (tc *Cache) shardFor(key string) *shard {
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return tc.shards[h.Sum32()%uint32(len(tc.shards))]
+}
+
+// entrySize returns our estimate of the bytes that the given entry takes up.
+func entrySize(key string, entry *Entry) int {
+
+	size := len(key) + len(entry.AddrPort) + len(entry.HashedID) + len(entry.Family) + len(entry.Error) + len(entry.ErrorCode) + EntryOverhead
+	if entry.Context != nil {
+		size += ContextOverhead
+	}
+	return size
+}
+
+// grow adds the given number of entries and bytes, which may be negative, to
+// our size.
+func (tc *Cache) grow(numEntries, numBytes int) {
+
+	atomic.AddInt64(&tc.numEntries, int64(numEntries))
+	atomic.AddInt64(&tc.numBytes, int64(numBytes))
+}
+
+// expired returns true if the given entry expired at the given time.
+func (tc *Cache) expired(entry *Entry, now time.Time) bool {
+	return entry.Time.Before(now.Add(-tc.Timeout(entry)))
+}
+
+// SetFormat determines the format in which WriteToDisk writes our cache
+// file, FormatGob or FormatJSONL.  ReadFromDisk understands both formats, so
+// operators can switch formats without losing their cache.
+func (tc *Cache) SetFormat(format string) error {
+
+	if err := ValidateFormat(format); err != nil {
+		return err
+	}
+	tc.l.Lock()
+	defer tc.l.Unlock()
+
+	tc.format = format
+	return nil
+}
+
+// SuccessTimeout returns how long the cache entries of functional bridges are
+// valid for.
+func (tc *Cache) SuccessTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tc.successTimeout))
+}
+
+// FailureTimeout returns how long the cache entries of dysfunctional bridges
+// are valid for.
+func (tc *Cache) FailureTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tc.failureTimeout))
+}
+
+// Timeout returns how long the given cache entry is valid for, which depends
+// on whether its bridge was functional.
+func (tc *Cache) Timeout(entry *Entry) time.Duration {
+
+	if entry.Error == "" {
+		return tc.SuccessTimeout()
+	}
+	return tc.FailureTimeout()
+}
+
+// SetTimeouts changes how long the cache entries of functional and
+// dysfunctional bridges are valid for, e.g., when we reload our
+// configuration.  Bridge operators often fix their bridges within hours, so
+// failures may expire sooner than successes.  The timeouts apply to the
+// entries that we already have.
+func (tc *Cache) SetTimeouts(success, failure time.Duration) {
+
+	atomic.StoreInt64(&tc.successTimeout, int64(success))
+	atomic.StoreInt64(&tc.failureTimeout, int64(failure))
+}
+
+// OnResize registers a function that we call whenever entries are added,
+// pruned, or read from disk.  The function is called right away, with our
+// current size, and must not call back into the cache.
+func (tc *Cache) OnResize(f ResizeFunc) {
+
+	tc.l.Lock()
+	tc.onResize = f
+	tc.l.Unlock()
+	tc.resized()
+}
+
+// Size returns the number of entries in the cache and an estimate of the
+// bytes that they take up.
+func (tc *Cache) Size() (int, int) {
+	return int(atomic.LoadInt64(&tc.numEntries)), int(atomic.LoadInt64(&tc.numBytes))
+}
+
+// resized calls our resize function, if any.  We hold our lock while calling
+// it, so it doesn't see sizes out of order.
+func (tc *Cache) resized() {
+
+	tc.l.Lock()
+	defer tc.l.Unlock()
+
+	if tc.onResize != nil {
+		tc.onResize(tc.Size())
+	}
+}
+
+// FracFunctional returns the fraction of bridges currently in the cache that
+// are functional.
+func (tc *Cache) FracFunctional() float64 {
+
+	numEntries, numFunctional := 0, 0
+	for _, s := range tc.shards {
+		s.Lock()
+		for _, entry := range s.entries {
+			if entry.Error == "" {
+				numFunctional++
+			}
+		}
+		numEntries += len(s.entries)
+		s.Unlock()
+	}
+	if numEntries == 0 {
+		return 0
+	}
+
+	return float64(numFunctional) / float64(numEntries)
+}
+
+// entries returns a copy of all of our entries, including expired ones.  We
+// lock one shard at a time, so the copy may miss changes that happen while
+// we're copying.
+func (tc *Cache) entries() map[string]*Entry {
+
+	entries := make(map[string]*Entry)
+	for _, s := range tc.shards {
+		s.Lock()
+		for key, entry := range s.entries {
+			e := *entry
+			entries[key] = &e
+		}
+		s.Unlock()
+	}
+	return entries
+}
+
+// WriteToDisk writes our test result cache to disk, allowing it to persist
+// across program restarts.
+func (tc *Cache) WriteToDisk(cacheFile string) error {
+
+	entries := tc.entries()
+	tc.l.Lock()
+	format := tc.format
+	tc.l.Unlock()
+
+	err := WriteFileAtomically(cacheFile, func(w io.Writer) error {
+		return encodeCache(w, entries, format)
+	})
+	if err == nil {
+		log.Printf("Wrote cache with %d elements to %q (%s).",
+			len(entries), cacheFile, format)
+	}
+
+	return err
+}
+
+// ReadFromDisk reads our test result cache from disk.
+func (tc *Cache) ReadFromDisk(cacheFile string) error {
+
+	fh, err := os.Open(cacheFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	entries, err := decodeCache(fh)
+	if err != nil {
+		return err
+	}
+	tc.Load(entries)
+	log.Printf("Read cache with %d elements from %q.", len(entries), cacheFile)
+
+	return nil
+}
+
+// Load replaces all of our entries with the given entries, which are keyed
+// like ours (see Key).
+func (tc *Cache) Load(entries map[string]*Entry) {
+
+	shards := make(map[*shard]map[string]*Entry)
+	for _, s := range tc.shards {
+		shards[s] = make(map[string]*Entry)
+	}
+	numBytes := 0
+	for key, entry := range entries {
+		shards[tc.shardFor(key)][key] = entry
+		numBytes += entrySize(key, entry)
+	}
+
+	// We hold all shard locks while swapping, so our size stays consistent
+	// with our entries.
+	for _, s := range tc.shards {
+		s.Lock()
+	}
+	for _, s := range tc.shards {
+		s.entries = shards[s]
+	}
+	atomic.StoreInt64(&tc.numEntries, int64(len(entries)))
+	atomic.StoreInt64(&tc.numBytes, int64(numBytes))
+	tc.summary.reset(entries)
+	tc.idLock.Lock()
+	tc.rebuildIndex(entries)
+	tc.idLock.Unlock()
+	for _, s := range tc.shards {
+		s.Unlock()
+	}
+	tc.resized()
+}
+
+// Merge adds the given cache entries, keyed like ours (see Key), to our cache,
+// unless we have a more recent entry for the same key, and returns the number
+// of entries that it added or replaced.  Unlike Load, it keeps our other
+// entries, so a warm standby can hand the results that it collected back to
+// its primary.
+func (tc *Cache) Merge(entries map[string]*Entry) int {
+
+	merged := 0
+	for key, entry := range entries {
+		e := *entry
+		s := tc.shardFor(key)
+		s.Lock()
+		numEntries, numBytes := 1, entrySize(key, &e)
+		if old, exists := s.entries[key]; exists {
+			if !old.Time.Before(e.Time) {
+				s.Unlock()
+				continue
+			}
+			if old.Hits > e.Hits {
+				e.Hits = old.Hits
+			}
+			numEntries, numBytes = 0, numBytes-entrySize(key, old)
+			tc.summary.count(old, -1)
+		}
+		s.entries[key] = &e
+		tc.idLock.Lock()
+		if tc.hasher != nil {
+			tc.removeFromIndex(key)
+			tc.addToIndex(key, tc.hashesOf(&e))
+		}
+		tc.idLock.Unlock()
+		tc.summary.count(&e, 1)
+		tc.grow(numEntries, numBytes)
+		s.Unlock()
+		merged++
+	}
+	tc.resized()
+	return merged
+}
+
+// SetHasher makes us index our entries by the hashed identifiers that the
+// given hasher derives from their addr:port tuples, for FindByHashedID.  Call
+// it again whenever the hasher's keys change, e.g., to rotate a key, so we
+// rebuild our index.
+func (tc *Cache) SetHasher(h IDHasher) {
+
+	// We hold all shard locks while rebuilding, so the index stays
+	// consistent with our entries.
+	for _, s := range tc.shards {
+		s.Lock()
+	}
+	entries := make(map[string]*Entry)
+	for _, s := range tc.shards {
+		for key, entry := range s.entries {
+			entries[key] = entry
+		}
+	}
+	tc.idLock.Lock()
+	tc.hasher = h
+	tc.rebuildIndex(entries)
+	tc.idLock.Unlock()
+	for _, s := range tc.shards {
+		s.Unlock()
+	}
+}
+
+// rebuildIndex replaces our index with one of the given entries.  The caller
+// must hold idLock.
+func (tc *Cache) rebuildIndex(entries map[string]*Entry) {
+
+	tc.index = make(map[string]map[string]bool)
+	tc.indexed = make(map[string][]string)
+	if tc.hasher == nil {
+		return
+	}
+	for key, entry := range entries {
+		tc.addToIndex(key, tc.hashesOf(entry))
+	}
+}
+
+// hashesOf returns the hashed identifiers under which we index the given
+// entry.  The caller must hold idLock, and we must have a hasher.
+func (tc *Cache) hashesOf(entry *Entry) []string {
+
+	if entry.AddrPort == "" && entry.HashedID != "" {
+		return []string{entry.HashedID}
+	}
+	return tc.hasher.HashesOf(entry.AddrPort)
+}
+
+// addToIndex adds the given key to our index under the given hashed
+// identifiers.  The caller must hold idLock.
+func (tc *Cache) addToIndex(key string, hashedIDs []string) {
+
+	for i, hashedID := range hashedIDs {
+		hashedIDs[i] = strings.ToUpper(hashedID)
+		if tc.index[hashedIDs[i]] == nil {
+			tc.index[hashedIDs[i]] = make(map[string]bool)
+		}
+		tc.index[hashedIDs[i]][key] = true
+	}
+	tc.indexed[key] = hashedIDs
+}
+
+// removeFromIndex removes the given key from our index.  The caller must hold
+// idLock.
+func (tc *Cache) removeFromIndex(key string) {
+
+	for _, hashedID := range tc.indexed[key] {
+		delete(tc.index[hashedID], key)
+		if len(tc.index[hashedID]) == 0 {
+			delete(tc.index, hashedID)
+		}
+	}
+	delete(tc.indexed, key)
+}
+
+// Export returns a copy of all unexpired cache entries, keyed like ours (see
+// Key), so another cache can Load them.
+func (tc *Cache) Export() map[string]*Entry {
+
+	now := time.Now().UTC()
+	entries := make(map[string]*Entry)
+	for _, s := range tc.shards {
+		s.Lock()
+		for key, entry := range s.entries {
+			if tc.expired(entry, now) {
+				continue
+			}
+			e := *entry
+			entries[key] = &e
+		}
+		s.Unlock()
+	}
+	return entries
+}
+
+// Prune removes expired cache entries.  It locks one shard at a time, so
+// other callers only wait for the shard that we're pruning.
+func (tc *Cache) Prune() {
+
+	now := time.Now().UTC()
+	tc.pruneIf(func(entry *Entry) bool { return tc.expired(entry, now) })
+}
+
+// StripAddresses replaces the addr:port tuples of the cache entries of bridges
+// that we tested before the given time with the hashed identifiers that the
+// given function returns for them, and returns the number of entries that it
+// stripped.  Stripped entries keep counting towards our summary, and can still
+// be found by their hashed identifier, as long as we don't rotate our key.
+func (tc *Cache) StripAddresses(cutoff time.Time, hash func(addrPort string) string) int {
+
+	numStripped, bytesStripped := 0, 0
+	for _, s := range tc.shards {
+		s.Lock()
+		for key, entry := range s.entries {
+			if entry.AddrPort == "" || !entry.Time.Before(cutoff) {
+				continue
+			}
+			// We replace the entry instead of modifying it, because
+			// callers may hold copies of it.
+			stripped := *entry
+			stripped.HashedID = hash(entry.AddrPort)
+			stripped.Family = bridgeline.Family(entry.AddrPort)
+			stripped.AddrPort = ""
+			s.entries[key] = &stripped
+			tc.summary.count(entry, -1)
+			tc.summary.count(&stripped, 1)
+			numStripped++
+			bytesStripped += entrySize(key, &stripped) - entrySize(key, entry)
+		}
+		s.Unlock()
+	}
+	if numStripped > 0 {
+		tc.grow(0, bytesStripped)
+		tc.resized()
+	}
+	return numStripped
+}
+
+// pruneIf removes the cache entries for which the given function returns
+// true, and returns the number of entries that it removed.
+func (tc *Cache) pruneIf(prune func(*Entry) bool) int {
+
+	numPruned, bytesPruned := 0, 0
+	for _, s := range tc.shards {
+		s.Lock()
+		for key, entry := range s.entries {
+			if prune(entry) {
+				delete(s.entries, key)
+				tc.idLock.Lock()
+				tc.removeFromIndex(key)
+				tc.idLock.Unlock()
+				tc.summary.count(entry, -1)
+				numPruned++
+				bytesPruned += entrySize(key, entry)
+			}
+		}
+		s.Unlock()
+	}
+	if numPruned > 0 {
+		tc.grow(-numPruned, -bytesPruned)
+		tc.resized()
+	}
+	return numPruned
+}
+
+// IsCached returns a cache entry if the given bridge line has been tested
+// recently (as determined by Timeout), and nil otherwise.
+func (tc *Cache) IsCached(bridgeLine string) *Entry {
+
+	// First, prune expired cache entries.
+	tc.Prune()
+
+	key, err := Key(bridgeLine)
+	if err != nil {
+		return nil
+	}
+
+	s := tc.shardFor(key)
+	s.Lock()
+	var r *Entry = s.entries[key]
+	if r != nil {
+		r.Hits++
+	}
+	s.Unlock()
+
+	return r
+}
+
+// Peek returns a copy of the given bridge line's unexpired cache entry, and
+// nil if there's none.  Unlike IsCached, it doesn't count as a cache hit.
+func (tc *Cache) Peek(bridgeLine string) *Entry {
+
+	key, err := Key(bridgeLine)
+	if err != nil {
+		return nil
+	}
+
+	s := tc.shardFor(key)
+	s.Lock()
+	defer s.Unlock()
+
+	entry, exists := s.entries[key]
+	if !exists || tc.expired(entry, time.Now().UTC()) {
+		return nil
+	}
+	e := *entry
+	return &e
+}
+
+// AddEntry adds an entry for the given bridge, test result, and test time to
+// our cache.
+func (tc *Cache) AddEntry(bridgeLine string, result error, lastTested time.Time) {
+	tc.AddResult(bridgeLine, result, "", lastTested, nil)
+}
+
+// AddResult is like AddEntry, but also records the machine-readable error code
+// of a failed test, and the given context of the test, which may be nil.
+func (tc *Cache) AddResult(bridgeLine string, result error, errorCode string, lastTested time.Time, context *Context) {
+
+	key, err := Key(bridgeLine)
+	if err != nil {
+		return
+	}
+	addrPort, _ := bridgeline.AddrPort(bridgeLine)
+
+	var errorStr string
+	if result == nil {
+		errorStr = ""
+	} else {
+		errorStr = result.Error()
+	}
+	entry := &Entry{
+		Error:     errorStr,
+		ErrorCode: errorCode,
+		Time:      lastTested,
+		Transport: bridgeline.Transport(bridgeLine),
+		AddrPort:  addrPort,
+		Context:   context,
+	}
+
+	s := tc.shardFor(key)
+	s.Lock()
+	numEntries, numBytes := 1, entrySize(key, entry)
+	reindex := false
+	if old, exists := s.entries[key]; exists {
+		entry.Hits = old.Hits
+		numEntries, numBytes = 0, numBytes-entrySize(key, old)
+		tc.summary.count(old, -1)
+		// Stripped entries are only indexed under our current key.
+		reindex = old.AddrPort == ""
+	}
+	s.entries[key] = entry
+	// Keys are derived from entire bridge lines, so an existing key is
+	// already indexed under the right hashed identifiers.
+	tc.idLock.Lock()
+	if _, exists := tc.indexed[key]; (!exists || reindex) && tc.hasher != nil {
+		tc.removeFromIndex(key)
+		tc.addToIndex(key, tc.hasher.HashesOf(addrPort))
+	}
+	tc.idLock.Unlock()
+	tc.summary.count(entry, 1)
+	tc.grow(numEntries, numBytes)
+	s.Unlock()
+	tc.resized()
+}
+
+// FindByHashedID returns the unexpired cache entry whose addr:port tuple
+// hashes to the given hashed identifier, and nil if no such entry exists or
+// SetHasher wasn't called.  If several bridge lines share the addr:port tuple,
+// we return the entry that we tested most recently.  The lookup uses our
+// index, so its cost doesn't grow with the size of our cache.
+func (tc *Cache) FindByHashedID(hashedID string) *Entry {
+
+	tc.idLock.Lock()
+	keys := []string{}
+	for key := range tc.index[strings.ToUpper(hashedID)] {
+		keys = append(keys, key)
+	}
+	tc.idLock.Unlock()
+
+	now := time.Now().UTC()
+	var found *Entry
+	for _, key := range keys {
+		s := tc.shardFor(key)
+		s.Lock()
+		entry, exists := s.entries[key]
+		if exists && !tc.expired(entry, now) && (found == nil || entry.Time.After(found.Time)) {
+			e := *entry
+			found = &e
+		}
+		s.Unlock()
+	}
+	return found
+}
+
+// SnapshotByHashedID returns a copy of all unexpired cache entries, keyed by
+// their hashed identifier under our hasher's current key.  We take hashed
+// identifiers from our index instead of hashing entries, and include entries
+// whose addresses StripAddresses removed.  If several bridge lines share a
+// hashed identifier, the snapshot contains the entry that we tested most
+// recently.  The snapshot is empty until SetHasher is called.
+func (tc *Cache) SnapshotByHashedID() map[string]Entry {
+
+	now := time.Now().UTC()
+	snapshot := make(map[string]Entry)
+	for _, s := range tc.shards {
+		s.Lock()
+		tc.idLock.Lock()
+		for key, entry := range s.entries {
+			hashedIDs := tc.indexed[key]
+			if len(hashedIDs) == 0 || tc.expired(entry, now) {
+				continue
+			}
+			if old, exists := snapshot[hashedIDs[0]]; exists && !entry.Time.After(old.Time) {
+				continue
+			}
+			snapshot[hashedIDs[0]] = *entry
+		}
+		tc.idLock.Unlock()
+		s.Unlock()
+	}
+	return snapshot
+}
+
+// Snapshot returns a copy of all unexpired cache entries, keyed by their
+// addr:port tuple.  If several bridge lines share an addr:port tuple, the
+// snapshot contains the entry that we tested most recently.  Entries whose
+// addresses StripAddresses removed aren't part of the snapshot.  Callers can
+// work with the snapshot without holding our locks.
+func (tc *Cache) Snapshot() map[string]Entry {
+
+	now := time.Now().UTC()
+	snapshot := make(map[string]Entry)
+	for _, s := range tc.shards {
+		s.Lock()
+		for _, entry := range s.entries {
+			if tc.expired(entry, now) || entry.AddrPort == "" {
+				continue
+			}
+			if old, exists := snapshot[entry.AddrPort]; exists && !entry.Time.After(old.Time) {
+				continue
+			}
+			snapshot[entry.AddrPort] = *entry
+		}
+		s.Unlock()
+	}
+	return snapshot
+}
@@ -0,0 +1,513 @@
+package testcache
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func NewCache() *Cache {
+	return New(18 * time.Hour)
+}
+
+func TestCacheFunctions(t *testing.T) {
+
+	cache := NewCache()
+	bridgeLine := "obfs4 127.0.0.1:1 cert=foo iat-mode=0"
+
+	e := cache.IsCached(bridgeLine)
+	if e != nil {
+		t.Errorf("Cache is empty but marks bridge line as existing.")
+	}
+
+	cache.AddEntry(bridgeLine, nil, time.Now().UTC())
+	e = cache.IsCached(bridgeLine)
+	if e == nil {
+		t.Errorf("Could not retrieve existing element from cache.")
+	}
+
+	testError := fmt.Errorf("bridge is on fire")
+	cache.AddEntry(bridgeLine, testError, time.Now().UTC())
+	e = cache.IsCached(bridgeLine)
+	if e.Error != testError.Error() {
+		t.Errorf("Got test result %q but expected %q.", e.Error, testError)
+	}
+
+	// A bogus bridge line shouldn't make it into the cache.
+	cache = NewCache()
+	bogusBridgeLine := "bogus-bridge-line"
+	cache.AddEntry(bogusBridgeLine, errors.New("bogus-error"), time.Now().UTC())
+	if n, _ := cache.Size(); n != 0 {
+		t.Errorf("Bogus bridge line made it into cache.")
+	}
+
+	e = cache.IsCached(bogusBridgeLine)
+	if e != nil {
+		t.Errorf("Got non-nil cache entry for bogus bridge line.")
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+
+	cache := NewCache()
+	cache.SetHasher(plainMatcher{})
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=foo iat-mode=0", nil, time.Now().UTC())
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=bar iat-mode=0", errors.New("error"), time.Now().UTC())
+
+	// Bridge lines that share an addr:port tuple must not collide.
+	if e := cache.IsCached("obfs4 1.1.1.1:1 cert=foo iat-mode=0"); e == nil || e.Error != "" {
+		t.Errorf("Bridge lines that share an addr:port tuple collided.")
+	}
+	if e := cache.IsCached("obfs4 1.1.1.1:1 cert=baz iat-mode=0"); e != nil {
+		t.Errorf("Found cache entry for untested bridge line.")
+	}
+
+	// Formatting differences must not matter.
+	if e := cache.IsCached("Bridge obfs4  1.1.1.1:1 iat-mode=0 cert=bar"); e == nil || e.Error != "error" {
+		t.Errorf("Failed to find cache entry for differently formatted bridge line.")
+	}
+
+	// Snapshots are keyed by addr:port tuple, and the most recent test wins.
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=foo iat-mode=0", nil, time.Now().UTC().Add(time.Minute))
+	snapshot := cache.Snapshot()
+	if e, exists := snapshot["1.1.1.1:1"]; !exists || len(snapshot) != 1 || e.Error != "" {
+		t.Errorf("Snapshot doesn't contain most recent entry for addr:port tuple.")
+	}
+	if e := cache.FindByHashedID("1.1.1.1:1"); e == nil || e.Error != "" {
+		t.Errorf("Failed to find most recent entry by hashed identifier.")
+	}
+}
+
+func TestCacheFracFunctional(t *testing.T) {
+
+	cache := NewCache()
+
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	cache.AddEntry("2.2.2.2:2", nil, time.Now().UTC())
+	cache.AddEntry("3.3.3.3:3", nil, time.Now().UTC())
+	cache.AddEntry("4.4.4.4:4", errors.New("error"), time.Now().UTC())
+
+	expected := 0.75
+	if cache.FracFunctional() != expected {
+		t.Errorf("Expected fraction %.2f but got %.2f.", expected, cache.FracFunctional())
+	}
+}
+
+func TestCachePeek(t *testing.T) {
+
+	cache := NewCache()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	cache.AddEntry("2.2.2.2:2", nil, time.Now().UTC().Add(-24*time.Hour))
+
+	if e := cache.Peek("1.1.1.1:1"); e == nil || e.Hits != 0 {
+		t.Errorf("Failed to peek at cache entry.")
+	}
+	if e := cache.IsCached("1.1.1.1:1"); e == nil || e.Hits != 1 {
+		t.Errorf("Peeking counted as cache hit.")
+	}
+	if cache.Peek("2.2.2.2:2") != nil {
+		t.Errorf("Peeked at expired cache entry.")
+	}
+}
+
+func TestCacheExpiration(t *testing.T) {
+
+	cache := NewCache()
+
+	const shortForm = "2006-Jan-02"
+	expiry, _ := time.Parse(shortForm, "2000-Jan-01")
+	bridgeLine1 := "1.1.1.1:1111"
+	cache.AddEntry(bridgeLine1, nil, expiry)
+
+	bridgeLine2 := "2.2.2.2:2222"
+	cache.AddEntry(bridgeLine2, nil, time.Now().UTC())
+
+	e := cache.IsCached(bridgeLine1)
+	if e != nil {
+		t.Errorf("Expired cache entry was not successfully pruned.")
+	}
+
+	e = cache.IsCached(bridgeLine2)
+	if e == nil {
+		t.Errorf("Valid cache entry was incorrectly pruned.")
+	}
+
+	// Failures may expire sooner than successes.
+	cache.SetTimeouts(18*time.Hour, time.Hour)
+	twoHoursAgo := time.Now().UTC().Add(-2 * time.Hour)
+	cache.AddEntry(bridgeLine1, nil, twoHoursAgo)
+	cache.AddEntry(bridgeLine2, errors.New("censorship"), twoHoursAgo)
+	if cache.Peek(bridgeLine1) == nil {
+		t.Errorf("Functional cache entry expired after failure timeout.")
+	}
+	if cache.Peek(bridgeLine2) != nil {
+		t.Errorf("Dysfunctional cache entry outlived failure timeout.")
+	}
+	if cache.IsCached(bridgeLine2) != nil || len(cache.Snapshot()) != 1 {
+		t.Errorf("Failed to prune expired dysfunctional cache entry.")
+	}
+}
+
+func BenchmarkIsCached(b *testing.B) {
+
+	getRandAddrPort := func() string {
+		return fmt.Sprintf("%d.%d.%d.%d:%d",
+			rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(65536))
+	}
+	getRandError := func() error {
+		errors := []error{nil, errors.New("censorship"), errors.New("no censorship")}
+		return errors[rand.Intn(len(errors))]
+	}
+
+	numCacheEntries := 10000
+	cache := NewCache()
+	for i := 0; i < numCacheEntries; i++ {
+		cache.AddEntry(getRandAddrPort(), getRandError(), time.Now().UTC())
+	}
+
+	// How long does it take to iterate over numCacheEntries cache entries?
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cache.IsCached("invalid bridge line")
+	}
+}
+
+// BenchmarkCacheContention compares an unsharded cache with our sharded cache
+// while parallel goroutines add and look up entries, and every thousandth
+// operation exports a snapshot, as our request path and exports do.
+func BenchmarkCacheContention(b *testing.B) {
+
+	numCacheEntries := 10000
+	bridgeLines := make([]string, numCacheEntries)
+	for i := range bridgeLines {
+		bridgeLines[i] = fmt.Sprintf("%d.%d.%d.%d:%d",
+			rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(256), rand.Intn(65536))
+	}
+
+	for _, numShards := range []int{1, NumShards} {
+		b.Run(fmt.Sprintf("shards=%d", numShards), func(b *testing.B) {
+			cache := newShardedCache(18*time.Hour, numShards)
+			for _, bridgeLine := range bridgeLines {
+				cache.AddEntry(bridgeLine, nil, time.Now().UTC())
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for i := 0; pb.Next(); i++ {
+					bridgeLine := bridgeLines[r.Intn(len(bridgeLines))]
+					switch {
+					case i%1000 == 0:
+						cache.Snapshot()
+					case i%2 == 0:
+						cache.AddEntry(bridgeLine, nil, time.Now().UTC())
+					default:
+						cache.Peek(bridgeLine)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCacheSerialisation(t *testing.T) {
+
+	cache := NewCache()
+	testError := fmt.Errorf("foo")
+	cache.AddEntry("1.1.1.1:1", testError, time.Now().UTC())
+	cache.AddResult("2.2.2.2:2", fmt.Errorf("bar"), "CONNECTREFUSED", time.Now().UTC(), nil)
+
+	tmpFh, err := ioutil.TempFile(os.TempDir(), "cache-file-")
+	if err != nil {
+		t.Errorf("Could not create temporary file for test: %s", err)
+	}
+	defer os.Remove(tmpFh.Name())
+
+	err = cache.WriteToDisk(tmpFh.Name())
+	if err != nil {
+		t.Errorf("Failed to write cache to disk: %s", err)
+	}
+	err = cache.ReadFromDisk(tmpFh.Name())
+	if err != nil {
+		t.Errorf("Failed to read cache from disk: %s", err)
+	}
+
+	if n, _ := cache.Size(); n != 2 {
+		t.Errorf("Cache supposed to contain but two elements but has %d.", n)
+	}
+
+	e1 := cache.IsCached("1.1.1.1:1")
+	if e1 == nil {
+		t.Errorf("Cache element supposed to exist but doesn't.")
+	}
+	if e1.Error != testError.Error() {
+		t.Errorf("Error string expected to be %q but is %q.", testError, e1.Error)
+	}
+	if e2 := cache.IsCached("2.2.2.2:2"); e2 == nil || e2.ErrorCode != "CONNECTREFUSED" {
+		t.Errorf("Error code didn't survive serialisation: %+v", e2)
+	}
+
+	// Test errors when reading/writing bogus files.
+	if err = cache.ReadFromDisk("/f/o/o/b/a/r"); err == nil {
+		t.Errorf("Failed to return error when reading bogus file.")
+	}
+	if err = cache.WriteToDisk("/f/o/o/b/a/r"); err == nil {
+		t.Errorf("Failed to return error when writing bogus file.")
+	}
+}
+
+func TestCacheConcurrency(t *testing.T) {
+
+	cache := NewCache()
+	max := 10000
+	doneReading := make(chan bool)
+	doneWriting := make(chan bool)
+
+	// Trigger many concurrent reads and writes, to verify that there are no
+	// synchronisation issues.
+	go func() {
+		for i := 0; i < max; i++ {
+			ipAddr := net.IPv4(byte((i>>24)&0xff),
+				byte((i>>16)&0xff),
+				byte((i>>8)&0xff),
+				byte(i&0xff))
+			cache.AddEntry(fmt.Sprintf("%s:1234", ipAddr.String()), nil, time.Now().UTC())
+		}
+		doneWriting <- true
+	}()
+
+	go func() {
+		for i := 0; i < max; i++ {
+			ipAddr := net.IPv4(byte((i>>24)&0xff),
+				byte((i>>16)&0xff),
+				byte((i>>8)&0xff),
+				byte(i&0xff))
+			cache.IsCached(fmt.Sprintf("%s:1234", ipAddr.String()))
+		}
+		doneReading <- true
+	}()
+
+	<-doneReading
+	<-doneWriting
+}
+
+// plainMatcher treats addr:port tuples as their own hashed identifiers.
+type plainMatcher struct{}
+
+func (plainMatcher) Matches(hashedID, addrPort string) bool {
+	return hashedID == addrPort
+}
+
+func (plainMatcher) HashesOf(addrPort string) []string {
+	return []string{addrPort}
+}
+
+// prefixHasher prefixes addr:port tuples with its key, like a keyed hash.
+type prefixHasher string
+
+func (h prefixHasher) HashesOf(addrPort string) []string {
+	return []string{string(h) + addrPort}
+}
+
+func TestCacheFindByHashedID(t *testing.T) {
+
+	cache := NewCache()
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	if e := cache.FindByHashedID("1.1.1.1:1"); e != nil {
+		t.Errorf("Found cache entry by hashed identifier without a hasher.")
+	}
+
+	// Entries that we had before we got a hasher must be indexed, too.
+	cache.SetHasher(plainMatcher{})
+	cache.AddEntry("2.2.2.2:2", errors.New("error"), time.Now().UTC())
+	if e := cache.FindByHashedID("1.1.1.1:1"); e == nil || e.Error != "" {
+		t.Errorf("Failed to find earlier cache entry by hashed identifier.")
+	}
+	e := cache.FindByHashedID("2.2.2.2:2")
+	if e == nil || e.Error != "error" {
+		t.Errorf("Failed to find cache entry by hashed identifier.")
+	}
+
+	if e = cache.FindByHashedID("3.3.3.3:3"); e != nil {
+		t.Errorf("Found cache entry for unknown hashed identifier.")
+	}
+
+	// Expired entries must not be found, and pruned entries must leave
+	// our index.
+	cache.AddEntry("1.1.1.1:1", nil, time.Now().UTC().Add(-48*time.Hour))
+	if e = cache.FindByHashedID("1.1.1.1:1"); e != nil {
+		t.Errorf("Found expired cache entry by hashed identifier.")
+	}
+	cache.Prune()
+	if _, exists := cache.index["1.1.1.1:1"]; exists {
+		t.Errorf("Pruned cache entry is still indexed.")
+	}
+
+	// Loaded entries replace our index.
+	other := NewCache()
+	other.AddEntry("4.4.4.4:4", nil, time.Now().UTC())
+	cache.Load(other.Export())
+	if cache.FindByHashedID("2.2.2.2:2") != nil || cache.FindByHashedID("4.4.4.4:4") == nil {
+		t.Errorf("Loading entries didn't rebuild our index.")
+	}
+
+	// Once our hasher's key changes, only the new hashed identifiers work.
+	cache.SetHasher(prefixHasher("new-"))
+	if cache.FindByHashedID("4.4.4.4:4") != nil || cache.FindByHashedID("new-4.4.4.4:4") == nil {
+		t.Errorf("Changing our hasher didn't rebuild our index.")
+	}
+}
+
+func TestCacheMerge(t *testing.T) {
+
+	now := time.Now().UTC()
+	cache := NewCache()
+	cache.SetHasher(plainMatcher{})
+	cache.AddEntry("1.1.1.1:1", nil, now)
+	cache.AddEntry("2.2.2.2:2", nil, now.Add(-time.Hour))
+	cache.AddEntry("3.3.3.3:3", nil, now)
+
+	other := NewCache()
+	other.AddEntry("1.1.1.1:1", errors.New("old"), now.Add(-time.Hour))
+	other.AddEntry("2.2.2.2:2", errors.New("new"), now)
+	other.AddEntry("4.4.4.4:4", nil, now)
+	if merged := cache.Merge(other.Export()); merged != 2 {
+		t.Errorf("Expected to merge 2 entries but merged %d.", merged)
+	}
+
+	// We keep our more recent entries, and our entries that the other cache
+	// doesn't have.
+	if e := cache.IsCached("1.1.1.1:1"); e == nil || e.Error != "" {
+		t.Errorf("Merge replaced more recent entry.")
+	}
+	if e := cache.IsCached("2.2.2.2:2"); e == nil || e.Error != "new" {
+		t.Errorf("Merge didn't replace older entry.")
+	}
+	if cache.IsCached("3.3.3.3:3") == nil || cache.IsCached("4.4.4.4:4") == nil {
+		t.Errorf("Merge lost entries.")
+	}
+	if numEntries, _ := cache.Size(); numEntries != 4 {
+		t.Errorf("Expected 4 entries but got %d.", numEntries)
+	}
+	if e := cache.FindByHashedID("4.4.4.4:4"); e == nil {
+		t.Errorf("Merged entry isn't indexed.")
+	}
+}
+
+func TestCacheSnapshotByHashedID(t *testing.T) {
+
+	cache := NewCache()
+	now := time.Now().UTC()
+	cache.AddEntry("1.1.1.1:1", nil, now.Add(-time.Minute))
+	cache.AddEntry("obfs4 1.1.1.1:1 cert=foo iat-mode=0", errors.New("error"), now)
+	cache.AddEntry("2.2.2.2:2", nil, now.Add(-2*time.Hour))
+	if len(cache.SnapshotByHashedID()) != 0 {
+		t.Errorf("Snapshot without hasher isn't empty.")
+	}
+
+	cache.SetHasher(prefixHasher("id-"))
+	cache.StripAddresses(now.Add(-time.Hour), func(addrPort string) string { return "id-" + addrPort })
+	snapshot := cache.SnapshotByHashedID()
+	if len(snapshot) != 2 {
+		t.Fatalf("Expected 2 entries but got %d.", len(snapshot))
+	}
+	if entry := snapshot["ID-1.1.1.1:1"]; entry.Error == "" {
+		t.Errorf("Snapshot doesn't contain most recent entry of shared hashed identifier.")
+	}
+	if entry, exists := snapshot["ID-2.2.2.2:2"]; !exists || entry.AddrPort != "" {
+		t.Errorf("Snapshot doesn't contain stripped entry.")
+	}
+}
+
+func TestCacheStripAddresses(t *testing.T) {
+
+	cache := NewCache()
+	cache.SetHasher(prefixHasher("id-"))
+	now := time.Now().UTC()
+	cache.AddEntry("1.1.1.1:1", nil, now.Add(-2*time.Hour))
+	cache.AddEntry("2.2.2.2:2", nil, now)
+
+	hash := func(addrPort string) string { return "id-" + addrPort }
+	if n := cache.StripAddresses(now.Add(-time.Hour), hash); n != 1 {
+		t.Errorf("Expected to strip 1 entry but stripped %d.", n)
+	}
+	if n := cache.StripAddresses(now.Add(-time.Hour), hash); n != 0 {
+		t.Errorf("Stripped %d entries twice.", n)
+	}
+	entry := cache.Peek("1.1.1.1:1")
+	if entry == nil || entry.AddrPort != "" || entry.HashedID != "id-1.1.1.1:1" || entry.Family != "ipv4" {
+		t.Errorf("Didn't strip old entry: %+v", entry)
+	}
+	if entry := cache.Peek("2.2.2.2:2"); entry == nil || entry.AddrPort != "2.2.2.2:2" {
+		t.Errorf("Stripped recent entry: %+v", entry)
+	}
+
+	// Stripped entries still count towards our aggregates, and their
+	// hashed identifiers still find them.
+	if numEntries, _ := cache.Size(); numEntries != 2 {
+		t.Errorf("Expected 2 entries but got %d.", numEntries)
+	}
+	summary := cache.Summary()
+	if summary.Bridges != 2 || len(summary.Groups) != 1 || summary.Groups[0].Family != "ipv4" {
+		t.Errorf("Unexpected summary after stripping: %+v", summary.Groups[0])
+	}
+	if cache.FindByHashedID("id-1.1.1.1:1") == nil {
+		t.Errorf("Failed to find stripped entry by its hashed identifier.")
+	}
+	if _, exists := cache.Snapshot()[""]; exists {
+		t.Errorf("Stripped entry is part of our snapshot.")
+	}
+
+	// Our index must survive a round trip to disk.
+	tmpFh, err := ioutil.TempFile(os.TempDir(), "cache-file-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpFh.Name())
+	if err := cache.WriteToDisk(tmpFh.Name()); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewCache()
+	reloaded.SetHasher(prefixHasher("id-"))
+	if err := reloaded.ReadFromDisk(tmpFh.Name()); err != nil {
+		t.Fatal(err)
+	}
+	if entry := reloaded.FindByHashedID("id-1.1.1.1:1"); entry == nil || entry.AddrPort != "" {
+		t.Errorf("Failed to find reloaded stripped entry by its hashed identifier.")
+	}
+}
+
+func TestCacheOnResize(t *testing.T) {
+
+	cache := NewCache()
+	numEntries, numBytes := -1, -1
+	cache.OnResize(func(n, b int) {
+		numEntries, numBytes = n, b
+	})
+	if numEntries != 0 || numBytes != 0 {
+		t.Errorf("Expected empty cache but got %d entries and %d bytes.", numEntries, numBytes)
+	}
+
+	cache.AddEntry("1.1.1.1:1", errors.New("error"), time.Now().UTC())
+	key, _ := Key("1.1.1.1:1")
+	expectedBytes := len(key) + len("1.1.1.1:1") + len("error") + EntryOverhead
+	if numEntries != 1 || numBytes != expectedBytes {
+		t.Errorf("Expected 1 entry and %d bytes but got %d entries and %d bytes.",
+			expectedBytes, numEntries, numBytes)
+	}
+	if n, b := cache.Size(); n != numEntries || b != numBytes {
+		t.Errorf("Size returned %d entries and %d bytes but resize function got %d and %d.",
+			n, b, numEntries, numBytes)
+	}
+
+	// Pruning an expired entry must shrink the cache.
+	cache.shardFor(key).entries[key].Time = time.Now().UTC().Add(-cache.SuccessTimeout() * 2)
+	cache.IsCached("2.2.2.2:2")
+	if numEntries != 0 || numBytes != 0 {
+		t.Errorf("Expected pruned cache but got %d entries and %d bytes.", numEntries, numBytes)
+	}
+}
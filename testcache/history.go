@@ -0,0 +1,259 @@
+package testcache
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// HistorySchemaVersion is the schema version of our history file.
+	HistorySchemaVersion = 1
+	// MaxHistoryLength is the maximum number of test results that we keep
+	// per bridge.  Older results make way for newer results.
+	MaxHistoryLength = 500
+)
+
+// HistoryResult represents a single test result in a bridge's history.
+// Error is empty if the bridge worked.  AddrPort is the addr:port tuple of the
+// tested bridge line, which lets us find bridges by their hashed identifier.
+// It's empty for results that we read from older history files, and for
+// results whose address we stripped, which only keep the addr:port tuple's
+// HashedID.
+type HistoryResult struct {
+	Time     time.Time
+	Error    string
+	AddrPort string
+	HashedID string
+}
+
+// History keeps a time series of test results per bridge, keyed by the
+// bridges' fingerprints, so bridge operators can learn when their bridge
+// started failing.  Unlike our cache, a history never answers test requests.
+// Bridge lines without a fingerprint have no history.  It's safe for
+// concurrent use.
+type History struct {
+	// Results maps a bridge's upper-case fingerprint to its test results,
+	// sorted from oldest to newest.
+	Results map[string][]*HistoryResult
+	// retention determines how long we keep test results for.
+	retention time.Duration
+	l         sync.Mutex
+}
+
+// persistedHistory is the on-disk representation of our history.
+type persistedHistory struct {
+	Version int
+	Results map[string][]*HistoryResult
+}
+
+// NewHistory returns a new history that keeps test results for the given
+// duration.
+func NewHistory(retention time.Duration) *History {
+	return &History{Results: make(map[string][]*HistoryResult), retention: retention}
+}
+
+// Retention returns how long we keep test results for.
+func (h *History) Retention() time.Duration {
+	return h.retention
+}
+
+// prune removes test results that are older than our retention period, and
+// bridges whose results are all gone.  The caller must hold our lock.
+func (h *History) prune(now time.Time) {
+
+	cutoff := now.Add(-h.retention)
+	for fingerprint, results := range h.Results {
+		i := 0
+		for i < len(results) && results[i].Time.Before(cutoff) {
+			i++
+		}
+		if i == len(results) {
+			delete(h.Results, fingerprint)
+		} else if i > 0 {
+			h.Results[fingerprint] = append([]*HistoryResult{}, results[i:]...)
+		}
+	}
+}
+
+// Add appends the given test result of the given bridge line to the bridge's
+// history.  We ignore bridge lines without a fingerprint.
+func (h *History) Add(bridgeLine string, result error, lastTested time.Time) {
+
+	fingerprint, err := bridgeline.Fingerprint(bridgeLine)
+	if err != nil {
+		return
+	}
+
+	var errorStr string
+	if result != nil {
+		errorStr = result.Error()
+	}
+	// Bridge lines that have a fingerprint also have an addr:port tuple.
+	addrPort, _ := bridgeline.AddrPort(bridgeLine)
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	results := h.Results[fingerprint]
+	// Results usually arrive in order, but concurrent tests may finish out
+	// of order, so we insert the result where it belongs.
+	i := len(results)
+	for i > 0 && results[i-1].Time.After(lastTested) {
+		i--
+	}
+	results = append(results, nil)
+	copy(results[i+1:], results[i:])
+	results[i] = &HistoryResult{Time: lastTested, Error: errorStr, AddrPort: addrPort}
+	if len(results) > MaxHistoryLength {
+		results = results[len(results)-MaxHistoryLength:]
+	}
+	h.Results[fingerprint] = results
+}
+
+// Lookup returns a copy of the test results that we have for the bridge with
+// the given fingerprint, sorted from oldest to newest.  It returns an empty
+// slice if we know nothing about the bridge.
+func (h *History) Lookup(fingerprint string) []HistoryResult {
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	h.prune(time.Now().UTC())
+	results := []HistoryResult{}
+	for _, result := range h.Results[fingerprint] {
+		results = append(results, *result)
+	}
+	return results
+}
+
+// FindByHashedID returns a copy of the test results of the bridge whose
+// addr:port tuple hashes to the given hashed identifier, sorted from oldest to
+// newest.  If several bridges had the addr:port tuple, we return the results
+// of the one that we tested with it most recently.  It returns an empty slice
+// if we know nothing about the bridge.
+func (h *History) FindByHashedID(m IDMatcher, hashedID string) []HistoryResult {
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	h.prune(time.Now().UTC())
+	var found []*HistoryResult
+	var foundTime time.Time
+	for _, results := range h.Results {
+		// A bridge rarely changes its addr:port tuple, so we hash each of
+		// its tuples only once.
+		matches := make(map[string]bool)
+		for i := len(results) - 1; i >= 0; i-- {
+			var matched bool
+			if addrPort := results[i].AddrPort; addrPort != "" {
+				if _, checked := matches[addrPort]; !checked {
+					matches[addrPort] = m.Matches(hashedID, addrPort)
+				}
+				matched = matches[addrPort]
+			} else if results[i].HashedID != "" {
+				// We stripped the result's address.
+				matched = strings.EqualFold(results[i].HashedID, hashedID)
+			}
+			if matched {
+				if found == nil || results[i].Time.After(foundTime) {
+					found, foundTime = results, results[i].Time
+				}
+				break
+			}
+		}
+	}
+
+	copied := []HistoryResult{}
+	for _, result := range found {
+		copied = append(copied, *result)
+	}
+	return copied
+}
+
+// StripAddresses replaces the addr:port tuples of the test results that we
+// got before the given time with the hashed identifiers that the given
+// function returns for them, and returns the number of results that it
+// stripped.  Stripped results can still be found by their hashed identifier,
+// as long as we don't rotate our key.
+func (h *History) StripAddresses(cutoff time.Time, hash func(addrPort string) string) int {
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	numStripped := 0
+	for _, results := range h.Results {
+		for _, result := range results {
+			if !result.Time.Before(cutoff) {
+				// Results are sorted from oldest to newest.
+				break
+			}
+			if result.AddrPort == "" {
+				continue
+			}
+			result.HashedID = hash(result.AddrPort)
+			result.AddrPort = ""
+			numStripped++
+		}
+	}
+	return numStripped
+}
+
+// WriteToDisk writes our history to disk, allowing it to persist across
+// program restarts.  We prune expired results first, so our history file
+// doesn't grow forever.
+func (h *History) WriteToDisk(historyFile string) error {
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	h.prune(time.Now().UTC())
+	err := WriteFileAtomically(historyFile, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(persistedHistory{
+			Version: HistorySchemaVersion,
+			Results: h.Results,
+		})
+	})
+	if err == nil {
+		log.Printf("Wrote history of %d bridges to %q.", len(h.Results), historyFile)
+	}
+
+	return err
+}
+
+// ReadFromDisk reads our history from disk.
+func (h *History) ReadFromDisk(historyFile string) error {
+
+	fh, err := os.Open(historyFile)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	ph := &persistedHistory{}
+	if err := gob.NewDecoder(fh).Decode(ph); err != nil {
+		return err
+	}
+	if ph.Version > HistorySchemaVersion {
+		return fmt.Errorf("history schema version %d is newer than ours (%d)",
+			ph.Version, HistorySchemaVersion)
+	}
+	if ph.Results == nil {
+		ph.Results = make(map[string][]*HistoryResult)
+	}
+
+	h.l.Lock()
+	h.Results = ph.Results
+	h.prune(time.Now().UTC())
+	log.Printf("Read history of %d bridges from %q.", len(h.Results), historyFile)
+	h.l.Unlock()
+
+	return nil
+}
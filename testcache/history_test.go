@@ -0,0 +1,123 @@
+package testcache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+
+	h := NewHistory(24 * time.Hour)
+	fingerprint := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	bridgeLine := "obfs4 1.2.3.4:1234 " + fingerprint + " cert=foo iat-mode=0"
+	now := time.Now().UTC()
+
+	h.Add(bridgeLine, nil, now.Add(-2*time.Hour))
+	h.Add(bridgeLine, errors.New("bridge is on fire"), now)
+	// Results that arrive out of order end up where they belong.
+	h.Add(bridgeLine, nil, now.Add(-time.Hour))
+	// Results that are past our retention period disappear.
+	h.Add(bridgeLine, nil, now.Add(-48*time.Hour))
+	// Bridge lines without fingerprint have no history.
+	h.Add("1.2.3.4:1234", nil, now)
+
+	results := h.Lookup(fingerprint)
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results but got %d.", len(results))
+	}
+	if !results[1].Time.Equal(now.Add(-time.Hour)) || results[2].Error != "bridge is on fire" {
+		t.Errorf("Results are in unexpected order: %v", results)
+	}
+	if len(h.Lookup("1234567890ABCDEF1234567890ABCDEF12345678")) != 0 {
+		t.Errorf("Got history of unknown bridge.")
+	}
+
+	for i := 0; i < MaxHistoryLength+10; i++ {
+		h.Add(bridgeLine, nil, now.Add(time.Duration(i)*time.Second))
+	}
+	if len(h.Lookup(fingerprint)) != MaxHistoryLength {
+		t.Errorf("History grew beyond %d results.", MaxHistoryLength)
+	}
+}
+
+func TestHistorySerialisation(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-history-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	historyFile := filepath.Join(dir, "history.bin")
+
+	fingerprint := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	h := NewHistory(24 * time.Hour)
+	h.Add("1.2.3.4:1234 "+fingerprint, errors.New("bridge is on fire"), time.Now().UTC())
+	if err := h.WriteToDisk(historyFile); err != nil {
+		t.Fatalf("Failed to write history to disk: %s", err)
+	}
+
+	h = NewHistory(24 * time.Hour)
+	if err := h.ReadFromDisk(historyFile); err != nil {
+		t.Fatalf("Failed to read history from disk: %s", err)
+	}
+	results := h.Lookup(fingerprint)
+	if len(results) != 1 || results[0].Error != "bridge is on fire" {
+		t.Errorf("History didn't survive serialisation: %v", results)
+	}
+}
+
+func TestHistoryFindByHashedID(t *testing.T) {
+
+	h := NewHistory(24 * time.Hour)
+	fingerprint1 := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	fingerprint2 := "1234567890ABCDEF1234567890ABCDEF12345678"
+	now := time.Now().UTC()
+
+	h.Add("1.2.3.4:1234 "+fingerprint1, nil, now.Add(-2*time.Hour))
+	h.Add("5.6.7.8:5678 "+fingerprint1, nil, now.Add(-time.Hour))
+	h.Add("1.2.3.4:1234 "+fingerprint2, errors.New("bridge is on fire"), now.Add(-time.Minute))
+
+	// The second bridge used the addr:port tuple most recently.
+	results := h.FindByHashedID(plainMatcher{}, "1.2.3.4:1234")
+	if len(results) != 1 || results[0].Error != "bridge is on fire" {
+		t.Errorf("Got unexpected results: %v", results)
+	}
+	// The first bridge moved to a new addr:port tuple.
+	if results = h.FindByHashedID(plainMatcher{}, "5.6.7.8:5678"); len(results) != 2 {
+		t.Errorf("Expected 2 results but got %v.", results)
+	}
+	if results = h.FindByHashedID(plainMatcher{}, "9.9.9.9:9"); len(results) != 0 {
+		t.Errorf("Got history of unknown bridge: %v", results)
+	}
+}
+
+func TestHistoryStripAddresses(t *testing.T) {
+
+	h := NewHistory(24 * time.Hour)
+	fingerprint := "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D"
+	now := time.Now().UTC()
+	h.Add("1.2.3.4:1234 "+fingerprint, nil, now.Add(-2*time.Hour))
+	h.Add("1.2.3.4:1234 "+fingerprint, nil, now.Add(-time.Minute))
+
+	hash := func(addrPort string) string { return "hashed-" + addrPort }
+	if n := h.StripAddresses(now.Add(-time.Hour), hash); n != 1 {
+		t.Errorf("Expected to strip 1 result but stripped %d.", n)
+	}
+	if n := h.StripAddresses(now.Add(-time.Hour), hash); n != 0 {
+		t.Errorf("Stripped %d results twice.", n)
+	}
+	results := h.Lookup(fingerprint)
+	if results[0].AddrPort != "" || results[0].HashedID != "hashed-1.2.3.4:1234" || results[1].AddrPort != "1.2.3.4:1234" {
+		t.Errorf("Unexpected results after stripping addresses: %v", results)
+	}
+
+	// Stripped results remain findable by their hashed identifier.
+	h.StripAddresses(now, hash)
+	if results = h.FindByHashedID(plainMatcher{}, "HASHED-1.2.3.4:1234"); len(results) != 2 {
+		t.Errorf("Failed to find stripped results by hashed identifier: %v", results)
+	}
+}
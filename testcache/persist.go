@@ -0,0 +1,343 @@
+package testcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	// CacheSchemaVersion is the schema version of our cache file.  Increment
+	// it whenever the meaning of persisted fields changes, and add a
+	// migration to cacheMigrations.  Adding fields doesn't require a new
+	// version because gob ignores fields that it doesn't know.
+	CacheSchemaVersion = 2
+
+	// FormatGob is our default cache file format: a single gob-encoded
+	// persistedCache.
+	FormatGob = "gob"
+	// FormatJSONL is a human-readable cache file format: a header line
+	// with our schema version, followed by one JSON-encoded entry per line.
+	// Later lines override earlier lines with the same key, so tools can
+	// append entries to the file.
+	FormatJSONL = "jsonl"
+
+	// maxJSONLLine is the maximum length of a line in a JSON Lines cache
+	// file.
+	maxJSONLLine = 1024 * 1024
+)
+
+// jsonlHeader is the first line of a JSON Lines cache file.
+type jsonlHeader struct {
+	Version int
+}
+
+// jsonlEntry is a line of a JSON Lines cache file, i.e., a cache entry along
+// with its key (see Key).
+type jsonlEntry struct {
+	Key string
+	*Entry
+}
+
+// persistedCache is the on-disk representation of our cache.  Cache files
+// that were written before we introduced schema versions have no Version
+// field, which gob decodes as version 0.
+type persistedCache struct {
+	Version int
+	Entries map[string]*Entry
+}
+
+// cacheMigration upgrades a persisted cache from one schema version to the
+// next.
+type cacheMigration func(*persistedCache) error
+
+// cacheMigrations maps a schema version to the migration that upgrades it to
+// the next version.
+var cacheMigrations = map[int]cacheMigration{
+	// Version 0 only lacks the version field, so there's nothing to do.
+	0: func(pc *persistedCache) error { return nil },
+	// Version 1 keyed entries by their addr:port tuple, which made bridge
+	// lines that share an addr:port tuple collide.  We don't know the
+	// bridge lines of these entries, but an addr:port tuple is a valid
+	// bridge line, so we key entries by its hash.  Lookups of full bridge
+	// lines miss these entries, but our hashed identifiers, which are based
+	// on addr:port tuples, keep finding them until they expire.
+	1: func(pc *persistedCache) error {
+		entries := make(map[string]*Entry)
+		for addrPort, entry := range pc.Entries {
+			key, err := Key(addrPort)
+			if err != nil {
+				log.Printf("Dropping cache entry with invalid addr:port tuple.")
+				continue
+			}
+			entry.AddrPort = addrPort
+			entries[key] = entry
+		}
+		pc.Entries = entries
+		return nil
+	},
+}
+
+// migrateCache upgrades the given persisted cache to our current schema
+// version.  Caches that were written by a newer version of bridgestrap are
+// left as they are, and we hope for the best.
+func migrateCache(pc *persistedCache) error {
+
+	if pc.Version > CacheSchemaVersion {
+		log.Printf("Cache schema version %d is newer than ours (%d).  Ignoring unknown fields.",
+			pc.Version, CacheSchemaVersion)
+		return nil
+	}
+	for pc.Version < CacheSchemaVersion {
+		migration, exists := cacheMigrations[pc.Version]
+		if !exists {
+			return fmt.Errorf("no migration for cache schema version %d", pc.Version)
+		}
+		if err := migration(pc); err != nil {
+			return fmt.Errorf("failed to migrate cache schema version %d: %v", pc.Version, err)
+		}
+		log.Printf("Migrated cache from schema version %d to %d.", pc.Version, pc.Version+1)
+		pc.Version++
+	}
+	return nil
+}
+
+// ValidateFormat returns an error if the given cache file format is neither
+// FormatGob nor FormatJSONL.
+func ValidateFormat(format string) error {
+
+	if format != FormatGob && format != FormatJSONL {
+		return fmt.Errorf("unknown cache format %q; use %q or %q", format, FormatGob, FormatJSONL)
+	}
+	return nil
+}
+
+// encodeCache writes the given cache entries, along with our current schema
+// version, to the given writer, in the given format.
+func encodeCache(w io.Writer, entries map[string]*Entry, format string) error {
+
+	if format == FormatJSONL {
+		return encodeJSONL(w, entries)
+	}
+	return gob.NewEncoder(w).Encode(persistedCache{
+		Version: CacheSchemaVersion,
+		Entries: entries,
+	})
+}
+
+// encodeJSONL writes the given cache entries to the given writer as JSON
+// Lines, sorted by key, so cache files are easy to diff.
+func encodeJSONL(w io.Writer, entries map[string]*Entry) error {
+
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	if err := encoder.Encode(&jsonlHeader{Version: CacheSchemaVersion}); err != nil {
+		return err
+	}
+	keys := []string{}
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := encoder.Encode(&jsonlEntry{Key: key, Entry: entries[key]}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// decodeJSONL reads a JSON Lines cache file from the given reader, one line
+// at a time, so we never hold the entire file in memory.
+func decodeJSONL(r io.Reader) (*persistedCache, error) {
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxJSONLLine)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	header := &jsonlHeader{}
+	if err := json.Unmarshal(scanner.Bytes(), header); err != nil {
+		return nil, fmt.Errorf("invalid header line: %v", err)
+	}
+
+	pc := &persistedCache{Version: header.Version, Entries: make(map[string]*Entry)}
+	for lineNum := 2; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		e := &jsonlEntry{}
+		if err := json.Unmarshal(line, e); err != nil {
+			return nil, fmt.Errorf("invalid entry in line %d: %v", lineNum, err)
+		}
+		if e.Key == "" || e.Entry == nil {
+			return nil, fmt.Errorf("incomplete entry in line %d", lineNum)
+		}
+		pc.Entries[e.Key] = e.Entry
+	}
+	return pc, scanner.Err()
+}
+
+// isJSONL returns true if the given reader holds a JSON Lines cache file.  A
+// gob stream can't start like a JSON object because its first message
+// defines a type, which gob encodes as an odd number.
+func isJSONL(r *bufio.Reader) bool {
+
+	prefix, _ := r.Peek(2)
+	return string(prefix) == `{"`
+}
+
+// decodeCache reads a persisted cache in either of our formats from the given
+// reader and migrates it to our current schema version.
+func decodeCache(r io.Reader) (map[string]*Entry, error) {
+
+	br := bufio.NewReader(r)
+	pc := &persistedCache{}
+	if isJSONL(br) {
+		var err error
+		if pc, err = decodeJSONL(br); err != nil {
+			return nil, err
+		}
+	} else if err := gob.NewDecoder(br).Decode(pc); err != nil {
+		return nil, err
+	}
+	if err := migrateCache(pc); err != nil {
+		return nil, err
+	}
+	if pc.Entries == nil {
+		pc.Entries = make(map[string]*Entry)
+	}
+	return pc.Entries, nil
+}
+
+// Decode reads the entries of a persisted cache in either of our formats from
+// the given reader, which lets tools inspect a cache file without loading it
+// into a Cache.
+func Decode(r io.Reader) (map[string]*Entry, error) {
+	return decodeCache(r)
+}
+
+// WriteFileAtomically writes to a temporary file in the same directory as the
+// given file, and then renames the temporary file.  That way, a crash while
+// writing never leaves us with a truncated file.
+func WriteFileAtomically(filename string, write func(io.Writer) error) error {
+
+	tmpFh, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFh.Name())
+
+	if err = write(tmpFh); err != nil {
+		tmpFh.Close()
+		return err
+	}
+	if err = tmpFh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFh.Name(), filename)
+}
+
+// Migration upgrades the top-level fields of a JSON state file from one schema
+// version to the next, in place.
+type Migration func(fields map[string]json.RawMessage) error
+
+// NoMigration is the migration of schema versions that only lack something
+// that we can do without, e.g., files that predate their version field.
+func NoMigration(fields map[string]json.RawMessage) error {
+	return nil
+}
+
+// Schema describes the format of one of our JSON state files, e.g., our
+// subscription file: a JSON object whose "version" field holds the schema
+// version of the object's other fields.  Files that predate schema versions
+// have no "version" field, which we read as version 0.
+type Schema struct {
+	// Name describes the file in errors and logs, e.g., "subscription".
+	Name string
+	// Version is the file's current schema version.  Increment it whenever
+	// the meaning of persisted fields changes, and add a migration to
+	// Migrations.  Adding fields doesn't require a new version because we
+	// ignore fields that we don't know.
+	Version int
+	// Migrations maps a schema version to the migration that upgrades a
+	// file from it to the next version.
+	Migrations map[int]Migration
+}
+
+// WriteFile atomically writes the given value, which must encode as a JSON
+// object, to the given file, along with our current schema version.
+func (s *Schema) WriteFile(filename string, v interface{}) error {
+
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return err
+	}
+	fields["version"] = json.RawMessage(strconv.Itoa(s.Version))
+
+	return WriteFileAtomically(filename, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(fields)
+	})
+}
+
+// ReadFile reads the given file, migrates it to our current schema version,
+// and decodes it into the given value.  It returns ioutil.ReadFile's error if
+// it can't read the file, so callers can check for os.IsNotExist.  Files that
+// were written by a newer version of bridgestrap are decoded as they are, and
+// we hope for the best.
+func (s *Schema) ReadFile(filename string, v interface{}) error {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return err
+	}
+	version := 0
+	if raw, exists := fields["version"]; exists {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return fmt.Errorf("invalid %s schema version: %v", s.Name, err)
+		}
+	}
+
+	if version > s.Version {
+		log.Printf("Schema version %d of %s file is newer than ours (%d).  Ignoring unknown fields.",
+			version, s.Name, s.Version)
+	}
+	for ; version < s.Version; version++ {
+		migration, exists := s.Migrations[version]
+		if !exists {
+			return fmt.Errorf("no migration for %s schema version %d", s.Name, version)
+		}
+		if err := migration(fields); err != nil {
+			return fmt.Errorf("failed to migrate %s schema version %d: %v", s.Name, version, err)
+		}
+		log.Printf("Migrated %s file from schema version %d to %d.", s.Name, version, version+1)
+	}
+
+	if content, err = json.Marshal(fields); err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
@@ -0,0 +1,258 @@
+package testcache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeLegacyCache(t *testing.T) {
+
+	// Caches without schema version were gob-encoded TestCache structs.
+	type legacyCache struct {
+		Entries map[string]*Entry
+	}
+	legacy := legacyCache{Entries: map[string]*Entry{
+		"1.1.1.1:1": &Entry{Error: "", Time: time.Now().UTC()},
+	}}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(legacy); err != nil {
+		t.Fatalf("Failed to encode legacy cache: %s", err)
+	}
+
+	entries, err := decodeCache(buf)
+	if err != nil {
+		t.Fatalf("Failed to decode legacy cache: %s", err)
+	}
+	key, _ := Key("1.1.1.1:1")
+	if entry, exists := entries[key]; !exists || len(entries) != 1 || entry.AddrPort != "1.1.1.1:1" {
+		t.Errorf("Legacy cache entries did not survive migration.")
+	}
+}
+
+func TestMigrateAddrPortKeys(t *testing.T) {
+
+	pc := &persistedCache{Version: 1, Entries: map[string]*Entry{
+		"1.1.1.1:1": &Entry{Error: "", Time: time.Now().UTC()},
+		"bogus":     &Entry{Error: "", Time: time.Now().UTC()},
+	}}
+	if err := migrateCache(pc); err != nil {
+		t.Fatalf("Failed to migrate cache: %s", err)
+	}
+	key, _ := Key("1.1.1.1:1")
+	if entry, exists := pc.Entries[key]; !exists || entry.AddrPort != "1.1.1.1:1" {
+		t.Errorf("Failed to re-key entry by hash of bridge line.")
+	}
+	if len(pc.Entries) != 1 {
+		t.Errorf("Failed to drop entry with invalid addr:port tuple.")
+	}
+}
+
+func TestDecodeNewerCache(t *testing.T) {
+
+	// Caches from future versions may contain fields that we don't know.
+	type futureCache struct {
+		Version  int
+		Entries  map[string]*Entry
+		Surprise string
+	}
+	future := futureCache{
+		Version:  CacheSchemaVersion + 1,
+		Entries:  map[string]*Entry{"1.1.1.1:1": &Entry{Error: "", Time: time.Now().UTC()}},
+		Surprise: "foo",
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(future); err != nil {
+		t.Fatalf("Failed to encode future cache: %s", err)
+	}
+
+	entries, err := decodeCache(buf)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Failed to decode cache of newer schema version: %s", err)
+	}
+}
+
+func TestMigrateCache(t *testing.T) {
+
+	pc := &persistedCache{Version: -1}
+	if err := migrateCache(pc); err == nil {
+		t.Errorf("Failed to reject cache without migration path.")
+	}
+
+	pc = &persistedCache{Version: 0}
+	if err := migrateCache(pc); err != nil || pc.Version != CacheSchemaVersion {
+		t.Errorf("Failed to migrate cache to current schema version: %s", err)
+	}
+}
+
+func TestWriteFileAtomically(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "atomic-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for test: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := path.Join(tmpDir, "file")
+	ioutil.WriteFile(filename, []byte("old"), 0600)
+
+	// A failed write must leave the original file intact.
+	err = WriteFileAtomically(filename, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return io.ErrUnexpectedEOF
+	})
+	if err == nil {
+		t.Errorf("Failed to return write error.")
+	}
+	if content, _ := ioutil.ReadFile(filename); string(content) != "old" {
+		t.Errorf("Failed write clobbered original file.")
+	}
+
+	err = WriteFileAtomically(filename, func(w io.Writer) error {
+		_, err := w.Write([]byte("new"))
+		return err
+	})
+	if content, _ := ioutil.ReadFile(filename); err != nil || string(content) != "new" {
+		t.Errorf("Failed to write file atomically.")
+	}
+
+	files, _ := ioutil.ReadDir(tmpDir)
+	if len(files) != 1 {
+		t.Errorf("Temporary files were left behind.")
+	}
+}
+
+func TestSchema(t *testing.T) {
+
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "schema-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory for test: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	filename := path.Join(tmpDir, "file.json")
+
+	// Version 1 renamed "names" to "clients".
+	type config struct {
+		Clients []string `json:"clients"`
+	}
+	schema := &Schema{Name: "test", Version: 2, Migrations: map[int]Migration{
+		0: NoMigration,
+		1: func(fields map[string]json.RawMessage) error {
+			fields["clients"] = fields["names"]
+			delete(fields, "names")
+			return nil
+		},
+	}}
+
+	// Files without version field are version 0.
+	ioutil.WriteFile(filename, []byte(`{"names": ["foo"]}`), 0600)
+	c := &config{}
+	if err := schema.ReadFile(filename, c); err != nil || len(c.Clients) != 1 {
+		t.Errorf("Failed to migrate file without version: %v %+v", err, c)
+	}
+
+	if err := schema.WriteFile(filename, c); err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+	if content, _ := ioutil.ReadFile(filename); !strings.Contains(string(content), `"version": 2`) {
+		t.Errorf("Written file lacks our schema version: %s", content)
+	}
+	c = &config{}
+	if err := schema.ReadFile(filename, c); err != nil || len(c.Clients) != 1 {
+		t.Errorf("Failed to read file of current version: %v %+v", err, c)
+	}
+
+	// Files of newer versions are read as they are, but we can't migrate
+	// versions that we don't know.
+	ioutil.WriteFile(filename, []byte(`{"version": 3, "clients": ["foo"], "surprise": 1}`), 0600)
+	if err := schema.ReadFile(filename, &config{}); err != nil {
+		t.Errorf("Failed to read file of newer version: %s", err)
+	}
+	ioutil.WriteFile(filename, []byte(`{"version": -1}`), 0600)
+	if err := schema.ReadFile(filename, &config{}); err == nil {
+		t.Errorf("Failed to reject file without migration path.")
+	}
+
+	if err := schema.ReadFile(path.Join(tmpDir, "missing"), &config{}); !os.IsNotExist(err) {
+		t.Errorf("Expected error for missing file but got %v.", err)
+	}
+}
+
+func TestJSONLCache(t *testing.T) {
+
+	now := time.Now().UTC().Truncate(time.Second)
+	entries := map[string]*Entry{
+		"aaaa": &Entry{Time: now, Transport: "obfs4", AddrPort: "1.1.1.1:1",
+			Context: &Context{Stages: []string{"validate", "tor"}, TorVersion: "0.4.8.10"}},
+		"bbbb": &Entry{Error: "bridge is on fire", Time: now, Hits: 3, AddrPort: "2.2.2.2:2"},
+	}
+	buf := new(bytes.Buffer)
+	if err := encodeCache(buf, entries, FormatJSONL); err != nil {
+		t.Fatalf("Failed to encode cache: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], `{"Key":"aaaa"`) {
+		t.Fatalf("Unexpected JSON Lines cache:\n%s", buf.String())
+	}
+
+	// Appended lines override earlier ones.
+	buf.WriteString(`{"Key":"aaaa","Error":"appended","Time":"` + now.Format(time.RFC3339) + `"}` + "\n")
+	decoded, err := decodeCache(buf)
+	if err != nil {
+		t.Fatalf("Failed to decode cache: %s", err)
+	}
+	if len(decoded) != 2 || decoded["aaaa"].Error != "appended" || decoded["bbbb"].Hits != 3 ||
+		!decoded["bbbb"].Time.Equal(now) {
+		t.Errorf("Unexpected decoded entries: %+v", decoded)
+	}
+	if decoded["bbbb"].Context != nil {
+		t.Errorf("Entry without context gained one: %+v", decoded["bbbb"].Context)
+	}
+	decoded, err = decodeCache(bytes.NewReader([]byte(lines[0] + "\n" + lines[1] + "\n")))
+	if err != nil || decoded["aaaa"].Context == nil || decoded["aaaa"].Context.TorVersion != "0.4.8.10" {
+		t.Errorf("Failed to round-trip entry context: %+v (%v)", decoded["aaaa"], err)
+	}
+
+	if _, err := decodeCache(strings.NewReader("{\"Version\":2}\n{bogus\n")); err == nil {
+		t.Errorf("Failed to reject malformed line.")
+	}
+	if err := ValidateFormat("xml"); err == nil {
+		t.Errorf("Accepted unknown format.")
+	}
+}
+
+func TestSwitchCacheFormat(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-cache-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cacheFile := path.Join(dir, "cache")
+
+	// A cache that was written as gob must be readable after switching to
+	// JSON Lines, and vice versa.
+	c := New(time.Hour)
+	c.AddEntry("1.1.1.1:1", nil, time.Now().UTC())
+	for _, format := range []string{FormatGob, FormatJSONL, FormatGob} {
+		if err := c.SetFormat(format); err != nil {
+			t.Fatalf("Failed to set format: %s", err)
+		}
+		if err := c.WriteToDisk(cacheFile); err != nil {
+			t.Fatalf("Failed to write %s cache: %s", format, err)
+		}
+		c = New(time.Hour)
+		if err := c.ReadFromDisk(cacheFile); err != nil {
+			t.Fatalf("Failed to read %s cache: %s", format, err)
+		}
+		if c.IsCached("1.1.1.1:1") == nil {
+			t.Errorf("Entry didn't survive %s cache.", format)
+		}
+	}
+}
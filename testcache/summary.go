@@ -0,0 +1,153 @@
+package testcache
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+// UnknownGroup is the transport or address family of summary groups whose
+// entries lack one, e.g., because we cached them before we kept track of
+// transports.
+const UnknownGroup = "unknown"
+
+// SummaryGroup is the aggregate reachability of the cached bridges that share
+// a transport and an address family.
+type SummaryGroup struct {
+	Transport      string  `json:"transport"`
+	Family         string  `json:"family"`
+	Bridges        int     `json:"bridges"`
+	Functional     int     `json:"functional"`
+	FracFunctional float64 `json:"frac_functional"`
+}
+
+// Summary is the aggregate reachability of all of our cached bridges, and of
+// each group of bridges that share a transport and an address family.
+// LastUpdate is the time of the most recent test result that it reflects.
+type Summary struct {
+	Bridges        int             `json:"bridges"`
+	Functional     int             `json:"functional"`
+	FracFunctional float64         `json:"frac_functional"`
+	LastUpdate     time.Time       `json:"last_update"`
+	Groups         []*SummaryGroup `json:"groups"`
+}
+
+// summaryKey identifies a SummaryGroup.
+type summaryKey struct {
+	transport string
+	family    string
+}
+
+// tally counts the entries of a summary group.
+type tally struct {
+	bridges    int
+	functional int
+}
+
+// summary keeps our tallies up to date as entries come and go, so building a
+// Summary doesn't require walking our entire cache.
+type summary struct {
+	tallies    map[summaryKey]*tally
+	lastUpdate time.Time
+	sync.Mutex
+}
+
+// keyOf returns the key of the summary group that the given entry belongs to.
+func keyOf(entry *Entry) summaryKey {
+
+	key := summaryKey{entry.Transport, bridgeline.Family(entry.AddrPort)}
+	if entry.AddrPort == "" {
+		key.family = entry.Family
+	}
+	if key.transport == "" {
+		key.transport = UnknownGroup
+	}
+	if key.family == "" {
+		key.family = UnknownGroup
+	}
+	return key
+}
+
+// count adds the given entry to our tallies if delta is 1, and removes it if
+// delta is -1.
+func (s *summary) count(entry *Entry, delta int) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tallies == nil {
+		s.tallies = make(map[summaryKey]*tally)
+	}
+	key := keyOf(entry)
+	t, exists := s.tallies[key]
+	if !exists {
+		t = &tally{}
+		s.tallies[key] = t
+	}
+	t.bridges += delta
+	if entry.Error == "" {
+		t.functional += delta
+	}
+	if t.bridges <= 0 {
+		delete(s.tallies, key)
+	}
+	if delta > 0 && entry.Time.After(s.lastUpdate) {
+		s.lastUpdate = entry.Time
+	}
+}
+
+// reset replaces our tallies with those of the given entries.
+func (s *summary) reset(entries map[string]*Entry) {
+
+	s.Lock()
+	s.tallies = make(map[summaryKey]*tally)
+	s.lastUpdate = time.Time{}
+	s.Unlock()
+
+	for _, entry := range entries {
+		s.count(entry, 1)
+	}
+}
+
+// fraction returns part/whole, and 0 if whole is 0.
+func fraction(part, whole int) float64 {
+
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole)
+}
+
+// Summary returns the aggregate reachability of our cached bridges, by
+// transport and address family.  We keep it up to date as we add and prune
+// entries, so it's cheap regardless of our cache's size.  Expired entries
+// count until we prune them, which we do whenever we look up a bridge line.
+func (tc *Cache) Summary() *Summary {
+
+	tc.summary.Lock()
+	defer tc.summary.Unlock()
+
+	summary := &Summary{LastUpdate: tc.summary.lastUpdate, Groups: []*SummaryGroup{}}
+	for key, t := range tc.summary.tallies {
+		summary.Groups = append(summary.Groups, &SummaryGroup{
+			Transport:      key.transport,
+			Family:         key.family,
+			Bridges:        t.bridges,
+			Functional:     t.functional,
+			FracFunctional: fraction(t.functional, t.bridges),
+		})
+		summary.Bridges += t.bridges
+		summary.Functional += t.functional
+	}
+	summary.FracFunctional = fraction(summary.Functional, summary.Bridges)
+	sort.Slice(summary.Groups, func(i, j int) bool {
+		a, b := summary.Groups[i], summary.Groups[j]
+		if a.Transport != b.Transport {
+			return a.Transport < b.Transport
+		}
+		return a.Family < b.Family
+	})
+	return summary
+}
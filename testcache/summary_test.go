@@ -0,0 +1,57 @@
+package testcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCacheSummary(t *testing.T) {
+
+	cache := NewCache()
+	if s := cache.Summary(); s.Bridges != 0 || len(s.Groups) != 0 || s.FracFunctional != 0 {
+		t.Errorf("Unexpected summary of empty cache: %+v", s)
+	}
+
+	now := time.Now().UTC()
+	failure := errors.New("bridge is on fire")
+	cache.AddEntry("obfs4 1.2.3.4:1234 cert=foo iat-mode=0", nil, now.Add(-time.Minute))
+	cache.AddEntry("obfs4 1.2.3.5:1234 cert=foo iat-mode=0", failure, now.Add(-2*time.Minute))
+	cache.AddEntry("[2001:db8::1]:443", nil, now.Add(-3*time.Minute))
+	// Re-testing a bridge replaces its entry in our summary.
+	cache.AddEntry("obfs4 1.2.3.5:1234 cert=foo iat-mode=0", nil, now)
+
+	s := cache.Summary()
+	if s.Bridges != 3 || s.Functional != 3 || s.FracFunctional != 1 || !s.LastUpdate.Equal(now) {
+		t.Errorf("Unexpected summary: %+v", s)
+	}
+	if len(s.Groups) != 2 {
+		t.Fatalf("Expected 2 groups but got %d.", len(s.Groups))
+	}
+	if g := s.Groups[0]; g.Transport != "obfs4" || g.Family != "ipv4" || g.Bridges != 2 {
+		t.Errorf("Unexpected group: %+v", g)
+	}
+	if g := s.Groups[1]; g.Transport != "vanilla" || g.Family != "ipv6" || g.Bridges != 1 {
+		t.Errorf("Unexpected group: %+v", g)
+	}
+
+	// Pruned entries leave our summary.
+	cache.AddEntry("obfs4 1.2.3.6:1234 cert=foo iat-mode=0", failure, now.Add(-24*time.Hour))
+	if s = cache.Summary(); s.Bridges != 4 || s.FracFunctional != 0.75 {
+		t.Errorf("Unexpected summary before pruning: %+v", s)
+	}
+	cache.Prune()
+	if s = cache.Summary(); s.Bridges != 3 || s.Functional != 3 {
+		t.Errorf("Unexpected summary after pruning: %+v", s)
+	}
+
+	// Loading entries replaces our summary.
+	cache.Load(map[string]*Entry{"foo": {Error: "failed", Time: now}})
+	s = cache.Summary()
+	if s.Bridges != 1 || s.Functional != 0 || len(s.Groups) != 1 {
+		t.Fatalf("Unexpected summary after loading: %+v", s)
+	}
+	if g := s.Groups[0]; g.Transport != UnknownGroup || g.Family != UnknownGroup {
+		t.Errorf("Entry without transport and address must be unknown: %+v", g)
+	}
+}
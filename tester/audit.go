@@ -0,0 +1,137 @@
+package tester
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yawning/bulb"
+)
+
+// ControllerAuditSize is the number of control port commands that our audit
+// trail remembers.
+var ControllerAuditSize = 500
+
+// bridgeArg matches the bridge lines in our SETCONF commands.
+var bridgeArg = regexp.MustCompile(`Bridge="([^"]*)"`)
+
+// controllerAudit is the audit trail of all of our Tor instances.
+var controllerAudit = NewCommandLog(ControllerAuditSize)
+
+// ControllerCommand represents a control port command that we issued, and
+// Tor's response to it.
+type ControllerCommand struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	// Command is the command, with bridge lines passed through
+	// LogBridgeLine.
+	Command string `json:"command"`
+	// Code is Tor's response code, e.g., 250 or 552, and zero if we didn't
+	// get a response.
+	Code     int     `json:"code"`
+	Error    string  `json:"error,omitempty"`
+	Duration float64 `json:"duration"`
+}
+
+// CommandLog is a ring buffer of the most recent control port commands.  It's
+// safe for concurrent use.
+type CommandLog struct {
+	commands []*ControllerCommand
+	next     int
+	full     bool
+	sync.Mutex
+}
+
+// NewCommandLog returns a new command log that remembers the given number of
+// commands.
+func NewCommandLog(size int) *CommandLog {
+
+	return &CommandLog{commands: make([]*ControllerCommand, size)}
+}
+
+// Add adds the given command to the log, replacing the oldest command if the
+// log is full.
+func (l *CommandLog) Add(cmd *ControllerCommand) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	if len(l.commands) == 0 {
+		return
+	}
+	l.commands[l.next] = cmd
+	l.next = (l.next + 1) % len(l.commands)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// Commands returns the commands in the log, oldest first.
+func (l *CommandLog) Commands() []*ControllerCommand {
+
+	l.Lock()
+	defer l.Unlock()
+
+	commands := []*ControllerCommand{}
+	if l.full {
+		commands = append(commands, l.commands[l.next:]...)
+	}
+	return append(commands, l.commands[:l.next]...)
+}
+
+// ControllerAudit returns the most recent control port commands of all of our
+// Tor instances, oldest first.
+func ControllerAudit() []*ControllerCommand {
+	return controllerAudit.Commands()
+}
+
+// scrubCommand passes the bridge lines in the given command through
+// LogBridgeLine, so our audit trail is as safe as our logs.
+func scrubCommand(cmd string) string {
+
+	return bridgeArg.ReplaceAllStringFunc(cmd, func(arg string) string {
+		bridgeLine := bridgeArg.FindStringSubmatch(arg)[1]
+		return fmt.Sprintf("Bridge=%q", LogBridgeLine(bridgeLine))
+	})
+}
+
+// request issues the given control port command, and records it and Tor's
+// response in our audit trail and metrics.
+func (c *TorContext) request(format string, args ...interface{}) (*bulb.Response, error) {
+
+	cmd := fmt.Sprintf(format, args...)
+	start := time.Now()
+	resp, err := c.ctrl().Request("%s", cmd)
+	traceCommand(c.Name, cmd, resp, err)
+
+	entry := &ControllerCommand{
+		Time:     start.UTC(),
+		Instance: c.Name,
+		Command:  scrubCommand(cmd),
+		Duration: time.Since(start).Seconds(),
+	}
+	status := "ok"
+	if err != nil {
+		status = "failed"
+		entry.Error = err.Error()
+	}
+	if resp != nil && resp.Err != nil {
+		entry.Code = resp.Err.Code
+	} else if err == nil {
+		entry.Code = 250
+	}
+	controllerAudit.Add(entry)
+
+	keyword := strings.Fields(cmd)
+	if len(keyword) > 0 {
+		metrics.ControllerCommands.With(prometheus.Labels{
+			"instance": c.Name,
+			"command":  strings.ToUpper(keyword[0]),
+			"status":   status,
+		}).Inc()
+	}
+	return resp, err
+}
@@ -0,0 +1,47 @@
+package tester
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandLog(t *testing.T) {
+
+	l := NewCommandLog(3)
+	if len(l.Commands()) != 0 {
+		t.Errorf("New command log isn't empty.")
+	}
+	for _, cmd := range []string{"A", "B"} {
+		l.Add(&ControllerCommand{Time: time.Now(), Command: cmd})
+	}
+	if commands := l.Commands(); len(commands) != 2 || commands[0].Command != "A" {
+		t.Errorf("Unexpected commands in command log.")
+	}
+
+	// Once the log is full, new commands replace the oldest ones.
+	for _, cmd := range []string{"C", "D"} {
+		l.Add(&ControllerCommand{Time: time.Now(), Command: cmd})
+	}
+	got := []string{}
+	for _, cmd := range l.Commands() {
+		got = append(got, cmd.Command)
+	}
+	if strings.Join(got, "") != "BCD" {
+		t.Errorf("Expected commands BCD but got %v.", got)
+	}
+}
+
+func TestScrubCommand(t *testing.T) {
+
+	defer func(f func(string) string) { LogBridgeLine = f }(LogBridgeLine)
+	LogBridgeLine = func(string) string { return "[scrubbed]" }
+
+	cmd := scrubCommand(`SETCONF Bridge="1.2.3.4:1234" Bridge="obfs4 5.6.7.8:443 cert=foo iat-mode=0"`)
+	if cmd != `SETCONF Bridge="[scrubbed]" Bridge="[scrubbed]"` {
+		t.Errorf("Failed to scrub command: %q", cmd)
+	}
+	if cmd := scrubCommand("GETINFO version"); cmd != "GETINFO version" {
+		t.Errorf("Scrubbed command without bridge lines: %q", cmd)
+	}
+}
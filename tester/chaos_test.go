@@ -0,0 +1,322 @@
+//go:build chaos
+// +build chaos
+
+package tester
+
+// This file contains a harness that checks if our event parsers attribute
+// Tor's events to the right bridges while several batches are in flight at
+// once, which is what concurrent batches on a single Tor process will look
+// like.  It feeds thousands of events, so it only runs with the "chaos" build
+// tag:
+//
+//   go test -tags chaos -run TestChaos ./tester/
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// chaosRounds is the number of times we run our harness, each time with
+	// new bridges and a new interleaving of their events.
+	chaosRounds = 5
+	// chaosBatches is the number of concurrent batches, and chaosBatchSize
+	// is the number of bridges per batch.
+	chaosBatches   = 8
+	chaosBatchSize = 40
+	// chaosNoise is the number of events per round that belong to Tor
+	// itself rather than to any of our bridges.
+	chaosNoise = 2000
+)
+
+// Outcomes that our mocked controller simulates for a bridge.
+const (
+	chaosWorks = iota
+	chaosFails
+	chaosImpostor
+)
+
+// chaosBridge is a bridge in our harness, along with the outcome that our
+// mocked controller simulates for it.
+type chaosBridge struct {
+	line        string
+	fingerprint string
+	// target is what Tor's LAUNCHED events call the bridge.  For fronted
+	// bridges (e.g., meek), it's the front's address, which many bridges
+	// share.
+	target  string
+	fronted bool
+	outcome int
+	reason  string
+}
+
+// expectedState returns the state in which our event parser must end up for
+// the bridge.  Tor's events only attribute a connection to a fronted bridge
+// once it connected to the bridge's fingerprint, so fronted bridges that fail
+// or turn out to be impostors stay pending until our test times out.
+func (b *chaosBridge) expectedState() int {
+
+	switch {
+	case b.outcome == chaosWorks:
+		return BridgeStateSuccess
+	case b.fronted:
+		return BridgeStatePending
+	}
+	return BridgeStateFailure
+}
+
+// mockController simulates the control connection of a single Tor process
+// that tests several batches at once.  Every batch sees all of the process's
+// events, i.e., the events of its own bridges, of other batches' bridges, and
+// of Tor itself, interleaved in random order.
+type mockController struct {
+	rand      *rand.Rand
+	nextID    int
+	sequences [][]string
+}
+
+// newMockController returns a mocked controller whose randomness comes from
+// the given seed.
+func newMockController(seed int64) *mockController {
+
+	return &mockController{rand: rand.New(rand.NewSource(seed)), nextID: 1}
+}
+
+// fingerprint returns a random fingerprint.
+func (m *mockController) fingerprint() string {
+
+	const digits = "0123456789ABCDEF"
+	fp := make([]byte, BridgeFingerprintLen)
+	for i := range fp {
+		fp[i] = digits[m.rand.Intn(len(digits))]
+	}
+	return string(fp)
+}
+
+// connID returns a new ORCONN ID.  Tor never reuses IDs within a process.
+func (m *mockController) connID() int {
+
+	m.nextID++
+	return m.nextID
+}
+
+// newBridges returns the given number of bridges with unique addresses and
+// fingerprints.  Many of the addresses are prefixes of one another, e.g.,
+// "10.1.2.1:44" and "10.1.2.11:443", which our parsers must tell apart.
+func (m *mockController) newBridges(num int) []*chaosBridge {
+
+	addrs := []string{}
+	for a := 0; a < 4; a++ {
+		for b := 0; b < 10; b++ {
+			for _, c := range []string{"1", "11", "111"} {
+				for _, port := range []string{"44", "443", "4430"} {
+					addrs = append(addrs, fmt.Sprintf("10.%d.%d.%s:%s", a, b, c, port))
+				}
+			}
+		}
+	}
+	m.rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if num > len(addrs) {
+		panic("not enough addresses for chaos bridges")
+	}
+
+	reasons := []string{"CONNECTREFUSED", "TIMEOUT", "NOROUTE", "IOERROR", "CONNECTRESET"}
+	bridges := []*chaosBridge{}
+	for i := 0; i < num; i++ {
+		b := &chaosBridge{fingerprint: m.fingerprint(), outcome: m.rand.Intn(3)}
+		switch m.rand.Intn(3) {
+		case 0:
+			// A vanilla bridge line without fingerprint.
+			b.line, b.target = addrs[i], addrs[i]
+			if b.outcome == chaosImpostor {
+				b.outcome = chaosWorks
+			}
+		case 1:
+			b.line = fmt.Sprintf("obfs4 %s %s cert=foo iat-mode=0", addrs[i], b.fingerprint)
+			b.target = "$" + b.fingerprint
+		case 2:
+			b.line = fmt.Sprintf("meek_lite 192.0.2.%d:%d %s url=https://meek.example.com/ front=www.example.com",
+				i%250+1, i+1, b.fingerprint)
+			b.target = fmt.Sprintf("203.0.113.%d:443", m.rand.Intn(3)+1)
+			b.fronted = true
+		}
+		if b.outcome == chaosFails {
+			b.reason = reasons[m.rand.Intn(len(reasons))]
+		}
+		bridges = append(bridges, b)
+	}
+	return bridges
+}
+
+// addBridge adds the events of the given bridge's test.  Some bridges first
+// get a connection that Tor closes, as it does when it retries.
+func (m *mockController) addBridge(b *chaosBridge) {
+
+	seq := []string{}
+	if m.rand.Intn(4) == 0 {
+		id := m.connID()
+		seq = append(seq,
+			fmt.Sprintf("650 ORCONN %s LAUNCHED ID=%d", b.target, id),
+			fmt.Sprintf("650 ORCONN %s CLOSED REASON=DONE ID=%d", b.target, id))
+	}
+
+	id := m.connID()
+	seq = append(seq, fmt.Sprintf("650 ORCONN %s LAUNCHED ID=%d", b.target, id))
+	switch b.outcome {
+	case chaosWorks:
+		seq = append(seq,
+			fmt.Sprintf("650 ORCONN $%s~chaos CONNECTED ID=%d", b.fingerprint, id),
+			fmt.Sprintf("650 NEWDESC $%s~chaos", b.fingerprint))
+	case chaosFails:
+		seq = append(seq, fmt.Sprintf("650 ORCONN %s FAILED REASON=%s NCIRCS=0 ID=%d", b.target, b.reason, id))
+	case chaosImpostor:
+		// Someone else runs a bridge at the bridge's address.
+		impostor := m.fingerprint()
+		seq = append(seq,
+			fmt.Sprintf("650 ORCONN $%s~impostor CONNECTED ID=%d", impostor, id),
+			fmt.Sprintf("650 NEWDESC $%s~impostor", impostor))
+	}
+	m.sequences = append(m.sequences, seq)
+}
+
+// addNoise adds the given number of events that belong to Tor itself, e.g.,
+// connections to relays and descriptors of other bridges.
+func (m *mockController) addNoise(num int) {
+
+	for i := 0; i < num; i++ {
+		fp := m.fingerprint()
+		switch m.rand.Intn(4) {
+		case 0:
+			id := m.connID()
+			m.sequences = append(m.sequences, []string{
+				fmt.Sprintf("650 ORCONN $%s~relay LAUNCHED ID=%d", fp, id),
+				fmt.Sprintf("650 ORCONN $%s~relay CONNECTED ID=%d", fp, id),
+				fmt.Sprintf("650 ORCONN $%s~relay CLOSED REASON=DONE ID=%d", fp, id),
+			})
+		case 1:
+			id := m.connID()
+			m.sequences = append(m.sequences, []string{
+				fmt.Sprintf("650 ORCONN 198.51.100.%d:443 LAUNCHED ID=%d", m.rand.Intn(250)+1, id),
+				fmt.Sprintf("650 ORCONN 198.51.100.%d:443 FAILED REASON=TIMEOUT NCIRCS=1 ID=%d", m.rand.Intn(250)+1, id),
+			})
+		case 2:
+			m.sequences = append(m.sequences, []string{fmt.Sprintf("650 NEWDESC $%s~relay", fp)})
+		case 3:
+			m.sequences = append(m.sequences, []string{"650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED"})
+		}
+	}
+}
+
+// events interleaves the events of all sequences in random order, while
+// keeping the order of events within each sequence.
+func (m *mockController) events() []string {
+
+	events := []string{}
+	pending := append([][]string{}, m.sequences...)
+	for len(pending) > 0 {
+		i := m.rand.Intn(len(pending))
+		events = append(events, pending[i][0])
+		pending[i] = pending[i][1:]
+		if len(pending[i]) == 0 {
+			pending = append(pending[:i], pending[i+1:]...)
+		}
+	}
+	return events
+}
+
+// runChaosBatch feeds the given events to the event parsers of the given
+// batch, the way our Tor instances do while testing a batch, and returns the
+// batch's parsers.
+func runChaosBatch(batch []*chaosBridge, events <-chan string) map[string]*TorEventState {
+
+	eventParsers := make(map[string]*TorEventState)
+	for _, b := range batch {
+		identifier, err := bridgeline.Identifier(b.line)
+		if err != nil {
+			panic(err)
+		}
+		eventParsers[b.line] = NewTorEventState(identifier)
+	}
+	result := NewTestResult()
+	for line := range events {
+		for _, bridgeLine := range feedParsers(eventParsers, result, line) {
+			result.Bridges[bridgeLine] = &BridgeTest{}
+		}
+	}
+	return eventParsers
+}
+
+func TestChaos(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for round := 0; round < chaosRounds; round++ {
+		seed := time.Now().UnixNano()
+		m := newMockController(seed)
+		bridges := m.newBridges(chaosBatches * chaosBatchSize)
+		for _, b := range bridges {
+			m.addBridge(b)
+		}
+		m.addNoise(chaosNoise)
+		events := m.events()
+
+		// Each batch gets its own copy of the event stream.
+		var wg sync.WaitGroup
+		var l sync.Mutex
+		parsers := make(map[string]*TorEventState)
+		for i := 0; i < chaosBatches; i++ {
+			batch := bridges[i*chaosBatchSize : (i+1)*chaosBatchSize]
+			ch := make(chan string, len(events))
+			for _, event := range events {
+				ch <- event
+			}
+			close(ch)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				batchParsers := runChaosBatch(batch, ch)
+				l.Lock()
+				for bridgeLine, parser := range batchParsers {
+					parsers[bridgeLine] = parser
+				}
+				l.Unlock()
+			}()
+		}
+		wg.Wait()
+
+		misattributed := []string{}
+		for _, b := range bridges {
+			parser := parsers[b.line]
+			ok := parser.State == b.expectedState()
+			switch {
+			case b.outcome == chaosWorks:
+				ok = ok && parser.Fingerprint == b.fingerprint
+			case b.fronted:
+			case b.outcome == chaosImpostor:
+				ok = ok && parser.ReasonCode == ErrorCodeWrongFingerprint
+			default:
+				ok = ok && parser.ReasonCode == b.reason
+			}
+			if !ok {
+				misattributed = append(misattributed, fmt.Sprintf("%q (outcome %d, state %d, fingerprint %s, reason %s)",
+					b.line, b.outcome, parser.State, parser.Fingerprint, parser.ReasonCode))
+			}
+		}
+		if len(misattributed) > 0 {
+			t.Fatalf("Round %d (seed %d, %d events): %d bridge(s) got the wrong result:\n%s",
+				round, seed, len(events), len(misattributed), strings.Join(misattributed, "\n"))
+		}
+		t.Logf("Round %d (seed %d): %d bridges in %d batches got the right result from %d events.",
+			round, seed, len(bridges), chaosBatches, len(events))
+	}
+}
@@ -0,0 +1,421 @@
+package tester
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Check is a composite check that an operator defines in terms of our test
+// results, e.g., "tcp_ok AND pt_ok AND descriptor_ok AND bandwidth > 1Mbps".
+// A check can tell that a bridge passed or failed it, or that our result
+// doesn't tell, e.g., because the check is about the bridge's descriptor and
+// our result came from our cache, which doesn't keep descriptors.
+//
+// Checks combine the following variables with AND, OR, NOT, and parentheses:
+//
+//   - functional: the bridge works.
+//   - validate_ok, tcp_ok, pt_ok, tor_ok, circuit_ok: the bridge passed the
+//     given stage of our test pipeline.  See StageOrder.
+//   - descriptor_ok: we fetched the bridge's descriptor.
+//   - protocols_ok: the bridge's descriptor lacks none of the upcoming
+//     required subprotocol versions.
+//   - bandwidth: the bandwidth that the bridge advertises in bits per
+//     second, with an optional unit of bps, kbps, mbps, or gbps.
+//   - time: the number of seconds that Tor took to test the bridge, with an
+//     optional unit of s or ms.
+//
+// Numeric variables can only appear in comparisons with a number, using >,
+// >=, <, <=, ==, or !=, e.g., "time < 500ms".
+type Check struct {
+	Name string
+	Expr string
+	root checkNode
+}
+
+// truth is the outcome of (part of) a check, using Kleene's three-valued
+// logic.
+type truth int
+
+const (
+	unknown truth = iota
+	no
+	yes
+)
+
+func truthOf(b bool) truth {
+
+	if b {
+		return yes
+	}
+	return no
+}
+
+// checkNode is a node of a check's syntax tree.
+type checkNode interface {
+	eval(*BridgeTest) truth
+}
+
+type andNode struct{ left, right checkNode }
+type orNode struct{ left, right checkNode }
+type notNode struct{ operand checkNode }
+type boolNode struct{ name string }
+type compareNode struct {
+	name  string
+	op    string
+	value float64
+}
+
+func (n *andNode) eval(b *BridgeTest) truth {
+
+	left, right := n.left.eval(b), n.right.eval(b)
+	if left == no || right == no {
+		return no
+	} else if left == yes && right == yes {
+		return yes
+	}
+	return unknown
+}
+
+func (n *orNode) eval(b *BridgeTest) truth {
+
+	left, right := n.left.eval(b), n.right.eval(b)
+	if left == yes || right == yes {
+		return yes
+	} else if left == no && right == no {
+		return no
+	}
+	return unknown
+}
+
+func (n *notNode) eval(b *BridgeTest) truth {
+
+	switch n.operand.eval(b) {
+	case yes:
+		return no
+	case no:
+		return yes
+	}
+	return unknown
+}
+
+func (n *boolNode) eval(b *BridgeTest) truth {
+
+	return checkBools[n.name](b)
+}
+
+func (n *compareNode) eval(b *BridgeTest) truth {
+
+	value, ok := checkNumbers[n.name].value(b)
+	if !ok {
+		return unknown
+	}
+	switch n.op {
+	case ">":
+		return truthOf(value > n.value)
+	case ">=":
+		return truthOf(value >= n.value)
+	case "<":
+		return truthOf(value < n.value)
+	case "<=":
+		return truthOf(value <= n.value)
+	case "==":
+		return truthOf(value == n.value)
+	}
+	return truthOf(value != n.value)
+}
+
+// stageOutcome tells if the given bridge passed the given stage.  If the
+// client didn't ask for stage results, we infer the outcome from the
+// bridge's verdict and error code where we can.
+func stageOutcome(b *BridgeTest, stage string) truth {
+
+	for _, r := range b.Stages {
+		if r.Stage == stage {
+			return truthOf(r.Passed)
+		}
+	}
+
+	switch {
+	case b.Verdict == VerdictInconclusive:
+		return unknown
+	case b.Functional:
+		if stage != StageCircuit {
+			return yes
+		} else if b.Circuit != nil {
+			return truthOf(b.Circuit.Built)
+		}
+		return unknown
+	case b.ErrorCode == ErrorCodeUnparseableLine:
+		return no
+	}
+	// A bridge that fails a stage doesn't proceed to the next one.
+	for i, s := range StageOrder {
+		if b.ErrorCode != StageFailureCode(s) {
+			continue
+		}
+		for _, earlier := range StageOrder[:i] {
+			if earlier == stage {
+				return yes
+			}
+		}
+		return no
+	}
+	// Tor failed to fetch the bridge's descriptor, which tells us nothing
+	// about the stages before it, unless they ran.
+	switch stage {
+	case StageValidate:
+		return yes
+	case StageTor, StageCircuit:
+		return no
+	}
+	return unknown
+}
+
+// descriptorOutcome tells if we fetched the given bridge's descriptor.
+func descriptorOutcome(b *BridgeTest) truth {
+
+	if b.Descriptor != nil {
+		return yes
+	}
+	if stageOutcome(b, StageTor) == no {
+		return no
+	}
+	return unknown
+}
+
+// checkBools maps the boolean variables of checks to their evaluation.
+var checkBools = map[string]func(*BridgeTest) truth{
+	"functional": func(b *BridgeTest) truth {
+		if b.Verdict == VerdictInconclusive {
+			return unknown
+		}
+		return truthOf(b.Functional)
+	},
+	"descriptor_ok": descriptorOutcome,
+	"protocols_ok": func(b *BridgeTest) truth {
+		if b.Descriptor != nil {
+			return truthOf(len(b.Descriptor.MissingProtocols) == 0)
+		}
+		return descriptorOutcome(b)
+	},
+}
+
+func init() {
+
+	for _, stage := range StageOrder {
+		stage := stage
+		checkBools[stage+"_ok"] = func(b *BridgeTest) truth {
+			return stageOutcome(b, stage)
+		}
+	}
+}
+
+// checkNumber is a numeric variable of checks.
+type checkNumber struct {
+	// units maps the variable's units to their value in the variable's
+	// base unit.
+	units map[string]float64
+	value func(*BridgeTest) (float64, bool)
+}
+
+// checkNumbers maps the numeric variables of checks to their units and
+// evaluation.
+var checkNumbers = map[string]*checkNumber{
+	"bandwidth": &checkNumber{
+		units: map[string]float64{"bps": 1, "kbps": 1e3, "mbps": 1e6, "gbps": 1e9},
+		value: func(b *BridgeTest) (float64, bool) {
+			if b.Descriptor == nil {
+				return 0, false
+			}
+			return float64(b.Descriptor.Bandwidth) * 8, true
+		},
+	},
+	"time": &checkNumber{
+		units: map[string]float64{"s": 1, "ms": 1e-3},
+		value: func(b *BridgeTest) (float64, bool) {
+			return b.Time, b.Time > 0
+		},
+	},
+}
+
+// ParseCheck parses the given check expression.
+func ParseCheck(name, expr string) (*Check, error) {
+
+	tokens, err := tokenizeCheck(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check %q: %v", name, err)
+	}
+	p := &checkParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid check %q: %v", name, err)
+	}
+	return &Check{Name: name, Expr: expr, root: root}, nil
+}
+
+// Evaluate returns true if the given bridge passed the check.  Its second
+// return value is false if our result doesn't tell.
+func (c *Check) Evaluate(b *BridgeTest) (bool, bool) {
+
+	t := c.root.eval(b)
+	return t == yes, t != unknown
+}
+
+// tokenizeCheck splits the given check expression into identifiers,
+// numbers, operators, and parentheses.
+func tokenizeCheck(expr string) ([]string, error) {
+
+	tokens := []string{}
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(' || r == ')':
+			i++
+		case strings.ContainsRune("<>=!", r):
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+		case r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.':
+			for i < len(runes) && (runes[i] == '_' || runes[i] == '.' ||
+				unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+		tokens = append(tokens, string(runes[start:i]))
+	}
+	return tokens, nil
+}
+
+// checkParser is a recursive descent parser for the following grammar:
+//
+//	or         = and { "OR" and }
+//	and        = not { "AND" not }
+//	not        = "NOT" not | "(" or ")" | comparison | variable
+//	comparison = variable op number [unit]
+type checkParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *checkParser) peek() string {
+
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *checkParser) next() string {
+
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *checkParser) parseOr() (checkNode, error) {
+
+	left, err := p.parseAnd()
+	for err == nil && strings.EqualFold(p.peek(), "OR") {
+		p.next()
+		var right checkNode
+		if right, err = p.parseAnd(); err == nil {
+			left = &orNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *checkParser) parseAnd() (checkNode, error) {
+
+	left, err := p.parseNot()
+	for err == nil && strings.EqualFold(p.peek(), "AND") {
+		p.next()
+		var right checkNode
+		if right, err = p.parseNot(); err == nil {
+			left = &andNode{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *checkParser) parseNot() (checkNode, error) {
+
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case strings.EqualFold(t, "NOT"):
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	case t == "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing \")\"")
+		}
+		return n, nil
+	}
+
+	name := strings.ToLower(t)
+	if _, ok := checkBools[name]; ok {
+		return &boolNode{name}, nil
+	}
+	number, ok := checkNumbers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown variable %q", t)
+	}
+	op := p.next()
+	switch op {
+	case ">", ">=", "<", "<=", "==", "!=":
+	default:
+		return nil, fmt.Errorf("%q lacks a comparison", t)
+	}
+	return p.parseNumber(name, op, number)
+}
+
+// parseNumber parses the number, and its optional unit, that the given
+// numeric variable is compared with.
+func (p *checkParser) parseNumber(name, op string, number *checkNumber) (checkNode, error) {
+
+	t := p.next()
+	i := strings.IndexFunc(t, unicode.IsLetter)
+	if i < 0 {
+		i = len(t)
+	}
+	value, err := strconv.ParseFloat(t[:i], 64)
+	if err != nil || i == 0 {
+		return nil, fmt.Errorf("%q is not a number", t)
+	}
+	unit := strings.ToLower(t[i:])
+	if unit == "" {
+		if _, ok := number.units[strings.ToLower(p.peek())]; ok {
+			unit = strings.ToLower(p.next())
+		}
+	}
+	if unit != "" {
+		factor, ok := number.units[unit]
+		if !ok {
+			return nil, fmt.Errorf("unknown unit %q for %q", unit, name)
+		}
+		value *= factor
+	}
+	return &compareNode{name: name, op: op, value: value}, nil
+}
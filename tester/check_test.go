@@ -0,0 +1,89 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestParseCheck(t *testing.T) {
+
+	for _, expr := range []string{
+		"functional",
+		"tcp_ok AND pt_ok AND descriptor_ok AND bandwidth > 1Mbps",
+		"NOT (tor_ok or circuit_ok) and time <= 500 ms",
+		"bandwidth>=1.5mbps OR bandwidth != 0",
+	} {
+		if _, err := ParseCheck("test", expr); err != nil {
+			t.Errorf("Failed to parse check %q: %s", expr, err)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"bogus_ok",
+		"functional AND",
+		"(functional",
+		"functional)",
+		"bandwidth",
+		"bandwidth > fast",
+		"bandwidth > 1ms",
+		"functional > 1",
+		"time < 1 AND $",
+	} {
+		if _, err := ParseCheck("test", expr); err == nil {
+			t.Errorf("Failed to reject invalid check %q.", expr)
+		}
+	}
+}
+
+func TestEvaluateCheck(t *testing.T) {
+
+	functional := &BridgeTest{
+		Functional: true,
+		Verdict:    VerdictFunctional,
+		Descriptor: &Descriptor{Bandwidth: 250000},
+		Time:       2,
+	}
+	cached := &BridgeTest{Functional: true, Verdict: VerdictFunctional}
+	tcpFailed := &BridgeTest{Verdict: VerdictDysfunctional, ErrorCode: StageFailureCode(StageTCP)}
+	torFailed := &BridgeTest{Verdict: VerdictDysfunctional, ErrorCode: "CONNECTREFUSED"}
+	withStages := &BridgeTest{
+		Verdict: VerdictDysfunctional,
+		Stages: []*StageResult{
+			&StageResult{Stage: StageValidate, Passed: true},
+			&StageResult{Stage: StageTCP, Passed: true},
+			&StageResult{Stage: StageTor, Passed: false},
+		},
+	}
+
+	for _, test := range []struct {
+		expr       string
+		bridgeTest *BridgeTest
+		passed     bool
+		known      bool
+	}{
+		{"functional AND bandwidth > 1Mbps", functional, true, true},
+		{"functional AND bandwidth > 3Mbps", functional, false, true},
+		{"time < 1500ms", functional, false, true},
+		{"tcp_ok AND pt_ok AND circuit_ok", functional, false, false},
+		{"tcp_ok AND descriptor_ok", cached, false, false},
+		{"tcp_ok OR descriptor_ok", cached, true, true},
+		{"tcp_ok", tcpFailed, false, true},
+		{"validate_ok AND NOT pt_ok", tcpFailed, true, true},
+		{"descriptor_ok", tcpFailed, false, true},
+		{"tcp_ok", torFailed, false, false},
+		{"tcp_ok OR tor_ok", torFailed, false, false},
+		{"tcp_ok AND tor_ok", torFailed, false, true},
+		{"tcp_ok AND NOT tor_ok", withStages, true, true},
+		{"functional", &BridgeTest{Verdict: VerdictInconclusive}, false, false},
+	} {
+		c, err := ParseCheck("test", test.expr)
+		if err != nil {
+			t.Fatalf("Failed to parse check %q: %s", test.expr, err)
+		}
+		passed, known := c.Evaluate(test.bridgeTest)
+		if passed != test.passed || known != test.known {
+			t.Errorf("Expected (%v, %v) for %q and %+v but got (%v, %v).",
+				test.passed, test.known, test.expr, test.bridgeTest, passed, known)
+		}
+	}
+}
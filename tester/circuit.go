@@ -0,0 +1,221 @@
+package tester
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CircuitHops is the length of the circuits that our circuit stage builds.
+// The bridge is the first hop, and the remaining hops are relays from our
+// consensus.
+const CircuitHops = 3
+
+// Examples of CIRC events:
+//
+//	650 CIRC 12 LAUNCHED BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL
+//	650 CIRC 12 EXTENDED $D9A82D2F9C2F65A18407B1D2B764F130847F8B5D~dragon PURPOSE=GENERAL
+//	650 CIRC 12 BUILT $D9A8...~dragon,$9695...~moria1,$7EA6...~tor26 PURPOSE=GENERAL
+//	650 CIRC 12 FAILED $D9A8...~dragon PURPOSE=GENERAL REASON=TIMEOUT
+//	650 CIRC 12 CLOSED $D9A8...~dragon PURPOSE=GENERAL REASON=FINISHED
+var CircEvent = regexp.MustCompile(`^650 CIRC `)
+var CircFields = regexp.MustCompile(`^650 CIRC ([0-9]+) ([A-Z]+)`)
+var CircReasonField = regexp.MustCompile(` REASON=([A-Z_]+)`)
+
+// Tor responds to EXTENDCIRCUIT with "250 EXTENDED <circuit ID>".
+var extendedReply = regexp.MustCompile(`^EXTENDED ([0-9]+)$`)
+
+// CircuitTest describes our attempt to build a circuit through a bridge whose
+// descriptor Tor fetched.  Some bridges accept connections but fail to extend
+// circuits, so their descriptor alone doesn't tell us that they work.
+type CircuitTest struct {
+	// Path contains the fingerprints of the circuit's hops, starting with
+	// the bridge.
+	Path  []string `json:"path"`
+	Built bool     `json:"built"`
+	// Events contains the statuses of the circuit's CIRC events in the
+	// order in which Tor reported them, e.g., "LAUNCHED", "EXTENDED", and
+	// "BUILT".
+	Events []string `json:"events"`
+	// Reason is Tor's reason for a failed circuit, e.g., "TIMEOUT", if it
+	// gave one.
+	Reason string `json:"reason,omitempty"`
+	// id is the circuit's ID, which Tor's CIRC events refer to.
+	id string
+}
+
+// parseCircEvent returns the circuit ID, the status, and the reason (if any)
+// of the given CIRC event.
+func parseCircEvent(line string) (string, string, string, error) {
+
+	matches := CircFields.FindStringSubmatch(line)
+	if len(matches) != 3 {
+		return "", "", "", fmt.Errorf("could not parse CIRC event %q", line)
+	}
+	reason := ""
+	if m := CircReasonField.FindStringSubmatch(line); len(m) == 2 {
+		reason = m[1]
+	}
+	return matches[1], matches[2], reason, nil
+}
+
+// record adds the given status and reason of a CIRC event to the circuit
+// test, and returns true if the circuit is done, i.e., built or failed.
+func (t *CircuitTest) record(status, reason string) bool {
+
+	t.Events = append(t.Events, status)
+	switch status {
+	case "BUILT":
+		t.Built = true
+		return true
+	case "FAILED", "CLOSED":
+		t.Reason = reason
+		return true
+	}
+	return false
+}
+
+// feedCircuits hands the given CIRC event to the circuit test that it belongs
+// to, if any.  The given map contains the results of the bridges whose
+// circuit we're building.  We remove the bridges whose circuit is done from
+// the map, and return their results.  We close built circuits because we no
+// longer need them.  The caller must hold our lock.
+func (c *TorContext) feedCircuits(circuits map[string]*BridgeTest, line string) map[string]*BridgeTest {
+
+	done := make(map[string]*BridgeTest)
+	id, status, reason, err := parseCircEvent(line)
+	if err != nil {
+		log.Printf("Bug: %s", err)
+		return done
+	}
+	for bridgeLine, bridgeTest := range circuits {
+		if bridgeTest.Circuit.id != id {
+			continue
+		}
+		metrics.Events.With(prometheus.Labels{"type": "circ", "status": strings.ToLower(status)}).Inc()
+		if !bridgeTest.Circuit.record(status, reason) {
+			continue
+		}
+		delete(circuits, bridgeLine)
+		if bridgeTest.Circuit.Built {
+			c.closeCircuit(bridgeTest.Circuit)
+		}
+		done[bridgeLine] = circuitResult(bridgeTest)
+	}
+	return done
+}
+
+// circuitResult turns the given bridge test, whose descriptor we have, into
+// the result of our circuit stage.  Bridges whose circuit we failed to build
+// are dysfunctional.
+func circuitResult(bridgeTest *BridgeTest) *BridgeTest {
+
+	circuit := bridgeTest.Circuit
+	if circuit.Built {
+		return bridgeTest
+	}
+	bridgeTest.Functional = false
+	bridgeTest.Verdict = VerdictDysfunctional
+	bridgeTest.Error = "failed to build circuit through bridge"
+	if circuit.Reason != "" {
+		bridgeTest.Error = fmt.Sprintf("%s: %s", bridgeTest.Error, circuit.Reason)
+	}
+	bridgeTest.ErrorCode = ErrorCodeCircuitFailed
+	return bridgeTest
+}
+
+// parseRelays returns the fingerprints of the running, valid, fast, and
+// stable relays in the given network status document, i.e., the output of
+// "GETINFO ns/all".
+func parseRelays(ns string) []string {
+
+	relays := []string{}
+	identity := ""
+	for _, line := range strings.Split(ns, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "r":
+			identity = ""
+			if len(fields) < 3 {
+				continue
+			}
+			raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(fields[2], "="))
+			if err != nil || len(raw)*2 != BridgeFingerprintLen {
+				continue
+			}
+			identity = strings.ToUpper(hex.EncodeToString(raw))
+		case "s":
+			if identity == "" {
+				continue
+			}
+			flags := make(map[string]bool)
+			for _, flag := range fields[1:] {
+				flags[flag] = true
+			}
+			if flags["Running"] && flags["Valid"] && flags["Fast"] && flags["Stable"] {
+				relays = append(relays, identity)
+			}
+			identity = ""
+		}
+	}
+	return relays
+}
+
+// circuitRelays returns randomly picked relays for the hops of our circuits
+// that follow the bridge.  The caller must hold our lock.
+func (c *TorContext) circuitRelays() ([]string, error) {
+
+	ns, err := c.queryInfo("ns/all")
+	if err != nil {
+		return nil, err
+	}
+	relays := parseRelays(ns)
+	if len(relays) < CircuitHops-1 {
+		return nil, errors.New("not enough relays in consensus to build circuit")
+	}
+	picked := []string{}
+	for _, i := range rand.Perm(len(relays))[:CircuitHops-1] {
+		picked = append(picked, relays[i])
+	}
+	return picked, nil
+}
+
+// extendCircuit asks Tor to build a circuit through the bridge with the given
+// fingerprint, followed by the given relays, and returns the circuit test that
+// keeps track of it.  The caller must hold our lock.
+func (c *TorContext) extendCircuit(fingerprint string, relays []string) (*CircuitTest, error) {
+
+	path := append([]string{fingerprint}, relays...)
+	hops := []string{}
+	for _, hop := range path {
+		hops = append(hops, "$"+hop)
+	}
+	resp, err := c.request("EXTENDCIRCUIT 0 %s", strings.Join(hops, ","))
+	if err != nil {
+		return nil, err
+	}
+	matches := extendedReply.FindStringSubmatch(resp.Reply)
+	if len(matches) != 2 {
+		return nil, fmt.Errorf("unexpected reply to EXTENDCIRCUIT: %q", resp.Reply)
+	}
+	return &CircuitTest{Path: path, Events: []string{}, id: matches[1]}, nil
+}
+
+// closeCircuit asks Tor to close the circuit of the given circuit test, which
+// we no longer need.  The caller must hold our lock.
+func (c *TorContext) closeCircuit(circuit *CircuitTest) {
+
+	if _, err := c.request("CLOSECIRCUIT %s", circuit.id); err != nil {
+		log.Printf("%s: Failed to close circuit %s: %s", c.Name, circuit.id, err)
+	}
+}
@@ -0,0 +1,76 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestParseCircEvent(t *testing.T) {
+
+	id, status, reason, err := parseCircEvent("650 CIRC 12 FAILED $D9A82D2F9C2F65A18407B1D2B764F130847F8B5D~dragon PURPOSE=GENERAL REASON=TIMEOUT")
+	if err != nil || id != "12" || status != "FAILED" || reason != "TIMEOUT" {
+		t.Errorf("Failed to parse CIRC event: %q %q %q %v", id, status, reason, err)
+	}
+
+	id, status, reason, err = parseCircEvent("650 CIRC 7 LAUNCHED BUILD_FLAGS=NEED_CAPACITY PURPOSE=GENERAL")
+	if err != nil || id != "7" || status != "LAUNCHED" || reason != "" {
+		t.Errorf("Failed to parse CIRC event: %q %q %q %v", id, status, reason, err)
+	}
+
+	if _, _, _, err = parseCircEvent("650 CIRC_MINOR 7 PURPOSE_CHANGED"); err == nil {
+		t.Errorf("Failed to reject malformed CIRC event.")
+	}
+}
+
+func TestCircuitResult(t *testing.T) {
+
+	newBridgeTest := func() *BridgeTest {
+		return &BridgeTest{
+			Functional: true,
+			Verdict:    VerdictFunctional,
+			Circuit:    &CircuitTest{Events: []string{}},
+		}
+	}
+
+	bridgeTest := newBridgeTest()
+	for _, status := range []string{"LAUNCHED", "EXTENDED", "EXTENDED"} {
+		if bridgeTest.Circuit.record(status, "") {
+			t.Errorf("Circuit must not be done after %s.", status)
+		}
+	}
+	if !bridgeTest.Circuit.record("BUILT", "") {
+		t.Errorf("Circuit must be done after BUILT.")
+	}
+	if r := circuitResult(bridgeTest); !r.Functional || r.Verdict != VerdictFunctional || len(r.Circuit.Events) != 4 {
+		t.Errorf("Bridge with built circuit must be functional: %+v", r)
+	}
+
+	// A bridge that accepts our connection but can't extend our circuit is
+	// dysfunctional.
+	bridgeTest = newBridgeTest()
+	bridgeTest.Circuit.record("LAUNCHED", "")
+	if !bridgeTest.Circuit.record("FAILED", "CHANNEL_CLOSED") {
+		t.Errorf("Circuit must be done after FAILED.")
+	}
+	r := circuitResult(bridgeTest)
+	if r.Functional || r.Verdict != VerdictDysfunctional || r.ErrorCode != ErrorCodeCircuitFailed || r.Circuit.Reason != "CHANNEL_CLOSED" {
+		t.Errorf("Bridge with failed circuit must be dysfunctional: %+v", r)
+	}
+}
+
+func TestParseRelays(t *testing.T) {
+
+	ns := `r moria1 lpXfw1/+uGEym58asExGOXAgzjE IpcU7dolas8+Q+oAzwgvZIWx7PA 2038-01-01 00:00:00 128.31.0.34 9101 9131
+s Authority Fast Running Stable V2Dir Valid
+r tor26 hnxpqShhqUXMxhvqvsDzg9ZdqS4 owrQM4Knh0BmGphzvwvFRHP5xjQ 2038-01-01 00:00:00 86.59.21.38 443 80
+s Authority Running Valid
+r dizum fx0B/pUGgvP+oZPrMCDGf1hvuNk K2GrtZJyr+4vJMsKVOaDgQeoYc8 2038-01-01 00:00:00 45.66.33.45 443 80
+s Fast Guard Running Stable Valid
+`
+	relays := parseRelays(ns)
+	if len(relays) != 2 {
+		t.Fatalf("Expected 2 relays but got %d: %v", len(relays), relays)
+	}
+	if relays[0] != "9695DFC35FFEB861329B9F1AB04C46397020CE31" {
+		t.Errorf("Unexpected fingerprint %q.", relays[0])
+	}
+}
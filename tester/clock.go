@@ -0,0 +1,141 @@
+package tester
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaxClockSkew is the clock skew beyond which we distrust the failures that a
+// Tor instance reports.  A skewed clock makes Tor reject consensuses and
+// descriptors as expired or not yet valid, so all bridges seem to fail.  Tor
+// itself warns about NETINFO cells that are skewed by more than an hour.
+var MaxClockSkew = time.Hour
+
+// ClockCheckInterval is how often we compare our clock with the validity
+// period of our Tor instances' consensus.
+var ClockCheckInterval = time.Hour
+
+// consensusTimeFormat is the format of the times in GETINFO's
+// consensus/valid-after and consensus/valid-until responses.
+const consensusTimeFormat = "2006-01-02 15:04:05"
+
+// clockSkewEvent captures the skew in Tor's clock skew warnings, which Tor
+// derives from the NETINFO cells of relays and from consensuses, e.g.,
+// "650 STATUS_GENERAL WARN CLOCK_SKEW SKEW=-3600 SOURCE=OR:1.2.3.4:443".  A
+// positive skew means that our clock is behind.
+var clockSkewEvent = regexp.MustCompile(`CLOCK_SKEW SKEW=(-?[0-9]+)`)
+
+// setClockSkew records our clock skew, which is positive if our clock is
+// ahead.
+func (c *TorContext) setClockSkew(skew time.Duration) {
+
+	old := time.Duration(atomic.SwapInt64(&c.clockSkew, int64(skew)))
+	metrics.ClockSkew.With(prometheus.Labels{"instance": c.Name}).Set(skew.Seconds())
+	if !exceedsMaxSkew(old) && exceedsMaxSkew(skew) {
+		log.Printf("%s: Our clock is skewed by %s.  We consider bridge failures inconclusive until it's fixed.",
+			c.Name, skew)
+	} else if exceedsMaxSkew(old) && !exceedsMaxSkew(skew) {
+		log.Printf("%s: Our clock is no longer skewed.", c.Name)
+	}
+}
+
+// ClockSkew returns the skew of our clock, which is positive if our clock is
+// ahead, as far as our Tor instance can tell.
+func (c *TorContext) ClockSkew() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.clockSkew))
+}
+
+// exceedsMaxSkew returns true if the given skew exceeds MaxClockSkew.
+func exceedsMaxSkew(skew time.Duration) bool {
+	return math.Abs(float64(skew)) > float64(MaxClockSkew)
+}
+
+// observeClockSkew updates our clock skew if the given event line is one of
+// Tor's clock skew warnings.
+func (c *TorContext) observeClockSkew(line string) {
+
+	matches := clockSkewEvent.FindStringSubmatch(line)
+	if len(matches) != 2 {
+		return
+	}
+	seconds, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil {
+		return
+	}
+	c.setClockSkew(-time.Duration(seconds) * time.Second)
+}
+
+// consensusSkew returns how far the given time lies outside the given
+// consensus validity period, and 0 if it lies inside.
+func consensusSkew(now, validAfter, validUntil time.Time) time.Duration {
+
+	if now.Before(validAfter) {
+		return now.Sub(validAfter)
+	}
+	if now.After(validUntil) {
+		return now.Sub(validUntil)
+	}
+	return 0
+}
+
+// learnClockSkew compares our clock with the validity period of our Tor
+// instance's consensus.  The caller must hold our lock.
+func (c *TorContext) learnClockSkew() error {
+
+	times := []time.Time{}
+	for _, key := range []string{"consensus/valid-after", "consensus/valid-until"} {
+		value, err := c.queryInfo(key)
+		if err != nil {
+			return err
+		}
+		t, err := time.Parse(consensusTimeFormat, value)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s %q: %v", key, value, err)
+		}
+		times = append(times, t)
+	}
+	c.setClockSkew(consensusSkew(time.Now().UTC(), times[0], times[1]))
+	return nil
+}
+
+// checkClocks periodically compares our clock with the consensus of each of
+// our Tor instances until we shut down.  Tor's clock skew warnings update our
+// skew in the meanwhile.
+func (p *TorPool) checkClocks() {
+
+	ticker := time.NewTicker(ClockCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.shutdown:
+			return
+		case <-ticker.C:
+			for _, c := range p.Instances {
+				c.Lock()
+				if err := c.learnClockSkew(); err != nil {
+					log.Printf("%s: Failed to compare our clock with the consensus: %s", c.Name, err)
+				}
+				c.Unlock()
+			}
+		}
+	}
+}
+
+// distrustFailure turns the given failed bridge test into an inconclusive one
+// if our clock is too skewed to blame the bridge.
+func (c *TorContext) distrustFailure(bridgeTest *BridgeTest) {
+
+	skew := c.ClockSkew()
+	if bridgeTest.Verdict != VerdictDysfunctional || !exceedsMaxSkew(skew) {
+		return
+	}
+	bridgeTest.Verdict = VerdictInconclusive
+	bridgeTest.Error = fmt.Sprintf("%s (but our clock is skewed by %s)", bridgeTest.Error, skew)
+}
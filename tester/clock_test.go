@@ -0,0 +1,57 @@
+package tester
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSkew(t *testing.T) {
+
+	c := &TorContext{Name: "tor0"}
+	c.observeClockSkew(`650 STATUS_GENERAL WARN CLOCK_SKEW SKEW=-7200 SOURCE=OR:1.2.3.4:443`)
+	if c.ClockSkew() != 2*time.Hour {
+		t.Errorf("Expected our clock to be two hours ahead but got %s.", c.ClockSkew())
+	}
+	if h := c.Health(); !h.ClockSkewed || h.ClockSkew != 7200 {
+		t.Errorf("Health doesn't report our clock skew: %+v", h)
+	}
+
+	failure := &BridgeTest{Verdict: VerdictDysfunctional, Error: "timed out waiting for bridge descriptor"}
+	c.distrustFailure(failure)
+	if failure.Verdict != VerdictInconclusive {
+		t.Errorf("Failure despite skewed clock must be inconclusive: %+v", failure)
+	}
+	success := &BridgeTest{Functional: true, Verdict: VerdictFunctional}
+	c.distrustFailure(success)
+	if success.Verdict != VerdictFunctional {
+		t.Errorf("Success despite skewed clock must stay functional: %+v", success)
+	}
+
+	// Events that aren't clock skew warnings leave our skew alone.
+	c.observeClockSkew(`650 STATUS_GENERAL NOTICE DANGEROUS_VERSION CURRENT=0.4.8.9 REASON=NEW RECOMMENDED="0.4.8.10"`)
+	if c.ClockSkew() != 2*time.Hour {
+		t.Errorf("Unrelated event changed our clock skew to %s.", c.ClockSkew())
+	}
+
+	c.observeClockSkew(`650 STATUS_GENERAL WARN CLOCK_SKEW SKEW=60 SOURCE=CONSENSUS`)
+	failure = &BridgeTest{Verdict: VerdictDysfunctional}
+	c.distrustFailure(failure)
+	if c.ClockSkew() != -time.Minute || failure.Verdict != VerdictDysfunctional {
+		t.Errorf("Small skew of %s must not affect verdict %q.", c.ClockSkew(), failure.Verdict)
+	}
+}
+
+func TestConsensusSkew(t *testing.T) {
+
+	validAfter := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	validUntil := validAfter.Add(3 * time.Hour)
+	for now, expected := range map[time.Time]time.Duration{
+		validAfter.Add(-2 * time.Hour): -2 * time.Hour,
+		validAfter.Add(time.Hour):      0,
+		validUntil.Add(5 * time.Hour):  5 * time.Hour,
+	} {
+		if skew := consensusSkew(now, validAfter, validUntil); skew != expected {
+			t.Errorf("Expected skew %s at %s but got %s.", expected, now, skew)
+		}
+	}
+}
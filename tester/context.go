@@ -0,0 +1,65 @@
+package tester
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"time"
+)
+
+// TestContext describes the conditions under which a Tor instance tested a
+// batch of bridges, so researchers can understand our measurements.
+type TestContext struct {
+	Instance   string `json:"instance"`
+	Vantage    string `json:"vantage"`
+	TorVersion string `json:"tor_version,omitempty"`
+	// ConsensusValidAfter is the valid-after time of the Tor instance's
+	// consensus, if it had one.
+	ConsensusValidAfter *time.Time `json:"consensus_valid_after,omitempty"`
+	// PluginsHash identifies our pluggable transport configuration (see
+	// PluginsHash).
+	PluginsHash string `json:"plugins_hash"`
+	// TestTimeout is the number of seconds that the Tor instance had to
+	// test the batch, and ClockSkew is our clock's skew in seconds.
+	TestTimeout float64 `json:"test_timeout"`
+	ClockSkew   float64 `json:"clock_skew"`
+}
+
+// PluginsHash returns the hex-encoded SHA-256 hash of the plugins that our Tor
+// instances use, which changes whenever the operator changes a plugin's
+// executable or arguments.
+func PluginsHash() string {
+
+	specs := []string{}
+	for _, p := range Plugins() {
+		specs = append(specs, p.String())
+	}
+	sum := sha256.Sum256([]byte(strings.Join(specs, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// testContext returns the context of a batch that our Tor instance tests with
+// the given timeout.  The caller must hold our lock.
+func (c *TorContext) testContext(testTimeout time.Duration) *TestContext {
+
+	ctx := &TestContext{
+		Instance:    c.Name,
+		Vantage:     c.GetVantage(),
+		PluginsHash: PluginsHash(),
+		TestTimeout: testTimeout.Seconds(),
+		ClockSkew:   c.ClockSkew().Seconds(),
+	}
+	if version, err := c.queryInfo("version"); err != nil {
+		log.Printf("%s: Failed to learn Tor's version: %s", c.Name, err)
+	} else {
+		ctx.TorVersion = version
+	}
+	// Tor may not have a consensus yet.
+	if value, err := c.queryInfo("consensus/valid-after"); err == nil {
+		if validAfter, err := time.Parse(consensusTimeFormat, value); err == nil {
+			ctx.ConsensusValidAfter = &validAfter
+		}
+	}
+	return ctx
+}
@@ -0,0 +1,183 @@
+package tester
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yawning/bulb"
+)
+
+// RequiredEvents are the Tor events that our event parsers need to learn
+// about bridge tests, that tell us about the circuits of our circuit stage,
+// and that tell us about Tor's bootstrap progress and clock skew warnings.  We
+// always subscribe to them.
+var RequiredEvents = []string{"ORCONN", "NEWDESC", "CIRC", "STATUS_CLIENT", "STATUS_GENERAL"}
+
+// EventStallTimeout is the time after which we raise an alarm (and re-issue
+// our SETEVENTS command) if our Tor instance sends us no events while it's
+// testing bridges.
+var EventStallTimeout = 30 * time.Second
+
+// EventStallRestarts is the number of consecutive event stalls during a test
+// after which we consider our event reader stuck, and restart our control
+// connection.  Tor sends ORCONN events for every bridge that it tests, so a
+// test that hears nothing for this long is unlikely to be merely slow.
+var EventStallRestarts = 2
+
+var eventName = regexp.MustCompile(`^[A-Z_]+$`)
+
+// ParseEvents turns the given comma-separated list of Tor event names, e.g.,
+// "TRANSPORT_LAUNCHED,STATUS_GENERAL", into a list of events that we can
+// subscribe to in addition to RequiredEvents.
+func ParseEvents(list string) ([]string, error) {
+
+	events := []string{}
+	for _, event := range strings.Split(list, ",") {
+		event = strings.ToUpper(strings.TrimSpace(event))
+		if event == "" {
+			continue
+		}
+		if !eventName.MatchString(event) {
+			return nil, fmt.Errorf("invalid event name %q", event)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// events returns the Tor events that our instance subscribes to:
+// RequiredEvents, followed by whatever additional events the instance was
+// configured with.
+func (c *TorContext) events() []string {
+
+	events := append([]string{}, RequiredEvents...)
+	for _, event := range c.Events {
+		if !containsEvent(events, event) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// containsEvent returns true if the given list contains the given event.
+func containsEvent(events []string, event string) bool {
+
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// ctrl returns our current control connection, which changes whenever we
+// reconnect.
+func (c *TorContext) ctrl() *bulb.Conn {
+
+	c.ctrlLock.RLock()
+	defer c.ctrlLock.RUnlock()
+
+	return c.Ctrl
+}
+
+// subscribe makes sure that Tor supports our events, and subscribes to them.
+// Each SETEVENTS command replaces the previous one, so we can subscribe as
+// often as we want.
+func (c *TorContext) subscribe() error {
+
+	events := c.events()
+	supported, err := c.queryInfo("events/names")
+	if err != nil {
+		return fmt.Errorf("failed to learn supported events: %v", err)
+	}
+	supportedEvents := strings.Fields(supported)
+	for _, event := range events {
+		if !containsEvent(supportedEvents, event) {
+			return fmt.Errorf("tor doesn't support event %q", event)
+		}
+	}
+
+	if _, err := c.request("SETEVENTS %s", strings.Join(events, " ")); err != nil {
+		return fmt.Errorf("tor rejected our SETEVENTS command: %v", err)
+	}
+	log.Printf("%s: Subscribed to events %s.", c.Name, strings.Join(events, ", "))
+
+	return nil
+}
+
+// resubscribe issues our SETEVENTS command again, but gives up after the given
+// timeout.  Our event reader also reads the responses to our commands, so a
+// stuck reader would otherwise make us wait forever.
+func (c *TorContext) resubscribe(timeout time.Duration) error {
+
+	done := make(chan error, 1)
+	go func() { done <- c.subscribe() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("tor didn't respond within %s", timeout)
+	}
+}
+
+// restartController closes our control connection because our event reader
+// appears to be stuck for the given reason.  Closing the connection unblocks
+// the reader, which then reconnects and subscribes to our events again.
+func (c *TorContext) restartController(reason string) {
+
+	log.Printf("%s: Event reader appears stuck (%s).  Restarting control connection.", c.Name, reason)
+	metrics.EventReaderRestarts.With(prometheus.Labels{"instance": c.Name}).Inc()
+	atomic.AddInt64(&c.readerRestarts, 1)
+	atomic.StoreInt64(&c.lastReaderRestart, time.Now().UnixNano())
+	if ctrl := c.ctrl(); ctrl != nil {
+		ctrl.Close()
+	}
+}
+
+// errSuperseded means that our supervisor replaced the Tor process that we
+// tried to reconnect to.
+var errSuperseded = errors.New("tor process was replaced")
+
+// reconnect replaces the given broken control connection to the Tor process
+// of the given generation, e.g., after tor closed it, and subscribes to our
+// events again because subscriptions don't survive connections.  If our
+// supervisor replaced the Tor process in the meanwhile, we return
+// errSuperseded and leave the new process's connection alone.
+func (c *TorContext) reconnect(generation int, broken *bulb.Conn) error {
+
+	status := "failure"
+	defer func() {
+		metrics.ControllerReconnects.With(prometheus.Labels{"instance": c.Name, "status": status}).Inc()
+	}()
+
+	broken.Close()
+	c.ctrlLock.RLock()
+	dataDir := c.DataDir
+	c.ctrlLock.RUnlock()
+	ctrl, err := makeControlConnection(getDomainSocketPath(dataDir))
+	if err != nil {
+		return err
+	}
+	ctrl.StartAsyncReader()
+
+	c.ctrlLock.Lock()
+	if generation != c.generation {
+		c.ctrlLock.Unlock()
+		ctrl.Close()
+		return errSuperseded
+	}
+	c.Ctrl = ctrl
+	c.ctrlLock.Unlock()
+
+	if err := c.subscribe(); err != nil {
+		return err
+	}
+	status = "success"
+	return nil
+}
@@ -0,0 +1,38 @@
+package tester
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEvents(t *testing.T) {
+
+	events, err := ParseEvents(" status_client, TRANSPORT_LAUNCHED,,")
+	if err != nil {
+		t.Fatalf("Failed to parse events: %s", err)
+	}
+	if strings.Join(events, " ") != "STATUS_CLIENT TRANSPORT_LAUNCHED" {
+		t.Errorf("Unexpected events: %v", events)
+	}
+
+	if events, err = ParseEvents(""); err != nil || len(events) != 0 {
+		t.Errorf("Expected no events but got %v (%v).", events, err)
+	}
+	if _, err = ParseEvents("ORCONN NEWDESC"); err == nil {
+		t.Errorf("Accepted invalid event name.")
+	}
+}
+
+func TestEvents(t *testing.T) {
+
+	c := &TorContext{}
+	if strings.Join(c.events(), " ") != "ORCONN NEWDESC CIRC STATUS_CLIENT STATUS_GENERAL" {
+		t.Errorf("Unexpected default events: %v", c.events())
+	}
+
+	// We always subscribe to our required events, and only once.
+	c.Events = []string{"TRANSPORT_LAUNCHED", "ORCONN"}
+	if strings.Join(c.events(), " ") != "ORCONN NEWDESC CIRC STATUS_CLIENT STATUS_GENERAL TRANSPORT_LAUNCHED" {
+		t.Errorf("Unexpected events: %v", c.events())
+	}
+}
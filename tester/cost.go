@@ -0,0 +1,124 @@
+package tester
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// costs keeps track of what our bridge tests cost us.
+var costs = NewCostTracker()
+
+// TransportCost summarises what it costs us to test bridges of a given
+// transport.
+type TransportCost struct {
+	Bridges int `json:"bridges"`
+	// AvgSeconds is the average time from the start of a bridge's batch
+	// until we had the bridge's verdict.
+	AvgSeconds float64 `json:"avg_seconds"`
+	// AvgEvents is the average number of Tor events that belonged to a
+	// bridge's test.
+	AvgEvents float64 `json:"avg_events"`
+}
+
+// CapacityReport estimates how many bridges we can sustainably test, based
+// on what our tests have cost us so far.
+type CapacityReport struct {
+	Instances          int     `json:"instances"`
+	TestTimeoutSeconds float64 `json:"test_timeout_seconds"`
+	BridgesTested      int     `json:"bridges_tested"`
+	BusySeconds        float64 `json:"busy_seconds"`
+	// MaxBridgesPerHour is the number of bridges that our Tor instances
+	// could test per hour if they never sat idle, assuming that future
+	// batches look like past batches.  It's 0 until we tested bridges.
+	MaxBridgesPerHour float64                   `json:"max_bridges_per_hour"`
+	Transports        map[string]*TransportCost `json:"transports"`
+}
+
+type transportTotals struct {
+	bridges int
+	elapsed time.Duration
+	events  int
+}
+
+// CostTracker aggregates the time and Tor events that our bridge tests
+// consumed, per transport, and the time our Tor instances spent testing
+// batches.  It's safe for concurrent use.
+type CostTracker struct {
+	transports map[string]*transportTotals
+	bridges    int
+	busy       time.Duration
+	sync.Mutex
+}
+
+// NewCostTracker returns a new cost tracker.
+func NewCostTracker() *CostTracker {
+
+	return &CostTracker{transports: make(map[string]*transportTotals)}
+}
+
+// AddBridge records that testing a bridge of the given transport took the
+// given time and the given number of Tor events.
+func (t *CostTracker) AddBridge(transport string, elapsed time.Duration, events int) {
+
+	metrics.BridgeTestTime.With(prometheus.Labels{"transport": transport}).Observe(elapsed.Seconds())
+	metrics.BridgeTestEvents.With(prometheus.Labels{"transport": transport}).Add(float64(events))
+
+	t.Lock()
+	defer t.Unlock()
+
+	totals, exists := t.transports[transport]
+	if !exists {
+		totals = &transportTotals{}
+		t.transports[transport] = totals
+	}
+	totals.bridges++
+	totals.elapsed += elapsed
+	totals.events += events
+}
+
+// AddBatch records that a Tor instance spent the given time testing a batch
+// of the given number of bridges.
+func (t *CostTracker) AddBatch(numBridges int, elapsed time.Duration) {
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.bridges += numBridges
+	t.busy += elapsed
+}
+
+// Report returns a capacity report for the given number of Tor instances.
+func (t *CostTracker) Report(instances int) *CapacityReport {
+
+	t.Lock()
+	defer t.Unlock()
+
+	report := &CapacityReport{
+		Instances:          instances,
+		TestTimeoutSeconds: TestTimeout().Seconds(),
+		BridgesTested:      t.bridges,
+		BusySeconds:        t.busy.Seconds(),
+		Transports:         make(map[string]*TransportCost),
+	}
+	// Our instances test batches one at a time, so each instance's throughput
+	// is the number of bridges that it tests per second of testing.
+	if t.busy > 0 {
+		report.MaxBridgesPerHour = float64(t.bridges) / t.busy.Hours() * float64(instances)
+	}
+	for transport, totals := range t.transports {
+		report.Transports[transport] = &TransportCost{
+			Bridges:    totals.bridges,
+			AvgSeconds: totals.elapsed.Seconds() / float64(totals.bridges),
+			AvgEvents:  float64(totals.events) / float64(totals.bridges),
+		}
+	}
+	return report
+}
+
+// Capacity returns a capacity report for our pool's Tor instances.
+func (p *TorPool) Capacity() *CapacityReport {
+
+	return costs.Report(len(p.Instances))
+}
@@ -0,0 +1,36 @@
+package tester
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCostTracker(t *testing.T) {
+
+	tracker := NewCostTracker()
+	if report := tracker.Report(2); report.MaxBridgesPerHour != 0 || len(report.Transports) != 0 {
+		t.Errorf("Expected empty report but got %+v.", report)
+	}
+
+	tracker.AddBridge("obfs4", 10*time.Second, 4)
+	tracker.AddBridge("obfs4", 20*time.Second, 6)
+	tracker.AddBridge("vanilla", 5*time.Second, 3)
+	tracker.AddBatch(3, 30*time.Second)
+
+	report := tracker.Report(2)
+	if report.BridgesTested != 3 || report.BusySeconds != 30 {
+		t.Errorf("Unexpected totals in report %+v.", report)
+	}
+	// Each instance tests three bridges per 30 seconds, i.e., 360 per hour.
+	if math.Abs(report.MaxBridgesPerHour-720) > 0.001 {
+		t.Errorf("Expected capacity of 720 bridges per hour but got %f.", report.MaxBridgesPerHour)
+	}
+	obfs4 := report.Transports["obfs4"]
+	if obfs4 == nil || obfs4.Bridges != 2 || obfs4.AvgSeconds != 15 || obfs4.AvgEvents != 5 {
+		t.Errorf("Unexpected obfs4 cost %+v.", obfs4)
+	}
+	if vanilla := report.Transports["vanilla"]; vanilla == nil || vanilla.AvgEvents != 3 {
+		t.Errorf("Unexpected vanilla cost %+v.", vanilla)
+	}
+}
@@ -0,0 +1,206 @@
+package tester
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// UpcomingRequiredProtocols contains the subprotocol versions that the
+// directory authorities are expected to require of relays and bridges soon.
+// Bridges that lack any of them will be rejected once the requirement is in
+// place, so we flag them early, which gives the network team advance warning.
+// The format is that of the "proto" line in server descriptors; see section
+// 9 of Tor's directory specification:
+// https://gitweb.torproject.org/torspec.git/tree/dir-spec.txt
+var UpcomingRequiredProtocols = "Cons=2 Desc=2 DirCache=2 HSDir=2 HSIntro=4 HSRend=2 Link=4-5 LinkAuth=3 Microdesc=2 Relay=2"
+
+// Descriptor describes the server descriptor that a bridge gave us.
+type Descriptor struct {
+	// Size is the size of the descriptor in bytes.
+	Size int `json:"size"`
+	// Protocols lists the subprotocol versions that the bridge supports,
+	// e.g., "Link=1-5 Relay=1-2".
+	Protocols string `json:"protocols,omitempty"`
+	// MissingProtocols lists the subprotocol versions in
+	// UpcomingRequiredProtocols that the bridge doesn't support.
+	MissingProtocols []string `json:"missing_protocols,omitempty"`
+	// TorVersion is the version of Tor that the bridge runs, e.g.,
+	// "0.4.8.10", and Platform is the descriptor's entire platform string,
+	// e.g., "Tor 0.4.8.10 on Linux".
+	TorVersion string `json:"tor_version,omitempty"`
+	Platform   string `json:"platform,omitempty"`
+	// ORPorts lists the addr:port tuples on which the bridge advertises its
+	// ORPort, starting with its primary one.
+	ORPorts []string `json:"orports,omitempty"`
+	// Transports lists the pluggable transports that the descriptor
+	// advertises, if any.  Bridges usually only advertise them in their
+	// extra-info descriptors, which clients don't fetch.
+	Transports []string `json:"transports,omitempty"`
+	// Bandwidth is the bandwidth that the bridge advertises in bytes per
+	// second, i.e., the minimum of its average, burst, and observed
+	// bandwidth.
+	Bandwidth int64 `json:"bandwidth,omitempty"`
+}
+
+// ProtocolVersions maps subprotocols, e.g., "Link", to the set of their
+// versions.
+type ProtocolVersions map[string]map[int]bool
+
+// ParseProtocols parses a list of subprotocol versions as it appears in the
+// "proto" line of server descriptors, e.g., "Link=1-5 LinkAuth=1,3".
+func ParseProtocols(s string) (ProtocolVersions, error) {
+
+	p := make(ProtocolVersions)
+	for _, entry := range strings.Fields(s) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid protocol entry %q", entry)
+		}
+		versions := make(map[int]bool)
+		if parts[1] != "" {
+			for _, r := range strings.Split(parts[1], ",") {
+				low, high, err := parseVersionRange(r)
+				if err != nil {
+					return nil, fmt.Errorf("invalid versions in protocol entry %q: %v", entry, err)
+				}
+				for v := low; v <= high; v++ {
+					versions[v] = true
+				}
+			}
+		}
+		p[parts[0]] = versions
+	}
+	return p, nil
+}
+
+// parseVersionRange parses a single version, e.g., "3", or a range of
+// versions, e.g., "1-5".
+func parseVersionRange(r string) (int, int, error) {
+
+	bounds := strings.SplitN(r, "-", 2)
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if low < 0 || high < low {
+		return 0, 0, fmt.Errorf("invalid range %q", r)
+	}
+	return low, high, nil
+}
+
+// Missing returns the sorted list of subprotocol versions in the given
+// requirements that we don't support, e.g., "Link=5".
+func (p ProtocolVersions) Missing(required ProtocolVersions) []string {
+
+	missing := []string{}
+	for proto, versions := range required {
+		for v := range versions {
+			if !p[proto][v] {
+				missing = append(missing, fmt.Sprintf("%s=%d", proto, v))
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ParseDescriptor extracts the size, the supported subprotocol versions, the
+// platform, the ORPorts, the transports, and the bandwidth from the given
+// server descriptor, and determines which of the upcoming required subprotocol
+// versions the bridge is lacking.  See section 2.1.1 of Tor's directory
+// specification for the descriptor's format.
+func ParseDescriptor(desc string) (*Descriptor, error) {
+
+	d := &Descriptor{Size: len(desc)}
+	for _, line := range strings.Split(desc, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "router":
+			// router NICKNAME ADDRESS ORPORT SOCKSPORT DIRPORT
+			if len(fields) >= 4 {
+				d.ORPorts = append([]string{net.JoinHostPort(fields[2], fields[3])}, d.ORPorts...)
+			}
+		case "or-address":
+			d.ORPorts = append(d.ORPorts, fields[1])
+		case "platform":
+			d.Platform = strings.Join(fields[1:], " ")
+			// The platform string looks like "Tor 0.4.8.10 on Linux".
+			if fields[1] == "Tor" && len(fields) >= 3 {
+				d.TorVersion = fields[2]
+			}
+		case "proto":
+			if d.Protocols == "" {
+				d.Protocols = strings.Join(fields[1:], " ")
+			}
+		case "transport":
+			// Only keep the transport's name, because the rest of the
+			// line may contain its secrets, e.g., obfs4's cert.
+			d.Transports = append(d.Transports, fields[1])
+		case "bandwidth":
+			// bandwidth AVERAGE BURST OBSERVED
+			for i, field := range fields[1:] {
+				bw, err := strconv.ParseInt(field, 10, 64)
+				if err != nil || bw < 0 {
+					return nil, fmt.Errorf("invalid bandwidth line %q", line)
+				}
+				if i == 0 || bw < d.Bandwidth {
+					d.Bandwidth = bw
+				}
+			}
+		}
+	}
+
+	supported, err := ParseProtocols(d.Protocols)
+	if err != nil {
+		return nil, err
+	}
+	required, err := ParseProtocols(UpcomingRequiredProtocols)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upcoming required protocols: %v", err)
+	}
+	d.MissingProtocols = supported.Missing(required)
+	return d, nil
+}
+
+// describeBridge fetches and parses the descriptor of the bridge with the
+// given fingerprint.  Failing to do so doesn't make the bridge any less
+// functional, so we merely log errors.  The caller must hold our lock.
+func (c *TorContext) describeBridge(fingerprint string) *Descriptor {
+
+	d, err := c.fetchDescriptor(fingerprint)
+	if err != nil {
+		log.Printf("Failed to fetch descriptor of bridge %s: %s", fingerprint, err)
+		return nil
+	}
+	for _, m := range d.MissingProtocols {
+		metrics.MissingProtocols.With(prometheus.Labels{"protocol": m}).Inc()
+	}
+	return d
+}
+
+// fetchDescriptor asks our Tor instance for the server descriptor of the
+// bridge with the given fingerprint, and parses it.  The caller must hold our
+// lock.
+func (c *TorContext) fetchDescriptor(fingerprint string) (*Descriptor, error) {
+
+	desc, err := c.queryInfo("desc/id/" + fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDescriptor(desc)
+}
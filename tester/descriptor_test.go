@@ -0,0 +1,85 @@
+package tester
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProtocols(t *testing.T) {
+
+	p, err := ParseProtocols("Link=1-3,5 Relay=2 Padding=")
+	if err != nil {
+		t.Fatalf("Failed to parse protocols: %s", err)
+	}
+	expected := ProtocolVersions{
+		"Link":    {1: true, 2: true, 3: true, 5: true},
+		"Relay":   {2: true},
+		"Padding": {},
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %v but got %v.", expected, p)
+	}
+
+	for _, invalid := range []string{"Link", "=1", "Link=a", "Link=3-1", "Link=1-"} {
+		if _, err := ParseProtocols(invalid); err == nil {
+			t.Errorf("Failed to reject invalid protocols %q.", invalid)
+		}
+	}
+}
+
+func TestMissingProtocols(t *testing.T) {
+
+	supported, _ := ParseProtocols("Link=1-4 Relay=1-2")
+	required, _ := ParseProtocols("Link=4-5 Relay=2 Cons=2")
+	missing := supported.Missing(required)
+	expected := []string{"Cons=2", "Link=5"}
+	if !reflect.DeepEqual(missing, expected) {
+		t.Errorf("Expected %v but got %v.", expected, missing)
+	}
+}
+
+func TestParseDescriptor(t *testing.T) {
+
+	desc := `router Unnamed 1.2.3.4 1234 0 0
+or-address [2001:db8::1]:443
+platform Tor 0.4.8.10 on Linux
+bandwidth 1073741824 1073741824 2500000
+transport obfs4 1.2.3.4:443 cert=foo,iat-mode=0
+proto Cons=1-2 Desc=1-2 DirCache=1-2 HSDir=1-2 HSIntro=3-4 HSRend=1-2 Link=1-5 LinkAuth=1,3 Microdesc=1-2 Relay=1-2
+router-signature`
+
+	d, err := ParseDescriptor(desc)
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %s", err)
+	}
+	if d.Size != len(desc) {
+		t.Errorf("Expected size %d but got %d.", len(desc), d.Size)
+	}
+	if len(d.MissingProtocols) != 0 {
+		t.Errorf("Up-to-date bridge lacks protocols: %v", d.MissingProtocols)
+	}
+	if d.TorVersion != "0.4.8.10" || d.Platform != "Tor 0.4.8.10 on Linux" {
+		t.Errorf("Unexpected version %q and platform %q.", d.TorVersion, d.Platform)
+	}
+	if !reflect.DeepEqual(d.ORPorts, []string{"1.2.3.4:1234", "[2001:db8::1]:443"}) {
+		t.Errorf("Unexpected ORPorts %v.", d.ORPorts)
+	}
+	if !reflect.DeepEqual(d.Transports, []string{"obfs4"}) {
+		t.Errorf("Unexpected transports %v.", d.Transports)
+	}
+	if d.Bandwidth != 2500000 {
+		t.Errorf("Expected bandwidth 2500000 but got %d.", d.Bandwidth)
+	}
+
+	d, err = ParseDescriptor("router Unnamed 1.2.3.4 1234 0 0\nproto Link=1-4 Relay=1-2\n")
+	if err != nil {
+		t.Fatalf("Failed to parse descriptor: %s", err)
+	}
+	if len(d.MissingProtocols) == 0 {
+		t.Errorf("Failed to flag outdated bridge.")
+	}
+
+	if _, err := ParseDescriptor("bandwidth 100 foo 100\n"); err == nil {
+		t.Errorf("Failed to reject invalid bandwidth.")
+	}
+}
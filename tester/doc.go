@@ -0,0 +1,6 @@
+// Package tester tests Tor bridges by making Tor instances fetch their
+// descriptors.  A TorPool schedules test requests among its Tor instances and
+// fairly shares their test capacity among clients.  Bridges can additionally
+// be put through the cheaper stages of our test pipeline (see
+// RunPreTorStages) before they are handed to Tor.
+package tester
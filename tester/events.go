@@ -1,4 +1,4 @@
-package main
+package tester
 
 import (
 	"errors"
@@ -8,6 +8,8 @@ import (
 	"math/rand"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -47,55 +49,74 @@ func extractFingerprint(line string) (string, error) {
 	}
 }
 
-// getFailureDesc takes as input an ORCONN line and maps the error code to a
-// more descriptive string.
-func getFailureDesc(line string) (string, error) {
+// FailureReasons maps the error codes of failed ORCONN events to descriptive
+// strings.  The codes are stable, so clients can rely on them, e.g., to show
+// translated error messages.  See the following part of our control
+// specification:
+// https://gitweb.torproject.org/torspec.git/tree/control-spec.txt?id=1ecf3f66586816fc718e38f8cd7cbb23fa9b81f5#n2472
+var FailureReasons = map[string]string{
+	"DONE":           "The OR connection has shut down cleanly.",
+	"CONNECTREFUSED": "We got an ECONNREFUSED while connecting to the target OR.",
+	"IDENTITY":       "We connected to the OR, but found that its identity was not what we expected.",
+	"CONNECTRESET":   "We got an ECONNRESET or similar IO error from the connection with the OR.",
+	"TIMEOUT":        "We got an ETIMEOUT or similar IO error from the connection with the OR, or we're closing the connection for being idle for too long.",
+	"NOROUTE":        "We got an ENOTCONN, ENETUNREACH, ENETDOWN, EHOSTUNREACH, or similar error while connecting to the OR.",
+	"IOERROR":        "We got some other IO error on our connection to the OR.",
+	"RESOURCELIMIT":  "We don't have enough operating system resources (file descriptors, buffers, etc) to connect to the OR.",
+	"PT_MISSING":     "No pluggable transport was available.",
+	"MISC":           "The OR connection closed for some other reason.",
+}
+
+// FailureCode returns the error code of the given descriptive string from
+// FailureReasons, or the empty string if there's none.  It lets us recover
+// error codes for results that we cached before we kept track of codes.
+func FailureCode(desc string) string {
 
-	// See the following part of our control specification:
-	// https://gitweb.torproject.org/torspec.git/tree/control-spec.txt?id=1ecf3f66586816fc718e38f8cd7cbb23fa9b81f5#n2472
-	var reasons = map[string]string{
-		"DONE":           "The OR connection has shut down cleanly.",
-		"CONNECTREFUSED": "We got an ECONNREFUSED while connecting to the target OR.",
-		"IDENTITY":       "We connected to the OR, but found that its identity was not what we expected.",
-		"CONNECTRESET":   "We got an ECONNRESET or similar IO error from the connection with the OR.",
-		"TIMEOUT":        "We got an ETIMEOUT or similar IO error from the connection with the OR, or we're closing the connection for being idle for too long.",
-		"NOROUTE":        "We got an ENOTCONN, ENETUNREACH, ENETDOWN, EHOSTUNREACH, or similar error while connecting to the OR.",
-		"IOERROR":        "We got some other IO error on our connection to the OR.",
-		"RESOURCELIMIT":  "We don't have enough operating system resources (file descriptors, buffers, etc) to connect to the OR.",
-		"PT_MISSING":     "No pluggable transport was available.",
-		"MISC":           "The OR connection closed for some other reason.",
+	for code, d := range FailureReasons {
+		if d == desc {
+			return code
+		}
 	}
+	return ""
+}
+
+// getFailureCode takes as input an ORCONN line and returns its error code.
+func getFailureCode(line string) (string, error) {
 
 	matches := OrConnReasonField.FindStringSubmatch(line)
 	expectedMatches := 2
 	if len(matches) != expectedMatches {
 		return "", fmt.Errorf("expected %d but got %d matches", expectedMatches, len(matches))
 	}
+	return matches[1], nil
+}
 
-	desc, exists := reasons[matches[1]]
-	if !exists {
-		return "", fmt.Errorf("could not find reason for %q", matches[1])
-	}
+// failureLabel returns the given error code as label of our ORCONN failure
+// metric.  Codes that our control specification doesn't know become
+// "UNKNOWN", so misbehaving Tor versions can't blow up our metric.
+func failureLabel(code string) string {
 
-	return desc, nil
+	if _, exists := FailureReasons[code]; !exists {
+		return "UNKNOWN"
+	}
+	return code
 }
 
-// calcMatchLength determines the number of digits that we should compare for
-// in an ORCONN LAUNCHED event.
-func calcMatchLength(target1, target2 string) int {
+// getFailureDesc takes as input an ORCONN line and maps the error code to a
+// more descriptive string.
+func getFailureDesc(line string) (string, error) {
 
-	// Start with min(target1, target2).
-	length := len(target1)
-	if len(target2) < len(target1) {
-		length = len(target2)
+	code, err := getFailureCode(line)
+	if err != nil {
+		return "", err
 	}
 
-	// We're dealing with a "$fingerprint~name" pattern.
-	if length > BridgeFingerprintLen+1 {
-		length = BridgeFingerprintLen + 1
+	desc, exists := FailureReasons[code]
+	if !exists {
+		return "", fmt.Errorf("could not find reason for %q", code)
 	}
 
-	return length
+	return desc, nil
 }
 
 // TorEventState represents a state machine that we use to parse ORCONN and
@@ -104,9 +125,22 @@ type TorEventState struct {
 	ConnIds     map[int]bool
 	State       int
 	Reason      string
+	ReasonCode  string
 	Fingerprint string
 	Target      string // If present, the fingerprint; otherwise address:port.
 	TestId      int
+	// NumEvents counts the events that belonged to our bridge, which tells
+	// us what testing the bridge cost.
+	NumEvents int
+	// LastProgress is the time of the last LAUNCHED or CONNECTED event of
+	// our bridge, and zero if there was none.
+	LastProgress time.Time
+}
+
+// ProgressedSince returns true if our bridge made progress, i.e., Tor launched
+// or completed a connection to it, at or after the given time.
+func (t *TorEventState) ProgressedSince(since time.Time) bool {
+	return !t.LastProgress.IsZero() && !t.LastProgress.Before(since)
 }
 
 // NewTorEventState returns a new TorEventState struct.
@@ -154,18 +188,28 @@ func (t *TorEventState) processOrConnLine(line string) {
 	// to our map, so we can keep track of it.
 	if eventType == "LAUNCHED" {
 		metrics.Events.With(prometheus.Labels{"type": "orconn", "status": "launched"}).Inc()
-		matchLen := calcMatchLength(target, t.Target)
-		if target == t.Target[:matchLen] {
+		if t.isTarget(target) {
 			log.Printf("%x: Adding ID %d to map.", t.TestId, i)
 			t.ConnIds[i] = true
+			t.LastProgress = time.Now()
 		}
 	}
 
+	// Bridges whose transport reaches them via a front (e.g., meek) may show
+	// up in LAUNCHED events under an address other than the one in their
+	// bridge line.  If we know our bridge's fingerprint, we therefore adopt
+	// connections whose later events name our fingerprint.
+	if !t.ConnIds[i] && eventType != "LAUNCHED" && t.matchesFingerprint(target) {
+		log.Printf("%x: Adopting ID %d because it names our fingerprint.", t.TestId, i)
+		t.ConnIds[i] = true
+	}
+
 	// Are we dealing with an ORCONN for a bridge line that isn't ours?  If so,
 	// let's get outta here.
 	if _, exists := t.ConnIds[i]; !exists {
 		return
 	}
+	t.NumEvents++
 
 	// Now decide what to do.  Here are the event types we're dealing with:
 	// https://gitweb.torproject.org/torspec.git/tree/control-spec.txt#n2448
@@ -186,12 +230,17 @@ func (t *TorEventState) processOrConnLine(line string) {
 			log.Printf("%x: ORCONN failed because: %s", t.TestId, desc)
 		}
 		t.Reason = desc
+		t.ReasonCode, _ = getFailureCode(line)
+		if _, exists := t.ConnIds[i]; exists {
+			metrics.OrConnFailures.With(prometheus.Labels{"reason": failureLabel(t.ReasonCode)}).Inc()
+		}
 	case "CONNECTED":
 		metrics.Events.With(prometheus.Labels{"type": "orconn", "status": "connected"}).Inc()
 		fingerprint, err := extractFingerprint(line)
 		if err == nil {
 			log.Printf("%x: Setting fingerprint to %s.", t.TestId, fingerprint)
 			t.Fingerprint = fingerprint
+			t.checkFingerprint()
 		} else {
 			log.Printf("%x: Bug: Failed to extract fingerprint from %q.", t.TestId, line)
 		}
@@ -199,10 +248,44 @@ func (t *TorEventState) processOrConnLine(line string) {
 		// An ORCONN succeeded.  Was it ours?
 		if _, exists := t.ConnIds[i]; exists {
 			log.Printf("%x: ORCONN success.  One step closer to NEWDESC.", t.TestId)
+			t.LastProgress = time.Now()
 		}
 	}
 }
 
+// isTarget returns true if the given ORCONN target, e.g., "1.2.3.4:443" or
+// "$FINGERPRINT~nickname", is our bridge.  Addresses must match exactly, so
+// that, e.g., "1.2.3.4:44" isn't mistaken for "1.2.3.4:443".
+func (t *TorEventState) isTarget(target string) bool {
+
+	return target == t.Target || strings.HasPrefix(target, t.Target+"~")
+}
+
+// checkFingerprint fails our bridge if our target is a fingerprint, but the
+// bridge that Tor connected to has another one.
+func (t *TorEventState) checkFingerprint() {
+
+	if len(t.Target) != BridgeFingerprintLen+1 || t.Target[0] != '$' {
+		return
+	}
+	if expected := t.Target[1:]; t.Fingerprint != expected {
+		log.Printf("%x: Bridge has fingerprint %s instead of %s.", t.TestId, t.Fingerprint, expected)
+		t.State = BridgeStateFailure
+		t.Reason = fmt.Sprintf("bridge has fingerprint %s instead of %s", t.Fingerprint, expected)
+		t.ReasonCode = ErrorCodeWrongFingerprint
+	}
+}
+
+// matchesFingerprint returns true if our target is a fingerprint, and the
+// given ORCONN target, e.g., "$FINGERPRINT~nickname", names it.
+func (t *TorEventState) matchesFingerprint(target string) bool {
+
+	if len(t.Target) != BridgeFingerprintLen+1 || t.Target[0] != '$' {
+		return false
+	}
+	return len(target) > BridgeFingerprintLen && target[:BridgeFingerprintLen+1] == t.Target
+}
+
 // processNewDescLine processes NEWDESC lines.
 func (t *TorEventState) processNewDescLine(line string) {
 
@@ -217,6 +300,7 @@ func (t *TorEventState) processNewDescLine(line string) {
 
 	// Is the NEWDESC event ours?
 	if fingerprint == t.Fingerprint {
+		t.NumEvents++
 		log.Printf("%x: Received NEWDESC event for our bridge.", t.TestId)
 		t.State = BridgeStateSuccess
 	}
@@ -0,0 +1,217 @@
+package tester
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExtractFingerprint(t *testing.T) {
+
+	expected := "0123456789ABCDEF0123456789ABCDEF01234567"
+	fingerprint, err := extractFingerprint("650 ORCONN $0123456789ABCDEF0123456789ABCDEF01234567~foobar CLOSED REASON=IOERROR ID=326")
+	if err != nil || fingerprint != expected {
+		t.Errorf("failed to extract fingerprint")
+	}
+
+	fingerprint, err = extractFingerprint("650 NEWDESC $0123456789ABCDEF0123456789ABCDEF01234567~foobar")
+	if err != nil || fingerprint != expected {
+		t.Errorf("failed to extract fingerprint")
+	}
+
+	fingerprint, err = extractFingerprint("650 NEWDESC $0123456789ABCDEF0123456789ABCDEF01234567")
+	if err != nil || fingerprint != expected {
+		t.Errorf("failed to extract fingerprint")
+	}
+
+	_, err = extractFingerprint("650 NEWDESC $ThisIsTooShort")
+	if err == nil {
+		t.Errorf("failed to reject invalid fingerprint")
+	}
+}
+
+func TestGetFailureDesc(t *testing.T) {
+
+	desc, err := getFailureDesc("650 ORCONN $0123456789ABCDEF0123456789ABCDEF01234567~Unnamed CLOSED REASON=IOERROR ID=266")
+	if err != nil || desc != "We got some other IO error on our connection to the OR." {
+		t.Errorf("failed to map error code")
+	}
+
+	code, err := getFailureCode("650 ORCONN $0123456789ABCDEF0123456789ABCDEF01234567~Unnamed CLOSED REASON=IOERROR ID=266")
+	if err != nil || code != "IOERROR" {
+		t.Errorf("failed to extract error code")
+	}
+	if FailureCode(desc) != "IOERROR" || FailureCode("bogus") != "" {
+		t.Errorf("failed to map description back to error code")
+	}
+}
+
+func TestIsTarget(t *testing.T) {
+
+	s := NewTorEventState("1.2.3.4:443")
+	if !s.isTarget("1.2.3.4:443") {
+		t.Errorf("Failed to match our address.")
+	}
+	for _, target := range []string{"1.2.3.4:44", "1.2.3.4:4430", "11.2.3.4:443"} {
+		if s.isTarget(target) {
+			t.Errorf("Mistook %q for our address.", target)
+		}
+	}
+
+	s = NewTorEventState("$0123456789ABCDEF0123456789ABCDEF01234567")
+	for _, target := range []string{"$0123456789ABCDEF0123456789ABCDEF01234567", "$0123456789ABCDEF0123456789ABCDEF01234567~foobar"} {
+		if !s.isTarget(target) {
+			t.Errorf("Failed to match %q.", target)
+		}
+	}
+	if s.isTarget("$0123456789ABCDEF0123456789ABCDEF01234568~foobar") {
+		t.Errorf("Mistook another fingerprint for ours.")
+	}
+}
+
+func TestTorEventStateSuccessful(t *testing.T) {
+
+	// Test run for when we start with an address:port tuple.
+	s := NewTorEventState("146.57.248.225:22")
+	s.Feed("650 ORCONN 146.57.248.225:22 LAUNCHED ID=69")
+	if s.State != BridgeStatePending {
+		t.Fatalf("state machine in unexpected state")
+	}
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0 CONNECTED ID=69")
+	if s.State != BridgeStatePending {
+		t.Fatalf("state machine in unexpected state")
+	}
+	s.Feed("650 NEWDESC $10A6CD36A537FCE513A322361547444B393989F0~hopperlab")
+	if s.State != BridgeStateSuccess {
+		t.Fatalf("state machine in unexpected state")
+	}
+
+	// Test run for when we start with a fingerprint.
+	s = NewTorEventState("$10A6CD36A537FCE513A322361547444B393989F0")
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0 LAUNCHED ID=69")
+	if s.State != BridgeStatePending {
+		t.Fatalf("state machine in unexpected state")
+	}
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0 CONNECTED ID=69")
+	if s.State != BridgeStatePending {
+		t.Fatalf("state machine in unexpected state")
+	}
+	s.Feed("650 NEWDESC $10A6CD36A537FCE513A322361547444B393989F0~hopperlab")
+	if s.State != BridgeStateSuccess {
+		t.Fatalf("state machine in unexpected state")
+	}
+
+	// Events that don't belong to our bridge don't count.
+	if s.NumEvents != 3 {
+		t.Errorf("expected 3 events but counted %d", s.NumEvents)
+	}
+	s.Feed("650 ORCONN 1.2.3.4:1234 LAUNCHED ID=70")
+	if s.NumEvents != 3 {
+		t.Errorf("counted event of other bridge")
+	}
+}
+
+func TestTorEventStateFail(t *testing.T) {
+
+	s := NewTorEventState("146.57.248.225:22")
+	s.Feed("650 ORCONN 146.57.248.225:22 LAUNCHED ID=69")
+	if s.State != BridgeStatePending {
+		t.Fatalf("state machine in unexpected state")
+	}
+	before := testutil.ToFloat64(metrics.OrConnFailures.With(prometheus.Labels{"reason": "DONE"}))
+	s.Feed("650 ORCONN 146.57.248.225:22 FAILED REASON=DONE ID=69")
+	if s.State != BridgeStateFailure {
+		t.Fatalf("state machine in unexpected state")
+	}
+	if testutil.ToFloat64(metrics.OrConnFailures.With(prometheus.Labels{"reason": "DONE"})) != before+1 {
+		t.Errorf("Failed to count ORCONN failure.")
+	}
+	// Failures of other connections don't count.
+	s.Feed("650 ORCONN 1.2.3.4:5 FAILED REASON=DONE ID=70")
+	if testutil.ToFloat64(metrics.OrConnFailures.With(prometheus.Labels{"reason": "DONE"})) != before+1 {
+		t.Errorf("Counted ORCONN failure of other connection.")
+	}
+}
+
+func TestFailureLabel(t *testing.T) {
+
+	if failureLabel("CONNECTREFUSED") != "CONNECTREFUSED" || failureLabel("BOGUS") != "UNKNOWN" || failureLabel("") != "UNKNOWN" {
+		t.Errorf("Unexpected failure labels.")
+	}
+}
+
+func TestTorEventStateProgress(t *testing.T) {
+
+	before := time.Now()
+	s := NewTorEventState("146.57.248.225:22")
+	if s.ProgressedSince(time.Time{}) {
+		t.Errorf("new state machine made progress")
+	}
+
+	// Events of other bridges aren't progress.
+	s.Feed("650 ORCONN 1.2.3.4:1234 LAUNCHED ID=70")
+	if s.ProgressedSince(time.Time{}) {
+		t.Errorf("event of other bridge counted as progress")
+	}
+
+	s.Feed("650 ORCONN 146.57.248.225:22 LAUNCHED ID=69")
+	if !s.ProgressedSince(before) {
+		t.Errorf("LAUNCHED event didn't count as progress")
+	}
+	launched := s.LastProgress
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0 CONNECTED ID=69")
+	if s.LastProgress.Before(launched) {
+		t.Errorf("CONNECTED event didn't count as progress")
+	}
+	if s.ProgressedSince(time.Now().Add(time.Minute)) {
+		t.Errorf("progress counted for the future")
+	}
+}
+
+func TestTorEventStateFronted(t *testing.T) {
+
+	// Tor's LAUNCHED event names an address that's not in the bridge line,
+	// but its CONNECTED event names our fingerprint.
+	s := NewTorEventState("$BE776A53492E1E044A26F17306E1BC46A55A1625")
+	s.Feed("650 ORCONN 13.107.246.10:443 LAUNCHED ID=7")
+	if len(s.ConnIds) != 0 {
+		t.Fatalf("adopted connection to unrelated address")
+	}
+	s.Feed("650 ORCONN $BE776A53492E1E044A26F17306E1BC46A55A1625~meek CONNECTED ID=7")
+	if !s.ConnIds[7] || s.Fingerprint != "BE776A53492E1E044A26F17306E1BC46A55A1625" {
+		t.Fatalf("failed to adopt connection that names our fingerprint")
+	}
+	s.Feed("650 NEWDESC $BE776A53492E1E044A26F17306E1BC46A55A1625~meek")
+	if s.State != BridgeStateSuccess {
+		t.Fatalf("state machine in unexpected state")
+	}
+
+	// Bridges without fingerprint never adopt connections.
+	s = NewTorEventState("192.0.2.18:80")
+	s.Feed("650 ORCONN $BE776A53492E1E044A26F17306E1BC46A55A1625 FAILED REASON=DONE ID=8")
+	if s.State != BridgeStatePending || len(s.ConnIds) != 0 {
+		t.Fatalf("state machine adopted connection without fingerprint")
+	}
+}
+
+func TestTorEventStateWrongFingerprint(t *testing.T) {
+
+	s := NewTorEventState("$10A6CD36A537FCE513A322361547444B393989F0")
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0 LAUNCHED ID=69")
+	s.Feed("650 ORCONN $D9A82D2F9C2F65A18407B1D2B764F130847F8B5D~dragon CONNECTED ID=69")
+	if s.State != BridgeStateFailure || s.ReasonCode != ErrorCodeWrongFingerprint {
+		t.Errorf("Bridge with wrong fingerprint must fail: %+v", s)
+	}
+	if s.Fingerprint != "D9A82D2F9C2F65A18407B1D2B764F130847F8B5D" {
+		t.Errorf("Unexpected observed fingerprint %q.", s.Fingerprint)
+	}
+
+	s = NewTorEventState("$10A6CD36A537FCE513A322361547444B393989F0")
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0 LAUNCHED ID=69")
+	s.Feed("650 ORCONN $10A6CD36A537FCE513A322361547444B393989F0~Unnamed CONNECTED ID=69")
+	if s.State != BridgeStatePending {
+		t.Errorf("Bridge with expected fingerprint must not fail: %+v", s)
+	}
+}
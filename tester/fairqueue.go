@@ -0,0 +1,144 @@
+package tester
+
+import (
+	"time"
+)
+
+const (
+	// FairQueueQuantum is the number of bridge lines that a client with a
+	// weight of 1 may have tested per round of our deficit round-robin.  It
+	// must not be smaller than MaxBridgesPerReq, or requests of clients with
+	// a weight of 1 may never fit into their deficit.
+	FairQueueQuantum = MaxBridgesPerReq
+	// DefaultWeight is the scheduling weight of clients that didn't
+	// configure one.
+	DefaultWeight = 1
+)
+
+// FairQueue implements deficit round-robin scheduling of test requests.  Each
+// client has its own queue and a deficit counter.  When it's a client's turn,
+// its deficit grows by FairQueueQuantum times the client's weight, and the
+// client may dispatch requests for as long as their size (in bridge lines)
+// fits into its deficit.  Over time, clients therefore get test capacity in
+// proportion to their weight, regardless of how they size their requests.
+//
+// FairQueue is not safe for concurrent use.
+type FairQueue struct {
+	queues   map[string][]*TestRequest
+	deficits map[string]int
+	// active contains the clients that have queued requests, in the order
+	// in which we serve them.
+	active []string
+	// cur is the index of the client in active whose turn it is.
+	cur int
+	// granted is true if the current client already received its quantum
+	// this round.
+	granted bool
+	len     int
+}
+
+// NewFairQueue returns a new, empty fair queue.
+func NewFairQueue() *FairQueue {
+	return &FairQueue{
+		queues:   make(map[string][]*TestRequest),
+		deficits: make(map[string]int),
+	}
+}
+
+// Len returns the number of queued requests.
+func (q *FairQueue) Len() int {
+	return q.len
+}
+
+// Push adds the given request to the queue of the request's client.
+func (q *FairQueue) Push(req *TestRequest) {
+
+	if req.queued.IsZero() {
+		req.queued = time.Now()
+	}
+	if _, exists := q.queues[req.Client]; !exists {
+		q.active = append(q.active, req.Client)
+	}
+	q.queues[req.Client] = append(q.queues[req.Client], req)
+	q.len++
+}
+
+// Oldest returns the time at which our oldest queued request was queued, or
+// the zero time if the queue is empty.
+func (q *FairQueue) Oldest() time.Time {
+
+	var oldest time.Time
+	// Each client's queue is in FIFO order, so we only need to look at the
+	// head of each queue.
+	for _, queue := range q.queues {
+		if oldest.IsZero() || queue[0].queued.Before(oldest) {
+			oldest = queue[0].queued
+		}
+	}
+	return oldest
+}
+
+// advance passes the turn to the next client.
+func (q *FairQueue) advance() {
+
+	q.granted = false
+	if len(q.active) > 0 {
+		q.cur = (q.cur + 1) % len(q.active)
+	}
+}
+
+// Pop returns the next request according to our deficit round-robin, or nil
+// if no request can be dispatched.  The given function tells us if a request
+// can be dispatched right now, e.g., because an idle Tor instance supports its
+// transports.  Clients whose next request can't be dispatched are skipped
+// without receiving their quantum, so they don't accumulate a deficit while
+// waiting.  We only give up once none of our clients' next requests can be
+// dispatched.  A client whose next request can be dispatched but doesn't fit
+// into its deficit passes the turn, and receives another quantum when its
+// turn comes again, so we always find a request eventually.
+func (q *FairQueue) Pop(ready func(*TestRequest) bool) *TestRequest {
+
+	for unready := 0; unready < len(q.active); {
+		client := q.active[q.cur]
+		head := q.queues[client][0]
+		if !ready(head) {
+			q.advance()
+			unready++
+			continue
+		}
+
+		if !q.granted {
+			weight := head.Weight
+			if weight < DefaultWeight {
+				weight = DefaultWeight
+			}
+			q.deficits[client] += FairQueueQuantum * weight
+			q.granted = true
+		}
+
+		cost := len(head.BridgeLines)
+		if cost > q.deficits[client] {
+			q.advance()
+			unready = 0
+			continue
+		}
+
+		q.deficits[client] -= cost
+		q.queues[client] = q.queues[client][1:]
+		q.len--
+		if len(q.queues[client]) == 0 {
+			// The client has no more requests, so it leaves the round and
+			// forfeits its deficit.
+			delete(q.queues, client)
+			delete(q.deficits, client)
+			q.active = append(q.active[:q.cur], q.active[q.cur+1:]...)
+			q.granted = false
+			if q.cur >= len(q.active) {
+				q.cur = 0
+			}
+		}
+		return head
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package tester
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func makeRequest(client string, weight, numBridges int) *TestRequest {
+
+	req := &TestRequest{Client: client, Weight: weight}
+	for i := 0; i < numBridges; i++ {
+		req.BridgeLines = append(req.BridgeLines, fmt.Sprintf("1.2.3.4:%d", i+1))
+	}
+	return req
+}
+
+func alwaysReady(*TestRequest) bool { return true }
+
+func TestFairQueueWeights(t *testing.T) {
+
+	q := NewFairQueue()
+	for i := 0; i < 100; i++ {
+		q.Push(makeRequest("rdsys", 3, MaxBridgesPerReq))
+		q.Push(makeRequest("user", 1, MaxBridgesPerReq))
+	}
+	if q.Len() != 200 {
+		t.Fatalf("Expected 200 queued requests but got %d.", q.Len())
+	}
+
+	// While both clients are backlogged, rdsys must get three times the
+	// capacity of user.
+	served := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		req := q.Pop(alwaysReady)
+		if req == nil {
+			t.Fatalf("Fair queue unexpectedly returned no request.")
+		}
+		served[req.Client] += len(req.BridgeLines)
+	}
+	if served["rdsys"] != 3*served["user"] {
+		t.Errorf("Expected 3:1 share but got %d:%d.", served["rdsys"], served["user"])
+	}
+}
+
+func TestFairQueueNoStarvation(t *testing.T) {
+
+	q := NewFairQueue()
+	for i := 0; i < 200; i++ {
+		q.Push(makeRequest("rdsys", 100, MaxBridgesPerReq))
+	}
+	q.Push(makeRequest("user", 1, 1))
+
+	// Despite its massive weight, rdsys must not starve our interactive user.
+	for i := 0; i < 101; i++ {
+		req := q.Pop(alwaysReady)
+		if req == nil {
+			t.Fatalf("Fair queue unexpectedly returned no request.")
+		}
+		if req.Client == "user" {
+			return
+		}
+	}
+	t.Errorf("Interactive user was starved.")
+}
+
+func TestFairQueueNotReady(t *testing.T) {
+
+	q := NewFairQueue()
+	if req := q.Pop(alwaysReady); req != nil {
+		t.Errorf("Empty fair queue returned a request.")
+	}
+
+	blocked := makeRequest("blocked", 1, 1)
+	q.Push(blocked)
+	q.Push(makeRequest("user", 1, 1))
+
+	req := q.Pop(func(r *TestRequest) bool { return r != blocked })
+	if req == nil || req.Client != "user" {
+		t.Errorf("Fair queue failed to skip request that isn't ready.")
+	}
+	if req = q.Pop(func(r *TestRequest) bool { return r != blocked }); req != nil {
+		t.Errorf("Fair queue returned request that isn't ready.")
+	}
+	if req = q.Pop(alwaysReady); req != blocked || q.Len() != 0 {
+		t.Errorf("Fair queue failed to return request once it was ready.")
+	}
+}
+
+func TestFairQueueLeftoverDeficit(t *testing.T) {
+
+	// After its first request, the client's leftover deficit of 40 bridge
+	// lines doesn't cover its second request.  It must get another quantum
+	// instead of leaving its request stuck in the queue.
+	q := NewFairQueue()
+	q.Push(makeRequest("user", 1, 60))
+	q.Push(makeRequest("user", 1, 60))
+	for i := 0; i < 2; i++ {
+		if req := q.Pop(alwaysReady); req == nil {
+			t.Fatalf("Fair queue returned no request with %d ready request(s) queued.", q.Len())
+		}
+	}
+
+	// The same must hold while other clients' requests aren't ready.
+	blocked := makeRequest("blocked", 1, 1)
+	q.Push(blocked)
+	q.Push(makeRequest("user", 1, 60))
+	q.Push(makeRequest("user", 1, 60))
+	notBlocked := func(r *TestRequest) bool { return r != blocked }
+	for i := 0; i < 2; i++ {
+		if req := q.Pop(notBlocked); req == nil || req.Client != "user" {
+			t.Fatalf("Fair queue returned %v with ready requests queued.", req)
+		}
+	}
+	if req := q.Pop(notBlocked); req != nil {
+		t.Errorf("Fair queue returned request that isn't ready.")
+	}
+}
+
+func TestFairQueueOldest(t *testing.T) {
+
+	q := NewFairQueue()
+	if !q.Oldest().IsZero() {
+		t.Errorf("Empty fair queue has an oldest request.")
+	}
+
+	old := makeRequest("user", 1, 1)
+	old.queued = time.Now().Add(-time.Hour)
+	q.Push(makeRequest("rdsys", 1, 1))
+	q.Push(old)
+	if !q.Oldest().Equal(old.queued) {
+		t.Errorf("Fair queue failed to return time of oldest request.")
+	}
+}
@@ -0,0 +1,110 @@
+package tester
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// bootstrapProgress captures the progress in Tor's bootstrap status, e.g.,
+// "650 STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"".
+var bootstrapProgress = regexp.MustCompile(`BOOTSTRAP PROGRESS=([0-9]{1,3})`)
+
+// InstanceHealth tells load balancers and operators if a Tor instance can
+// test bridges.
+type InstanceHealth struct {
+	Name string `json:"name"`
+	// Bootstrap is the Tor process's bootstrap progress in percent.
+	Bootstrap int `json:"bootstrap"`
+	// ControlAlive is true if our control connection to the Tor process
+	// works.
+	ControlAlive bool `json:"control_alive"`
+	// Ready is true if the Tor process bootstrapped and our control
+	// connection works.
+	Ready bool `json:"ready"`
+	// EventReaderRestarts is the number of times that we restarted our
+	// control connection because our event reader appeared stuck, and
+	// LastEventReaderRestart is the time of the latest restart.
+	EventReaderRestarts    int64      `json:"event_reader_restarts"`
+	LastEventReaderRestart *time.Time `json:"last_event_reader_restart,omitempty"`
+	// ClockSkew is our clock's skew in seconds as far as the Tor process
+	// can tell, and ClockSkewed is true if it exceeds MaxClockSkew, which
+	// makes us consider bridge failures inconclusive.
+	ClockSkew   float64 `json:"clock_skew"`
+	ClockSkewed bool    `json:"clock_skewed"`
+}
+
+// observeBootstrap updates our Tor process's bootstrap progress if the given
+// event line contains it.
+func (c *TorContext) observeBootstrap(line string) {
+
+	matches := bootstrapProgress.FindStringSubmatch(line)
+	if len(matches) != 2 {
+		return
+	}
+	progress, err := strconv.Atoi(matches[1])
+	if err != nil || progress > 100 {
+		return
+	}
+	if old := atomic.SwapInt32(&c.bootstrap, int32(progress)); old != int32(progress) && progress == 100 {
+		log.Printf("%s: Tor finished bootstrapping.", c.Name)
+	}
+}
+
+// learnBootstrap asks our Tor process for its current bootstrap progress,
+// which we otherwise only learn from STATUS_CLIENT events.  The caller must
+// hold our lock.
+func (c *TorContext) learnBootstrap() {
+
+	phase, err := c.queryInfo("status/bootstrap-phase")
+	if err != nil {
+		log.Printf("%s: Failed to learn bootstrap progress: %s", c.Name, err)
+		return
+	}
+	c.observeBootstrap(phase)
+}
+
+// setControlAlive records if our control connection works.
+func (c *TorContext) setControlAlive(alive bool) {
+
+	var value int32
+	if alive {
+		value = 1
+	}
+	atomic.StoreInt32(&c.ctrlAlive, value)
+}
+
+// Health tells if our Tor instance can test bridges.
+func (c *TorContext) Health() *InstanceHealth {
+
+	h := &InstanceHealth{
+		Name:         c.Name,
+		Bootstrap:    int(atomic.LoadInt32(&c.bootstrap)),
+		ControlAlive: atomic.LoadInt32(&c.ctrlAlive) == 1,
+	}
+	h.Ready = h.Bootstrap == 100 && h.ControlAlive
+	h.ClockSkew = c.ClockSkew().Seconds()
+	h.ClockSkewed = exceedsMaxSkew(c.ClockSkew())
+	h.EventReaderRestarts = atomic.LoadInt64(&c.readerRestarts)
+	if last := atomic.LoadInt64(&c.lastReaderRestart); last != 0 {
+		t := time.Unix(0, last).UTC()
+		h.LastEventReaderRestart = &t
+	}
+	return h
+}
+
+// Health returns the health of each of our Tor instances, and true if at
+// least one of them is ready to test bridges.
+func (p *TorPool) Health() ([]*InstanceHealth, bool) {
+
+	ready := false
+	health := []*InstanceHealth{}
+	for _, c := range p.Instances {
+		h := c.Health()
+		ready = ready || h.Ready
+		health = append(health, h)
+	}
+	return health, ready
+}
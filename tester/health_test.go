@@ -0,0 +1,45 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+
+	c := &TorContext{Name: "tor0"}
+	if h := c.Health(); h.Ready || h.Bootstrap != 0 {
+		t.Errorf("Fresh instance must not be ready: %+v", h)
+	}
+
+	c.observeBootstrap(`650 STATUS_CLIENT NOTICE BOOTSTRAP PROGRESS=75 TAG=enough_dirinfo SUMMARY="Loaded enough directory info to build circuits"`)
+	c.observeBootstrap(`650 ORCONN $0123456789ABCDEF0123456789ABCDEF01234567 CONNECTED ID=1`)
+	c.setControlAlive(true)
+	if h := c.Health(); h.Ready || h.Bootstrap != 75 || !h.ControlAlive {
+		t.Errorf("Unexpected health while bootstrapping: %+v", h)
+	}
+
+	// Responses to "GETINFO status/bootstrap-phase" look like events.
+	c.observeBootstrap(`NOTICE BOOTSTRAP PROGRESS=100 TAG=done SUMMARY="Done"`)
+	if h := c.Health(); !h.Ready || h.Bootstrap != 100 {
+		t.Errorf("Bootstrapped instance must be ready: %+v", h)
+	}
+
+	c.setControlAlive(false)
+	pool := NewTorPool(c, &TorContext{})
+	if health, ready := pool.Health(); ready || len(health) != 2 {
+		t.Errorf("Pool without working control connection must not be ready: %v", health)
+	}
+	c.setControlAlive(true)
+	if _, ready := pool.Health(); !ready {
+		t.Errorf("Pool with a ready instance must be ready.")
+	}
+
+	// Our watchdog's restarts of a stuck event reader must show up.
+	if h := c.Health(); h.EventReaderRestarts != 0 || h.LastEventReaderRestart != nil {
+		t.Errorf("Fresh instance reports event reader restarts: %+v", h)
+	}
+	c.restartController("test")
+	if h := c.Health(); h.EventReaderRestarts != 1 || h.LastEventReaderRestart == nil {
+		t.Errorf("Event reader restart isn't reported: %+v", h)
+	}
+}
@@ -0,0 +1,396 @@
+package tester
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	PrometheusNamespace = "bridgestrap"
+)
+
+// Metrics contains the Prometheus metrics of our Tor instances and their
+// scheduler.
+type Metrics struct {
+	PendingReqs    prometheus.Gauge
+	BackgroundReqs prometheus.Gauge
+	ExpeditedReqs  prometheus.Gauge
+	PendingEvents  prometheus.Gauge
+	TorTestTime    prometheus.Histogram
+	Events         *prometheus.CounterVec
+	OrConnFailures *prometheus.CounterVec
+	TorInfo        *prometheus.GaugeVec
+
+	Wakeups        *prometheus.CounterVec
+	WakeupVerdicts *prometheus.CounterVec
+
+	InstanceLoad        *prometheus.GaugeVec
+	InstancePendingReqs *prometheus.GaugeVec
+	InstanceTests       *prometheus.CounterVec
+
+	InFlightBridges    *prometheus.GaugeVec
+	InFlightTransports *prometheus.GaugeVec
+	OldestQueuedAge    prometheus.GaugeFunc
+
+	MissingProtocols *prometheus.CounterVec
+	StageCache       *prometheus.CounterVec
+
+	BridgeTestTime   *prometheus.HistogramVec
+	BridgeTestEvents *prometheus.CounterVec
+	QueueWaitTime    *prometheus.HistogramVec
+	BatchSize        prometheus.Histogram
+
+	ControllerReconnects *prometheus.CounterVec
+	EventStalls          *prometheus.CounterVec
+	EventReaderRestarts  *prometheus.CounterVec
+	ClockSkew            *prometheus.GaugeVec
+	TorRestarts          *prometheus.CounterVec
+	DeadlineExtensions   *prometheus.CounterVec
+	ControllerCommands   *prometheus.CounterVec
+	PluginAvailable      *prometheus.GaugeVec
+}
+
+// metrics always exists, so the tester works regardless of whether its
+// embedder registers our metrics.
+var metrics = newMetrics()
+
+// RegisterMetrics registers our Prometheus metrics with the given registerer.
+// Call it after setting TorTestTimeout, which determines the buckets of our
+// test time histograms.
+func RegisterMetrics(reg prometheus.Registerer) error {
+
+	metrics.TorTestTime = newTorTestTime()
+	metrics.BridgeTestTime = newBridgeTestTime()
+	for _, c := range []prometheus.Collector{
+		metrics.PendingReqs,
+		metrics.BackgroundReqs,
+		metrics.ExpeditedReqs,
+		metrics.PendingEvents,
+		metrics.TorTestTime,
+		metrics.Events,
+		metrics.OrConnFailures,
+		metrics.TorInfo,
+		metrics.Wakeups,
+		metrics.WakeupVerdicts,
+		metrics.InstanceLoad,
+		metrics.InstancePendingReqs,
+		metrics.InstanceTests,
+		metrics.InFlightBridges,
+		metrics.InFlightTransports,
+		metrics.OldestQueuedAge,
+		metrics.MissingProtocols,
+		metrics.StageCache,
+		metrics.BridgeTestTime,
+		metrics.BridgeTestEvents,
+		metrics.QueueWaitTime,
+		metrics.BatchSize,
+		metrics.ControllerReconnects,
+		metrics.EventStalls,
+		metrics.EventReaderRestarts,
+		metrics.ClockSkew,
+		metrics.TorRestarts,
+		metrics.DeadlineExtensions,
+		metrics.ControllerCommands,
+		metrics.PluginAvailable,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testTimeBuckets returns histogram buckets that cover TorTestTimeout.
+func testTimeBuckets() []float64 {
+
+	buckets := []float64{}
+	for i := 0.5; i < TorTestTimeout.Seconds(); i *= 2 {
+		buckets = append(buckets, i)
+	}
+	return append(buckets, TorTestTimeout.Seconds()+1)
+}
+
+// newTorTestTime returns a histogram of test times whose buckets cover
+// TorTestTimeout.
+func newTorTestTime() prometheus.Histogram {
+
+	return prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "tor_test_time",
+		Help:      "The time it took to finish bridge tests",
+		Buckets:   testTimeBuckets(),
+	})
+}
+
+// newBridgeTestTime returns a histogram of per-bridge test times, per
+// transport, whose buckets cover TorTestTimeout.
+func newBridgeTestTime() *prometheus.HistogramVec {
+
+	return prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "bridge_test_seconds",
+			Help:      "The time from the start of a bridge's batch until we had the bridge's verdict, per transport",
+			Buckets:   testTimeBuckets(),
+		},
+		[]string{"transport"},
+	)
+}
+
+// newMetrics returns our (unregistered) Prometheus metrics.
+func newMetrics() *Metrics {
+
+	m := &Metrics{}
+
+	m.PendingReqs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "pending_requests",
+		Help:      "The number of pending requests",
+	})
+
+	m.BackgroundReqs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "pending_background_requests",
+		Help:      "The number of pending background requests, which wait until Tor instances are otherwise idle",
+	})
+
+	m.ExpeditedReqs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "pending_expedited_requests",
+		Help:      "The number of pending expedited background requests, which wait until Tor instances are otherwise idle but go before other background requests",
+	})
+
+	m.PendingEvents = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "pending_events",
+		Help:      "The number of pending Tor controller events",
+	})
+
+	m.Events = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_events_total",
+			Help:      "The number of Tor events",
+		},
+		[]string{"type", "status"},
+	)
+
+	m.OrConnFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "orconn_failures_total",
+			Help:      "The number of failed ORCONN events of the bridges that we tested, per reason, e.g., \"CONNECTREFUSED\"",
+		},
+		[]string{"reason"},
+	)
+
+	m.TorInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_info",
+			Help:      "The version of each Tor instance, as a constant 1 labelled by version",
+		},
+		[]string{"instance", "version"},
+	)
+
+	m.Wakeups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_wakeups_total",
+			Help:      "The number of times that a Tor instance was dormant when we asked it to test bridges",
+		},
+		[]string{"instance"},
+	)
+
+	m.WakeupVerdicts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_test_verdicts_total",
+			Help:      "The verdicts of Tor tests, by whether the test immediately followed a wakeup from dormant mode",
+		},
+		[]string{"after_wakeup", "verdict"},
+	)
+
+	m.InstanceLoad = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "instance_load",
+			Help:      "The number of bridge lines that a Tor instance is testing or has queued",
+		},
+		[]string{"instance"},
+	)
+
+	m.InstancePendingReqs = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "instance_pending_requests",
+			Help:      "The number of pending requests per Tor instance",
+		},
+		[]string{"instance"},
+	)
+
+	m.InstanceTests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "instance_tests_total",
+			Help:      "The number of test requests that a Tor instance finished",
+		},
+		[]string{"instance"},
+	)
+
+	m.InFlightBridges = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "in_flight_bridges",
+			Help:      "The number of bridges that a Tor instance is currently testing",
+		},
+		[]string{"instance"},
+	)
+
+	m.InFlightTransports = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "in_flight_transports",
+			Help:      "The number of bridges currently being tested, per transport",
+		},
+		[]string{"transport"},
+	)
+
+	m.OldestQueuedAge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "oldest_queued_request_age_seconds",
+			Help:      "The age of the oldest request in the scheduler's queue, or 0 if the queue is empty",
+		},
+		func() float64 {
+			queued := atomic.LoadInt64(&oldestQueued)
+			if queued == 0 {
+				return 0
+			}
+			return time.Since(time.Unix(0, queued)).Seconds()
+		},
+	)
+
+	m.MissingProtocols = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "bridges_missing_protocols_total",
+			Help:      "The number of functional bridges that lack a subprotocol version that's going to be required",
+		},
+		[]string{"protocol"},
+	)
+
+	m.StageCache = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "stage_cache_total",
+			Help:      "The number of stage cache hits and misses, per pipeline stage",
+		},
+		[]string{"stage", "type"},
+	)
+
+	m.BridgeTestEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "bridge_test_events_total",
+			Help:      "The number of Tor events that belonged to bridge tests, per transport",
+		},
+		[]string{"transport"},
+	)
+
+	m.QueueWaitTime = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "queue_wait_seconds",
+			Help:      "The time that test requests waited between entering our scheduler's queue and the start of their test, per queue",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+		},
+		[]string{"queue"},
+	)
+
+	m.BatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: PrometheusNamespace,
+		Name:      "batch_size",
+		Help:      "The number of bridge lines in the batches that our Tor instances tested",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, MaxBridgesPerReq},
+	})
+
+	m.ControllerReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_controller_reconnects_total",
+			Help:      "The number of times that we re-established a Tor instance's control connection, by whether we succeeded",
+		},
+		[]string{"instance", "status"},
+	)
+
+	m.EventStalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_event_stalls_total",
+			Help:      "The number of times that a Tor instance sent no events for EventStallTimeout while testing bridges",
+		},
+		[]string{"instance"},
+	)
+
+	m.EventReaderRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_event_reader_restarts_total",
+			Help:      "The number of times that we restarted a Tor instance's control connection because its event reader appeared stuck",
+		},
+		[]string{"instance"},
+	)
+
+	m.ClockSkew = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_clock_skew_seconds",
+			Help:      "The skew of our clock as far as a Tor instance can tell, positive if our clock is ahead",
+		},
+		[]string{"instance"},
+	)
+
+	m.TorRestarts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "tor_restarts_total",
+			Help:      "The number of times that we restarted a Tor instance after its process died, by whether we succeeded",
+		},
+		[]string{"instance", "status"},
+	)
+
+	m.DeadlineExtensions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "deadline_extensions_total",
+			Help:      "The number of bridges whose test deadline we extended because they made progress shortly before it, by their eventual verdict",
+		},
+		[]string{"verdict"},
+	)
+
+	m.ControllerCommands = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "controller_commands_total",
+			Help:      "The number of control port commands that we issued, by Tor instance, command, and whether Tor accepted them",
+		},
+		[]string{"instance", "command", "status"},
+	)
+
+	m.PluginAvailable = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: PrometheusNamespace,
+			Name:      "plugin_available",
+			Help:      "Whether the plugin of a transport ran when we probed it at startup (1) or not (0)",
+		},
+		[]string{"transport"},
+	)
+
+	m.TorTestTime = newTorTestTime()
+	m.BridgeTestTime = newBridgeTestTime()
+
+	return m
+}
@@ -0,0 +1,107 @@
+package tester
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Origin describes the network location that bridgestrap tests bridges from.
+// Including the origin in our results makes datasets that combine results of
+// several bridgestrap deployments self-describing.
+type Origin struct {
+	ASN     string `json:"asn,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// NewOrigin returns a new origin for the given ASN and country, or nil if
+// both are empty.
+func NewOrigin(asn, country string) *Origin {
+
+	asn = strings.ToUpper(strings.TrimSpace(asn))
+	if asn != "" && !strings.HasPrefix(asn, "AS") {
+		asn = "AS" + asn
+	}
+	country = strings.ToLower(strings.TrimSpace(country))
+	if asn == "" && country == "" {
+		return nil
+	}
+	return &Origin{ASN: asn, Country: country}
+}
+
+// getInfo issues a GETINFO command for the given key to our Tor instance and
+// returns the value.
+func (c *TorContext) getInfo(key string) (string, error) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	return c.queryInfo(key)
+}
+
+// queryInfo is like getInfo but expects the caller to hold our lock.
+func (c *TorContext) queryInfo(key string) (string, error) {
+
+	resp, err := c.request("GETINFO %s", key)
+	if err != nil {
+		return "", err
+	}
+	return parseInfo(resp.Data, key)
+}
+
+// parseInfo extracts the value of the given key from the data of a GETINFO
+// response.  Single-line values follow the key on the same line, e.g.,
+// "version=0.4.5.7".  Multi-line values, e.g., descriptors, follow an empty
+// "key=" line as separate data element.
+func parseInfo(data []string, key string) (string, error) {
+
+	prefix := key + "="
+	for i, line := range data {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		value := strings.TrimPrefix(line, prefix)
+		if value == "" && i+1 < len(data) {
+			value = data[i+1]
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("GETINFO response contains no value for %q", key)
+}
+
+// isDormant returns true if our Tor instance is in dormant mode.  If we fail
+// to find out, we assume that it isn't.  The caller must hold our lock.
+func (c *TorContext) isDormant() bool {
+
+	dormant, err := c.queryInfo("dormant")
+	if err != nil {
+		log.Printf("%s: Failed to learn if Tor is dormant: %s", c.Name, err)
+		return false
+	}
+	return dormant == "1"
+}
+
+// Version returns the version of our Tor instance, e.g., "0.4.5.7".
+func (c *TorContext) Version() (string, error) {
+
+	return c.getInfo("version")
+}
+
+// DetectCountry asks our Tor instance for our public IP address, and then
+// uses Tor's GeoIP database to determine the country that the address is
+// located in.
+func (c *TorContext) DetectCountry() (string, error) {
+
+	addr, err := c.getInfo("address")
+	if err != nil {
+		return "", fmt.Errorf("failed to learn our IP address: %v", err)
+	}
+	country, err := c.getInfo("ip-to-country/" + addr)
+	if err != nil {
+		return "", fmt.Errorf("failed to map our IP address to country: %v", err)
+	}
+	if country == "??" || country == "" {
+		return "", fmt.Errorf("our IP address is not in Tor's GeoIP database")
+	}
+	return country, nil
+}
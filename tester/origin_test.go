@@ -0,0 +1,39 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestNewOrigin(t *testing.T) {
+
+	if o := NewOrigin("", " "); o != nil {
+		t.Errorf("Expected nil origin for empty ASN and country.")
+	}
+
+	o := NewOrigin("3320", "DE")
+	if o == nil || o.ASN != "AS3320" || o.Country != "de" {
+		t.Errorf("Failed to normalise origin: %+v", o)
+	}
+
+	o = NewOrigin("as3320", "")
+	if o == nil || o.ASN != "AS3320" || o.Country != "" {
+		t.Errorf("Failed to normalise origin: %+v", o)
+	}
+}
+
+func TestParseInfo(t *testing.T) {
+
+	value, err := parseInfo([]string{"version=0.4.5.7", "OK"}, "version")
+	if err != nil || value != "0.4.5.7" {
+		t.Errorf("Failed to parse single-line value: %q (%v)", value, err)
+	}
+
+	value, err = parseInfo([]string{"desc/id/ABCD=", "router foo\nproto Link=1-5"}, "desc/id/ABCD")
+	if err != nil || value != "router foo\nproto Link=1-5" {
+		t.Errorf("Failed to parse multi-line value: %q (%v)", value, err)
+	}
+
+	if _, err = parseInfo([]string{"foo=bar"}, "version"); err == nil {
+		t.Errorf("Failed to reject response without our key.")
+	}
+}
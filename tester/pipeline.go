@@ -0,0 +1,235 @@
+package tester
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// StageValidate checks if a bridge line is syntactically valid.
+	StageValidate = "validate"
+	// StageTCP checks if a bridge's endpoint accepts TCP connections.
+	StageTCP = "tcp"
+	// StagePT checks if a bridge completes a pluggable transport handshake.
+	StagePT = "pt"
+	// StageTor checks if Tor can fetch a bridge's descriptor.
+	StageTor = "tor"
+	// StageCircuit checks if Tor can build a circuit through a bridge whose
+	// descriptor it fetched.  It's slow, so we only run it if a client asks
+	// for it.
+	StageCircuit = "circuit"
+)
+
+// SnowflakeTransport is the name of the snowflake transport.
+const SnowflakeTransport = "snowflake"
+
+// brokeredTransports contains the transports whose bridge lines contain a
+// placeholder address because clients reach the bridge via a broker rather
+// than directly.  Our TCP and pluggable transport stages can't test these
+// bridges, so only Tor can.
+var brokeredTransports = map[string]bool{SnowflakeTransport: true}
+
+// StageOrder determines the order of our test pipeline.  A bridge that fails
+// a stage doesn't proceed to the next one.
+var StageOrder = []string{StageValidate, StageTCP, StagePT, StageTor, StageCircuit}
+
+// DefaultStages are the stages that we run unless a client asks for others.
+var DefaultStages = []string{StageValidate, StageTor}
+
+// TCPTestTimeout is the amount of time we give a bridge to accept our TCP
+// connection.
+var TCPTestTimeout = 10 * time.Second
+
+// StageResult represents the result of a single stage of our test pipeline.
+type StageResult struct {
+	Stage   string `json:"stage"`
+	Passed  bool   `json:"passed"`
+	Skipped bool   `json:"skipped,omitempty"`
+	// Cached is true if the bridge recently passed the stage, so we didn't
+	// run it again.
+	Cached bool    `json:"cached,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	Time   float64 `json:"time"`
+	// Inconclusive is true if the stage failed because of a problem on our
+	// side, e.g., because we couldn't launch obfs4proxy.
+	Inconclusive bool `json:"-"`
+}
+
+// TesterError represents a test failure that's our fault rather than the
+// bridge's.
+type TesterError struct {
+	Err error
+}
+
+func (e *TesterError) Error() string {
+	return e.Err.Error()
+}
+
+// ResolveStages turns the stages that a client requested into an ordered
+// list of stages.  Validation always runs, the circuit stage implies the Tor
+// stage, and an empty list results in DefaultStages.  If a requested stage doesn't exist, the function returns an
+// error.
+func ResolveStages(requested []string) ([]string, error) {
+
+	if len(requested) == 0 {
+		return DefaultStages, nil
+	}
+
+	wanted := map[string]bool{StageValidate: true}
+	for _, stage := range requested {
+		stage = strings.ToLower(stage)
+		if !HasStage(StageOrder, stage) {
+			return nil, fmt.Errorf("unknown test stage %q", stage)
+		}
+		wanted[stage] = true
+	}
+	if wanted[StageCircuit] {
+		wanted[StageTor] = true
+	}
+
+	stages := []string{}
+	for _, stage := range StageOrder {
+		if wanted[stage] {
+			stages = append(stages, stage)
+		}
+	}
+	return stages, nil
+}
+
+// HasStage returns true if the given list of stages contains the given stage.
+func HasStage(stages []string, stage string) bool {
+
+	for _, s := range stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// TorStageResults returns the results of the stages that Tor ran for the given
+// bridge in the given number of seconds: the Tor stage and, if we built a
+// circuit through the bridge, the circuit stage.
+func TorStageResults(bridgeTest *BridgeTest, seconds float64) []*StageResult {
+
+	if bridgeTest.Circuit == nil {
+		return []*StageResult{&StageResult{
+			Stage:  StageTor,
+			Passed: bridgeTest.Functional,
+			Error:  bridgeTest.Error,
+			Time:   seconds,
+		}}
+	}
+	circuit := &StageResult{Stage: StageCircuit, Passed: bridgeTest.Circuit.Built}
+	if !circuit.Passed {
+		circuit.Error = bridgeTest.Error
+	}
+	return []*StageResult{&StageResult{Stage: StageTor, Passed: true, Time: seconds}, circuit}
+}
+
+// testTCP returns nil if the given addr:port accepts TCP connections.
+func testTCP(addrPort string) error {
+
+	conn, err := net.DialTimeout("tcp", addrPort, TCPTestTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// supportsPTStage returns true if our pluggable transport stage can test
+// bridges of the given transport.
+func supportsPTStage(transport string) bool {
+
+	if pluginFor(transport) == nil {
+		return false
+	}
+	for _, t := range Obfs4proxyTransports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// runStage runs the given stage for the given bridge line and returns its
+// result.  Stages that don't apply to a bridge line (e.g., the pluggable
+// transport stage for vanilla, webtunnel, and meek bridges) are skipped and count as passed.  If
+// the bridge recently passed the stage, we return the cached result instead.
+func runStage(stage, bridgeLine string) *StageResult {
+
+	// Brokered bridges share placeholder addresses, so we must not cache
+	// their stage results.
+	if brokeredTransports[bridgeline.Transport(bridgeLine)] {
+		return &StageResult{Stage: stage, Passed: true, Skipped: true}
+	}
+	if cached := stageCache.Get(stage, bridgeLine); cached != nil {
+		return cached
+	}
+	result := &StageResult{Stage: stage}
+	start := time.Now()
+
+	var err error
+	switch stage {
+	case StageTCP:
+		var endpoint string
+		if endpoint, err = bridgeline.Endpoint(bridgeLine); err == nil {
+			err = testTCP(endpoint)
+		}
+	case StagePT:
+		if !supportsPTStage(bridgeline.Transport(bridgeLine)) {
+			result.Skipped = true
+		} else {
+			err = testPT(bridgeLine)
+		}
+	}
+
+	result.Time = time.Since(start).Seconds()
+	result.Passed = err == nil
+	if err != nil {
+		result.Error = err.Error()
+		_, result.Inconclusive = err.(*TesterError)
+	}
+	stageCache.Add(bridgeLine, result)
+	return result
+}
+
+// RunPreTorStages runs all of the given stages that precede the Tor stage for
+// each of the given bridge lines, in parallel.  For each bridge line, it
+// returns the results of the stages that ran.  A bridge line passed all
+// stages if its last result passed.
+func RunPreTorStages(bridgeLines []string, stages []string) map[string][]*StageResult {
+
+	results := make(map[string][]*StageResult)
+	var l sync.Mutex
+	var wg sync.WaitGroup
+	for _, bridgeLine := range bridgeLines {
+		wg.Add(1)
+		go func(bridgeLine string) {
+			defer wg.Done()
+			// The validation stage already ran before we got here.
+			stageResults := []*StageResult{&StageResult{Stage: StageValidate, Passed: true}}
+			for _, stage := range stages {
+				if stage != StageTCP && stage != StagePT {
+					continue
+				}
+				r := runStage(stage, bridgeLine)
+				stageResults = append(stageResults, r)
+				if !r.Passed {
+					break
+				}
+			}
+			l.Lock()
+			results[bridgeLine] = stageResults
+			l.Unlock()
+		}(bridgeLine)
+	}
+	wg.Wait()
+
+	return results
+}
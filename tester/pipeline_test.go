@@ -0,0 +1,110 @@
+package tester
+
+import (
+	"net"
+	"testing"
+)
+
+func TestResolveStages(t *testing.T) {
+
+	stages, err := ResolveStages(nil)
+	if err != nil || len(stages) != len(DefaultStages) {
+		t.Errorf("Failed to fall back to default stages.")
+	}
+
+	stages, err = ResolveStages([]string{"tor", "TCP"})
+	if err != nil || len(stages) != 3 ||
+		stages[0] != StageValidate || stages[1] != StageTCP || stages[2] != StageTor {
+		t.Errorf("Failed to resolve stages: %v", stages)
+	}
+
+	// The circuit stage builds on the Tor stage.
+	stages, err = ResolveStages([]string{"circuit"})
+	if err != nil || len(stages) != 3 ||
+		stages[0] != StageValidate || stages[1] != StageTor || stages[2] != StageCircuit {
+		t.Errorf("Failed to resolve circuit stage: %v", stages)
+	}
+	if HasStage(DefaultStages, StageCircuit) {
+		t.Errorf("Circuit stage must be opt-in.")
+	}
+
+	if _, err = ResolveStages([]string{"bogus"}); err == nil {
+		t.Errorf("Failed to reject unknown stage.")
+	}
+}
+
+func TestTorStageResults(t *testing.T) {
+
+	results := TorStageResults(&BridgeTest{Error: "timed out"}, 10)
+	if len(results) != 1 || results[0].Stage != StageTor || results[0].Passed || results[0].Error != "timed out" {
+		t.Errorf("Unexpected stage results of failed bridge: %+v", results)
+	}
+
+	bridgeTest := &BridgeTest{Error: "failed to build circuit through bridge", Circuit: &CircuitTest{}}
+	results = TorStageResults(bridgeTest, 10)
+	if len(results) != 2 || !results[0].Passed || results[1].Stage != StageCircuit || results[1].Passed || results[1].Error == "" {
+		t.Errorf("Unexpected stage results of bridge with failed circuit: %+v", results)
+	}
+}
+
+func TestGetPTArgs(t *testing.T) {
+
+	args := getPTArgs("obfs4 1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678 cert=foo;bar iat-mode=0")
+	if args != `cert=foo\;bar;iat-mode=0` {
+		t.Errorf("Unexpected pluggable transport arguments %q.", args)
+	}
+
+	if args = getPTArgs("1.2.3.4:1234"); args != "" {
+		t.Errorf("Expected no pluggable transport arguments but got %q.", args)
+	}
+}
+
+func TestRunPreTorStages(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	reachable := ln.Addr().String()
+	ln.Close()
+	// Now that the listener is closed, nobody's listening on the port.
+	unreachable := reachable
+
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer ln.Close()
+	reachable = ln.Addr().String()
+
+	// Snowflake bridge lines contain a placeholder address, so we must not
+	// try to reach it.
+	snowflake := "snowflake " + unreachable + " 2B280B23E1107BB62ABFC40DDCC8824814F80A72 ice=stun:stun.l.google.com:19302"
+
+	// We must test a webtunnel bridge's URL rather than its placeholder
+	// address.
+	webtunnel := "webtunnel " + unreachable + " url=http://" + reachable + "/secret-path ver=0.0.1"
+
+	results := RunPreTorStages([]string{reachable, unreachable, snowflake, webtunnel}, []string{StageValidate, StageTCP, StagePT})
+
+	r := results[reachable]
+	if len(r) != 3 || !r[1].Passed || !r[2].Skipped || !r[2].Passed {
+		t.Errorf("Unexpected stage results for reachable vanilla bridge.")
+	}
+
+	// The unreachable bridge must not proceed to the PT stage.
+	r = results[unreachable]
+	if len(r) != 2 || r[1].Stage != StageTCP || r[1].Passed || r[1].Error == "" {
+		t.Errorf("Unexpected stage results for unreachable bridge.")
+	}
+
+	r = results[snowflake]
+	if len(r) != 3 || !r[1].Skipped || !r[1].Passed || !r[2].Skipped || !r[2].Passed {
+		t.Errorf("Unexpected stage results for snowflake bridge.")
+	}
+
+	r = results[webtunnel]
+	if len(r) != 3 || !r[1].Passed || r[1].Skipped || !r[2].Skipped {
+		t.Errorf("Unexpected stage results for webtunnel bridge.")
+	}
+}
@@ -0,0 +1,183 @@
+package tester
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+// pluginTransport matches the transport names that tor accepts in its
+// ClientTransportPlugin option.
+var pluginTransport = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Plugin maps transports to the client executable that implements them, like
+// tor's ClientTransportPlugin option.
+type Plugin struct {
+	Transports []string
+	Binary     string
+	Args       []string
+}
+
+// ConfiguredPlugins are the plugins that the operator configured, e.g., to
+// test obfs4 bridges with lyrebird.  They take precedence over our built-in
+// plugins for their transports, and if several of them implement the same
+// transport, the last one wins.  Once our Tor instances run, only change them
+// with SetPlugins.
+var ConfiguredPlugins []*Plugin
+
+// pluginLock protects ConfiguredPlugins, which we may change at runtime.
+var pluginLock sync.RWMutex
+
+// SetPlugins replaces ConfiguredPlugins, e.g., when we reload our
+// configuration.  Use TorPool.ReloadPlugins to tell running Tor instances.
+func SetPlugins(plugins []*Plugin) {
+
+	pluginLock.Lock()
+	defer pluginLock.Unlock()
+
+	ConfiguredPlugins = plugins
+}
+
+// ParsePlugin parses a plugin of the form "TRANSPORT[,TRANSPORT...]=BINARY
+// [ARG...]", e.g., "obfs4,meek_lite=/usr/bin/lyrebird -enableLogging".
+func ParsePlugin(spec string) (*Plugin, error) {
+
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("plugin %q lacks \"=\"", spec)
+	}
+	if strings.ContainsAny(parts[1], "\"\\") {
+		return nil, fmt.Errorf("plugin %q contains forbidden characters", spec)
+	}
+	command := strings.Fields(parts[1])
+	if len(command) == 0 {
+		return nil, fmt.Errorf("plugin %q lacks an executable", spec)
+	}
+	p := &Plugin{Binary: command[0], Args: command[1:]}
+	for _, transport := range strings.Split(parts[0], ",") {
+		transport = strings.ToLower(strings.TrimSpace(transport))
+		if !pluginTransport.MatchString(transport) || transport == bridgeline.VanillaTransport {
+			return nil, fmt.Errorf("invalid transport name %q in plugin %q", transport, spec)
+		}
+		p.Transports = append(p.Transports, transport)
+	}
+	return p, nil
+}
+
+// String returns the plugin in the form that ParsePlugin accepts.
+func (p *Plugin) String() string {
+	return strings.Join(p.Transports, ",") + "=" + p.command()
+}
+
+// command returns the plugin's command line, as it appears in our torrc.
+func (p *Plugin) command() string {
+	return strings.Join(append([]string{p.Binary}, p.Args...), " ")
+}
+
+// builtinPlugins returns the plugins that we use unless the operator
+// configured otherwise.  Plugins whose executable path is empty are disabled.
+func builtinPlugins() []*Plugin {
+
+	return []*Plugin{
+		{Obfs4proxyTransports, Obfs4proxyBinary, []string{"-enableLogging", "-logLevel", "DEBUG"}},
+		{[]string{SnowflakeTransport}, SnowflakeBinary, nil},
+		{[]string{bridgeline.WebtunnelTransport}, WebtunnelBinary, nil},
+		{[]string{bridgeline.MeekTransport}, MeekBinary, nil},
+	}
+}
+
+// Plugins returns the plugins that our Tor instances use: our built-in
+// plugins for the transports that the operator didn't configure, followed by
+// ConfiguredPlugins.  Each transport has at most one plugin.  Plugins whose
+// executable failed our probe (see ProbePlugins) are missing, so we don't
+// offer to test their transports.
+func Plugins() []*Plugin {
+
+	pluginLock.RLock()
+	defer pluginLock.RUnlock()
+
+	return resolvePlugins(false)
+}
+
+// resolvePlugins implements Plugins.  If all is true, it includes plugins
+// whose executable failed our probe.  The caller must hold pluginLock.
+func resolvePlugins(all bool) []*Plugin {
+
+	owner := make(map[string]*Plugin)
+	for _, p := range ConfiguredPlugins {
+		for _, transport := range p.Transports {
+			owner[transport] = p
+		}
+	}
+
+	plugins := []*Plugin{}
+	for _, p := range append(builtinPlugins(), ConfiguredPlugins...) {
+		if p.Binary == "" {
+			continue
+		}
+		if probe, exists := pluginProbes[p.Binary]; exists && !all && probe.err != nil {
+			continue
+		}
+		transports := []string{}
+		for _, transport := range p.Transports {
+			if o, exists := owner[transport]; !exists || o == p {
+				transports = append(transports, transport)
+			}
+		}
+		if len(transports) > 0 {
+			plugins = append(plugins, &Plugin{transports, p.Binary, p.Args})
+		}
+	}
+	return plugins
+}
+
+// pluginFor returns the plugin that implements the given transport, or nil if
+// we have none.
+func pluginFor(transport string) *Plugin {
+
+	for _, p := range Plugins() {
+		for _, t := range p.Transports {
+			if t == transport {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// ReloadPlugins tells our Tor instances about our current plugins.  Each
+// instance first finishes the batch of bridges that it's testing, and keeps
+// its queue of test requests.
+func (p *TorPool) ReloadPlugins() error {
+
+	for _, c := range p.Instances {
+		if err := c.reloadPlugins(); err != nil {
+			return fmt.Errorf("%s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// reloadPlugins replaces our Tor instance's ClientTransportPlugin lines.  Tor
+// launches the new plugins when it needs them.
+func (c *TorContext) reloadPlugins() error {
+
+	c.Lock()
+	defer c.Unlock()
+
+	// A SETCONF without value resets the option, i.e., removes all plugins.
+	cmdPieces := []string{"SETCONF"}
+	plugins := Plugins()
+	for _, p := range plugins {
+		cmdPieces = append(cmdPieces, fmt.Sprintf("ClientTransportPlugin=%q",
+			strings.Join(p.Transports, ",")+" exec "+p.command()))
+	}
+	if len(plugins) == 0 {
+		cmdPieces = append(cmdPieces, "ClientTransportPlugin")
+	}
+	_, err := c.request("%s", strings.Join(cmdPieces, " "))
+	return err
+}
@@ -0,0 +1,63 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestParsePlugin(t *testing.T) {
+
+	for _, spec := range []string{"/usr/bin/lyrebird", "obfs4=", "obfs-4=/usr/bin/lyrebird", "vanilla=/bin/true", ",obfs4=/usr/bin/lyrebird"} {
+		if _, err := ParsePlugin(spec); err == nil {
+			t.Errorf("Accepted invalid plugin %q.", spec)
+		}
+	}
+
+	p, err := ParsePlugin("OBFS4, meek_lite=/usr/bin/lyrebird -enableLogging -logLevel DEBUG")
+	if err != nil {
+		t.Fatalf("Failed to parse plugin: %s", err)
+	}
+	if p.String() != "obfs4,meek_lite=/usr/bin/lyrebird -enableLogging -logLevel DEBUG" {
+		t.Errorf("Unexpected plugin: %q", p.String())
+	}
+}
+
+func TestPlugins(t *testing.T) {
+
+	defer func() { ConfiguredPlugins = nil }()
+	lyrebird, _ := ParsePlugin("obfs4,meek_lite=/usr/bin/lyrebird")
+	conjure, _ := ParsePlugin("conjure=/usr/bin/conjure-client -registerURL https://registration.refraction.network/api")
+	builtinHash := PluginsHash()
+	ConfiguredPlugins = []*Plugin{lyrebird, conjure}
+	if PluginsHash() == builtinHash {
+		t.Errorf("Plugins hash doesn't reflect configured plugins.")
+	}
+
+	expected := []string{
+		"obfs2,obfs3,scramblesuit=/usr/bin/obfs4proxy -enableLogging -logLevel DEBUG",
+		"snowflake=/usr/bin/snowflake-client",
+		"webtunnel=/usr/bin/webtunnel-client",
+		"meek=/usr/bin/meek-client",
+		"obfs4,meek_lite=/usr/bin/lyrebird",
+		"conjure=/usr/bin/conjure-client -registerURL https://registration.refraction.network/api",
+	}
+	plugins := Plugins()
+	if len(plugins) != len(expected) {
+		t.Fatalf("Expected %d plugins but got %d.", len(expected), len(plugins))
+	}
+	for i, p := range plugins {
+		if p.String() != expected[i] {
+			t.Errorf("Expected plugin %q but got %q.", expected[i], p.String())
+		}
+	}
+
+	if p := pluginFor("obfs4"); p == nil || p.Binary != "/usr/bin/lyrebird" {
+		t.Errorf("Configured plugin doesn't take precedence over built-in plugin.")
+	}
+	if !TransportAvailable("conjure") || TransportAvailable("foo") {
+		t.Errorf("Unexpected transport availability.")
+	}
+	c := &TorContext{}
+	if !c.SupportsTransport("conjure") {
+		t.Errorf("Tor instance doesn't support configured transport.")
+	}
+}
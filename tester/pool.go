@@ -0,0 +1,414 @@
+package tester
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// DefaultVantage is the vantage point of Tor instances that weren't
+	// configured with one.
+	DefaultVantage = "default"
+	// AllVantages is the vantage point that API clients can request to have
+	// their bridges tested from all of our vantage points.
+	AllVantages = "all"
+)
+
+// oldestQueued holds the time (in nanoseconds since the epoch) at which our
+// scheduler's oldest queued request was queued, or 0 if the queue is empty.
+// We store it separately because Prometheus reads it from another goroutine.
+var oldestQueued int64
+
+// queuedRequests holds the number of requests in our scheduler's fair queue,
+// for the same reason.
+var queuedRequests int64
+
+// QueueLength returns the number of requests that wait in our scheduler's
+// fair queue for an idle Tor instance, not counting background requests.  It's
+// safe to call from any goroutine.
+func QueueLength() int {
+	return int(atomic.LoadInt64(&queuedRequests))
+}
+
+// MaxQueueLength is the number of requests that may wait for our scheduler
+// before we turn away new ones.  Only change it before starting a pool.
+var MaxQueueLength = MaxRequestBacklog
+
+// TorPool represents a pool of Tor instances.  Each instance has its own event
+// reader and request dispatcher, and a scheduler on top of the pool assigns
+// incoming test requests to the least-loaded instance that supports all
+// transports of a given request.  Requests wait in the scheduler's fair queue
+// until an instance is idle, which allows the scheduler to share our test
+// capacity among clients according to their weight.  Background requests wait
+// in a separate queue, and only get dispatched while no other request waits.
+// Expedited background requests wait in a queue of their own, and get
+// dispatched ahead of routine background requests.
+type TorPool struct {
+	Instances    []*TorContext
+	RequestQueue chan *TestRequest
+	queue        *FairQueue
+	expedited    *FairQueue
+	background   *FairQueue
+	// wakeup tells the scheduler that an instance finished a request.
+	wakeup   chan bool
+	shutdown chan bool
+}
+
+// NewTorPool returns a new Tor pool that consists of the given instances.
+func NewTorPool(instances ...*TorContext) *TorPool {
+
+	p := &TorPool{
+		Instances:  instances,
+		queue:      NewFairQueue(),
+		expedited:  NewFairQueue(),
+		background: NewFairQueue(),
+		wakeup:     make(chan bool, 1),
+	}
+	for i, c := range instances {
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("tor%d", i)
+		}
+		c.finished = p.wakeup
+	}
+	return p
+}
+
+// Start starts all Tor instances in the pool, followed by the scheduler.  If
+// any instance fails to start, the function stops all instances that were
+// already started and returns the error.
+func (p *TorPool) Start() error {
+
+	p.RequestQueue = make(chan *TestRequest, MaxQueueLength)
+	p.shutdown = make(chan bool)
+
+	for i, c := range p.Instances {
+		if err := c.Start(); err != nil {
+			log.Printf("Failed to start Tor instance %s: %s", c.Name, err)
+			for _, started := range p.Instances[:i] {
+				started.Stop()
+			}
+			return err
+		}
+		if version, err := c.Version(); err != nil {
+			log.Printf("Failed to learn version of Tor instance %s: %s", c.Name, err)
+		} else {
+			metrics.TorInfo.With(prometheus.Labels{"instance": c.Name, "version": version}).Set(1)
+		}
+	}
+	go p.scheduler()
+	go p.checkClocks()
+
+	return nil
+}
+
+// Stop stops the scheduler and all Tor instances in the pool.  Errors during
+// cleanup are logged and the last occuring error is returned.
+func (p *TorPool) Stop() error {
+
+	var err error
+	close(p.shutdown)
+	for _, c := range p.Instances {
+		if e := c.Stop(); e != nil {
+			log.Printf("Failed to stop Tor instance %s: %s", c.Name, e)
+			err = e
+		}
+	}
+	return err
+}
+
+// Vantages returns the sorted list of vantage points of our Tor instances,
+// which is empty for a nil pool.
+func (p *TorPool) Vantages() []string {
+
+	if p == nil {
+		return []string{}
+	}
+	seen := make(map[string]bool)
+	vantages := []string{}
+	for _, c := range p.Instances {
+		if !seen[c.GetVantage()] {
+			seen[c.GetVantage()] = true
+			vantages = append(vantages, c.GetVantage())
+		}
+	}
+	sort.Strings(vantages)
+	return vantages
+}
+
+// ResolveVantages turns the vantage points that an API client requested into
+// a list of vantage points that we can test from.  The special vantage point
+// AllVantages expands to all of our vantage points.  If a requested vantage
+// point doesn't exist, the function returns an error.
+func (p *TorPool) ResolveVantages(requested []string) ([]string, error) {
+
+	available := p.Vantages()
+	resolved := []string{}
+	seen := make(map[string]bool)
+	for _, vantage := range requested {
+		vantage = strings.ToLower(vantage)
+		if vantage == AllVantages {
+			return available, nil
+		}
+		found := false
+		for _, v := range available {
+			if v == vantage {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown vantage point %q", vantage)
+		}
+		if !seen[vantage] {
+			seen[vantage] = true
+			resolved = append(resolved, vantage)
+		}
+	}
+	return resolved, nil
+}
+
+// Test hands the given request to our scheduler, waits until one of our Tor
+// instances tested it, and returns the result.  Bridge lines that we failed to
+// test are marked as inconclusive, and so are all bridge lines if the pool is
+// nil or stopped before it tested them, e.g., because a warm standby stepped
+// down while the request was in flight.
+func (p *TorPool) Test(req *TestRequest) *TestResult {
+
+	stopped := NewTestResult()
+	stopped.Error = "test aborted because our Tor instances stopped"
+	if p == nil {
+		completeResult(stopped, req.BridgeLines)
+		return stopped
+	}
+
+	// The result channel is buffered, so our Tor instances never block on
+	// requests that we stopped waiting for.
+	req.resultChan = make(chan *TestResult, 1)
+	result := stopped
+	select {
+	case p.RequestQueue <- req:
+		select {
+		case result = <-req.resultChan:
+		case <-p.shutdown:
+			select {
+			case result = <-req.resultChan:
+			default:
+			}
+		}
+	case <-p.shutdown:
+	}
+	completeResult(result, req.BridgeLines)
+	return result
+}
+
+// QueueDepth returns the number of requests that wait for our scheduler,
+// either in its fair queue or because it hasn't read them yet.  Background
+// requests don't count.
+func (p *TorPool) QueueDepth() int {
+
+	if p == nil {
+		return 0
+	}
+	return QueueLength() + len(p.RequestQueue)
+}
+
+// Full returns true if MaxQueueLength requests wait for our scheduler.  Test
+// would then block, so callers that must not block should turn the request
+// away instead.
+func (p *TorPool) Full() bool {
+	return p.QueueDepth() >= MaxQueueLength
+}
+
+// pickInstance returns the least-loaded Tor instance that supports all
+// transports of the given request's bridge lines and, if the request asks for
+// a specific vantage point, is located at this vantage point.  If no such
+// instance exists, the function returns an error.
+func (p *TorPool) pickInstance(req *TestRequest) (*TorContext, error) {
+
+	var best *TorContext
+	for _, c := range p.Instances {
+		if req.Vantage != "" && req.Vantage != c.GetVantage() {
+			continue
+		}
+		capable := true
+		for _, bridgeLine := range req.BridgeLines {
+			if !c.SupportsTransport(bridgeline.Transport(bridgeLine)) {
+				capable = false
+				break
+			}
+		}
+		if !capable {
+			continue
+		}
+		if best == nil || c.Load() < best.Load() {
+			best = c
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("no tor instance supports the given transports and vantage point")
+	}
+	return best, nil
+}
+
+// isReady returns true if an idle Tor instance can test the given request
+// right now.
+func (p *TorPool) isReady(req *TestRequest) bool {
+
+	c, err := p.pickInstance(req)
+	return err == nil && c.Load() == 0
+}
+
+// queueName returns the name of the scheduler queue that the request waits
+// in, for our metrics.
+func (req *TestRequest) queueName() string {
+
+	switch {
+	case req.Background && req.Expedited:
+		return "expedited"
+	case req.Background:
+		return "background"
+	default:
+		return "default"
+	}
+}
+
+// dispatchQueued assigns queued requests to idle Tor instances, for as long
+// as our fair queue has requests that an idle instance can test.  Once our
+// fair queue is empty, idle instances get to test expedited background
+// requests, followed by routine background requests.
+func (p *TorPool) dispatchQueued() {
+
+	for {
+		req := p.queue.Pop(p.isReady)
+		if req == nil && p.queue.Len() == 0 {
+			req = p.expedited.Pop(p.isReady)
+		}
+		if req == nil && p.queue.Len() == 0 && p.expedited.Len() == 0 {
+			req = p.background.Pop(p.isReady)
+		}
+		if req == nil {
+			break
+		}
+		c, _ := p.pickInstance(req)
+		c.Assign(req)
+	}
+	metrics.BackgroundReqs.Set(float64(p.background.Len()))
+	metrics.ExpeditedReqs.Set(float64(p.expedited.Len()))
+	metrics.PendingReqs.Set(float64(p.queue.Len()))
+	atomic.StoreInt64(&queuedRequests, int64(p.queue.Len()))
+	if oldest := p.queue.Oldest(); oldest.IsZero() {
+		atomic.StoreInt64(&oldestQueued, 0)
+	} else {
+		atomic.StoreInt64(&oldestQueued, oldest.UnixNano())
+	}
+}
+
+// scheduler reads new bridge test requests, adds them to our fair queue, and
+// hands them to the Tor instance that is best suited to test them, once an
+// instance is idle.
+func (p *TorPool) scheduler() {
+	log.Printf("Starting request scheduler for %d Tor instance(s).", len(p.Instances))
+	defer log.Printf("Stopping request scheduler.")
+	for {
+		select {
+		case req := <-p.RequestQueue:
+			// Reject requests that none of our instances can ever test.
+			if _, err := p.pickInstance(req); err != nil {
+				log.Printf("Failed to schedule test request: %s", err)
+				result := NewTestResult()
+				result.Error = err.Error()
+				req.resultChan <- result
+				continue
+			}
+			if req.Background && req.Expedited {
+				p.expedited.Push(req)
+			} else if req.Background {
+				p.background.Push(req)
+			} else {
+				p.queue.Push(req)
+			}
+		case <-p.wakeup:
+		case <-p.shutdown:
+			return
+		}
+		p.dispatchQueued()
+	}
+}
+
+// GetVantage returns the vantage point of the Tor instance.
+func (c *TorContext) GetVantage() string {
+
+	if c.Vantage == "" {
+		return DefaultVantage
+	}
+	return c.Vantage
+}
+
+// SupportsTransport returns true if at least one of our Tor instances is able
+// to test bridges of the given transport.
+func (p *TorPool) SupportsTransport(transport string) bool {
+
+	for _, c := range p.Instances {
+		if c.SupportsTransport(transport) {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsTransport returns true if the Tor instance is able to test bridges
+// of the given transport, and we have a client for the transport.
+func (c *TorContext) SupportsTransport(transport string) bool {
+
+	if !TransportAvailable(transport) {
+		return false
+	}
+	if c.Transports == nil {
+		return true
+	}
+	for _, t := range c.Transports {
+		if t == transport {
+			return true
+		}
+	}
+	return false
+}
+
+// Load returns the number of bridge lines that the Tor instance is currently
+// testing or has queued for testing.
+func (c *TorContext) Load() int64 {
+	return atomic.LoadInt64(&c.load)
+}
+
+// Assign adds the given test request to the Tor instance's request queue.
+func (c *TorContext) Assign(req *TestRequest) {
+
+	load := atomic.AddInt64(&c.load, int64(len(req.BridgeLines)))
+	metrics.InstanceLoad.With(prometheus.Labels{"instance": c.Name}).Set(float64(load))
+	c.RequestQueue <- req
+}
+
+// finish marks the given test request as done, which reduces the Tor
+// instance's load.
+func (c *TorContext) finish(req *TestRequest) {
+
+	load := atomic.AddInt64(&c.load, -int64(len(req.BridgeLines)))
+	metrics.InstanceLoad.With(prometheus.Labels{"instance": c.Name}).Set(float64(load))
+	metrics.InstanceTests.With(prometheus.Labels{"instance": c.Name}).Inc()
+
+	// Wake up our scheduler, unless it's already been woken up.
+	if c.finished != nil {
+		select {
+		case c.finished <- true:
+		default:
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package tester
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+func TestPickInstance(t *testing.T) {
+
+	c1 := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog)}
+	c2 := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog),
+		Transports: []string{bridgeline.VanillaTransport}}
+	pool := NewTorPool(c1, c2)
+
+	if c1.Name != "tor0" || c2.Name != "tor1" {
+		t.Errorf("Tor instances were not given default names.")
+	}
+
+	// Both instances are idle, so the first one wins.
+	c, err := pool.pickInstance(&TestRequest{BridgeLines: []string{"1.2.3.4:1234"}})
+	if err != nil || c != c1 {
+		t.Errorf("Failed to pick idle Tor instance.")
+	}
+
+	// The first instance is busy, so the second one should be picked.
+	c1.Assign(&TestRequest{BridgeLines: []string{"1.2.3.4:1234"}})
+	c, err = pool.pickInstance(&TestRequest{BridgeLines: []string{"1.2.3.4:1234"}})
+	if err != nil || c != c2 {
+		t.Errorf("Failed to pick least-loaded Tor instance.")
+	}
+
+	// Only the first instance supports obfs4.
+	c, err = pool.pickInstance(&TestRequest{BridgeLines: []string{"1.2.3.4:1234", "obfs4 1.2.3.4:1234 cert=foo iat-mode=0"}})
+	if err != nil || c != c1 {
+		t.Errorf("Failed to pick Tor instance that supports obfs4.")
+	}
+
+	// No instance supports this transport.
+	if _, err = pool.pickInstance(&TestRequest{BridgeLines: []string{"foo 1.2.3.4:1234"}}); err == nil {
+		t.Errorf("Failed to reject unsupported transport.")
+	}
+
+	// Without obfs4proxy, we can only test vanilla bridges.
+	defer func(binary string) { Obfs4proxyBinary = binary }(Obfs4proxyBinary)
+	Obfs4proxyBinary = ""
+	if _, err = pool.pickInstance(&TestRequest{BridgeLines: []string{"obfs4 1.2.3.4:1234 cert=foo iat-mode=0"}}); err == nil {
+		t.Errorf("Failed to reject obfs4 bridge without obfs4proxy.")
+	}
+	if _, err = pool.pickInstance(&TestRequest{BridgeLines: []string{"1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678"}}); err != nil {
+		t.Errorf("Failed to pick Tor instance for vanilla bridge without obfs4proxy.")
+	}
+
+	// Finishing a request must reduce an instance's load.
+	c1.finish(<-c1.RequestQueue)
+	if c1.Load() != 0 {
+		t.Errorf("Expected load of 0 but got %d.", c1.Load())
+	}
+}
+
+func TestVantages(t *testing.T) {
+
+	c1 := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog), Vantage: "ru"}
+	c2 := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog), Vantage: "ir"}
+	c3 := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog), Vantage: "ir"}
+	pool := NewTorPool(c1, c2, c3)
+
+	vantages, err := pool.ResolveVantages([]string{AllVantages})
+	if err != nil || len(vantages) != 2 || vantages[0] != "ir" || vantages[1] != "ru" {
+		t.Errorf("Failed to resolve all vantage points: %v", vantages)
+	}
+
+	vantages, err = pool.ResolveVantages([]string{"RU", "ru"})
+	if err != nil || len(vantages) != 1 || vantages[0] != "ru" {
+		t.Errorf("Failed to resolve vantage point: %v", vantages)
+	}
+
+	if _, err = pool.ResolveVantages([]string{"cn"}); err == nil {
+		t.Errorf("Failed to reject unknown vantage point.")
+	}
+
+	// Requests for a given vantage point must only go to matching instances.
+	req := &TestRequest{BridgeLines: []string{"1.2.3.4:1234"}, Vantage: "ru"}
+	c, err := pool.pickInstance(req)
+	if err != nil || c != c1 {
+		t.Errorf("Failed to pick Tor instance at requested vantage point.")
+	}
+	c1.Assign(req)
+	c, err = pool.pickInstance(req)
+	if err != nil || c != c1 {
+		t.Errorf("Picked Tor instance at wrong vantage point.")
+	}
+
+	req.Vantage = "ir"
+	c2.Assign(req)
+	c, err = pool.pickInstance(req)
+	if err != nil || c != c3 {
+		t.Errorf("Failed to pick least-loaded Tor instance at vantage point.")
+	}
+}
+
+func TestScheduler(t *testing.T) {
+
+	c := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog)}
+	pool := NewTorPool(c)
+	pool.RequestQueue = make(chan *TestRequest, MaxRequestBacklog)
+	pool.shutdown = make(chan bool)
+	go pool.scheduler()
+	defer close(pool.shutdown)
+
+	// Our fake dispatcher answers requests right away.
+	go func() {
+		for req := range c.RequestQueue {
+			if c.Load() != int64(len(req.BridgeLines)) {
+				t.Errorf("Scheduler assigned request to busy Tor instance.")
+			}
+			req.resultChan <- NewTestResult()
+			c.finish(req)
+		}
+	}()
+	defer close(c.RequestQueue)
+
+	reqs := []*TestRequest{}
+	for i := 0; i < 10; i++ {
+		req := makeRequest("user", 1, 5)
+		req.resultChan = make(chan *TestResult, 1)
+		reqs = append(reqs, req)
+		pool.RequestQueue <- req
+	}
+	for _, req := range reqs {
+		<-req.resultChan
+	}
+
+	// Requests that no instance supports must be rejected.
+	req := &TestRequest{BridgeLines: []string{"foo 1.2.3.4:1234"}, resultChan: make(chan *TestResult)}
+	pool.RequestQueue <- req
+	if result := <-req.resultChan; result.Error == "" {
+		t.Errorf("Scheduler failed to reject request with unsupported transport.")
+	}
+}
+
+func TestBackgroundRequests(t *testing.T) {
+
+	c := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog)}
+	pool := NewTorPool(c)
+
+	background := makeRequest("subscriptions", 1, 5)
+	background.Background = true
+	pool.background.Push(background)
+	req := makeRequest("user", 1, 5)
+	pool.queue.Push(req)
+
+	// Regular requests go first, even if they were queued later.
+	pool.dispatchQueued()
+	if assigned := <-c.RequestQueue; assigned != req {
+		t.Fatalf("Background request overtook regular request.")
+	}
+	if len(c.RequestQueue) != 0 {
+		t.Fatalf("Assigned background request to busy Tor instance.")
+	}
+
+	// Once the instance is idle and nothing else waits, it's the background
+	// request's turn.
+	c.finish(req)
+	pool.dispatchQueued()
+	if assigned := <-c.RequestQueue; assigned != background {
+		t.Errorf("Failed to dispatch background request to idle Tor instance.")
+	}
+}
+
+func TestExpeditedRequests(t *testing.T) {
+
+	c := &TorContext{RequestQueue: make(chan *TestRequest, MaxRequestBacklog)}
+	pool := NewTorPool(c)
+
+	background := makeRequest("subscriptions", 1, 5)
+	background.Background = true
+	pool.background.Push(background)
+	expedited := makeRequest("rdsys", 1, 5)
+	expedited.Background = true
+	expedited.Expedited = true
+	pool.expedited.Push(expedited)
+	req := makeRequest("user", 1, 5)
+	pool.queue.Push(req)
+
+	// Regular requests still go first.
+	pool.dispatchQueued()
+	if assigned := <-c.RequestQueue; assigned != req {
+		t.Fatalf("Expedited request overtook regular request.")
+	}
+
+	// Expedited requests overtake routine background requests, even if
+	// they were queued later.
+	c.finish(req)
+	pool.dispatchQueued()
+	if assigned := <-c.RequestQueue; assigned != expedited {
+		t.Fatalf("Routine background request overtook expedited request.")
+	}
+	c.finish(expedited)
+	pool.dispatchQueued()
+	if assigned := <-c.RequestQueue; assigned != background {
+		t.Errorf("Failed to dispatch background request after expedited request.")
+	}
+}
+
+func TestQueueName(t *testing.T) {
+
+	for req, expected := range map[*TestRequest]string{
+		&TestRequest{}:                                  "default",
+		&TestRequest{Background: true}:                  "background",
+		&TestRequest{Background: true, Expedited: true}: "expedited",
+	} {
+		if name := req.queueName(); name != expected {
+			t.Errorf("Expected queue %q but got %q.", expected, name)
+		}
+	}
+}
+
+func TestFull(t *testing.T) {
+
+	oldMax := MaxQueueLength
+	defer func() {
+		MaxQueueLength = oldMax
+		atomic.StoreInt64(&queuedRequests, 0)
+	}()
+	MaxQueueLength = 3
+
+	p := NewTorPool()
+	p.RequestQueue = make(chan *TestRequest, MaxQueueLength)
+	if p.Full() {
+		t.Errorf("Empty pool is full.")
+	}
+	p.RequestQueue <- &TestRequest{}
+	atomic.StoreInt64(&queuedRequests, 1)
+	if p.QueueDepth() != 2 || p.Full() {
+		t.Errorf("Pool with queue depth %d is full.", p.QueueDepth())
+	}
+	atomic.StoreInt64(&queuedRequests, 2)
+	if !p.Full() {
+		t.Errorf("Pool with queue depth %d isn't full.", p.QueueDepth())
+	}
+}
+
+func TestStoppedPool(t *testing.T) {
+
+	var nilPool *TorPool
+	result := nilPool.Test(&TestRequest{BridgeLines: []string{"1.2.3.4:1234"}})
+	if bridgeTest := result.Bridges["1.2.3.4:1234"]; bridgeTest == nil || bridgeTest.Verdict != VerdictInconclusive {
+		t.Errorf("Nil pool didn't answer request with inconclusive result.")
+	}
+	if nilPool.QueueDepth() != 0 || len(nilPool.Vantages()) != 0 {
+		t.Errorf("Nil pool has queue or vantage points.")
+	}
+
+	// Requests that wait for a pool that stops must not wait forever.
+	p := NewTorPool()
+	p.RequestQueue = make(chan *TestRequest, 1)
+	p.shutdown = make(chan bool)
+	done := make(chan *TestResult)
+	go func() { done <- p.Test(&TestRequest{BridgeLines: []string{"1.2.3.4:1234"}}) }()
+	close(p.shutdown)
+	select {
+	case result = <-done:
+		if result.Bridges["1.2.3.4:1234"].Verdict != VerdictInconclusive {
+			t.Errorf("Stopped pool didn't answer request with inconclusive result.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Request waited forever for stopped pool.")
+	}
+}
@@ -0,0 +1,122 @@
+package tester
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// PluginProbeTimeout is how long we let a plugin's executable run when we
+// probe it.
+var PluginProbeTimeout = 5 * time.Second
+
+// PluginStatus tells us if a plugin's executable ran when we probed it.
+type PluginStatus struct {
+	Transports []string `json:"transports"`
+	Binary     string   `json:"binary"`
+	Available  bool     `json:"available"`
+	// Version is the first line that the executable printed when we ran it
+	// with --version, if it understood the flag.
+	Version string `json:"version,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// pluginProbe is the outcome of probing a plugin's executable.
+type pluginProbe struct {
+	version string
+	err     error
+}
+
+// pluginProbes maps plugin executables to the outcome of our latest probe.
+// pluginLock protects it.  We assume that executables that we never probed
+// work.
+var pluginProbes = make(map[string]*pluginProbe)
+
+// ProbePlugins runs the executable of each plugin that our Tor instances would
+// use with --version, so we learn at startup, and not after bridge tests
+// mysteriously fail, that an executable is missing or broken.  From then on,
+// Plugins leaves out plugins whose executable didn't run, and we refuse to
+// test bridges of their transports.  An executable that exits with an error
+// or doesn't exit in time still ran, so it counts as available.
+func ProbePlugins() []*PluginStatus {
+
+	pluginLock.RLock()
+	candidates := resolvePlugins(true)
+	pluginLock.RUnlock()
+
+	probes := make(map[string]*pluginProbe)
+	for _, p := range candidates {
+		if _, exists := probes[p.Binary]; !exists {
+			version, err := probePlugin(p.Binary)
+			probes[p.Binary] = &pluginProbe{version, err}
+		}
+	}
+
+	pluginLock.Lock()
+	for binary, probe := range probes {
+		pluginProbes[binary] = probe
+	}
+	pluginLock.Unlock()
+
+	statuses := PluginStatuses()
+	for _, status := range statuses {
+		available := 0.0
+		if status.Available {
+			available = 1
+		}
+		for _, transport := range status.Transports {
+			metrics.PluginAvailable.WithLabelValues(transport).Set(available)
+		}
+	}
+	return statuses
+}
+
+// PluginStatuses returns the status of each plugin that our Tor instances
+// would use if all of their executables worked.
+func PluginStatuses() []*PluginStatus {
+
+	pluginLock.RLock()
+	defer pluginLock.RUnlock()
+
+	statuses := []*PluginStatus{}
+	for _, p := range resolvePlugins(true) {
+		status := &PluginStatus{Transports: p.Transports, Binary: p.Binary, Available: true}
+		if probe, exists := pluginProbes[p.Binary]; exists {
+			status.Version = probe.version
+			if probe.err != nil {
+				status.Available = false
+				status.Error = probe.err.Error()
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// probePlugin runs the given plugin executable with --version and returns the
+// first line of its output if it exits successfully.  It returns an error if
+// the executable doesn't exist or fails to start.
+func probePlugin(binary string) (string, error) {
+
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PluginProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		// Plugins that don't understand --version may refuse to run
+		// without Tor's environment variables, or wait for Tor until we
+		// kill them.  Either way, they ran.
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]), nil
+}
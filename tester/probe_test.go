@@ -0,0 +1,80 @@
+package tester
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProbePlugins(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-probe")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	scripts := map[string]string{
+		"lyrebird":  "#!/bin/sh\necho 'lyrebird-0.1.0'\necho 'more output'\n",
+		"conjure":   "#!/bin/sh\necho 'unknown flag' >&2\nexit 2\n",
+		"broken":    "#!/nonexistent/interpreter\n",
+		"forbidden": "#!/bin/sh\n",
+	}
+	for name, script := range scripts {
+		mode := os.FileMode(0700)
+		if name == "forbidden" {
+			mode = 0600
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), mode); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	oldObfs4proxy, oldSnowflake, oldWebtunnel, oldMeek := Obfs4proxyBinary, SnowflakeBinary, WebtunnelBinary, MeekBinary
+	defer func() {
+		Obfs4proxyBinary, SnowflakeBinary, WebtunnelBinary, MeekBinary = oldObfs4proxy, oldSnowflake, oldWebtunnel, oldMeek
+		ConfiguredPlugins = nil
+		pluginProbes = make(map[string]*pluginProbe)
+	}()
+	Obfs4proxyBinary, SnowflakeBinary, WebtunnelBinary, MeekBinary = "", "", "", ""
+	for _, spec := range []string{
+		"obfs4=" + filepath.Join(dir, "lyrebird"),
+		"conjure=" + filepath.Join(dir, "conjure"),
+		"broken=" + filepath.Join(dir, "broken"),
+		"forbidden=" + filepath.Join(dir, "forbidden"),
+		"missing=" + filepath.Join(dir, "missing"),
+	} {
+		p, err := ParsePlugin(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse plugin: %s", err)
+		}
+		ConfiguredPlugins = append(ConfiguredPlugins, p)
+	}
+
+	statuses := ProbePlugins()
+	if len(statuses) != 5 {
+		t.Fatalf("Expected 5 plugin statuses but got %d.", len(statuses))
+	}
+	if s := statuses[0]; !s.Available || s.Version != "lyrebird-0.1.0" {
+		t.Errorf("Unexpected status of working plugin: %+v", s)
+	}
+	if s := statuses[1]; !s.Available || s.Version != "" {
+		t.Errorf("Plugin that rejects --version must be available: %+v", s)
+	}
+	for _, s := range statuses[2:] {
+		if s.Available || s.Error == "" {
+			t.Errorf("Plugin that fails to run must be unavailable: %+v", s)
+		}
+	}
+
+	for transport, expected := range map[string]bool{
+		"obfs4": true, "conjure": true, "broken": false, "forbidden": false, "missing": false,
+	} {
+		if TransportAvailable(transport) != expected {
+			t.Errorf("Expected availability of %q to be %t.", transport, expected)
+		}
+	}
+	if len(Plugins()) != 2 {
+		t.Errorf("Plugins must leave out unavailable plugins: %v", Plugins())
+	}
+}
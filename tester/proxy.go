@@ -0,0 +1,94 @@
+package tester
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// UpstreamProxy, if set, is the proxy through which our Tor instances make
+// all of their connections, including their connections to the bridges that
+// we test.  Operators use it to test bridges from behind, e.g., a VPN
+// endpoint in a censored network.
+var UpstreamProxy *Proxy
+
+// Proxy represents an upstream proxy that Tor supports, i.e., a SOCKS4,
+// SOCKS5, or HTTPS CONNECT proxy.
+type Proxy struct {
+	// Scheme is "socks4", "socks5", or "https".
+	Scheme   string
+	Addr     string
+	Username string
+	Password string
+}
+
+// ParseProxy parses a proxy URL of the form "SCHEME://[USER:PASS@]HOST:PORT",
+// e.g., "socks5://127.0.0.1:1080".  We accept the schemes "socks4",
+// "socks5", "http", and "https".  For the latter two, we use the proxy's
+// CONNECT method, like Tor's HTTPSProxy option.
+func ParseProxy(spec string) (*Proxy, error) {
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	p := &Proxy{Scheme: strings.ToLower(u.Scheme), Addr: u.Host}
+	if p.Scheme == "http" {
+		p.Scheme = "https"
+	}
+	if p.Scheme != "socks4" && p.Scheme != "socks5" && p.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(p.Addr); err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %v", p.Addr, err)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("proxy URL must not contain a path or query")
+	}
+	if u.User != nil {
+		if p.Scheme == "socks4" {
+			return nil, fmt.Errorf("SOCKS4 proxies don't support authentication")
+		}
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+		// Tor's torrc format has no way to quote whitespace, and SOCKS5
+		// limits both fields to 255 bytes.
+		if strings.ContainsAny(p.Username+p.Password, " \t\r\n") {
+			return nil, fmt.Errorf("proxy credentials must not contain whitespace")
+		}
+		if p.Scheme == "socks5" && (len(p.Username) == 0 || len(p.Username) > 255 || len(p.Password) == 0 || len(p.Password) > 255) {
+			return nil, fmt.Errorf("SOCKS5 username and password must have 1 to 255 bytes")
+		}
+	}
+	return p, nil
+}
+
+// String returns the proxy's URL without its credentials, so we can log it.
+func (p *Proxy) String() string {
+
+	return fmt.Sprintf("%s://%s", p.Scheme, p.Addr)
+}
+
+// torrcLines returns the torrc options that make Tor use the proxy.
+func (p *Proxy) torrcLines() []string {
+
+	switch p.Scheme {
+	case "socks4":
+		return []string{"Socks4Proxy " + p.Addr}
+	case "socks5":
+		lines := []string{"Socks5Proxy " + p.Addr}
+		if p.Username != "" {
+			lines = append(lines,
+				"Socks5ProxyUsername "+p.Username,
+				"Socks5ProxyPassword "+p.Password)
+		}
+		return lines
+	default:
+		lines := []string{"HTTPSProxy " + p.Addr}
+		if p.Username != "" {
+			lines = append(lines, fmt.Sprintf("HTTPSProxyAuthenticator %s:%s", p.Username, p.Password))
+		}
+		return lines
+	}
+}
@@ -0,0 +1,261 @@
+package tester
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+// Obfs4proxyBinary is the path to the obfs4proxy executable, which implements
+// Obfs4proxyTransports.  An empty path disables obfs4proxy, and with it our
+// pluggable transport stage, which lets us test vanilla bridges on machines
+// that lack obfs4proxy.
+var Obfs4proxyBinary = "/usr/bin/obfs4proxy"
+
+// Obfs4proxyTransports are the transports that obfs4proxy implements.  Our
+// pluggable transport stage only supports these.
+var Obfs4proxyTransports = []string{"obfs2", "obfs3", "obfs4", "scramblesuit", bridgeline.MeekLiteTransport}
+
+// SnowflakeBinary is the path to the snowflake-client executable, which
+// implements the snowflake transport.  Snowflake bridge lines carry the
+// client's broker and ICE configuration (e.g., "url=...", "fronts=...", and
+// "ice=..."), which Tor passes on to snowflake-client as transport arguments.
+var SnowflakeBinary = "/usr/bin/snowflake-client"
+
+// WebtunnelBinary is the path to the webtunnel-client executable, which
+// implements the webtunnel transport.
+var WebtunnelBinary = "/usr/bin/webtunnel-client"
+
+// MeekBinary is the path to the meek-client executable, which implements the
+// meek transport.  obfs4proxy implements the compatible meek_lite transport.
+var MeekBinary = "/usr/bin/meek-client"
+
+// TransportAvailable returns true if we have a client for the given transport.
+// Vanilla bridges need no client.
+func TransportAvailable(transport string) bool {
+
+	return transport == bridgeline.VanillaTransport || pluginFor(transport) != nil
+}
+
+// PTTestTimeout is the amount of time we give a pluggable transport to
+// complete its handshake with a bridge.
+var PTTestTimeout = 30 * time.Second
+
+// getPTArgs extracts the pluggable transport arguments (e.g., "cert=..." and
+// "iat-mode=...") from the given bridge line and encodes them as described in
+// section 3.5 of the pluggable transport specification.
+func getPTArgs(bridgeLine string) string {
+
+	args := []string{}
+	for _, field := range strings.Fields(bridgeLine) {
+		if !strings.Contains(field, "=") {
+			continue
+		}
+		field = strings.Replace(field, `\`, `\\`, -1)
+		field = strings.Replace(field, `;`, `\;`, -1)
+		args = append(args, field)
+	}
+	return strings.Join(args, ";")
+}
+
+// launchPT launches the plugin of the given transport (usually obfs4proxy) as
+// managed client proxy, and returns the address of its SOCKS listener.  The
+// process is killed when the given context is done.
+func launchPT(ctx context.Context, transport, stateDir string) (string, error) {
+
+	p := pluginFor(transport)
+	if p == nil {
+		return "", fmt.Errorf("no plugin implements %q", transport)
+	}
+	name := filepath.Base(p.Binary)
+	cmd := exec.CommandContext(ctx, p.Binary, p.Args...)
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_CLIENT_TRANSPORTS="+transport,
+		"TOR_PT_STATE_LOCATION="+stateDir,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1")
+	// obfs4proxy exits when its stdin is closed, i.e., when we kill it.
+	if _, err := cmd.StdinPipe(); err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err = cmd.Start(); err != nil {
+		return "", err
+	}
+	go cmd.Wait()
+
+	// Parse obfs4proxy's output, which looks as follows:
+	//   VERSION 1
+	//   CMETHOD obfs4 socks5 127.0.0.1:41234
+	//   CMETHODS DONE
+	scanner := bufio.NewScanner(stdout)
+	addr := ""
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CMETHOD":
+			if len(fields) >= 4 && fields[1] == transport && fields[2] == "socks5" {
+				addr = fields[3]
+			}
+		case "CMETHODS":
+			if addr == "" {
+				return "", fmt.Errorf("%s doesn't support %q", name, transport)
+			}
+			go io.Copy(ioutil.Discard, stdout)
+			return addr, nil
+		case "CMETHOD-ERROR", "VERSION-ERROR", "ENV-ERROR":
+			return "", fmt.Errorf("%s failed: %s", name, scanner.Text())
+		}
+	}
+	return "", fmt.Errorf("%s exited before reporting its SOCKS listener", name)
+}
+
+// socksConnect asks the given SOCKS5 proxy to connect to the given addr:port,
+// passing our pluggable transport arguments as username and password.  It
+// returns nil if the proxy reports success.
+func socksConnect(conn net.Conn, addrPort, args string) error {
+
+	host, portStr, err := net.SplitHostPort(addrPort)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+
+	// Offer username/password authentication, which carries our arguments.
+	if _, err = conn.Write([]byte{5, 1, 2}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != 2 {
+		return errors.New("SOCKS proxy refused username/password authentication")
+	}
+
+	// Arguments that don't fit into the username spill over into the
+	// password, which must not be empty.
+	user, pass := args, "\x00"
+	if len(user) > 255 {
+		user, pass = args[:255], args[255:]
+	}
+	if len(user) == 0 {
+		user = "\x00"
+	}
+	if len(pass) > 255 {
+		return errors.New("pluggable transport arguments are too long")
+	}
+	auth := []byte{1, byte(len(user))}
+	auth = append(auth, user...)
+	auth = append(auth, byte(len(pass)))
+	auth = append(auth, pass...)
+	if _, err = conn.Write(auth); err != nil {
+		return err
+	}
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("SOCKS proxy rejected our arguments")
+	}
+
+	req := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// The proxy only replies once the transport's handshake is done.
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("pluggable transport handshake failed (SOCKS error %d)", header[1])
+	}
+
+	// Consume the rest of the reply: the bound address and port.
+	var addrLen int
+	switch header[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		length := make([]byte, 1)
+		if _, err = io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addrLen = int(length[0])
+	default:
+		return fmt.Errorf("SOCKS reply contains invalid address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// testPT makes obfs4proxy perform a handshake with the given bridge and
+// returns nil if the handshake succeeded.
+func testPT(bridgeLine string) error {
+
+	addrPort, err := bridgeline.AddrPort(bridgeLine)
+	if err != nil {
+		return err
+	}
+	stateDir, err := ioutil.TempDir(os.TempDir(), "pt-state-")
+	if err != nil {
+		return &TesterError{err}
+	}
+	defer os.RemoveAll(stateDir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PTTestTimeout)
+	defer cancel()
+	socksAddr, err := launchPT(ctx, bridgeline.Transport(bridgeLine), stateDir)
+	if err != nil {
+		return &TesterError{err}
+	}
+
+	conn, err := net.DialTimeout("tcp", socksAddr, PTTestTimeout)
+	if err != nil {
+		return &TesterError{err}
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	return socksConnect(conn, addrPort, getPTArgs(bridgeLine))
+}
@@ -0,0 +1,63 @@
+package tester
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSocksConnect(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// Our fake SOCKS server checks the client's requests and reports
+	// success.
+	errChan := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		expect := func(expected []byte) {
+			buf := make([]byte, len(expected))
+			if _, err := io.ReadFull(server, buf); err != nil || !bytes.Equal(buf, expected) {
+				errChan <- io.ErrUnexpectedEOF
+			}
+		}
+		expect([]byte{5, 1, 2})
+		server.Write([]byte{5, 2})
+		expect(append(append([]byte{1, 10}, "cert=foo;x"...), 1, 0))
+		server.Write([]byte{1, 0})
+		expect([]byte{5, 1, 0, 1, 1, 2, 3, 4, 0x04, 0xd2})
+		server.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		errChan <- nil
+	}()
+
+	if err := socksConnect(client, "1.2.3.4:1234", "cert=foo;x"); err != nil {
+		t.Errorf("SOCKS connect failed: %s", err)
+	}
+	if err := <-errChan; err != nil {
+		t.Errorf("SOCKS server received unexpected request.")
+	}
+}
+
+func TestSocksConnectFailure(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 512)
+		server.Read(buf)
+		server.Write([]byte{5, 2})
+		server.Read(buf)
+		server.Write([]byte{1, 0})
+		server.Read(buf)
+		// Report a general SOCKS server failure.
+		server.Write([]byte{5, 1, 0, 1})
+	}()
+
+	if err := socksConnect(client, "[2001:db8::1]:443", ""); err == nil {
+		t.Errorf("Failed to report failed handshake.")
+	}
+}
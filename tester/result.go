@@ -0,0 +1,254 @@
+package tester
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// VerdictFunctional means that the bridge works.
+	VerdictFunctional = "functional"
+	// VerdictDysfunctional means that the bridge doesn't work.
+	VerdictDysfunctional = "dysfunctional"
+	// VerdictInconclusive means that we failed to test the bridge, e.g.,
+	// because our Tor instance was overloaded or shutting down.  We don't
+	// cache inconclusive results because they say nothing about the bridge.
+	VerdictInconclusive = "inconclusive"
+)
+
+const (
+	// PriorityNormal requests wait in our fair queue, which shares our test
+	// capacity among clients according to their weight.
+	PriorityNormal = "normal"
+	// PriorityBackground requests only get tested while our Tor instances
+	// have nothing else to do.
+	PriorityBackground = "background"
+)
+
+// Error codes of failures that bridgestrap detects itself, as opposed to the
+// ORCONN failures that Tor reports (see FailureReasons).
+const (
+	// ErrorCodeTorError means that Tor failed to test the entire batch,
+	// e.g., because it rejected our configuration.
+	ErrorCodeTorError = "TOR_ERROR"
+	// ErrorCodeUnparseableLine means that the bridge line is malformed.
+	ErrorCodeUnparseableLine = "UNPARSEABLE_LINE"
+	// ErrorCodeDescriptorTimeout means that Tor attempted to connect to the
+	// bridge, but didn't get its descriptor in time.
+	ErrorCodeDescriptorTimeout = "DESCRIPTOR_TIMEOUT"
+	// ErrorCodeNotAttempted means that our test timed out before Tor
+	// attempted to connect to the bridge.
+	ErrorCodeNotAttempted = "NOT_ATTEMPTED"
+	// ErrorCodeWrongFingerprint means that the bridge that we connected to
+	// has a fingerprint other than the one in its bridge line.
+	ErrorCodeWrongFingerprint = "WRONG_FINGERPRINT"
+	// ErrorCodeCircuitFailed means that Tor fetched the bridge's descriptor
+	// but failed to build a circuit through the bridge.
+	ErrorCodeCircuitFailed = "CIRCUIT_FAILED"
+	// ErrorCodeCheckFailed means that the bridge failed the composite check
+	// that decides the client's verdicts.  See Check.
+	ErrorCodeCheckFailed = "CHECK_FAILED"
+)
+
+// StageFailureCode returns the error code of bridges that failed the given
+// stage of our test pipeline, e.g., "TCP_FAILED".
+func StageFailureCode(stage string) string {
+
+	return strings.ToUpper(stage) + "_FAILED"
+}
+
+// BridgeTest represents the result of a bridge test, sent back to the client
+// as JSON object.
+type BridgeTest struct {
+	Functional bool      `json:"functional"`
+	Verdict    string    `json:"verdict"`
+	LastTested time.Time `json:"last_tested"`
+	Error      string    `json:"error,omitempty"`
+	// ErrorCode is a stable, machine-readable code for Error, if we have
+	// one, e.g., "CONNECTREFUSED".  See FailureReasons.
+	ErrorCode string `json:"error_code,omitempty"`
+	// Stages contains the results of our test pipeline's stages, if the
+	// client asked for specific stages.
+	Stages []*StageResult `json:"stages,omitempty"`
+	// Descriptor describes the descriptor that a functional bridge gave us.
+	Descriptor *Descriptor `json:"descriptor,omitempty"`
+	// ObservedFingerprint is the fingerprint of the bridge that Tor connected
+	// to, if it got that far.
+	ObservedFingerprint string `json:"observed_fingerprint,omitempty"`
+	// FunctionalIPv4 and FunctionalIPv6 tell if a functional bridge whose
+	// descriptor advertises ORPorts in both address families works over
+	// each of them.  They're nil for other bridges, and for families whose
+	// test was inconclusive.
+	FunctionalIPv4 *bool `json:"functional_ipv4,omitempty"`
+	FunctionalIPv6 *bool `json:"functional_ipv6,omitempty"`
+	// Circuit describes the circuit that we built through the bridge, if
+	// the client asked for our circuit stage and we got the bridge's
+	// descriptor.
+	Circuit *CircuitTest `json:"circuit,omitempty"`
+	// RetiredAt is the time at which a distributor told us that it retired
+	// the bridge, if it did so recently.
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	// Country and ASN locate the bridge's address, e.g., "de" and
+	// "AS3320", if we have GeoIP databases that know the address.
+	Country string `json:"country,omitempty"`
+	ASN     string `json:"asn,omitempty"`
+	// Check is the name of the composite check that decided the bridge's
+	// verdict, if the client has one and our result told us the check's
+	// outcome.
+	Check string `json:"check,omitempty"`
+	// Time is the number of seconds that passed between handing the bridge
+	// to Tor and learning its result.  It's zero for results that didn't
+	// come from Tor, e.g., cached ones.
+	Time float64 `json:"time,omitempty"`
+	// Context describes the conditions under which Tor tested the bridge.
+	// It's nil for results that didn't come from Tor.
+	Context *TestContext `json:"-"`
+}
+
+// TestResult represents the result of a test.
+type TestResult struct {
+	Bridges map[string]*BridgeTest `json:"bridge_results"`
+	// VantageResults maps vantage points to their test results, if the
+	// client requested specific vantage points.
+	VantageResults map[string]*TestResult `json:"vantage_results,omitempty"`
+	// Origin tells clients where we tested their bridges from.
+	Origin *Origin `json:"origin,omitempty"`
+	// Replica tells clients how fresh our results are if we're a read-only
+	// replica that serves results of another bridgestrap instance.
+	Replica *ReplicaStatus `json:"replica,omitempty"`
+	// ORPortExposure maps bridge fingerprints to the combined result of the
+	// bridge's vanilla and pluggable transport bridge lines, if the client
+	// submitted both.
+	ORPortExposure map[string]*ORPortExposure `json:"orport_exposure,omitempty"`
+	// Diagnostics explains what's wrong with the malformed bridge lines of
+	// the client's request, if any.
+	Diagnostics []*LineDiagnostic `json:"diagnostics,omitempty"`
+	Time        float64           `json:"time"`
+	Error       string            `json:"error,omitempty"`
+}
+
+// LineDiagnostic explains what's wrong with one of the bridge lines of a
+// client's request.
+type LineDiagnostic struct {
+	// Index is the bridge line's position in the request's bridge lines.
+	Index int `json:"index"`
+	// Field is the invalid part of the bridge line, e.g., "port", if we
+	// know it.  See bridgeline.ValidationError.
+	Field string `json:"field,omitempty"`
+	Error string `json:"error"`
+}
+
+// ORPortExposure tells operators if the ORPort of a bridge that runs a
+// pluggable transport is reachable.  Reachable ORPorts undermine pluggable
+// transports like obfs4 because censors can find the bridge by scanning for
+// Tor's own protocol.
+type ORPortExposure struct {
+	VanillaBridgeLine   string `json:"vanilla_bridge_line"`
+	TransportBridgeLine string `json:"transport_bridge_line"`
+	// ORPortReachable is true if we could connect to the bridge over its
+	// vanilla bridge line, i.e., its ORPort.
+	ORPortReachable bool `json:"orport_reachable"`
+	// TransportReachable is true if we could connect to the bridge over its
+	// pluggable transport.
+	TransportReachable bool `json:"transport_reachable"`
+}
+
+// ReplicaStatus describes how fresh a read-only replica's results are.
+type ReplicaStatus struct {
+	// LastSync is the time of the replica's last successful sync, and zero
+	// if it never synced.
+	LastSync time.Time `json:"last_sync"`
+	// Stale is true if the replica failed to sync for a while, so its
+	// results may be outdated.
+	Stale bool `json:"stale"`
+}
+
+// ProgressFunc receives the result of a single bridge's test.
+type ProgressFunc func(bridgeLine string, bridgeTest *BridgeTest)
+
+// TestRequest represents a client's request to test a batch of bridges.
+type TestRequest struct {
+	BridgeLines []string `json:"bridge_lines"`
+	Vantages    []string `json:"vantages,omitempty"`
+	Stages      []string `json:"stages,omitempty"`
+	// Format is the format of the response that the client wants, e.g.,
+	// "ooni".  It's empty for our own format.
+	Format string `json:"format,omitempty"`
+	// Timeout is the number of seconds that Tor may take to test the
+	// request's bridges.  It's 0 for TorTestTimeout.
+	Timeout float64 `json:"timeout,omitempty"`
+	// Priority is the request's priority, e.g., PriorityBackground.  It's
+	// empty for PriorityNormal.
+	Priority string `json:"priority,omitempty"`
+	// Circuit asks Tor to build a circuit through each bridge whose
+	// descriptor it fetched (see StageCircuit).
+	Circuit bool `json:"-"`
+	// Vantage is the vantage point that the scheduler must test the request
+	// from.  It's empty if any vantage point will do.
+	Vantage string `json:"-"`
+	// Client and Weight identify the client that sent the request, and its
+	// share of our test capacity.
+	Client string `json:"-"`
+	Weight int    `json:"-"`
+	// Background requests only get tested while our Tor instances have
+	// nothing else to do, e.g., periodic re-tests of subscribed bridges.
+	Background bool `json:"-"`
+	// Expedited background requests get tested ahead of routine background
+	// requests, e.g., re-tests of bridges that a distributor is about to
+	// hand out.
+	Expedited bool `json:"-"`
+	// Diagnostics explains what's wrong with the request's malformed bridge
+	// lines.  We either dropped them from BridgeLines, or report them as
+	// dysfunctional.
+	Diagnostics []*LineDiagnostic `json:"-"`
+	// Progress, if set, is called as soon as a bridge's test is done, so
+	// clients can learn about results before the entire batch is done.  It's
+	// called from the goroutine of the Tor instance that tests the request,
+	// so it must not block.
+	Progress ProgressFunc `json:"-"`
+	// queued is the time at which the request entered our scheduler's queue.
+	queued     time.Time
+	resultChan chan *TestResult
+}
+
+// testTimeout returns the time that Tor may take to test the request's
+// bridges.
+func (req *TestRequest) testTimeout() time.Duration {
+
+	if req.Timeout > 0 {
+		return time.Duration(req.Timeout * float64(time.Second))
+	}
+	return TestTimeout()
+}
+
+// NewTestResult returns a new, empty test result.
+func NewTestResult() *TestResult {
+
+	t := &TestResult{}
+	t.Bridges = make(map[string]*BridgeTest)
+	return t
+}
+
+// completeResult marks all of the given bridge lines that are missing in the
+// given result as inconclusive.  Bridge lines go missing if the entire test
+// failed, e.g., because Tor rejected our configuration or because we're
+// shutting down.
+func completeResult(result *TestResult, bridgeLines []string) {
+
+	for _, bridgeLine := range bridgeLines {
+		if _, exists := result.Bridges[bridgeLine]; exists {
+			continue
+		}
+		reason := result.Error
+		if reason == "" {
+			reason = "test did not complete"
+		}
+		result.Bridges[bridgeLine] = &BridgeTest{
+			Functional: false,
+			Verdict:    VerdictInconclusive,
+			Error:      reason,
+			ErrorCode:  ErrorCodeTorError,
+			LastTested: time.Now().UTC(),
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestCompleteResult(t *testing.T) {
+
+	result := NewTestResult()
+	result.Error = "tor restarted"
+	result.Bridges["1.2.3.4:1234"] = &BridgeTest{Verdict: VerdictDysfunctional}
+
+	completeResult(result, []string{"1.2.3.4:1234", "5.6.7.8:5678"})
+
+	if result.Bridges["1.2.3.4:1234"].Verdict != VerdictDysfunctional {
+		t.Errorf("Existing bridge result was overwritten.")
+	}
+	r, exists := result.Bridges["5.6.7.8:5678"]
+	if !exists || r.Verdict != VerdictInconclusive || r.Functional || r.Error != result.Error {
+		t.Errorf("Missing bridge result was not marked as inconclusive.")
+	}
+	if r.ErrorCode != ErrorCodeTorError {
+		t.Errorf("Expected error code %q but got %q.", ErrorCodeTorError, r.ErrorCode)
+	}
+}
+
+func TestStageFailureCode(t *testing.T) {
+
+	if code := StageFailureCode(StageTCP); code != "TCP_FAILED" {
+		t.Errorf("Unexpected error code %q.", code)
+	}
+}
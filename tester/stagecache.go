@@ -0,0 +1,104 @@
+package tester
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// MaxStageCacheEntries is the number of entries in our stage cache after
+	// which we start pruning expired entries.
+	MaxStageCacheEntries = 10000
+)
+
+// StageCacheTTLs determines how long we remember that a bridge passed one of
+// our pre-Tor stages.  Reachability changes more often than a bridge's
+// cryptographic parameters, so these TTLs are much shorter than the TTL of
+// our cache of Tor verdicts.  Stages without TTL aren't cached.
+var StageCacheTTLs = map[string]time.Duration{
+	StageTCP: 10 * time.Minute,
+	StagePT:  30 * time.Minute,
+}
+
+// stageCache remembers the bridges that recently passed our pre-Tor stages,
+// which lets our pipeline skip these stages and save its capacity for the
+// expensive Tor stage.
+var stageCache = NewStageCache()
+
+type stageCacheEntry struct {
+	result *StageResult
+	time   time.Time
+}
+
+// StageCache caches the outcomes of the stages of our test pipeline that
+// precede the Tor stage.  We only cache passed stages: failed stages end a
+// bridge's test, so their outcome ends up in our cache of verdicts anyway.
+type StageCache struct {
+	entries map[string]*stageCacheEntry
+	sync.Mutex
+}
+
+// NewStageCache returns a new, empty stage cache.
+func NewStageCache() *StageCache {
+
+	return &StageCache{entries: make(map[string]*stageCacheEntry)}
+}
+
+// stageCacheKey returns the key under which we cache the given stage's
+// outcome for the given bridge line.  A TCP test only depends on a bridge's
+// endpoint, while a PT handshake depends on the entire bridge line.
+func stageCacheKey(stage, bridgeLine string) string {
+
+	if stage == StageTCP {
+		if endpoint, err := bridgeline.Endpoint(bridgeLine); err == nil {
+			return stage + " " + endpoint
+		}
+	}
+	return stage + " " + bridgeLine
+}
+
+// Get returns a copy of the cached result of the given stage for the given
+// bridge line, or nil if there's no unexpired result.
+func (c *StageCache) Get(stage, bridgeLine string) *StageResult {
+
+	c.Lock()
+	defer c.Unlock()
+
+	entry, exists := c.entries[stageCacheKey(stage, bridgeLine)]
+	if !exists || time.Since(entry.time) > StageCacheTTLs[stage] {
+		metrics.StageCache.With(prometheus.Labels{"stage": stage, "type": "miss"}).Inc()
+		return nil
+	}
+	metrics.StageCache.With(prometheus.Labels{"stage": stage, "type": "hit"}).Inc()
+	result := *entry.result
+	result.Cached = true
+	result.Time = 0
+	return &result
+}
+
+// Add caches the given stage result for the given bridge line if it's worth
+// caching.
+func (c *StageCache) Add(bridgeLine string, result *StageResult) {
+
+	if !result.Passed || result.Skipped || StageCacheTTLs[result.Stage] == 0 {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= MaxStageCacheEntries {
+		for key, entry := range c.entries {
+			if now.Sub(entry.time) > StageCacheTTLs[entry.result.Stage] {
+				delete(c.entries, key)
+			}
+		}
+	}
+	if len(c.entries) < MaxStageCacheEntries {
+		c.entries[stageCacheKey(result.Stage, bridgeLine)] = &stageCacheEntry{result: result, time: now}
+	}
+}
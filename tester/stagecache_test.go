@@ -0,0 +1,43 @@
+package tester
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStageCache(t *testing.T) {
+
+	c := NewStageCache()
+	bridgeLine := "obfs4 1.2.3.4:1234 cert=foo iat-mode=0"
+
+	if c.Get(StageTCP, bridgeLine) != nil {
+		t.Errorf("Empty cache returned result.")
+	}
+
+	c.Add(bridgeLine, &StageResult{Stage: StageTCP, Passed: true, Time: 1.5})
+	r := c.Get(StageTCP, bridgeLine)
+	if r == nil || !r.Passed || !r.Cached || r.Time != 0 {
+		t.Fatalf("Failed to return cached result: %+v", r)
+	}
+	// TCP results only depend on a bridge's addr:port.
+	if c.Get(StageTCP, "1.2.3.4:1234") == nil {
+		t.Errorf("TCP result wasn't shared among bridge lines with the same addr:port.")
+	}
+	if c.Get(StagePT, bridgeLine) != nil {
+		t.Errorf("TCP result was returned for PT stage.")
+	}
+
+	// We don't cache failed, skipped, or uncacheable stages.
+	c.Add(bridgeLine, &StageResult{Stage: StagePT, Passed: false, Error: "handshake failed"})
+	c.Add("5.6.7.8:1234", &StageResult{Stage: StagePT, Passed: true, Skipped: true})
+	c.Add(bridgeLine, &StageResult{Stage: StageTor, Passed: true})
+	if len(c.entries) != 1 {
+		t.Errorf("Expected 1 cache entry but got %d.", len(c.entries))
+	}
+
+	// Expired results must not be returned.
+	c.entries[stageCacheKey(StageTCP, bridgeLine)].time = time.Now().Add(-StageCacheTTLs[StageTCP] - time.Second)
+	if c.Get(StageTCP, bridgeLine) != nil {
+		t.Errorf("Returned expired result.")
+	}
+}
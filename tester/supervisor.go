@@ -0,0 +1,130 @@
+package tester
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// MinRestartBackoff is how long we wait before we try again after we
+	// failed to restart a Tor process.  We double the wait after each
+	// failed attempt, up to MaxRestartBackoff.
+	MinRestartBackoff = 5 * time.Second
+	MaxRestartBackoff = 5 * time.Minute
+)
+
+// diedChan returns the channel that is closed once our current Tor process
+// dies.
+func (c *TorContext) diedChan() chan bool {
+
+	c.ctrlLock.RLock()
+	defer c.ctrlLock.RUnlock()
+
+	return c.died
+}
+
+// currentGeneration returns the number of our current Tor process.  It
+// increases whenever we restart Tor.
+func (c *TorContext) currentGeneration() int {
+
+	c.ctrlLock.RLock()
+	defer c.ctrlLock.RUnlock()
+
+	return c.generation
+}
+
+// isShuttingDown returns true if Stop was called.
+func (c *TorContext) isShuttingDown() bool {
+
+	select {
+	case <-c.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportDeath tells our supervisor that the Tor process of the given
+// generation died for the given reason.  Reports about earlier generations,
+// which we already restarted, and reports during shutdown are ignored.
+func (c *TorContext) reportDeath(generation int, reason string) {
+
+	if c.isShuttingDown() {
+		return
+	}
+
+	c.ctrlLock.Lock()
+	defer c.ctrlLock.Unlock()
+
+	if generation != c.generation || c.dead {
+		return
+	}
+	log.Printf("%s: Tor process died: %s", c.Name, reason)
+	c.dead = true
+	close(c.died)
+}
+
+// supervise restarts our Tor process, with a fresh data directory, whenever
+// it dies, until we're shutting down.  Our dispatcher keeps running in the
+// meanwhile; tests that were in flight when Tor died are inconclusive.
+func (c *TorContext) supervise() {
+
+	for {
+		select {
+		case <-c.diedChan():
+		case <-c.shutdown:
+			return
+		}
+
+		backoff := MinRestartBackoff
+		for {
+			err := c.restart()
+			if err == nil {
+				break
+			}
+			log.Printf("%s: Failed to restart Tor: %s.  Trying again in %s.", c.Name, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-c.shutdown:
+				return
+			}
+			if backoff *= 2; backoff > MaxRestartBackoff {
+				backoff = MaxRestartBackoff
+			}
+		}
+	}
+}
+
+// restart replaces our dead Tor process with a new one that uses a fresh
+// data directory.
+func (c *TorContext) restart() error {
+
+	// testBridgeLines holds our lock while testing and gives up once Tor
+	// died, so we don't have to wait long.
+	c.Lock()
+	defer c.Unlock()
+
+	if c.isShuttingDown() {
+		return nil
+	}
+	status := "failure"
+	defer func() {
+		metrics.TorRestarts.With(prometheus.Labels{"instance": c.Name, "status": status}).Inc()
+	}()
+
+	log.Printf("%s: Restarting Tor process.", c.Name)
+	c.Cancel()
+	if ctrl := c.ctrl(); ctrl != nil {
+		ctrl.Close()
+	}
+	c.removeDataDir()
+	if err := c.launch(); err != nil {
+		return fmt.Errorf("failed to launch tor: %v", err)
+	}
+	status = "success"
+	log.Printf("%s: Restarted Tor process.", c.Name)
+	return nil
+}
@@ -0,0 +1,35 @@
+package tester
+
+import (
+	"testing"
+)
+
+func TestReportDeath(t *testing.T) {
+
+	c := &TorContext{Name: "test", shutdown: make(chan bool), generation: 2, died: make(chan bool)}
+	died := c.diedChan()
+
+	// Reports about processes that we already replaced don't count.
+	c.reportDeath(1, "old process exited")
+	select {
+	case <-died:
+		t.Fatalf("Reported death of old process.")
+	default:
+	}
+
+	c.reportDeath(2, "process exited")
+	c.reportDeath(2, "lost control connection")
+	select {
+	case <-died:
+	default:
+		t.Fatalf("Failed to report death of current process.")
+	}
+
+	// Nothing dies while we're shutting down.
+	c = &TorContext{Name: "test", shutdown: make(chan bool), generation: 1, died: make(chan bool)}
+	close(c.shutdown)
+	c.reportDeath(1, "process exited")
+	if c.dead {
+		t.Errorf("Reported death during shutdown.")
+	}
+}
@@ -0,0 +1,777 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yawning/bulb"
+	"gitlab.torproject.org/tpo/anti-censorship/bridgestrap/bridgeline"
+)
+
+const (
+	// We're using the following default bridges to bootstrap our Tor instance.
+	// Once it's bootstrapped, we no longer need them.
+	DefaultBridge1 = "obfs4 192.95.36.142:443 CDF2E852BF539B82BD10E27E9115A31734E378C2 cert=qUVQ0srL1JI/vO6V6m/24anYXiJD3QP2HgzUKQtQ7GRqqUvs7P+tG43RtAqdhLOALP7DJQ iat-mode=1"
+	DefaultBridge2 = "obfs4 193.11.166.194:27015 2D82C2E354D531A68469ADF7F878FA6060C6BACA cert=4TLQPJrTSaDffMK7Nbao6LC7G9OW/NHkUwIdjLSS3KYf0Nv4/nQiiI8dY2TcsQx01NniOg iat-mode=0"
+	DefaultBridge3 = "obfs4 37.218.245.14:38224 D9A82D2F9C2F65A18407B1D2B764F130847F8B5D cert=bjRaMrr1BRiAW8IE9U5z27fQaYgOhX1UCmOpg2pFpoMvo6ZgQMzLsaTzzQNTlm7hNcb+Sg iat-mode=0"
+	// The maximum amount of bridges per batch.
+	MaxBridgesPerReq  = 100
+	MaxEventBacklog   = 100
+	MaxRequestBacklog = 100
+)
+
+// BootstrapBridges are the bridges that our Tor instances bootstrap with.
+// They default to our obfs4 default bridges, so operators who disable
+// obfs4proxy must replace them, e.g., with vanilla bridges.
+var BootstrapBridges = []string{DefaultBridge1, DefaultBridge2, DefaultBridge3}
+
+// The amount of time we give Tor to test a batch of bridges.  Once our Tor
+// instances run, only change it with SetTestTimeout.
+var TorTestTimeout time.Duration
+
+// testTimeoutLock protects TorTestTimeout, which we may change at runtime.
+var testTimeoutLock sync.RWMutex
+
+// SetTestTimeout changes TorTestTimeout, e.g., when we reload our
+// configuration.  Tests that are in flight keep their timeout.
+func SetTestTimeout(timeout time.Duration) {
+
+	testTimeoutLock.Lock()
+	defer testTimeoutLock.Unlock()
+
+	TorTestTimeout = timeout
+}
+
+// TestTimeout returns TorTestTimeout.
+func TestTimeout() time.Duration {
+
+	testTimeoutLock.RLock()
+	defer testTimeoutLock.RUnlock()
+
+	return TorTestTimeout
+}
+
+// WakeupGracePeriod is the extra time that we give Tor to test the first batch
+// of bridges after it woke up from dormant mode.  A Tor instance that just woke
+// up may first have to refresh its directory information before it gets to
+// our bridges.
+var WakeupGracePeriod = 30 * time.Second
+
+// ProgressGracePeriod is the extra time that we give bridges that Tor launched
+// or completed a connection to within ProgressGracePeriod before our test
+// timed out.  Slow but working bridges often just need a few more seconds to
+// hand us their descriptor.  We extend a test's deadline at most once.
+var ProgressGracePeriod = 15 * time.Second
+
+// LogBridgeLine turns a bridge line into what we may write to our logs.  By
+// default, we log bridge lines as they are; embedders can replace the
+// function to redact them.
+var LogBridgeLine = func(bridgeLine string) string {
+	return bridgeLine
+}
+
+// getDomainSocketPath takes as input the path to our data directory and
+// returns the path to the domain socket for tor's control port.
+func getDomainSocketPath(dataDir string) string {
+	return fmt.Sprintf("%s/control-socket", dataDir)
+}
+
+// LoadBootstrapBridges reads bridge lines, one per line, from the given file.
+// Empty lines and lines that start with "#" are ignored.  We must have a
+// client for the transport of each bridge line.
+func LoadBootstrapBridges(filename string) ([]string, error) {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	bridgeLines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "Bridge "))
+		if err := bridgeline.Validate(line); err != nil {
+			return nil, fmt.Errorf("invalid bootstrap bridge %q: %s", LogBridgeLine(line), err)
+		}
+		if transport := bridgeline.Transport(line); !TransportAvailable(transport) {
+			return nil, fmt.Errorf("no client for transport %q of bootstrap bridge %q", transport, LogBridgeLine(line))
+		}
+		bridgeLines = append(bridgeLines, line)
+	}
+	if len(bridgeLines) == 0 {
+		return nil, fmt.Errorf("bootstrap bridge file %q contains no bridges", filename)
+	}
+	return bridgeLines, nil
+}
+
+// writeConfigToTorrc writes a Tor config file to the given file handle.  We
+// only configure the pluggable transports that we have plugins for, so Tor
+// doesn't need obfs4proxy if we only test vanilla bridges.  If we have an
+// upstream proxy, Tor (and its pluggable transports) connect through it.
+func writeConfigToTorrc(tmpFh io.Writer, dataDir string) error {
+
+	_, err := fmt.Fprintf(tmpFh, "UseBridges 1\n"+
+		"ControlPort unix:%s\n"+
+		"SocksPort auto\n"+
+		"SafeLogging 0\n"+
+		"Log notice file %s/tor.log\n"+
+		"DataDirectory %s\n", getDomainSocketPath(dataDir), dataDir, dataDir)
+	if err != nil {
+		return err
+	}
+
+	if UpstreamProxy != nil {
+		for _, line := range UpstreamProxy.torrcLines() {
+			if _, err := fmt.Fprintln(tmpFh, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, p := range Plugins() {
+		if _, err := fmt.Fprintf(tmpFh, "ClientTransportPlugin %s exec %s\n", strings.Join(p.Transports, ","), p.command()); err != nil {
+			return err
+		}
+	}
+
+	for _, bridgeLine := range BootstrapBridges {
+		if _, err := fmt.Fprintf(tmpFh, "Bridge %s\n", bridgeLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// makeControlConnection attempts to establish a control connection with Tor's
+// given domain socket.  If successful, it returns the connection.  Otherwise,
+// it returns an error.
+func makeControlConnection(domainSocket string) (*bulb.Conn, error) {
+
+	var torCtrl *bulb.Conn
+	var err error
+
+	// Try connecting to tor's control socket.  It may take a second or two for
+	// it to be ready.
+	for attempts := 0; attempts < 10; attempts++ {
+		torCtrl, err = bulb.Dial("unix", domainSocket)
+		if err == nil {
+			if err := torCtrl.Authenticate(""); err != nil {
+				return nil, fmt.Errorf("authentication with tor's control port failed: %v", err)
+			}
+			return torCtrl, nil
+		} else {
+			time.Sleep(time.Second)
+		}
+	}
+
+	return nil, fmt.Errorf("unable to connect to domain socket")
+}
+
+// TorContext represents the data structures and methods we need to control a
+// Tor process.
+type TorContext struct {
+	// load must be the first field to guarantee 64-bit alignment for atomic
+	// operations on 32-bit platforms.
+	load int64
+	// readerRestarts counts the times that our watchdog restarted our stuck
+	// event reader, and lastReaderRestart is the Unix time in nanoseconds of
+	// the latest restart.  Both must only be accessed atomically.
+	readerRestarts    int64
+	lastReaderRestart int64
+	// clockSkew is our clock's skew in nanoseconds (see ClockSkew).  It must
+	// only be accessed atomically.
+	clockSkew int64
+	// bootstrap is our Tor process's bootstrap progress in percent, and
+	// ctrlAlive is 1 while our control connection works.  Both must only be
+	// accessed atomically.
+	bootstrap int32
+	ctrlAlive int32
+	sync.Mutex
+	// Ctrl is our control connection.  It changes whenever we reconnect,
+	// so we access it via ctrl().
+	Ctrl         *bulb.Conn
+	ctrlLock     sync.RWMutex
+	DataDir      string
+	Cancel       context.CancelFunc
+	Context      context.Context
+	RequestQueue chan *TestRequest
+	TorBinary    string
+	// Name identifies the Tor instance in logs and metrics.
+	Name string
+	// Transports contains the transports that the Tor instance can test.  If
+	// nil, it can test vanilla bridges and all transports that we have
+	// plugins for.
+	Transports []string
+	// Vantage is the vantage point (e.g., a country code) from which the Tor
+	// instance tests bridges.
+	Vantage string
+	// Origin describes where the Tor instance tests bridges from.  We
+	// include it in our results if it's set.
+	Origin *Origin
+	// Events contains the Tor events that the instance subscribes to in
+	// addition to RequiredEvents, e.g., "TRANSPORT_LAUNCHED".
+	Events    []string
+	eventChan chan *bulb.Response
+	shutdown  chan bool
+	// finished is signalled whenever the Tor instance finished a request.
+	finished chan bool
+	// generation counts the Tor processes that we started, so goroutines
+	// that belong to a process that we already replaced can tell.  died is
+	// closed (and dead is set) once the current process dies.  All three
+	// are protected by ctrlLock.
+	generation int
+	died       chan bool
+	dead       bool
+}
+
+// Stop stops the Tor process.  Errors during cleanup are logged and the last
+// occuring error is returned.
+func (c *TorContext) Stop() error {
+	c.Lock()
+	defer c.Unlock()
+
+	var err error
+	close(c.shutdown)
+	log.Printf("%s: Stopping Tor process.", c.Name)
+	c.Cancel()
+
+	if ctrl := c.ctrl(); ctrl != nil {
+		if err = ctrl.Close(); err != nil {
+			log.Printf("Failed to close control connection: %s", err)
+		}
+	}
+
+	if e := c.removeDataDir(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// removeDataDir removes our Tor process's data directory.
+func (c *TorContext) removeDataDir() error {
+
+	err := os.RemoveAll(c.DataDir)
+	if err != nil {
+		log.Printf("Failed to remove data directory: %s", err)
+	}
+	return err
+}
+
+// Start starts the Tor process, along with the goroutines that dispatch our
+// test requests and that restart Tor whenever it dies.
+func (c *TorContext) Start() error {
+	c.Lock()
+	defer c.Unlock()
+	log.Printf("%s: Starting Tor process.", c.Name)
+
+	c.eventChan = make(chan *bulb.Response, MaxEventBacklog)
+	c.RequestQueue = make(chan *TestRequest, MaxRequestBacklog)
+	c.shutdown = make(chan bool)
+
+	if err := c.launch(); err != nil {
+		return err
+	}
+	go c.dispatcher()
+	go c.supervise()
+
+	return nil
+}
+
+// launch starts a new Tor process with a fresh data directory, connects to
+// its control port, and subscribes to its events.  The caller must hold our
+// lock.
+func (c *TorContext) launch() error {
+
+	// Create Tor's data directory.  Our event reader may read it while
+	// reconnecting, so we protect it with ctrlLock.
+	dataDir, err := ioutil.TempDir(os.TempDir(), "tor-datadir-")
+	if err != nil {
+		return err
+	}
+	c.ctrlLock.Lock()
+	c.DataDir = dataDir
+	c.ctrlLock.Unlock()
+	log.Printf("Created data directory %q.", c.DataDir)
+
+	// Create our torrc.
+	tmpFh, err := ioutil.TempFile(c.DataDir, "torrc-")
+	if err != nil {
+		return err
+	}
+	if err = writeConfigToTorrc(tmpFh, c.DataDir); err != nil {
+		return err
+	}
+	log.Println("Wrote Tor config file.")
+
+	// Start our Tor process, and tell our supervisor if it exits.
+	generation := c.currentGeneration() + 1
+	c.Context, c.Cancel = context.WithCancel(context.Background())
+	cmd := exec.CommandContext(c.Context, c.TorBinary, "-f", tmpFh.Name())
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	log.Println("Started Tor process.")
+	go func() {
+		err := cmd.Wait()
+		c.reportDeath(generation, fmt.Sprintf("tor exited (%v)", err))
+	}()
+
+	// Start a control connection with our Tor process.
+	atomic.StoreInt32(&c.bootstrap, 0)
+	ctrl, err := makeControlConnection(getDomainSocketPath(c.DataDir))
+	if err != nil {
+		c.Cancel()
+		return err
+	}
+	ctrl.StartAsyncReader()
+	c.ctrlLock.Lock()
+	c.Ctrl = ctrl
+	c.generation = generation
+	c.died = make(chan bool)
+	c.dead = false
+	c.ctrlLock.Unlock()
+	c.setControlAlive(true)
+	go c.eventReader(generation)
+
+	if err := c.subscribe(); err != nil {
+		return err
+	}
+	c.learnBootstrap()
+	// Tor may not have a consensus yet, in which case its clock skew
+	// warnings and our periodic checks tell us about our clock.
+	if err := c.learnClockSkew(); err != nil {
+		log.Printf("%s: Failed to compare our clock with the consensus: %s", c.Name, err)
+	}
+
+	return nil
+}
+
+// TestBridgeLines takes as input a list of bridge lines, tells Tor to test
+// them, and returns the resulting TestResult.
+func (c *TorContext) TestBridgeLines(bridgeLines []string) *TestResult {
+	return c.testBridgeLines(bridgeLines, nil, false, TestTimeout())
+}
+
+// testBridgeLines is like TestBridgeLines but also hands each bridge's result
+// to the given progress function (if any) as soon as we have it.  If circuit
+// is true, we don't stop at a bridge's descriptor but also build a circuit
+// through the bridge (see StageCircuit).  Tor may take the given time to test
+// the bridges.
+func (c *TorContext) testBridgeLines(bridgeLines []string, progress ProgressFunc, circuit bool, testTimeout time.Duration) *TestResult {
+	c.Lock()
+	defer c.Unlock()
+
+	if len(bridgeLines) == 0 {
+		return NewTestResult()
+	}
+
+	result := NewTestResult()
+	result.Origin = c.Origin
+	log.Printf("Testing %d bridge lines.", len(bridgeLines))
+	died := c.diedChan()
+
+	// We maintain per-bridge state machines that parse Tor's event output.
+	eventParsers := make(map[string]*TorEventState)
+	for _, bridgeLine := range bridgeLines {
+		identifier, err := bridgeline.Identifier(bridgeLine)
+		if err != nil {
+			log.Printf("Bug: Could not extract identifier from bridge line %q.", LogBridgeLine(bridgeLine))
+			continue
+		}
+		eventParsers[bridgeLine] = NewTorEventState(identifier)
+	}
+
+	// extended contains the bridges whose deadline we extended because they
+	// made progress shortly before our test timed out.
+	extended := make(map[string]bool)
+
+	// circuits maps the bridges whose descriptor we have to the result that
+	// we report once we're done building a circuit through them.  We pick
+	// the relays that follow the bridges once per batch.
+	circuits := make(map[string]*BridgeTest)
+	var relays []string
+
+	// setResult records the given bridge's result, along with what testing
+	// the bridge cost us.  Each bridge's test time starts when we hand the
+	// bridge to Tor in our SETCONF.
+	start := time.Now()
+	var setconfTime time.Time
+	var testCtx *TestContext
+	setResult := func(bridgeLine string, bridgeTest *BridgeTest) {
+		bridgeTest.Time = time.Since(setconfTime).Seconds()
+		bridgeTest.Context = testCtx
+		c.distrustFailure(bridgeTest)
+		result.Bridges[bridgeLine] = bridgeTest
+		if extended[bridgeLine] {
+			metrics.DeadlineExtensions.With(prometheus.Labels{"verdict": bridgeTest.Verdict}).Inc()
+		}
+		numEvents := 0
+		if parser, exists := eventParsers[bridgeLine]; exists {
+			numEvents = parser.NumEvents
+		}
+		costs.AddBridge(bridgeline.Transport(bridgeLine), time.Since(start), numEvents)
+		if progress != nil {
+			progress(bridgeLine, bridgeTest)
+		}
+	}
+
+	// By default, Tor enters dormant mode 24 hours after seeing no user
+	// activity.  Bridgestrap's control port interaction doesn't count as user
+	// activity, which is why we explicitly wake up Tor before issuing our
+	// SETCONF.  See the following issue for more details:
+	// https://gitlab.torproject.org/tpo/anti-censorship/bridgestrap/-/issues/12
+	// We first ask Tor if it's dormant, so we can measure how often our
+	// wakeup is actually needed, and how it affects the tests that follow.
+	wokeUp := c.isDormant()
+	if wokeUp {
+		log.Printf("%s: Tor is dormant.  Waking it up.", c.Name)
+		metrics.Wakeups.With(prometheus.Labels{"instance": c.Name}).Inc()
+	}
+	defer func() {
+		for _, bridgeTest := range result.Bridges {
+			metrics.WakeupVerdicts.With(prometheus.Labels{
+				"after_wakeup": strconv.FormatBool(wokeUp),
+				"verdict":      bridgeTest.Verdict,
+			}).Inc()
+		}
+	}()
+	if _, err := c.request("SIGNAL ACTIVE"); err != nil {
+		log.Printf("Bug: error after sending SIGNAL ACTIVE: %s", err)
+		result.Error = err.Error()
+		return result
+	}
+
+	if wokeUp {
+		testTimeout += WakeupGracePeriod
+	}
+	testCtx = c.testContext(testTimeout)
+
+	// Create our SETCONF line, which tells Tor what bridges it should test.
+	// It has the following format:
+	//   SETCONF Bridge="BRIDGE1" Bridge="BRIDGE2" ...
+	cmdPieces := []string{"SETCONF"}
+	for _, bridgeLine := range bridgeLines {
+		cmdPieces = append(cmdPieces, fmt.Sprintf("Bridge=%q", bridgeLine))
+	}
+	cmd := strings.Join(cmdPieces, " ")
+
+	setconfTime = time.Now()
+	if _, err := c.request("%s", cmd); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	log.Printf("Waiting for Tor to give us test results.")
+	timeout := time.After(testTimeout)
+	// If Tor stops sending us events while we're testing bridges, our
+	// subscription may have gone missing.
+	stall := time.NewTimer(EventStallTimeout)
+	defer stall.Stop()
+	stalls := 0
+	for {
+		select {
+		case ev := <-c.eventChan:
+			// Our channel is closed.
+			if ev == nil {
+				result.Error = "test aborted because bridgestrap is shutting down"
+				return result
+			}
+			if !stall.Stop() {
+				<-stall.C
+			}
+			stall.Reset(EventStallTimeout)
+			stalls = 0
+			for _, line := range ev.RawLines {
+				// CIRC events are about the circuits of our circuit
+				// stage, if they're about ours at all.
+				if CircEvent.MatchString(line) {
+					for bridgeLine, bridgeTest := range c.feedCircuits(circuits, line) {
+						log.Printf("Setting %s to '%t' after circuit test", LogBridgeLine(bridgeLine), bridgeTest.Functional)
+						setResult(bridgeLine, bridgeTest)
+					}
+					if len(result.Bridges) == len(bridgeLines) {
+						return result
+					}
+					continue
+				}
+				for _, bridgeLine := range feedParsers(eventParsers, result, line) {
+					parser := eventParsers[bridgeLine]
+					if parser.State == BridgeStateSuccess {
+						bridgeTest := &BridgeTest{
+							Functional:          true,
+							Verdict:             VerdictFunctional,
+							LastTested:          time.Now().UTC(),
+							Descriptor:          c.describeBridge(parser.Fingerprint),
+							ObservedFingerprint: parser.Fingerprint,
+						}
+						if !circuit {
+							log.Printf("Setting %s to 'true'", LogBridgeLine(bridgeLine))
+							setResult(bridgeLine, bridgeTest)
+							continue
+						}
+						var err error
+						if relays == nil {
+							relays, err = c.circuitRelays()
+						}
+						if err == nil {
+							bridgeTest.Circuit, err = c.extendCircuit(parser.Fingerprint, relays)
+						}
+						if err != nil {
+							// We can't tell if the bridge extends
+							// circuits.
+							log.Printf("%s: Failed to build circuit through %s: %s", c.Name, LogBridgeLine(bridgeLine), err)
+							bridgeTest.Functional = false
+							bridgeTest.Verdict = VerdictInconclusive
+							bridgeTest.Error = fmt.Sprintf("failed to build circuit: %s", err)
+							bridgeTest.ErrorCode = ErrorCodeTorError
+							setResult(bridgeLine, bridgeTest)
+							continue
+						}
+						circuits[bridgeLine] = bridgeTest
+					} else if parser.State == BridgeStateFailure {
+						log.Printf("Setting %s to 'false'", LogBridgeLine(bridgeLine))
+						setResult(bridgeLine, &BridgeTest{
+							Functional:          false,
+							Verdict:             VerdictDysfunctional,
+							Error:               parser.Reason,
+							ErrorCode:           parser.ReasonCode,
+							LastTested:          time.Now().UTC(),
+							ObservedFingerprint: parser.Fingerprint,
+						})
+					}
+				}
+
+				// Do we have test results for all bridges?  If so, we're done.
+				if len(result.Bridges) == len(bridgeLines) {
+					return result
+				}
+			}
+		case <-died:
+			// Our supervisor restarts Tor once we release our lock.
+			// Bridges that we have no result for are inconclusive.
+			result.Error = "test aborted because tor died"
+			return result
+		case <-stall.C:
+			stalls++
+			log.Printf("%s: Tor sent no events for %s while testing bridges.",
+				c.Name, time.Duration(stalls)*EventStallTimeout)
+			metrics.EventStalls.With(prometheus.Labels{"instance": c.Name}).Inc()
+			// If re-subscribing doesn't bring back our events, our event
+			// reader is likely wedged rather than Tor being quiet.
+			if stalls >= EventStallRestarts {
+				c.restartController(fmt.Sprintf("no events for %s", time.Duration(stalls)*EventStallTimeout))
+				stalls = 0
+			} else if err := c.resubscribe(EventStallTimeout); err != nil {
+				c.restartController(fmt.Sprintf("failed to re-subscribe: %s", err))
+				stalls = 0
+			}
+			stall.Reset(EventStallTimeout)
+		case <-timeout:
+			pending := []string{}
+			for _, bridgeLine := range bridgeLines {
+				if _, exists := result.Bridges[bridgeLine]; !exists {
+					pending = append(pending, bridgeLine)
+				}
+			}
+			// Bridges that recently made progress get a grace period,
+			// unless we already gave them one.
+			grace := []string{}
+			if len(extended) == 0 {
+				grace = progressedRecently(pending, eventParsers, time.Now())
+			}
+			if len(grace) > 0 {
+				log.Printf("%s: Giving %d bridge(s) that recently made progress another %s.",
+					c.Name, len(grace), ProgressGracePeriod)
+				for _, bridgeLine := range grace {
+					extended[bridgeLine] = true
+				}
+				timeout = time.After(ProgressGracePeriod)
+			} else {
+				log.Printf("Tor process timed out.")
+			}
+
+			// Mark whatever bridge results we're missing as timed out.
+			for _, bridgeLine := range pending {
+				if len(grace) > 0 && extended[bridgeLine] {
+					continue
+				}
+				if bridgeTest, exists := circuits[bridgeLine]; exists {
+					delete(circuits, bridgeLine)
+					c.closeCircuit(bridgeTest.Circuit)
+					bridgeTest.Circuit.Reason = "TIMEOUT"
+					setResult(bridgeLine, circuitResult(bridgeTest))
+					continue
+				}
+				setResult(bridgeLine, timedOutBridgeTest(eventParsers[bridgeLine]))
+			}
+			if len(grace) == 0 {
+				return result
+			}
+		}
+	}
+
+	return result
+}
+
+// feedParsers hands the given event line to the event parsers of the bridges
+// that are still pending, and returns the bridge lines whose parser reached a
+// verdict because of it.  Bridges that are in the given result are done
+// testing, including the ones that timed out while we waited for others.
+func feedParsers(eventParsers map[string]*TorEventState, result *TestResult, line string) []string {
+
+	decided := []string{}
+	for bridgeLine, parser := range eventParsers {
+		if _, done := result.Bridges[bridgeLine]; done || parser.State != BridgeStatePending {
+			continue
+		}
+		parser.Feed(line)
+		if parser.State != BridgeStatePending {
+			decided = append(decided, bridgeLine)
+		}
+	}
+	return decided
+}
+
+// timedOutBridgeTest returns the result of a bridge whose test timed out,
+// given the bridge's event parser, which may be nil.  If Tor never even tried
+// to connect to the bridge (e.g., because it was overloaded or the batch was
+// too large), the bridge wasn't tested and isn't to blame, so our verdict is
+// inconclusive, which keeps the bridge out of our cache.
+func timedOutBridgeTest(parser *TorEventState) *BridgeTest {
+
+	bridgeTest := &BridgeTest{
+		Functional: false,
+		Verdict:    VerdictDysfunctional,
+		Error:      "timed out waiting for bridge descriptor",
+		ErrorCode:  ErrorCodeDescriptorTimeout,
+		LastTested: time.Now().UTC(),
+	}
+	if parser == nil || len(parser.ConnIds) == 0 {
+		bridgeTest.Verdict = VerdictInconclusive
+		bridgeTest.Error = "timed out before tor attempted to connect to bridge"
+		bridgeTest.ErrorCode = ErrorCodeNotAttempted
+	}
+	return bridgeTest
+}
+
+// progressedRecently returns the given bridge lines whose event parser saw
+// progress within ProgressGracePeriod before the given time.
+func progressedRecently(bridgeLines []string, eventParsers map[string]*TorEventState, now time.Time) []string {
+
+	progressed := []string{}
+	for _, bridgeLine := range bridgeLines {
+		parser, exists := eventParsers[bridgeLine]
+		if exists && parser.ProgressedSince(now.Add(-ProgressGracePeriod)) {
+			progressed = append(progressed, bridgeLine)
+		}
+	}
+	return progressed
+}
+
+// dispatcher reads new bridge test requests, triggers the test, and writes the
+// result to the given channel.
+func (c *TorContext) dispatcher() {
+	log.Printf("Starting request dispatcher.")
+	defer log.Printf("Stopping request dispatcher.")
+	for {
+		select {
+		case req := <-c.RequestQueue:
+			log.Printf("%s: %d pending test requests.", c.Name, len(c.RequestQueue))
+			metrics.InstancePendingReqs.With(prometheus.Labels{"instance": c.Name}).Set(float64(len(c.RequestQueue)))
+
+			transports := make(map[string]int)
+			for _, bridgeLine := range req.BridgeLines {
+				transports[bridgeline.Transport(bridgeLine)]++
+			}
+			c.setInFlight(req.BridgeLines, transports, 1)
+
+			start := time.Now()
+			if !req.queued.IsZero() {
+				metrics.QueueWaitTime.With(prometheus.Labels{"queue": req.queueName()}).Observe(start.Sub(req.queued).Seconds())
+			}
+			metrics.BatchSize.Observe(float64(len(req.BridgeLines)))
+			result := c.testBridgeLines(req.BridgeLines, req.Progress, req.Circuit, req.testTimeout())
+			elapsed := time.Since(start)
+			c.setInFlight(req.BridgeLines, transports, -1)
+			metrics.TorTestTime.Observe(elapsed.Seconds())
+			costs.AddBatch(len(req.BridgeLines), elapsed)
+
+			req.resultChan <- result
+			c.finish(req)
+		case <-c.eventChan:
+			// Discard events that happen while we are not testing bridges.
+			log.Printf("Discarding event because we're not testing bridges.")
+		case <-c.shutdown:
+			return
+		}
+	}
+}
+
+// setInFlight updates our metrics for the given in-flight bridge lines.  The
+// sign is 1 when a batch starts and -1 when it's done.
+func (c *TorContext) setInFlight(bridgeLines []string, transports map[string]int, sign int) {
+
+	if sign > 0 {
+		metrics.InFlightBridges.With(prometheus.Labels{"instance": c.Name}).Set(float64(len(bridgeLines)))
+	} else {
+		metrics.InFlightBridges.With(prometheus.Labels{"instance": c.Name}).Set(0)
+	}
+	for transport, num := range transports {
+		metrics.InFlightTransports.With(prometheus.Labels{"transport": transport}).Add(float64(sign * num))
+	}
+}
+
+// eventReader reads events from the control port of the Tor process of the
+// given generation and writes them to c.eventChan, allowing TestBridgeLines
+// to read Tor's events in a select statement.  If we lose our control
+// connection while we're not shutting down, we reconnect and re-subscribe to
+// our events.  If we can't reconnect, we consider Tor dead, which makes our
+// supervisor restart it, along with a new event reader.
+func (c *TorContext) eventReader(generation int) {
+	log.Println("Starting event reader.")
+	defer log.Printf("Stopping event reader.")
+	for {
+		ctrl := c.ctrl()
+		ev, err := ctrl.NextEvent()
+		if err != nil {
+			if c.isShuttingDown() {
+				close(c.eventChan)
+				return
+			}
+			if generation != c.currentGeneration() {
+				// Our supervisor already replaced our Tor process.
+				return
+			}
+			c.setControlAlive(false)
+			log.Printf("%s: Lost control connection (%s).  Reconnecting.", c.Name, err)
+			if err := c.reconnect(generation, ctrl); err == errSuperseded {
+				return
+			} else if err != nil {
+				c.reportDeath(generation, fmt.Sprintf("failed to reconnect to tor: %v", err))
+				return
+			}
+			c.setControlAlive(true)
+			continue
+		}
+		traceEvent(c.Name, ev)
+		for _, line := range ev.RawLines {
+			c.observeBootstrap(line)
+			c.observeClockSkew(line)
+		}
+		metrics.PendingEvents.Set(float64(len(c.eventChan)))
+		c.eventChan <- ev
+	}
+}
@@ -0,0 +1,183 @@
+package tester
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteConfigToTorrc(t *testing.T) {
+
+	dataDir := "/foo"
+	fileBuf := new(bytes.Buffer)
+	torrc := `UseBridges 1
+ControlPort unix:/foo/control-socket
+SocksPort auto
+SafeLogging 0
+Log notice file /foo/tor.log
+DataDirectory /foo
+ClientTransportPlugin obfs2,obfs3,obfs4,scramblesuit,meek_lite exec /usr/bin/obfs4proxy -enableLogging -logLevel DEBUG
+ClientTransportPlugin snowflake exec /usr/bin/snowflake-client
+ClientTransportPlugin webtunnel exec /usr/bin/webtunnel-client
+ClientTransportPlugin meek exec /usr/bin/meek-client
+Bridge obfs4 192.95.36.142:443 CDF2E852BF539B82BD10E27E9115A31734E378C2 cert=qUVQ0srL1JI/vO6V6m/24anYXiJD3QP2HgzUKQtQ7GRqqUvs7P+tG43RtAqdhLOALP7DJQ iat-mode=1
+Bridge obfs4 193.11.166.194:27015 2D82C2E354D531A68469ADF7F878FA6060C6BACA cert=4TLQPJrTSaDffMK7Nbao6LC7G9OW/NHkUwIdjLSS3KYf0Nv4/nQiiI8dY2TcsQx01NniOg iat-mode=0
+Bridge obfs4 37.218.245.14:38224 D9A82D2F9C2F65A18407B1D2B764F130847F8B5D cert=bjRaMrr1BRiAW8IE9U5z27fQaYgOhX1UCmOpg2pFpoMvo6ZgQMzLsaTzzQNTlm7hNcb+Sg iat-mode=0
+`
+	err := writeConfigToTorrc(fileBuf, dataDir)
+	if err != nil {
+		t.Errorf("Failed to write config to torrc: %s", err)
+	}
+
+	if torrc != fileBuf.String() {
+		t.Errorf("Torrc is not as expected.")
+	}
+}
+
+func TestWriteVanillaConfigToTorrc(t *testing.T) {
+
+	defer func(binary string, bridges []string) {
+		Obfs4proxyBinary, BootstrapBridges = binary, bridges
+	}(Obfs4proxyBinary, BootstrapBridges)
+	Obfs4proxyBinary = ""
+	BootstrapBridges = []string{"1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678"}
+
+	fileBuf := new(bytes.Buffer)
+	torrc := `UseBridges 1
+ControlPort unix:/foo/control-socket
+SocksPort auto
+SafeLogging 0
+Log notice file /foo/tor.log
+DataDirectory /foo
+ClientTransportPlugin snowflake exec /usr/bin/snowflake-client
+ClientTransportPlugin webtunnel exec /usr/bin/webtunnel-client
+ClientTransportPlugin meek exec /usr/bin/meek-client
+Bridge 1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678
+`
+	if err := writeConfigToTorrc(fileBuf, "/foo"); err != nil {
+		t.Errorf("Failed to write config to torrc: %s", err)
+	}
+	if torrc != fileBuf.String() {
+		t.Errorf("Expected torrc\n%s\nbut got\n%s", torrc, fileBuf.String())
+	}
+}
+
+func TestLoadBootstrapBridges(t *testing.T) {
+
+	fh, err := ioutil.TempFile("", "bridgestrap-bootstrap-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fh.Name())
+	fh.WriteString("# Our vanilla bootstrap bridges.\n" +
+		"Bridge 1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678\n\n" +
+		"5.6.7.8:5678\n")
+	fh.Close()
+
+	bridgeLines, err := LoadBootstrapBridges(fh.Name())
+	if err != nil {
+		t.Fatalf("Failed to load bootstrap bridges: %s", err)
+	}
+	if len(bridgeLines) != 2 || bridgeLines[0] != "1.2.3.4:1234 1234567890ABCDEF1234567890ABCDEF12345678" {
+		t.Errorf("Unexpected bootstrap bridges: %v", bridgeLines)
+	}
+
+	// We can't bootstrap with obfs4 bridges without obfs4proxy.
+	defer func(binary string) { Obfs4proxyBinary = binary }(Obfs4proxyBinary)
+	Obfs4proxyBinary = ""
+	ioutil.WriteFile(fh.Name(), []byte(DefaultBridge1+"\n"), 0600)
+	if _, err := LoadBootstrapBridges(fh.Name()); err == nil {
+		t.Errorf("Accepted obfs4 bootstrap bridge without obfs4proxy.")
+	}
+}
+
+func TestBridgeTest(t *testing.T) {
+
+	// Taken from:
+	// https://gitlab.torproject.org/tpo/anti-censorship/team/-/wikis/Default-Bridges
+	defaultBridge1 := "obfs4 192.95.36.142:443 cert=qUVQ0srL1JI/vO6V6m/24anYXiJD3QP2HgzUKQtQ7GRqqUvs7P+tG43RtAqdhLOALP7DJQ iat-mode=1"
+	defaultBridge2 := "obfs4 193.11.166.194:27015 2D82C2E354D531A68469ADF7F878FA6060C6BACA cert=4TLQPJrTSaDffMK7Nbao6LC7G9OW/NHkUwIdjLSS3KYf0Nv4/nQiiI8dY2TcsQx01NniOg iat-mode=0"
+	bogusBridge := "127.0.0.1:1"
+
+	TorTestTimeout = time.Minute
+	torCtx := &TorContext{TorBinary: "tor"}
+	if err := torCtx.Start(); err != nil {
+		t.Fatalf("Failed to start tor: %s", err)
+	}
+
+	resultChan := make(chan *TestResult)
+	req := &TestRequest{
+		BridgeLines: []string{defaultBridge1, defaultBridge2, bogusBridge},
+		resultChan:  resultChan,
+	}
+	// Submit the test request.
+	start := time.Now()
+	torCtx.Assign(req)
+	// Now wait for the test result.
+	result := <-resultChan
+
+	r, _ := result.Bridges[defaultBridge1]
+	if !r.Functional {
+		t.Errorf("Default bridge #1 deemed non-functional.")
+	}
+	r, _ = result.Bridges[defaultBridge2]
+	if !r.Functional {
+		t.Errorf("Default bridge #2 deemed non-functional.")
+	}
+	r, _ = result.Bridges[bogusBridge]
+	if r.Functional {
+		t.Errorf("Bogus bridge deemed functional.")
+	}
+	for bridgeLine, r := range result.Bridges {
+		if r.Time <= 0 || r.Time > time.Since(start).Seconds() {
+			t.Errorf("Bridge %q has implausible test time %f.", bridgeLine, r.Time)
+		}
+		if r.Context == nil || r.Context.TorVersion == "" {
+			t.Errorf("Bridge %q lacks its test context: %+v", bridgeLine, r.Context)
+		}
+	}
+
+	if err := torCtx.Stop(); err != nil {
+		t.Fatalf("Failed to stop tor: %s", err)
+	}
+}
+
+func TestProgressedRecently(t *testing.T) {
+
+	now := time.Now()
+	slow := NewTorEventState("1.1.1.1:1")
+	slow.LastProgress = now.Add(-ProgressGracePeriod / 2)
+	stuck := NewTorEventState("2.2.2.2:2")
+	stuck.LastProgress = now.Add(-2 * ProgressGracePeriod)
+	silent := NewTorEventState("3.3.3.3:3")
+	eventParsers := map[string]*TorEventState{
+		"1.1.1.1:1": slow,
+		"2.2.2.2:2": stuck,
+		"3.3.3.3:3": silent,
+	}
+
+	progressed := progressedRecently([]string{"1.1.1.1:1", "2.2.2.2:2", "3.3.3.3:3", "4.4.4.4:4"}, eventParsers, now)
+	if len(progressed) != 1 || progressed[0] != "1.1.1.1:1" {
+		t.Errorf("Expected only the slow bridge to get a grace period but got %v.", progressed)
+	}
+}
+
+func TestTimedOutBridgeTest(t *testing.T) {
+
+	// Bridges that Tor never got to were not tested, so we must not blame
+	// them.
+	untested := NewTorEventState("1.1.1.1:1")
+	for _, parser := range []*TorEventState{nil, untested} {
+		if r := timedOutBridgeTest(parser); r.Verdict != VerdictInconclusive || r.Functional || r.ErrorCode != ErrorCodeNotAttempted {
+			t.Errorf("Untested bridge must be inconclusive: %+v", r)
+		}
+	}
+
+	attempted := NewTorEventState("2.2.2.2:2")
+	attempted.Feed("650 ORCONN 2.2.2.2:2 LAUNCHED ID=1")
+	if r := timedOutBridgeTest(attempted); r.Verdict != VerdictDysfunctional || r.Functional || r.ErrorCode != ErrorCodeDescriptorTimeout {
+		t.Errorf("Bridge that Tor attempted to connect to must be dysfunctional: %+v", r)
+	}
+}
@@ -0,0 +1,93 @@
+package tester
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MinTorVersion is the oldest version of Tor that we're willing to run.
+const MinTorVersion = "0.4.5.0"
+
+// torVersionRegexp matches the version in the output of "tor --version", e.g.,
+// "Tor version 0.4.8.10." or "Tor version 0.4.9.0-alpha-dev (git-a1b2c3d4)."
+var torVersionRegexp = regexp.MustCompile(`Tor version ([0-9]+(?:\.[0-9]+){2,3})`)
+
+// TorBinary describes the Tor executable that we resolved at startup.
+type TorBinary struct {
+	// Path is the absolute path of the executable, after looking it up in
+	// our PATH.
+	Path string `json:"path"`
+	// Version is the version that the executable reported, e.g.,
+	// "0.4.8.10".
+	Version string `json:"version"`
+}
+
+// ResolveTorBinary looks up the given Tor executable in our PATH, runs it with
+// --version, and makes sure that it's at least MinTorVersion.  We do this at
+// startup, so a container that ships without Tor, or with a Tor for the wrong
+// architecture, fails with a clear error instead of a cryptic exec error while
+// we're starting our Tor instances.
+func ResolveTorBinary(name string) (*TorBinary, error) {
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find Tor executable: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), PluginProbeTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, path, "--version").CombinedOutput()
+	if err != nil {
+		// Unlike plugins, Tor understands --version, so any error means
+		// that the executable is broken, e.g., because it was built for
+		// another architecture.
+		return nil, fmt.Errorf("failed to run Tor executable %s: %w", path, err)
+	}
+	version, err := parseTorVersion(string(output))
+	if err != nil {
+		return nil, fmt.Errorf("failed to learn version of Tor executable %s: %w", path, err)
+	}
+	if compareTorVersions(version, MinTorVersion) < 0 {
+		return nil, fmt.Errorf("Tor executable %s has version %s but we need at least %s", path, version, MinTorVersion)
+	}
+	return &TorBinary{Path: path, Version: version}, nil
+}
+
+// parseTorVersion extracts the version number from the output of
+// "tor --version".
+func parseTorVersion(output string) (string, error) {
+
+	matches := torVersionRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		firstLine := strings.TrimSpace(strings.SplitN(output, "\n", 2)[0])
+		return "", fmt.Errorf("unexpected output %q", firstLine)
+	}
+	return matches[1], nil
+}
+
+// compareTorVersions compares the two given version numbers, e.g., "0.4.8.10"
+// and "0.4.5.0", and returns -1 if a is older than b, 1 if a is newer than b,
+// and 0 if they're equal.  A missing component counts as 0.
+func compareTorVersions(a, b string) int {
+
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
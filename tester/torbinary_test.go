@@ -0,0 +1,82 @@
+package tester
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTorVersion(t *testing.T) {
+
+	for output, expected := range map[string]string{
+		"Tor version 0.4.8.10.\n": "0.4.8.10",
+		"Tor version 0.4.9.0-alpha-dev (git-a1b2c3d4).\nTor is running on Linux.\n": "0.4.9.0",
+		"Tor version 0.4.7.": "0.4.7",
+	} {
+		version, err := parseTorVersion(output)
+		if err != nil || version != expected {
+			t.Errorf("Expected %q for %q but got %q (%v).", expected, output, version, err)
+		}
+	}
+	for _, output := range []string{"", "exec format error", "Tor version 0.4"} {
+		if _, err := parseTorVersion(output); err == nil {
+			t.Errorf("Parsed version from %q.", output)
+		}
+	}
+}
+
+func TestCompareTorVersions(t *testing.T) {
+
+	for _, test := range []struct {
+		a, b     string
+		expected int
+	}{
+		{"0.4.8.10", "0.4.5.0", 1},
+		{"0.4.8.10", "0.4.8.9", 1},
+		{"0.4.5.0", "0.4.5.0", 0},
+		{"0.4.5", "0.4.5.0", 0},
+		{"0.3.5.17", "0.4.5.0", -1},
+	} {
+		if c := compareTorVersions(test.a, test.b); c != test.expected {
+			t.Errorf("Expected %d for %s and %s but got %d.", test.expected, test.a, test.b, c)
+		}
+	}
+}
+
+func TestResolveTorBinary(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "bridgestrap-tor")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	scripts := map[string]string{
+		"tor":     "#!/bin/sh\necho 'Tor version 0.4.8.10.'\n",
+		"old-tor": "#!/bin/sh\necho 'Tor version 0.3.5.17.'\n",
+		"failing": "#!/bin/sh\nexit 1\n",
+		"broken":  "#!/nonexistent/interpreter\n",
+	}
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0700); err != nil {
+			t.Fatalf("Failed to write %s: %s", name, err)
+		}
+	}
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	os.Setenv("PATH", dir)
+
+	binary, err := ResolveTorBinary("tor")
+	if err != nil {
+		t.Fatalf("Failed to resolve working Tor executable: %s", err)
+	}
+	if binary.Path != filepath.Join(dir, "tor") || binary.Version != "0.4.8.10" {
+		t.Errorf("Unexpected Tor executable: %+v", binary)
+	}
+	for _, name := range []string{"old-tor", "failing", "broken", "missing"} {
+		if _, err := ResolveTorBinary(name); err == nil {
+			t.Errorf("Resolved unusable Tor executable %q.", name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package tester
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/yawning/bulb"
+)
+
+// Controller trace levels, from least to most verbose.
+const (
+	// TraceOff logs nothing of our control port traffic.
+	TraceOff = "off"
+	// TraceCommands logs the commands that we issue and the status lines of
+	// Tor's responses.
+	TraceCommands = "commands"
+	// TraceAll additionally logs the data lines of Tor's responses and all
+	// of Tor's events.  It floods our logs on busy instances.
+	TraceAll = "all"
+)
+
+// traceLevels lists our controller trace levels in the order of their
+// verbosity.
+var traceLevels = []string{TraceOff, TraceCommands, TraceAll}
+
+// controllerTrace is the index of our current trace level in traceLevels.  It
+// must only be accessed atomically.
+var controllerTrace int32
+
+// fingerprintPattern matches the relay fingerprints in Tor's events, e.g., in
+// ORCONN and CIRC events.
+var fingerprintPattern = regexp.MustCompile(`\$?\b[0-9A-Fa-f]{40}\b`)
+
+// bridgeReply matches the bridge lines in Tor's replies to GETCONF Bridge.
+var bridgeReply = regexp.MustCompile(`^(\d{3}[-+ ]Bridge=)(.*)$`)
+
+// SetControllerTrace sets our controller trace level, e.g., TraceCommands.
+// It takes effect immediately for all of our Tor instances.
+func SetControllerTrace(level string) error {
+
+	for i, l := range traceLevels {
+		if l == level {
+			atomic.StoreInt32(&controllerTrace, int32(i))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown controller trace level %q", level)
+}
+
+// ControllerTrace returns our current controller trace level.
+func ControllerTrace() string {
+	return traceLevels[atomic.LoadInt32(&controllerTrace)]
+}
+
+// tracing returns true if our trace level is at least the given level.
+func tracing(level string) bool {
+
+	current := atomic.LoadInt32(&controllerTrace)
+	for i, l := range traceLevels {
+		if l == level {
+			return current >= int32(i)
+		}
+	}
+	return false
+}
+
+// scrubTraceLine passes the bridge lines in the given line of control port
+// traffic through LogBridgeLine, and removes relay fingerprints, so our
+// traces are as safe as the rest of our logs.  Our log scrubber takes care
+// of IP addresses.
+func scrubTraceLine(line string) string {
+
+	line = scrubCommand(line)
+	if m := bridgeReply.FindStringSubmatch(line); m != nil {
+		line = m[1] + LogBridgeLine(m[2])
+	}
+	return fingerprintPattern.ReplaceAllString(line, "[scrubbed fingerprint]")
+}
+
+// traceCommand logs the given command that the given Tor instance issued, and
+// Tor's response, if our trace level asks for it.
+func traceCommand(instance, cmd string, resp *bulb.Response, err error) {
+
+	if !tracing(TraceCommands) {
+		return
+	}
+	log.Printf("%s: C: %s", instance, scrubTraceLine(cmd))
+	if resp == nil || len(resp.RawLines) == 0 {
+		if err != nil {
+			log.Printf("%s: S: %s", instance, err)
+		}
+		return
+	}
+	lines := resp.RawLines
+	if !tracing(TraceAll) {
+		// The last line is the status line.
+		lines = lines[len(lines)-1:]
+	}
+	for _, line := range lines {
+		log.Printf("%s: S: %s", instance, scrubTraceLine(line))
+	}
+}
+
+// traceEvent logs the given event of the given Tor instance, if our trace
+// level asks for it.
+func traceEvent(instance string, ev *bulb.Response) {
+
+	if !tracing(TraceAll) {
+		return
+	}
+	for _, line := range ev.RawLines {
+		log.Printf("%s: E: %s", instance, scrubTraceLine(line))
+	}
+}
@@ -0,0 +1,71 @@
+package tester
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/yawning/bulb"
+)
+
+func TestSetControllerTrace(t *testing.T) {
+
+	defer SetControllerTrace(TraceOff)
+
+	if ControllerTrace() != TraceOff {
+		t.Errorf("Tracing is enabled by default.")
+	}
+	if err := SetControllerTrace(TraceCommands); err != nil || ControllerTrace() != TraceCommands {
+		t.Errorf("Failed to set trace level: %v", err)
+	}
+	if !tracing(TraceCommands) || tracing(TraceAll) {
+		t.Errorf("Unexpected tracing at level %q.", ControllerTrace())
+	}
+	if err := SetControllerTrace("bogus"); err == nil || ControllerTrace() != TraceCommands {
+		t.Errorf("Failed to reject invalid trace level.")
+	}
+}
+
+func TestTraceCommand(t *testing.T) {
+
+	defer SetControllerTrace(TraceOff)
+	defer func(f func(string) string) { LogBridgeLine = f }(LogBridgeLine)
+	LogBridgeLine = func(string) string { return "[scrubbed]" }
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	resp := &bulb.Response{RawLines: []string{
+		"250-Bridge=obfs4 1.2.3.4:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=foo iat-mode=0",
+		"250 OK",
+	}}
+	traceCommand("tor0", `SETCONF Bridge="1.2.3.4:1234"`, resp, nil)
+	if buf.Len() != 0 {
+		t.Errorf("Traced command while tracing is off: %s", buf)
+	}
+
+	SetControllerTrace(TraceCommands)
+	traceCommand("tor0", `SETCONF Bridge="1.2.3.4:1234"`, resp, nil)
+	if !strings.Contains(buf.String(), `tor0: C: SETCONF Bridge="[scrubbed]"`) ||
+		!strings.Contains(buf.String(), "tor0: S: 250 OK") || strings.Contains(buf.String(), "250-Bridge") {
+		t.Errorf("Unexpected command trace: %s", buf)
+	}
+
+	buf.Reset()
+	SetControllerTrace(TraceAll)
+	traceCommand("tor0", "GETCONF Bridge", resp, nil)
+	traceEvent("tor0", &bulb.Response{RawLines: []string{
+		"650 ORCONN $0123456789ABCDEF0123456789ABCDEF01234567~Unnamed CONNECTED",
+	}})
+	for _, secret := range []string{"cert=foo", "0123456789ABCDEF"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("Trace reveals %q: %s", secret, buf)
+		}
+	}
+	if !strings.Contains(buf.String(), "tor0: S: 250-Bridge=[scrubbed]") ||
+		!strings.Contains(buf.String(), "tor0: E: 650 ORCONN [scrubbed fingerprint]~Unnamed CONNECTED") {
+		t.Errorf("Unexpected full trace: %s", buf)
+	}
+}